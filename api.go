@@ -36,6 +36,8 @@ func StartAPIService() (*http.Server, chan error) {
 				panic(err)
 			}
 		}
+
+		service.MyService.Health().SetGatewayRegistered(true)
 	}
 
 	v2Prefix, v2Router := route.InitV2Router()
@@ -8,5 +8,39 @@ const (
 
 	BackupRootFolder = "Backup"
 	MetadataFileName = ".zima_backup"
-	Throttling       = 4
+	// MetadataSchemaVersion is the version of the metadata file format. Bump it along with a new
+	// migration whenever the format changes.
+	MetadataSchemaVersion = 1
+	Throttling            = 4
+
+	// StateFolderName is the hidden folder under each folder backup that holds service state,
+	// such as the manifests submitted by the client.
+	StateFolderName    = ".zima_backup.d"
+	ManifestFolderName = "manifests"
+	RunFileName        = "run.json"
+	DeletedFileName    = "deleted.json"
+	MaxManifestCount   = 100
+
+	// VersionFolderName is the hidden folder under each folder backup using the hidden version store that
+	// holds the history copies, in the same layout as the files.
+	VersionFolderName = ".versions"
+
+	// UploadFolderName is the folder under the state folder of each client that holds files being
+	// uploaded via the native upload API.
+	UploadFolderName = "uploads"
+	DefaultChunkSize = 8 << 20
+	MaxChunkSize     = 64 << 20
+
+	// ClientFileName is the file under the state folder of each client that keeps its settings, such as
+	// the path policy.
+	ClientFileName = "client.json"
+
+	// IndexFileName is the embedded database under the DB path that indexes all folder backups.
+	IndexFileName = "files-backup.db"
+
+	// WebhookFileName is the file under the DB path that keeps the webhooks configured through the API.
+	WebhookFileName = "webhooks.json"
+
+	// ReplicationFolderName is the folder under the DB path that keeps what has been replicated to each target.
+	ReplicationFolderName = "replication"
 )
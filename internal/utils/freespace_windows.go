@@ -0,0 +1,18 @@
+package utils
+
+import "golang.org/x/sys/windows"
+
+// FreeSpace returns the bytes available to the calling user on the volume holding path.
+func FreeSpace(path string) (uint64, error) {
+	name, err := windows.UTF16PtrFromString(path)
+	if err != nil {
+		return 0, err
+	}
+
+	var available, total, free uint64
+	if err := windows.GetDiskFreeSpaceEx(name, &available, &total, &free); err != nil {
+		return 0, err
+	}
+
+	return available, nil
+}
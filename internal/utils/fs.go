@@ -3,6 +3,7 @@ package utils
 import (
 	"io/fs"
 	"log"
+	"os"
 	"path/filepath"
 	"sync"
 )
@@ -59,3 +60,56 @@ func SizeAndCount(dir string, workerLimit int) (int64, int, error) {
 
 	return totalSize, fileCount, nil
 }
+
+// WriteFileAtomic writes data to a temporary file in the same folder, syncs it to disk and renames it
+// to path, so path is never left partially written even if the process crashes or the disk is full.
+func WriteFileAtomic(path string, data []byte, perm os.FileMode) error {
+	dir := filepath.Dir(path)
+
+	tmpFile, err := os.CreateTemp(dir, filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	tmpFilePath := tmpFile.Name()
+
+	// remove the temporary file if anything goes wrong before it is renamed
+	succeeded := false
+	defer func() {
+		if !succeeded {
+			tmpFile.Close()
+			os.Remove(tmpFilePath)
+		}
+	}()
+
+	if _, err := tmpFile.Write(data); err != nil {
+		return err
+	}
+
+	if err := tmpFile.Chmod(perm); err != nil {
+		return err
+	}
+
+	if err := tmpFile.Sync(); err != nil {
+		return err
+	}
+
+	if err := tmpFile.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmpFilePath, path); err != nil {
+		return err
+	}
+
+	succeeded = true
+
+	// sync the folder as well so the rename itself is durable
+	if d, err := os.Open(dir); err == nil {
+		defer d.Close()
+		if err := d.Sync(); err != nil {
+			log.Printf("Error syncing directory: %v", err)
+		}
+	}
+
+	return nil
+}
@@ -59,3 +59,32 @@ func TestSizeAndCount(t *testing.T) {
 		assert.Equal(t, numFiles, fileCount, "File count mismatch")
 	})
 }
+
+func TestWriteFileAtomic(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	tempDir, err := os.MkdirTemp("", "test-atomic")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tempDir)
+
+	filePath := filepath.Join(tempDir, "file.json")
+
+	assert.NoError(t, utils.WriteFileAtomic(filePath, []byte("first"), 0o600))
+	assert.NoError(t, utils.WriteFileAtomic(filePath, []byte("second"), 0o644))
+
+	content, err := os.ReadFile(filePath)
+	assert.NoError(t, err)
+	assert.Equal(t, "second", string(content))
+
+	fileInfo, err := os.Stat(filePath)
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0o644), fileInfo.Mode().Perm())
+
+	// no temporary file is left behind
+	entries, err := os.ReadDir(tempDir)
+	assert.NoError(t, err)
+	assert.Len(t, entries, 1)
+
+	// the folder must exist
+	assert.Error(t, utils.WriteFileAtomic(filepath.Join(tempDir, "missing", "file.json"), []byte("third"), 0o600))
+}
@@ -5,6 +5,7 @@ package main
 import (
 	"context"
 	_ "embed"
+	"errors"
 	"flag"
 	"fmt"
 	"net/http"
@@ -18,6 +19,7 @@ import (
 	"github.com/IceWhaleTech/IceWhale-Files-Backup/pkg/config"
 	"github.com/IceWhaleTech/IceWhale-Files-Backup/service"
 	"github.com/coreos/go-systemd/daemon"
+	"go.etcd.io/bbolt"
 	"go.uber.org/zap"
 )
 
@@ -37,6 +39,8 @@ func main() {
 	{
 		configFlag := flag.String("c", "", "config file path")
 		versionFlag := flag.Bool("v", false, "version")
+		rebuildIndexFlag := flag.Bool("rebuild-index", false, "rebuild the index from the backup root and exit")
+		migrateVersionsFlag := flag.Bool("migrate-versions", false, "move history copies of all folder backups to their hidden version folders and exit")
 
 		flag.Parse()
 
@@ -52,11 +56,40 @@ func main() {
 
 		logger.LogInit(config.AppInfo.LogPath, config.AppInfo.LogSaveName, config.AppInfo.LogFileExt)
 
+		if *rebuildIndexFlag {
+			if err := rebuildIndex(); err != nil {
+				fmt.Printf("Error rebuilding index: %s\n", err)
+				os.Exit(1)
+			}
+			os.Exit(0)
+		}
+
+		if *migrateVersionsFlag {
+			count, err := migrateVersions()
+			if err != nil {
+				fmt.Printf("Error migrating history copies: %s\n", err)
+				os.Exit(1)
+			}
+			fmt.Printf("%d history copies migrated\n", count)
+			os.Exit(0)
+		}
+
 		service.MyService = service.NewService(config.CommonInfo.RuntimePath)
 	}
 
+	monitorCtx, stopMonitor := context.WithCancel(context.Background())
+	defer stopMonitor()
+
+	go service.MyService.Monitor().Start(monitorCtx)
+
+	replicatorCtx, stopReplicator := context.WithCancel(context.Background())
+	defer stopReplicator()
+
+	go service.MyService.Replicator().Start(replicatorCtx)
+
 	apiService, apiServiceError := StartAPIService()
 	webdavService, webdavServiceError := StartWebDAVService()
+	metricsService, metricsServiceError := StartMetricsService()
 
 	// notify systemd that we are ready
 	{
@@ -69,6 +102,11 @@ func main() {
 		}
 	}
 
+	watchdogCtx, stopWatchdog := context.WithCancel(context.Background())
+	defer stopWatchdog()
+
+	go service.MyService.Health().Watchdog(watchdogCtx)
+
 	// Set up a channel to catch the Ctrl+C signal (SIGINT)
 	signalChan := make(chan os.Signal, 1)
 	signal.Notify(signalChan, os.Interrupt, syscall.SIGTERM)
@@ -87,6 +125,11 @@ func main() {
 		if err != http.ErrServerClosed {
 			os.Exit(1)
 		}
+	case err := <-metricsServiceError:
+		fmt.Printf("Error starting metrics service: %s\n", err)
+		if err != http.ErrServerClosed {
+			os.Exit(1)
+		}
 	}
 
 	// Create a context with a timeout to allow the server to shut down gracefully
@@ -104,4 +147,56 @@ func main() {
 		logger.Error("Failed to shutdown webdav server", zap.Any("error", err))
 		os.Exit(1)
 	}
+
+	// Shutdown the metricsService, if it has been started
+	if metricsService != nil {
+		if err := metricsService.Shutdown(ctx); err != nil {
+			logger.Error("Failed to shutdown metrics server", zap.Any("error", err))
+			os.Exit(1)
+		}
+	}
+}
+
+func rebuildIndex() error {
+	index, err := service.OpenIndex(service.IndexFilePath())
+	if err != nil {
+		if errors.Is(err, bbolt.ErrTimeout) {
+			return fmt.Errorf("index is in use, stop the service first: %w", err)
+		}
+		return err
+	}
+	defer index.Close()
+
+	storage, err := service.OpenStorage(config.AppInfo.DataRootPath, *config.StorageInfo)
+	if err != nil {
+		return err
+	}
+
+	backupService := service.NewBackupServiceWith(storage, service.SystemClock)
+	backupService.SetIndex(index)
+
+	return backupService.RebuildIndex()
+}
+
+func migrateVersions() (int, error) {
+	storage, err := service.OpenStorage(config.AppInfo.DataRootPath, *config.StorageInfo)
+	if err != nil {
+		return 0, err
+	}
+
+	backupService := service.NewBackupServiceWith(storage, service.SystemClock)
+
+	// the running service holds the index, and would run folder backups while they are migrated
+	index, err := service.OpenIndex(service.IndexFilePath())
+	if err != nil {
+		if errors.Is(err, bbolt.ErrTimeout) {
+			return 0, fmt.Errorf("index is in use, stop the service first: %w", err)
+		}
+		return 0, err
+	}
+	defer index.Close()
+
+	backupService.SetIndex(index)
+
+	return backupService.MigrateVersions()
 }
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/IceWhaleTech/CasaOS-Common/utils/logger"
+	"github.com/IceWhaleTech/IceWhale-Files-Backup/pkg/config"
+	"github.com/IceWhaleTech/IceWhale-Files-Backup/service"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.uber.org/zap"
+)
+
+// StartMetricsService serves the metrics for Prometheus at /metrics, and the health and readiness of the
+// service at /health and /ready, unless the metrics port is not set. Health and readiness are served by the
+// API as well, so they can be probed either way.
+func StartMetricsService() (*http.Server, chan error) {
+	if config.AppInfo.MetricsPort == "" {
+		logger.Info("metrics port is not set, metrics are not served")
+		return nil, nil
+	}
+
+	// setup listener
+	listener, err := net.Listen("tcp", net.JoinHostPort(config.AppInfo.MetricsHost, config.AppInfo.MetricsPort))
+	if err != nil {
+		panic(err)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(service.MetricsRegistry, promhttp.HandlerOpts{}))
+	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
+		report := service.MyService.Health().Check(r.Context())
+		writeHealthReport(w, report, report.Healthy)
+	})
+	mux.HandleFunc("/ready", func(w http.ResponseWriter, r *http.Request) {
+		report := service.MyService.Health().Check(r.Context())
+		writeHealthReport(w, report, report.Ready)
+	})
+
+	metricsServerError := make(chan error, 1)
+	metricsServer := &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: 5 * time.Second, // fix G112: Potential slowloris attack (see https://github.com/securego/gosec)
+	}
+
+	go func() {
+		metricsServerError <- metricsServer.Serve(listener) // not using http.serve() to fix G114: Use of net/http serve function that has no support for setting timeouts (see https://github.com/securego/gosec)
+	}()
+
+	logger.Info("metrics service is listening...", zap.Any("address", listener.Addr().String()))
+
+	return metricsServer, metricsServerError
+}
+
+func writeHealthReport(w http.ResponseWriter, report service.HealthReport, ok bool) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if !ok {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+
+	if err := json.NewEncoder(w).Encode(report); err != nil {
+		logger.Error("failed to write health report", zap.Error(err))
+	}
+}
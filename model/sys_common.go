@@ -1,5 +1,7 @@
 package model
 
+import "time"
+
 type CommonModel struct {
 	RuntimePath string
 }
@@ -9,6 +11,87 @@ type APPModel struct {
 	LogSaveName string
 	LogFileExt  string
 
-	WebDAVPort   string
+	WebDAVPort  string
+	MetricsPort string
+
+	// MetricsHost is the address the metrics, health and readiness endpoints listen on, which are not
+	// authenticated. Only local clients can reach them by default.
+	MetricsHost string
+
 	DataRootPath string
+	DBPath       string
+
+	// FreeSpaceReserve is the free space in bytes to keep on the data root. The service is not ready below it.
+	FreeSpaceReserve int64
+
+	// VersionStore is where new folder backups keep their history copies, either "suffix" next to the files
+	// or "hidden" under the .versions folder of the folder backup.
+	VersionStore string
+}
+
+type MonitorModel struct {
+	// ExpectedInterval is how often each folder is expected to be backed up before it is reported overdue.
+	ExpectedInterval time.Duration
+	CheckInterval    time.Duration
+
+	// MaxFailureCount is how many runs in a row may fail before the folder backup is reported failing.
+	MaxFailureCount int
+
+	WebhookURL string
+
+	// SMTPAddress is the local SMTP relay to send emails through, e.g. localhost:25. No email is sent if empty.
+	SMTPAddress string
+	EmailFrom   string
+	EmailTo     []string
+}
+
+// StorageModel is where the folder backups under the data root are kept. Service state such as locks
+// and uploads in progress stays on the local data root either way.
+type StorageModel struct {
+	// Type is local or s3.
+	Type string
+
+	// Endpoint is the host and port of the S3-compatible service.
+	Endpoint        string
+	Bucket          string
+	Prefix          string
+	Region          string
+	AccessKeyID     string
+	SecretAccessKey string
+	UseSSL          bool
+}
+
+type ReplicationModel struct {
+	// Interval is how often the backup root is replicated to each target. Nothing is replicated if it is 0.
+	Interval time.Duration
+}
+
+// ReplicationTargetModel is a target the backup root is replicated to, configured in a child section
+// of the replication section, e.g. [replication.offsite]. Which fields apply depends on the type.
+type ReplicationTargetModel struct {
+	Name string `ini:"-"`
+
+	// Type is local, sftp or s3.
+	Type string
+
+	// Path is the folder on a local disk or the SFTP server to replicate to.
+	Path string
+
+	// Address is the host and port of the SFTP server.
+	Address string
+	User    string
+
+	// Password or PrivateKeyPath authenticates with the SFTP server, whose host key must be in KnownHostsPath.
+	Password       string
+	PrivateKeyPath string
+	KnownHostsPath string
+
+	// Endpoint is the host and port of the S3-compatible service.
+	Endpoint        string
+	Bucket          string
+	Prefix          string
+	Region          string
+	AccessKeyID     string
+	SecretAccessKey string
+	UseSSL          bool
 }
@@ -2,6 +2,8 @@ package config
 
 import (
 	"log"
+	"strings"
+	"time"
 
 	"github.com/IceWhaleTech/IceWhale-Files-Backup/common"
 	"github.com/IceWhaleTech/IceWhale-Files-Backup/model"
@@ -19,9 +21,32 @@ var (
 		LogFileExt:  "log",
 
 		WebDAVPort:   "7070",
+		MetricsPort:  "7071",
+		MetricsHost:  "127.0.0.1",
 		DataRootPath: "/DATA",
+		DBPath:       "/var/lib/casaos/db",
+
+		FreeSpaceReserve: 1 << 30,
+		VersionStore:     "suffix",
+	}
+
+	MonitorInfo = &model.MonitorModel{
+		ExpectedInterval: 7 * 24 * time.Hour,
+		CheckInterval:    time.Hour,
+		MaxFailureCount:  3,
+		EmailFrom:        common.FilesBackupServiceName + "@localhost",
+	}
+
+	StorageInfo = &model.StorageModel{
+		Type: "local",
+	}
+
+	ReplicationInfo = &model.ReplicationModel{
+		Interval: 24 * time.Hour,
 	}
 
+	ReplicationTargets = []model.ReplicationTargetModel{}
+
 	Cfg            *ini.File
 	ConfigFilePath string
 )
@@ -40,6 +65,20 @@ func InitSetup(config string) {
 	}
 
 	mapTo("common", CommonInfo)
+	mapTo("app", AppInfo)
+	mapTo("monitor", MonitorInfo)
+	mapTo("storage", StorageInfo)
+	mapTo("replication", ReplicationInfo)
+
+	for _, section := range Cfg.Section("replication").ChildSections() {
+		target := model.ReplicationTargetModel{
+			Name: strings.TrimPrefix(section.Name(), "replication."),
+		}
+
+		mapTo(section.Name(), &target)
+
+		ReplicationTargets = append(ReplicationTargets, target)
+	}
 }
 
 func mapTo(section string, v interface{}) {
@@ -2,6 +2,7 @@ package route
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net/http"
 
@@ -109,6 +110,12 @@ func (a *api) RunFolderBackup(ctx echo.Context, clientID codegen.ClientIDParam)
 	folderBackup, err := service.MyService.Backup().Proceed(request)
 	if err != nil {
 		message := err.Error()
+		if errors.Is(err, service.ErrInsufficientSpace) {
+			return ctx.JSON(http.StatusInsufficientStorage, codegen.ResponseInsufficientStorage{Message: &message})
+		}
+		if errors.Is(err, service.ErrInvalidFilterPattern) || errors.Is(err, service.ErrInvalidPathPolicy) || errors.Is(err, service.ErrReservedPath) {
+			return ctx.JSON(http.StatusBadRequest, codegen.ResponseBadRequest{Message: &message})
+		}
 		return ctx.JSON(http.StatusInternalServerError, codegen.ResponseInternalServerError{Message: &message})
 	}
 
@@ -116,3 +123,102 @@ func (a *api) RunFolderBackup(ctx echo.Context, clientID codegen.ClientIDParam)
 		Data: folderBackup,
 	})
 }
+
+func (a *api) CompleteFolderBackup(ctx echo.Context, clientID codegen.ClientIDParam) error {
+	var request codegen.CompleteFolderBackupJSONRequestBody
+	if err := ctx.Bind(&request); err != nil {
+		message := err.Error()
+		return ctx.JSON(http.StatusBadRequest, codegen.ResponseBadRequest{Message: &message})
+	}
+
+	if clientID == "" || request.ClientFolderPath == "" {
+		message := "certain fields are missing in the request body"
+		return ctx.JSON(http.StatusBadRequest, codegen.ResponseBadRequest{Message: &message})
+	}
+
+	backupExists, err := service.MyService.Backup().IsBackupExists(string(clientID), request.ClientFolderPath)
+	if err != nil {
+		message := err.Error()
+		return ctx.JSON(http.StatusInternalServerError, codegen.ResponseInternalServerError{Message: &message})
+	}
+
+	if !backupExists {
+		message := fmt.Sprintf("no backup found for this client id %s and client folder path %s", clientID, request.ClientFolderPath)
+		return ctx.JSON(http.StatusNotFound, codegen.ResponseNotFound{Message: &message})
+	}
+
+	// verify the uploaded files against the manifest submitted when the run started
+	verification, err := service.MyService.Backup().Complete(string(clientID), request.ClientFolderPath)
+	if err != nil {
+		if errors.Is(err, service.ErrManifestNotFound) {
+			message := fmt.Sprintf("no manifest found for this client id %s and client folder path %s", clientID, request.ClientFolderPath)
+			return ctx.JSON(http.StatusNotFound, codegen.ResponseNotFound{Message: &message})
+		}
+
+		message := err.Error()
+		return ctx.JSON(http.StatusInternalServerError, codegen.ResponseInternalServerError{Message: &message})
+	}
+
+	return ctx.JSON(http.StatusOK, codegen.FolderBackupVerificationOK{
+		Data: verification,
+	})
+}
+
+func (a *api) GetFolderBackupManifest(ctx echo.Context, clientID codegen.ClientIDParam, params codegen.GetFolderBackupManifestParams) error {
+	if clientID == "" {
+		message := "client id is missing"
+		return ctx.JSON(http.StatusBadRequest, codegen.ResponseBadRequest{Message: &message})
+	}
+
+	if params.ClientFolderPath == "" {
+		message := "client folder path is missing"
+		return ctx.JSON(http.StatusBadRequest, codegen.ResponseBadRequest{Message: &message})
+	}
+
+	var at int64
+	if params.Time != nil {
+		at = *params.Time
+	}
+
+	manifest, err := service.MyService.Backup().GetManifest(string(clientID), params.ClientFolderPath, at)
+	if err != nil {
+		if errors.Is(err, service.ErrManifestNotFound) {
+			message := fmt.Sprintf("no manifest found for this client id %s and client folder path %s", clientID, params.ClientFolderPath)
+			return ctx.JSON(http.StatusNotFound, codegen.ResponseNotFound{Message: &message})
+		}
+
+		message := err.Error()
+		return ctx.JSON(http.StatusInternalServerError, codegen.ResponseInternalServerError{Message: &message})
+	}
+
+	return ctx.JSON(http.StatusOK, codegen.ManifestOK{
+		Data: manifest,
+	})
+}
+
+func (a *api) GetDeletedFiles(ctx echo.Context, clientID codegen.ClientIDParam, params codegen.GetDeletedFilesParams) error {
+	if clientID == "" {
+		message := "client id is missing"
+		return ctx.JSON(http.StatusBadRequest, codegen.ResponseBadRequest{Message: &message})
+	}
+
+	if params.ClientFolderPath == "" {
+		message := "client folder path is missing"
+		return ctx.JSON(http.StatusBadRequest, codegen.ResponseBadRequest{Message: &message})
+	}
+
+	deletedFiles, err := service.MyService.Backup().GetDeletedFiles(string(clientID), params.ClientFolderPath)
+	if err != nil {
+		if errors.Is(err, service.ErrFolderBackupNotFound) {
+			message := fmt.Sprintf("no folder backup found for this client id %s and client folder path %s", clientID, params.ClientFolderPath)
+			return ctx.JSON(http.StatusNotFound, codegen.ResponseNotFound{Message: &message})
+		}
+
+		message := err.Error()
+		return ctx.JSON(http.StatusInternalServerError, codegen.ResponseInternalServerError{Message: &message})
+	}
+
+	return ctx.JSON(http.StatusOK, codegen.DeletedFilesOK{
+		Data: &deletedFiles,
+	})
+}
@@ -0,0 +1,61 @@
+package route
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/IceWhaleTech/IceWhale-Files-Backup/codegen"
+	"github.com/IceWhaleTech/IceWhale-Files-Backup/service"
+	"github.com/labstack/echo/v4"
+)
+
+const eventKeepAliveInterval = 15 * time.Second
+
+func (a *api) GetBackupEvents(ctx echo.Context, params codegen.GetBackupEventsParams) error {
+	events, unsubscribe := service.MyService.Backup().Events().Subscribe()
+	defer unsubscribe()
+
+	response := ctx.Response()
+	response.Header().Set(echo.HeaderContentType, "text/event-stream")
+	response.Header().Set(echo.HeaderCacheControl, "no-cache")
+	response.Header().Set(echo.HeaderConnection, "keep-alive")
+	response.WriteHeader(http.StatusOK)
+	response.Flush()
+
+	ticker := time.NewTicker(eventKeepAliveInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Request().Context().Done():
+			return nil
+
+		case <-ticker.C:
+			if _, err := fmt.Fprint(response, ": keep-alive\n\n"); err != nil {
+				return nil
+			}
+			response.Flush()
+
+		case event, ok := <-events:
+			if !ok {
+				return nil
+			}
+
+			if params.ClientID != nil && (event.ClientID == nil || *event.ClientID != *params.ClientID) {
+				continue
+			}
+
+			buf, err := json.Marshal(event)
+			if err != nil {
+				return err
+			}
+
+			if _, err := fmt.Fprintf(response, "event: %s\ndata: %s\n\n", *event.Type, buf); err != nil {
+				return nil
+			}
+			response.Flush()
+		}
+	}
+}
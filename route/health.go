@@ -0,0 +1,26 @@
+package route
+
+import (
+	"net/http"
+
+	"github.com/IceWhaleTech/IceWhale-Files-Backup/service"
+	"github.com/labstack/echo/v4"
+)
+
+func (a *api) GetHealth(ctx echo.Context) error {
+	report := service.MyService.Health().Check(ctx.Request().Context())
+	return healthReport(ctx, report, report.Healthy)
+}
+
+func (a *api) GetReadiness(ctx echo.Context) error {
+	report := service.MyService.Health().Check(ctx.Request().Context())
+	return healthReport(ctx, report, report.Ready)
+}
+
+func healthReport(ctx echo.Context, report service.HealthReport, ok bool) error {
+	if !ok {
+		return ctx.JSON(http.StatusServiceUnavailable, report)
+	}
+
+	return ctx.JSON(http.StatusOK, report)
+}
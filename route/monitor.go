@@ -0,0 +1,21 @@
+package route
+
+import (
+	"net/http"
+
+	"github.com/IceWhaleTech/IceWhale-Files-Backup/codegen"
+	"github.com/IceWhaleTech/IceWhale-Files-Backup/service"
+	"github.com/labstack/echo/v4"
+)
+
+func (a *api) GetUnhealthyFolderBackups(ctx echo.Context) error {
+	unhealthyBackups, err := service.MyService.Monitor().Check(ctx.Request().Context())
+	if err != nil {
+		message := err.Error()
+		return ctx.JSON(http.StatusInternalServerError, codegen.ResponseInternalServerError{Message: &message})
+	}
+
+	return ctx.JSON(http.StatusOK, codegen.UnhealthyFolderBackupsOK{
+		Data: &unhealthyBackups,
+	})
+}
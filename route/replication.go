@@ -0,0 +1,39 @@
+package route
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/IceWhaleTech/IceWhale-Files-Backup/codegen"
+	"github.com/IceWhaleTech/IceWhale-Files-Backup/service"
+	"github.com/labstack/echo/v4"
+)
+
+func (a *api) GetReplicationTargets(ctx echo.Context) error {
+	targets := service.MyService.Replicator().Targets()
+
+	return ctx.JSON(http.StatusOK, codegen.ReplicationTargetsOK{
+		Data: &targets,
+	})
+}
+
+func (a *api) RunReplication(ctx echo.Context, targetName codegen.TargetNameParam) error {
+	target, err := service.MyService.Replicator().RunInBackground(targetName)
+	if err != nil {
+		message := err.Error()
+
+		if errors.Is(err, service.ErrReplicationTargetNotFound) {
+			return ctx.JSON(http.StatusNotFound, codegen.ResponseNotFound{Message: &message})
+		}
+
+		if errors.Is(err, service.ErrReplicationInProgress) {
+			return ctx.JSON(http.StatusConflict, codegen.ResponseConflict{Message: &message})
+		}
+
+		return ctx.JSON(http.StatusInternalServerError, codegen.ResponseInternalServerError{Message: &message})
+	}
+
+	return ctx.JSON(http.StatusOK, codegen.ReplicationTargetOK{
+		Data: target,
+	})
+}
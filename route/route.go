@@ -58,12 +58,22 @@ func InitV2Router() (string, http.Handler) {
 		AllowCredentials: true,
 	})))
 
-	e.Use(echo_middleware.Gzip())
+	e.Use(echo_middleware.GzipWithConfig(echo_middleware.GzipConfig{
+		// events are streamed, so they shouldn't be held up by compression
+		Skipper: func(c echo.Context) bool {
+			return strings.Contains(c.Request().Header.Get(echo.HeaderAccept), "text/event-stream")
+		},
+	}))
 
 	e.Use(echo_middleware.Logger())
 
 	e.Use(echo_middleware.JWTWithConfig(echo_middleware.JWTConfig{
 		Skipper: func(c echo.Context) bool {
+			// health and readiness are probed without an access token
+			if c.Path() == V2APIPath+"/health" || c.Path() == V2APIPath+"/ready" {
+				return true
+			}
+
 			return c.RealIP() == "::1" || c.RealIP() == "127.0.0.1"
 		},
 		ParseTokenFunc: func(token string, c echo.Context) (interface{}, error) {
@@ -78,6 +88,11 @@ func InitV2Router() (string, http.Handler) {
 		},
 		TokenLookupFuncs: []echo_middleware.ValuesExtractor{
 			func(c echo.Context) ([]string, error) {
+				// EventSource cannot set headers, so the event stream takes the token as a query parameter too
+				if token := c.QueryParam("token"); token != "" && c.Request().Header.Get(echo.HeaderAuthorization) == "" && c.Path() == V2APIPath+"/event" {
+					return []string{token}, nil
+				}
+
 				return []string{c.Request().Header.Get(echo.HeaderAuthorization)}, nil
 			},
 		},
@@ -0,0 +1,111 @@
+package route
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/IceWhaleTech/IceWhale-Files-Backup/codegen"
+	"github.com/IceWhaleTech/IceWhale-Files-Backup/service"
+	"github.com/labstack/echo/v4"
+)
+
+func (a *api) CreateUpload(ctx echo.Context, clientID codegen.ClientIDParam) error {
+	var request codegen.CreateUploadJSONRequestBody
+	if err := ctx.Bind(&request); err != nil {
+		message := err.Error()
+		return ctx.JSON(http.StatusBadRequest, codegen.ResponseBadRequest{Message: &message})
+	}
+
+	if clientID == "" ||
+		request.ClientFolderPath == nil ||
+		request.ClientFilePath == nil ||
+		request.Size == nil ||
+		request.Hash == nil {
+		message := "certain fields are missing in the request body"
+		return ctx.JSON(http.StatusBadRequest, codegen.ResponseBadRequest{Message: &message})
+	}
+
+	backupExists, err := service.MyService.Backup().IsBackupExists(string(clientID), *request.ClientFolderPath)
+	if err != nil {
+		message := err.Error()
+		return ctx.JSON(http.StatusInternalServerError, codegen.ResponseInternalServerError{Message: &message})
+	}
+
+	if !backupExists {
+		message := fmt.Sprintf("no backup found for this client id %s and client folder path %s", clientID, *request.ClientFolderPath)
+		return ctx.JSON(http.StatusNotFound, codegen.ResponseNotFound{Message: &message})
+	}
+
+	upload, err := service.MyService.Backup().CreateUpload(string(clientID), request)
+	if err != nil {
+		return uploadErrorResponse(ctx, err)
+	}
+
+	return ctx.JSON(http.StatusOK, codegen.UploadOK{
+		Data: upload,
+	})
+}
+
+func (a *api) GetUpload(ctx echo.Context, clientID codegen.ClientIDParam, uploadID codegen.UploadIDParam) error {
+	upload, err := service.MyService.Backup().GetUpload(string(clientID), uploadID)
+	if err != nil {
+		return uploadErrorResponse(ctx, err)
+	}
+
+	return ctx.JSON(http.StatusOK, codegen.UploadOK{
+		Data: upload,
+	})
+}
+
+func (a *api) DeleteUpload(ctx echo.Context, clientID codegen.ClientIDParam, uploadID codegen.UploadIDParam) error {
+	if err := service.MyService.Backup().DeleteUpload(string(clientID), uploadID); err != nil {
+		return uploadErrorResponse(ctx, err)
+	}
+
+	message := fmt.Sprintf("upload %s has been cancelled", uploadID)
+
+	return ctx.JSON(http.StatusOK, codegen.ResponseOK{
+		Message: &message,
+	})
+}
+
+func (a *api) UploadChunk(ctx echo.Context, clientID codegen.ClientIDParam, uploadID codegen.UploadIDParam, chunkIndex codegen.ChunkIndexParam, params codegen.UploadChunkParams) error {
+	upload, err := service.MyService.Backup().WriteChunk(string(clientID), uploadID, chunkIndex, params.Hash, ctx.Request().Body)
+	if err != nil {
+		return uploadErrorResponse(ctx, err)
+	}
+
+	return ctx.JSON(http.StatusOK, codegen.UploadOK{
+		Data: upload,
+	})
+}
+
+func (a *api) FinishUpload(ctx echo.Context, clientID codegen.ClientIDParam, uploadID codegen.UploadIDParam) error {
+	upload, err := service.MyService.Backup().FinishUpload(string(clientID), uploadID)
+	if err != nil {
+		return uploadErrorResponse(ctx, err)
+	}
+
+	return ctx.JSON(http.StatusOK, codegen.UploadOK{
+		Data: upload,
+	})
+}
+
+func uploadErrorResponse(ctx echo.Context, err error) error {
+	message := err.Error()
+
+	switch {
+	case errors.Is(err, service.ErrUploadNotFound):
+		return ctx.JSON(http.StatusNotFound, codegen.ResponseNotFound{Message: &message})
+	case errors.Is(err, service.ErrInsufficientSpace):
+		return ctx.JSON(http.StatusInsufficientStorage, codegen.ResponseInsufficientStorage{Message: &message})
+	case errors.Is(err, service.ErrInvalidUpload),
+		errors.Is(err, service.ErrInvalidChunk),
+		errors.Is(err, service.ErrUploadIncomplete),
+		errors.Is(err, service.ErrUploadHashMismatch):
+		return ctx.JSON(http.StatusBadRequest, codegen.ResponseBadRequest{Message: &message})
+	default:
+		return ctx.JSON(http.StatusInternalServerError, codegen.ResponseInternalServerError{Message: &message})
+	}
+}
@@ -0,0 +1,100 @@
+package route
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/IceWhaleTech/IceWhale-Files-Backup/codegen"
+	"github.com/IceWhaleTech/IceWhale-Files-Backup/service"
+	"github.com/labstack/echo/v4"
+)
+
+func (a *api) GetWebhooks(ctx echo.Context) error {
+	webhooks := service.MyService.Webhooks().Webhooks()
+
+	return ctx.JSON(http.StatusOK, codegen.WebhooksOK{
+		Data: &webhooks,
+	})
+}
+
+func (a *api) CreateWebhook(ctx echo.Context) error {
+	var request codegen.CreateWebhookJSONRequestBody
+	if err := ctx.Bind(&request); err != nil {
+		message := err.Error()
+		return ctx.JSON(http.StatusBadRequest, codegen.ResponseBadRequest{Message: &message})
+	}
+
+	webhook, err := service.MyService.Webhooks().CreateWebhook(request)
+	if err != nil {
+		return webhookErrorResponse(ctx, err)
+	}
+
+	return ctx.JSON(http.StatusOK, codegen.WebhookOK{
+		Data: webhook,
+	})
+}
+
+func (a *api) GetWebhook(ctx echo.Context, webhookID codegen.WebhookIDParam) error {
+	webhook, err := service.MyService.Webhooks().Webhook(webhookID)
+	if err != nil {
+		return webhookErrorResponse(ctx, err)
+	}
+
+	return ctx.JSON(http.StatusOK, codegen.WebhookOK{
+		Data: webhook,
+	})
+}
+
+func (a *api) UpdateWebhook(ctx echo.Context, webhookID codegen.WebhookIDParam) error {
+	var request codegen.UpdateWebhookJSONRequestBody
+	if err := ctx.Bind(&request); err != nil {
+		message := err.Error()
+		return ctx.JSON(http.StatusBadRequest, codegen.ResponseBadRequest{Message: &message})
+	}
+
+	webhook, err := service.MyService.Webhooks().UpdateWebhook(webhookID, request)
+	if err != nil {
+		return webhookErrorResponse(ctx, err)
+	}
+
+	return ctx.JSON(http.StatusOK, codegen.WebhookOK{
+		Data: webhook,
+	})
+}
+
+func (a *api) DeleteWebhook(ctx echo.Context, webhookID codegen.WebhookIDParam) error {
+	if err := service.MyService.Webhooks().DeleteWebhook(webhookID); err != nil {
+		return webhookErrorResponse(ctx, err)
+	}
+
+	message := fmt.Sprintf("webhook %s has been deleted", webhookID)
+
+	return ctx.JSON(http.StatusOK, codegen.ResponseOK{
+		Message: &message,
+	})
+}
+
+func (a *api) GetWebhookDeliveries(ctx echo.Context, webhookID codegen.WebhookIDParam) error {
+	deliveries, err := service.MyService.Webhooks().Deliveries(webhookID)
+	if err != nil {
+		return webhookErrorResponse(ctx, err)
+	}
+
+	return ctx.JSON(http.StatusOK, codegen.WebhookDeliveriesOK{
+		Data: &deliveries,
+	})
+}
+
+func webhookErrorResponse(ctx echo.Context, err error) error {
+	message := err.Error()
+
+	switch {
+	case errors.Is(err, service.ErrWebhookNotFound):
+		return ctx.JSON(http.StatusNotFound, codegen.ResponseNotFound{Message: &message})
+	case errors.Is(err, service.ErrInvalidWebhook):
+		return ctx.JSON(http.StatusBadRequest, codegen.ResponseBadRequest{Message: &message})
+	default:
+		return ctx.JSON(http.StatusInternalServerError, codegen.ResponseInternalServerError{Message: &message})
+	}
+}
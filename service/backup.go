@@ -2,13 +2,14 @@ package service
 
 import (
 	"context"
-	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/fs"
 	"os"
 	"path/filepath"
 	"regexp"
+	"sort"
 	"strings"
 	"sync"
 	"time"
@@ -16,25 +17,87 @@ import (
 	"github.com/IceWhaleTech/CasaOS-Common/utils/logger"
 	"github.com/IceWhaleTech/IceWhale-Files-Backup/codegen"
 	"github.com/IceWhaleTech/IceWhale-Files-Backup/common"
-	"github.com/IceWhaleTech/IceWhale-Files-Backup/internal/utils"
 	"github.com/IceWhaleTech/IceWhale-Files-Backup/pkg/config"
 	"github.com/cespare/xxhash/v2"
 	"github.com/samber/lo"
 	"go.uber.org/zap"
 )
 
+const partialFileExt = ".partial"
+
 type BackupService struct {
 	backupRoot string
+	storage    Storage
+	clock      Clock
+
+	locks  *LockManager
+	events *EventBus
+
+	uploadingIDs map[string]*uploadLock
+	uploadMutex  *sync.Mutex
+
+	// runMutex serializes updates to runs made outside of the folder backup lock, i.e. by WebDAV writes.
+	runMutex *sync.Mutex
+
+	index      *Index
+	indexMutex *sync.RWMutex
 
-	proceedingPaths map[string]*sync.Mutex
-	deletingPaths   map[string]*sync.Mutex
-	lockMutex       *sync.Mutex
+	// quotaWarnings keeps when a quota warning was last published for each folder backup.
+	quotaWarnings map[string]time.Time
+	quotaMutex    *sync.Mutex
+
+	// pathPolicies caches the path policy of each client, which is kept under the state folder of the client.
+	pathPolicies    map[string]codegen.PathPolicy
+	pathPolicyMutex *sync.Mutex
+
+	// folderBackups caches the version store of each folder backup seen, by its backup folder path, so WebDAV
+	// requests don't look up folder backups and their metadata on storage.
+	folderBackups     map[string]codegen.VersionStore
+	folderBackupMutex *sync.Mutex
+}
+
+// Locks returns the lock manager guarding the folder backups.
+func (b *BackupService) Locks() *LockManager {
+	return b.locks
+}
+
+// Events returns the bus of events of the folder backups.
+func (b *BackupService) Events() *EventBus {
+	return b.events
+}
+
+// Storage returns where the folder backups are kept.
+func (b *BackupService) Storage() Storage {
+	return b.storage
+}
+
+// SetIndex makes the service keep the index up to date and query it instead of walking the backup root.
+func (b *BackupService) SetIndex(index *Index) {
+	b.index = index
 }
 
 func (b *BackupService) GetAllBackups(ctx context.Context, full bool) (map[string][]codegen.FolderBackup, error) {
 	allBackups := map[string][]codegen.FolderBackup{}
+
+	if b.index != nil {
+		backups, err := b.indexedFolderBackups("")
+		if err != nil {
+			return nil, err
+		}
+
+		for _, backup := range backups {
+			if full {
+				fillSizeAndCount(b.storage, filepath.Join(b.storage.Root(), *backup.BackupFolderPath), &backup)
+			}
+
+			allBackups[*backup.ClientID] = append(allBackups[*backup.ClientID], backup)
+		}
+
+		return allBackups, nil
+	}
+
 	// for each child folder under backupRoot, call GetBackupsByPath
-	err := filepath.WalkDir(b.backupRoot, func(path string, d fs.DirEntry, err error) error {
+	err := b.storage.WalkDir(b.backupRoot, func(path string, d fs.DirEntry, err error) error {
 		if err != nil {
 			return err
 		}
@@ -48,11 +111,16 @@ func (b *BackupService) GetAllBackups(ctx context.Context, full bool) (map[strin
 			return nil
 		}
 
+		// the state folder under backupRoot, e.g. holding lock files, is not a client
+		if d.Name() == common.StateFolderName {
+			return fs.SkipDir
+		}
+
 		// get the clientID
 		clientID := filepath.Base(path)
 
 		// get the backups
-		backupsByClient, err := GetBackupsByPath(path, full)
+		backupsByClient, err := getBackupsByPath(b.storage, b.clock, path, full)
 		if err != nil {
 			return err
 		}
@@ -69,9 +137,24 @@ func (b *BackupService) GetAllBackups(ctx context.Context, full bool) (map[strin
 }
 
 func (b *BackupService) GetBackupsByClientID(ctx context.Context, clientID string, full bool) ([]codegen.FolderBackup, error) {
+	if b.index != nil {
+		backups, err := b.indexedFolderBackups(clientID)
+		if err != nil {
+			return nil, err
+		}
+
+		if full {
+			for i := range backups {
+				fillSizeAndCount(b.storage, filepath.Join(b.storage.Root(), *backups[i].BackupFolderPath), &backups[i])
+			}
+		}
+
+		return backups, nil
+	}
+
 	// traverse the backup folder and get all the backups
 	backupRootByClient := filepath.Join(b.backupRoot, clientID)
-	backups, err := GetBackupsByPath(backupRootByClient, full)
+	backups, err := getBackupsByPath(b.storage, b.clock, backupRootByClient, full)
 	if err != nil {
 		return nil, err
 	}
@@ -81,7 +164,7 @@ func (b *BackupService) GetBackupsByClientID(ctx context.Context, clientID strin
 
 func (b *BackupService) IsClientIDExists(clientID string) (bool, error) {
 	backupRootByClient := filepath.Join(b.backupRoot, clientID)
-	if _, err := os.Stat(backupRootByClient); err != nil {
+	if _, err := b.storage.Stat(backupRootByClient); err != nil {
 		if os.IsNotExist(err) {
 			return false, nil
 		}
@@ -91,13 +174,10 @@ func (b *BackupService) IsClientIDExists(clientID string) (bool, error) {
 }
 
 func (b *BackupService) IsBackupExists(clientID, clientFolderPath string) (bool, error) {
-	backupRootByClient := filepath.Join(b.backupRoot, clientID)
-
-	// convert Windows path to Unix path
-	clientFolderPath = Normalize(clientFolderPath)
+	// convert Windows path to Unix path, and look up the folder as the client compares paths
+	backupFolderPath := b.clientPathsOf(clientID, clientFolderPath).backupFolderFullPath
 
-	backupFolderPath := filepath.Join(backupRootByClient, clientFolderPath)
-	if _, err := os.Stat(backupFolderPath); err != nil {
+	if _, err := b.storage.Stat(backupFolderPath); err != nil {
 		if os.IsNotExist(err) {
 			return false, nil
 		}
@@ -107,61 +187,224 @@ func (b *BackupService) IsBackupExists(clientID, clientFolderPath string) (bool,
 }
 
 func (b *BackupService) Proceed(backup codegen.FolderBackup) (*codegen.FolderBackup, error) {
+	start := time.Now()
+
+	runsTotal.WithLabelValues("started").Inc()
+
+	result, err := b.proceed(backup)
+
+	proceedDurationSeconds.WithLabelValues(lo.Ternary(err == nil, "succeeded", "failed")).Observe(time.Since(start).Seconds())
+	if err != nil {
+		runsTotal.WithLabelValues("failed").Inc()
+	}
+
+	if err != nil && backup.ClientID != nil && backup.ClientFolderPath != nil {
+		b.publish(codegen.RunFailed, b.clientPathsOf(*backup.ClientID, *backup.ClientFolderPath).backupFolderPath, codegen.BackupEvent{
+			Message: lo.ToPtr(err.Error()),
+		})
+	}
+
+	return result, err
+}
+
+func (b *BackupService) proceed(backup codegen.FolderBackup) (*codegen.FolderBackup, error) {
 	if backup.ClientFolderFileHashes == nil {
 		return nil, fmt.Errorf("client folder file hashes is nil")
 	}
 
-	b.lockMutex.Lock()
-	defer b.lockMutex.Unlock()
+	policy, err := b.pathPolicyFor(&backup)
+	if err != nil {
+		return nil, err
+	}
+	backup.PathPolicy = &policy
 
-	// convert Windows path to Unix path
-	clientFolderPathNormalized := Normalize(*backup.ClientFolderPath)
-	backupFolderPath := filepath.Join(common.BackupRootFolder, *backup.ClientID, clientFolderPathNormalized)
+	// convert Windows path to Unix path, and look up the folder backup as the client compares paths
+	paths := b.clientPathsWith(*backup.ClientID, *backup.ClientFolderPath, policy)
+	backupFolderPath := paths.backupFolderPath
 
-	if _, ok := b.proceedingPaths[backupFolderPath]; ok {
-		return nil, fmt.Errorf("backup is already proceeding")
+	// wait for any other operation on the folder backup, including WebDAV writes, and hold off new ones
+	unlock, err := b.locks.Lock(backupFolderPath, "proceed")
+	if err != nil {
+		return nil, err
 	}
+	defer unlock()
+
+	backupFolderFullpath := paths.backupFolderFullPath
 
-	b.proceedingPaths[backupFolderPath] = &sync.Mutex{}
-	defer delete(b.proceedingPaths, backupFolderPath)
+	// keep the patterns and the retention of the last run unless the client gives new ones, while the version
+	// store is only ever chosen for a new folder backup
+	backup.VersionStore = lo.ToPtr(configuredVersionStore())
+	if previousBackup, err := LoadMetadata(b.storage, backupFolderFullpath); err == nil {
+		backup.ExcludePatterns = lo.Ternary(backup.ExcludePatterns == nil, previousBackup.ExcludePatterns, backup.ExcludePatterns)
+		backup.IncludePatterns = lo.Ternary(backup.IncludePatterns == nil, previousBackup.IncludePatterns, backup.IncludePatterns)
+		backup.DeletedFileRetentionDays = lo.Ternary(backup.DeletedFileRetentionDays == nil, previousBackup.DeletedFileRetentionDays, backup.DeletedFileRetentionDays)
+		backup.VersionStore = lo.Ternary(previousBackup.VersionStore == nil, lo.ToPtr(codegen.Suffix), previousBackup.VersionStore)
+	} else if _, err := b.storage.Stat(backupFolderFullpath); err == nil {
+		// kept before the version store could be chosen, or without its metadata
+		backup.VersionStore = lo.ToPtr(codegen.Suffix)
+	}
+
+	filter, err := NewFilter(&backup)
+	if err != nil {
+		return nil, err
+	}
+
+	// files are expected under the names already kept, if they only differ in how they are written
+	clientFileMap := map[string]string{}
+	for clientFile := range *backup.ClientFolderFileSizes {
+		relativePath := paths.relativePath(clientFile)
+
+		// ignored files are left out of the run, as if the client didn't have them
+		if filter.IsIgnored(relativePath) {
+			delete(*backup.ClientFolderFileSizes, clientFile)
+			delete(*backup.ClientFolderFileHashes, clientFile)
+			continue
+		}
+
+		if err := CheckPath(policy, relativePath); err != nil {
+			return nil, err
+		}
+
+		clientFileMap[relativePath] = clientFile
+	}
+
+	clientExists, err := b.IsClientIDExists(*backup.ClientID)
+	if err != nil {
+		return nil, err
+	}
 
-	b.proceedingPaths[backupFolderPath].Lock()
-	defer b.proceedingPaths[backupFolderPath].Unlock()
+	if err := b.setPathPolicy(*backup.ClientID, policy); err != nil {
+		return nil, err
+	}
 
-	if err := os.MkdirAll(backupFolderPath, 0o755); err != nil {
+	if err := b.storage.MkdirAll(backupFolderFullpath, 0o755); err != nil {
 		return nil, err
 	}
+
+	if !clientExists {
+		b.publish(codegen.ClientRegistered, backupFolderPath, codegen.BackupEvent{
+			ClientName: backup.ClientName,
+		})
+	}
 	backup.BackupFolderPath = &backupFolderPath
 
 	// checkpoint
-	if err := SaveMetadata(&backup); err != nil {
+	if err := SaveMetadata(b.storage, &backup); err != nil {
 		return nil, err
 	}
 
-	backupFolderFullpath := filepath.Join(config.AppInfo.DataRootPath, backupFolderPath)
+	b.rememberFolderBackup(backupFolderPath, *backup.VersionStore)
+
+	// indexed right away, so it is listed even if this run fails
+	b.updateIndex(func(index *Index) error {
+		return index.PutFolderBackup(&backup)
+	})
 
-	nonBackupFiles, err := FilterBackupFiles(backupFolderFullpath)
+	nonBackupFiles, err := FilterBackupFiles(b.storage, backupFolderFullpath)
 	if err != nil {
 		return nil, err
 	}
 	backup.InProgress = lo.ToPtr(true)
 
 	// checkpoint
-	if err := SaveMetadata(&backup); err != nil {
+	if err := SaveMetadata(b.storage, &backup); err != nil {
 		return nil, err
 	}
 
-	clientFileMap := map[string]string{}
-	for clientFile := range *backup.ClientFolderFileSizes {
-		clientFileMap[Normalize(clientFile)] = clientFile
+	// resume the previous run if it was interrupted before being completed
+	previousRun, err := LoadRun(b.storage, backupFolderFullpath)
+	if err != nil {
+		logger.Error("failed to load the previous run, starting over", zap.String("path", backupFolderFullpath), zap.Error(err))
+		previousRun = nil
+	}
+
+	// sizes the client gave for the files of the previous run, telling half-written files from complete ones
+	previousSizes := map[string]int64{}
+
+	if previousRun != nil && !previousRun.Completed {
+		logger.Info("resuming the interrupted backup", zap.String("path", backupFolderFullpath), zap.Int("pending", len(previousRun.PendingFiles)))
+		backup.Resumed = lo.ToPtr(true)
+
+		if manifest, err := LoadManifest(b.storage, backupFolderFullpath, previousRun.StartTime); err == nil && manifest.FileSizes != nil {
+			for clientFile, size := range *manifest.FileSizes {
+				previousSizes[paths.relativePath(clientFile)] = size
+			}
+		} else if err != nil && !errors.Is(err, ErrManifestNotFound) {
+			return nil, err
+		}
+
+		b.cleanUpUploads(*backup.ClientID, paths, backup.ClientFolderFileHashes)
+	} else {
+		previousRun = &Run{}
 	}
 
+	upToDateFiles := map[string]bool{}
+	existingFiles := map[string]bool{}
+	versionings := []versioning{}
+
 	for _, file := range nonBackupFiles {
 
 		shouldBackup := false
 		shouldMove := false
 
-		clientFile, ok := clientFileMap[strings.TrimLeft(strings.TrimPrefix(file, backupFolderFullpath), `/\`)]
+		relativePath := strings.TrimLeft(strings.TrimPrefix(file, backupFolderFullpath), `/\`)
+
+		// ignored files are never versioned, whether the client has them or not
+		if filter.IsIgnored(filepath.ToSlash(relativePath)) {
+			continue
+		}
+
+		existingFiles[relativePath] = true
+
+		clientFile, ok := clientFileMap[relativePath]
+
+		if previousRun.IsPending(relativePath) {
+			// the file was being uploaded when the previous run was interrupted, and its previous version
+			// has already been kept, so it is either uploaded completely or half-written.
+			if ok {
+				upToDate, err := isFileUpToDate(b.storage, file, (*backup.ClientFolderFileSizes)[clientFile], (*backup.ClientFolderFileHashes)[clientFile])
+				if err != nil {
+					return nil, err
+				}
+
+				if upToDate {
+					logger.Info("file has been uploaded before the interruption, no backup needed.", zap.String("file", file))
+					upToDateFiles[relativePath] = true
+					continue
+				}
+			}
+
+			// only a file shorter than the client said is known to be half-written. Any other is the version
+			// uploaded by the previous run, e.g. by a client never completing its runs, and is kept as usual.
+			fileInfo, err := b.storage.Stat(file)
+			if err != nil {
+				return nil, err
+			}
+
+			if size, known := previousSizes[relativePath]; known && fileInfo.Size() < size {
+				if err := b.storage.Remove(file); err != nil {
+					return nil, err
+				}
+
+				b.updateIndex(func(index *Index) error {
+					return index.DeleteFile(backupFolderPath, relativePath)
+				})
+
+				logger.Info("half-written file has been removed", zap.String("file", file))
+				continue
+			}
+		}
+
+		if !ok && strings.HasSuffix(file, partialFileExt) {
+			// leftover of an interrupted transfer by Rclone
+			if err := b.storage.Remove(file); err != nil {
+				return nil, err
+			}
+
+			logger.Info("partial file has been removed", zap.String("file", file))
+			continue
+		}
+
 		if !ok {
 			// file doesn't exist in the client folder, so consider it has been deleted.
 			shouldMove = true
@@ -170,7 +413,7 @@ func (b *BackupService) Proceed(backup codegen.FolderBackup) (*codegen.FolderBac
 
 		// check by comparing the sizes
 		if !shouldBackup {
-			fileInfo, err := os.Stat(file)
+			fileInfo, err := b.storage.Stat(file)
 			if err != nil {
 				return nil, err
 			}
@@ -190,7 +433,7 @@ func (b *BackupService) Proceed(backup codegen.FolderBackup) (*codegen.FolderBac
 
 		// check again by comparing the hashes if the sizes are identical
 		if !shouldBackup {
-			fileHash, err := FileHash(file)
+			fileHash, err := FileHash(b.storage, file)
 			if err != nil {
 				return nil, err
 			}
@@ -209,42 +452,193 @@ func (b *BackupService) Proceed(backup codegen.FolderBackup) (*codegen.FolderBac
 
 		if !shouldBackup {
 			logger.Info("file is up to date, no backup needed.", zap.String("file", file))
+			upToDateFiles[relativePath] = true
 			continue
 		}
 
-		backupFilePath, err := BackupFile(file, shouldMove)
+		versionings = append(versionings, versioning{file: file, relativePath: relativePath, move: shouldMove, deleted: !ok})
+	}
+
+	// files the client has moved or renamed are moved along rather than uploaded again
+	moves, versionings, err := findMoves(b.storage, &backup, clientFileMap, existingFiles, versionings)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, m := range moves {
+		upToDateFiles[m.newRelativePath] = true
+	}
+
+	// whatever is not up to date is expected to be uploaded by the client
+	uploadSize := int64(0)
+	for relativePath, clientFile := range clientFileMap {
+		if !upToDateFiles[relativePath] {
+			uploadSize += (*backup.ClientFolderFileSizes)[clientFile]
+		}
+	}
+
+	// make room before anything is copied, so a full data root doesn't leave the metadata half-written
+	if err := b.ensureSpace(backupFolderPath, backupFolderFullpath, versionings, uploadSize); err != nil {
+		return nil, err
+	}
+
+	for _, m := range moves {
+		if err := b.applyMove(backupFolderPath, backupFolderFullpath, m); err != nil {
+			logger.Error("failed to move file", zap.String("file", m.file), zap.Error(err))
+			return nil, err
+		}
+	}
+
+	// loaded only now, since making room might have pruned the last versions of deleted files
+	deletedFiles, err := LoadDeletedFiles(b.storage, backupFolderFullpath)
+	if err != nil {
+		return nil, err
+	}
+
+	deletedFilesChanged := false
+
+	// files the client has again are no longer deleted
+	for relativePath := range clientFileMap {
+		if _, ok := deletedFiles[relativePath]; ok {
+			delete(deletedFiles, relativePath)
+			deletedFilesChanged = true
+		}
+	}
+
+	for _, v := range versionings {
+		backupFilePath, err := b.backupFile(*backup.VersionStore, backupFolderFullpath, v.file, v.move)
 		if err != nil {
-			logger.Error("failed to backup file", zap.String("file", file), zap.Error(err))
+			logger.Error("failed to backup file", zap.String("file", v.file), zap.Error(err))
 			return nil, err
 		}
 
-		logger.Info("file has been backed up", zap.String("file", file), zap.String("backup", backupFilePath))
+		// a deleted file is recorded as such, so it isn't taken for just another version
+		if v.deleted {
+			fileInfo, err := b.storage.Stat(backupFilePath)
+			if err != nil {
+				return nil, err
+			}
+
+			if err := deletedFiles.add(backupFolderFullpath, v.relativePath, backupFilePath, fileInfo.Size(), b.clock.Now()); err != nil {
+				return nil, err
+			}
+			deletedFilesChanged = true
+		}
+
+		logger.Info("file has been backed up", zap.String("file", v.file), zap.String("backup", backupFilePath))
+
+		b.indexVersion(backupFolderPath, backupFolderFullpath, v.relativePath, backupFilePath, v.move)
+
+		filesVersionedTotal.WithLabelValues(lo.Ternary(v.move, "move", "copy")).Inc()
+
+		b.publish(codegen.FileVersioned, backupFolderPath, codegen.BackupEvent{
+			Path: lo.ToPtr(filepath.ToSlash(v.relativePath)),
+		})
+	}
+
+	if b.pruneDeletedFiles(backupFolderPath, backupFolderFullpath, deletedFiles, lo.FromPtr(backup.DeletedFileRetentionDays), b.clock.Now()) > 0 {
+		deletedFilesChanged = true
+	}
+
+	if deletedFilesChanged {
+		if err := SaveDeletedFiles(b.storage, backupFolderFullpath, deletedFiles); err != nil {
+			return nil, err
+		}
+	}
+
+	satisfiedFiles := lo.Map(moves, func(m move, _ int) string { return clientFileMap[m.newRelativePath] })
+
+	// content backed up before, e.g. by another client, is copied on the server rather than uploaded
+	relativePaths := lo.Keys(clientFileMap)
+	sort.Strings(relativePaths)
+
+	for _, relativePath := range relativePaths {
+		if upToDateFiles[relativePath] {
+			continue
+		}
+
+		clientFile := clientFileMap[relativePath]
+		if b.copyFromIndex(backupFolderFullpath, relativePath, (*backup.ClientFolderFileSizes)[clientFile], (*backup.ClientFolderFileHashes)[clientFile]) {
+			upToDateFiles[relativePath] = true
+			satisfiedFiles = append(satisfiedFiles, clientFile)
+		}
 	}
 
-	backup.LastBackupTime = lo.ToPtr(time.Now().Unix())
+	now := b.clock.Now()
+
+	// keep the accepted manifest so later requests don't need to ask the client again
+	if err := SaveManifest(b.storage, backupFolderFullpath, &codegen.Manifest{
+		ClientFolderPath: backup.ClientFolderPath,
+		Time:             lo.ToPtr(now.UnixMilli()),
+		FileSizes:        backup.ClientFolderFileSizes,
+		FileHashes:       backup.ClientFolderFileHashes,
+	}); err != nil {
+		logger.Error("failed to save manifest", zap.String("path", backupFolderFullpath), zap.Error(err))
+		return nil, err
+	}
+
+	run := &Run{
+		StartTime:    now.UnixMilli(),
+		PendingFiles: []string{},
+	}
+
+	for relativePath := range clientFileMap {
+		if !upToDateFiles[relativePath] {
+			run.AddPending(relativePath)
+		}
+	}
+
+	sort.Strings(run.PendingFiles)
+
+	if err := SaveRun(b.storage, backupFolderFullpath, run); err != nil {
+		return nil, err
+	}
+
+	b.updateIndex(func(index *Index) error {
+		for relativePath := range upToDateFiles {
+			clientFile := clientFileMap[relativePath]
+			if err := index.PutFile(backupFolderPath, relativePath, (*backup.ClientFolderFileHashes)[clientFile], (*backup.ClientFolderFileSizes)[clientFile]); err != nil {
+				return err
+			}
+		}
+
+		return index.PutRun(backupFolderPath, run)
+	})
+
+	backup.LastBackupTime = lo.ToPtr(now.UnixMilli())
 
 	// checkpoint
 	backup.ClientFolderFileHashes = nil
 	backup.ClientFolderFileSizes = nil
 
-	if err := SaveMetadata(&backup); err != nil {
+	if err := SaveMetadata(b.storage, &backup); err != nil {
 		return nil, err
 	}
 
+	b.updateIndex(func(index *Index) error {
+		return index.PutFolderBackup(&backup)
+	})
+
+	b.publish(codegen.RunStarted, backupFolderPath, codegen.BackupEvent{
+		FileCount: lo.ToPtr(len(run.PendingFiles)),
+	})
+
+	// only told to the client, not kept
+	sort.Strings(satisfiedFiles)
+	backup.SatisfiedFiles = &satisfiedFiles
+
 	return &backup, nil
 }
 
 func (b *BackupService) DeleteBackupsByClientID(ctx context.Context, clientID, clientFolderPath string) error {
-	// convert Windows path to Unix path
-	clientFolderPathNormalized := Normalize(clientFolderPath)
+	// convert Windows path to Unix path, and look up the folder backup as the client compares paths
+	paths := b.clientPathsOf(clientID, clientFolderPath)
 
-	backupRoot := filepath.Join(config.AppInfo.DataRootPath, common.BackupRootFolder)
-	backupRootByClient := filepath.Join(backupRoot, clientID)
-
-	backupFolderPath := filepath.Join(backupRootByClient, clientFolderPathNormalized)
+	backupRoot := b.backupRoot
+	backupFolderPath := paths.backupFolderFullPath
 
 	// check if the backup folder exists
-	if _, err := os.Stat(backupFolderPath); err != nil {
+	if _, err := b.storage.Stat(backupFolderPath); err != nil {
 		if os.IsNotExist(err) {
 			logger.Error("backup folder doesn't exist", zap.String("path", backupFolderPath))
 		} else {
@@ -253,37 +647,50 @@ func (b *BackupService) DeleteBackupsByClientID(ctx context.Context, clientID, c
 		return err
 	}
 
-	b.lockMutex.Lock()
-	defer b.lockMutex.Unlock()
+	unlock, err := b.locks.Lock(paths.backupFolderPath, "delete")
+	if err != nil {
+		return err
+	}
+	defer unlock()
 
-	if _, ok := b.deletingPaths[backupFolderPath]; ok {
-		logger.Info("backup folder is already being deleted", zap.String("path", backupFolderPath))
+	// check again, since the lock might have been waited for another deletion
+	if _, err := b.storage.Stat(backupFolderPath); os.IsNotExist(err) {
+		logger.Info("backup folder has already been deleted", zap.String("path", backupFolderPath))
 		return nil
 	}
 
-	b.deletingPaths[backupFolderPath] = &sync.Mutex{}
-	defer delete(b.deletingPaths, backupFolderPath)
+	b.updateIndex(func(index *Index) error {
+		return index.DeleteFolderBackup(paths.backupFolderPath)
+	})
 
-	b.deletingPaths[backupFolderPath].Lock()
-	defer b.deletingPaths[backupFolderPath].Unlock()
+	b.forgetFolderBackup(paths.backupFolderPath)
 
 	// delete the backup folder
 	currentPath := backupFolderPath
 
 	for {
-		if err := os.RemoveAll(currentPath); err != nil {
+		if err := b.storage.RemoveAll(currentPath); err != nil {
 			logger.Error("failed to delete backup folder", zap.String("path", backupFolderPath), zap.Error(err))
 			return err
 		}
 
 		currentPath = filepath.Dir(currentPath)
 
-		if currentPath == backupRoot || currentPath == config.AppInfo.DataRootPath {
+		if currentPath == backupRoot || currentPath == b.storage.Root() {
+			break
+		}
+
+		// the folder of the client goes along with its settings once its last folder backup is deleted
+		if filepath.Dir(currentPath) == backupRoot {
+			if err := b.deleteClientIfUnused(filepath.Base(currentPath)); err != nil {
+				logger.Error("failed to delete client folder", zap.String("path", currentPath), zap.Error(err))
+				return err
+			}
 			break
 		}
 
 		// check if the current path is empty
-		entries, err := os.ReadDir(currentPath)
+		entries, err := b.storage.ReadDir(currentPath)
 		if err != nil {
 			logger.Error("failed to read backup folder", zap.String("path", currentPath), zap.Error(err))
 			return err
@@ -294,16 +701,27 @@ func (b *BackupService) DeleteBackupsByClientID(ctx context.Context, clientID, c
 		}
 	}
 
+	b.publish(codegen.BackupDeleted, paths.backupFolderPath, codegen.BackupEvent{})
+
 	return nil
 }
 
+// NewBackupService returns the service keeping the folder backups under the configured data root on the
+// local file system.
 func NewBackupService() *BackupService {
-	backupRoot := filepath.Join(config.AppInfo.DataRootPath, common.BackupRootFolder)
+	return NewBackupServiceWith(NewLocalStorage(config.AppInfo.DataRootPath), SystemClock)
+}
+
+// NewBackupServiceWith returns the service keeping the folder backups in the storage and telling the time
+// by the clock. Locks and uploads in progress are kept under the data root of the storage on the local
+// file system, whichever the storage is.
+func NewBackupServiceWith(storage Storage, clock Clock) *BackupService {
+	backupRoot := filepath.Join(storage.Root(), common.BackupRootFolder)
 
-	if _, err := os.Stat(backupRoot); err != nil {
+	if _, err := storage.Stat(backupRoot); err != nil {
 		if os.IsNotExist(err) {
 			logger.Info("backup root folder doesn't exist, creating one", zap.String("path", backupRoot))
-			if err := os.MkdirAll(backupRoot, 0o755); err != nil {
+			if err := storage.MkdirAll(backupRoot, 0o755); err != nil {
 				logger.Error("failed to create backup root folder", zap.String("path", backupRoot), zap.Error(err))
 			}
 		} else {
@@ -313,17 +731,39 @@ func NewBackupService() *BackupService {
 
 	return &BackupService{
 		backupRoot: backupRoot,
+		storage:    storage,
+		clock:      clock,
+
+		locks:  NewLockManager(filepath.Join(backupRoot, common.StateFolderName, lockFolderName)),
+		events: NewEventBus(),
+
+		uploadingIDs: map[string]*uploadLock{},
+		uploadMutex:  &sync.Mutex{},
+
+		runMutex: &sync.Mutex{},
+
+		indexMutex: &sync.RWMutex{},
+
+		quotaWarnings: map[string]time.Time{},
+		quotaMutex:    &sync.Mutex{},
+
+		pathPolicies:    map[string]codegen.PathPolicy{},
+		pathPolicyMutex: &sync.Mutex{},
 
-		proceedingPaths: map[string]*sync.Mutex{},
-		deletingPaths:   map[string]*sync.Mutex{},
-		lockMutex:       &sync.Mutex{},
+		folderBackups:     map[string]codegen.VersionStore{},
+		folderBackupMutex: &sync.Mutex{},
 	}
 }
 
-func GetBackupsByPath(root string, full bool) ([]codegen.FolderBackup, error) {
+// GetBackupsByPath returns the folder backups under the root, recovering any corrupt metadata.
+func GetBackupsByPath(storage Storage, root string, full bool) ([]codegen.FolderBackup, error) {
+	return getBackupsByPath(storage, SystemClock, root, full)
+}
+
+func getBackupsByPath(storage Storage, clock Clock, root string, full bool) ([]codegen.FolderBackup, error) {
 	var backups []codegen.FolderBackup
 
-	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+	err := storage.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
 		if err != nil {
 			return err
 		}
@@ -334,21 +774,15 @@ func GetBackupsByPath(root string, full bool) ([]codegen.FolderBackup, error) {
 
 		metadataFilePath := filepath.Join(path, common.MetadataFileName)
 
-		if _, err := os.Stat(metadataFilePath); err == nil {
-			backup, err := LoadMetadata(path)
+		if _, err := storage.Stat(metadataFilePath); err == nil {
+			backup, err := LoadOrRecoverMetadata(storage, clock, path)
 			if err != nil {
 				logger.Error("failed to load metadata", zap.String("path", metadataFilePath), zap.Error(err))
 				return fs.SkipDir
 			}
 
 			if full {
-				size, count, err := utils.SizeAndCount(path, common.Throttling)
-				if err != nil {
-					logger.Info("failed to calculate the size and count", zap.String("path", path), zap.Error(err))
-				}
-
-				backup.BackupFolderCount = &count
-				backup.BackupFolderSize = &size
+				fillSizeAndCount(storage, path, backup)
 			}
 
 			backup.ClientFolderFileHashes = nil
@@ -367,8 +801,19 @@ func GetBackupsByPath(root string, full bool) ([]codegen.FolderBackup, error) {
 	return backups, nil
 }
 
+func fillSizeAndCount(storage Storage, path string, backup *codegen.FolderBackup) {
+	size, count, err := storage.SizeAndCount(path)
+	if err != nil {
+		logger.Info("failed to calculate the size and count", zap.String("path", path), zap.Error(err))
+	}
+
+	backup.BackupFolderCount = &count
+	backup.BackupFolderSize = &size
+}
+
 func isBackupFile(filename string) bool {
-	if filename == common.MetadataFileName {
+	// including temporary files left by an interrupted metadata write
+	if strings.HasPrefix(filename, common.MetadataFileName) {
 		return true
 	}
 
@@ -376,19 +821,31 @@ func isBackupFile(filename string) bool {
 	return backupFilePattern.MatchString(filename)
 }
 
-func FilterBackupFiles(root string) ([]string, error) {
+// FilterBackupFiles returns the files of the client under the folder backup, leaving out what the service
+// keeps there, such as history copies in the version store of the folder backup.
+func FilterBackupFiles(storage Storage, root string) ([]string, error) {
 	var nonBackupFiles []string
 
-	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+	store := versionStoreOf(storage, root)
+
+	err := storage.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
 		if err != nil {
 			return err
 		}
 
 		if d.IsDir() {
+			if d.Name() == common.StateFolderName || store == codegen.Hidden && path == filepath.Join(root, common.VersionFolderName) {
+				return fs.SkipDir
+			}
 			return nil
 		}
 
-		if !isBackupFile(d.Name()) {
+		relativePath, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+
+		if !isReservedPath(store, relativePath) {
 			nonBackupFiles = append(nonBackupFiles, path)
 		}
 
@@ -403,18 +860,50 @@ func FilterBackupFiles(root string) ([]string, error) {
 
 // TODO - implement a scheduled job to calculate the hash of all files in the backup folder
 
-func FileHash(path string) (string, error) {
-	// TODO - read from in-memory cache if it exists and motification time matches
+// isFileUpToDate compares the file with the size and hash given by the client.
+func isFileUpToDate(storage Storage, path string, size int64, hash string) (bool, error) {
+	fileInfo, err := storage.Stat(path)
+	if err != nil {
+		return false, err
+	}
+
+	if fileInfo.Size() != size {
+		return false, nil
+	}
+
+	fileHash, err := FileHash(storage, path)
+	if err != nil {
+		return false, err
+	}
+
+	return fileHash == hash, nil
+}
+
+func FileHash(storage Storage, path string) (string, error) {
+	fileInfo, err := storage.Stat(path)
+	if err != nil {
+		return "", err
+	}
+
+	if hash, ok := fileHashCache.get(path, fileInfo); ok {
+		return hash, nil
+	}
+
 	// TODO - read from the checksum file if it exists and motification time matches
 
-	// TODO - calculate the hash of the file if it doesn't exist
-	hash, err := XXHash(path)
+	f, err := storage.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	hash, err := XXHashReader(f)
 	if err != nil {
 		return "", err
 	}
 
 	// TODO - write the hash to the checksum file and touch it with the same modification time as the file
-	// TODO - write to the in-memory cache along with the modification time
+	fileHashCache.put(path, fileInfo, hash)
 
 	return hash, nil
 }
@@ -426,37 +915,60 @@ func XXHash(path string) (string, error) {
 	}
 	defer f.Close()
 
+	return XXHashReader(f)
+}
+
+func XXHashReader(r io.Reader) (string, error) {
 	hash := xxhash.New()
-	if _, err := io.Copy(hash, f); err != nil {
+	n, err := io.Copy(hash, r)
+	hashedBytesTotal.Add(float64(n))
+	if err != nil {
 		return "", err
 	}
 
 	return fmt.Sprintf("%x", hash.Sum(nil)), nil
 }
 
-func BackupFile(path string, move bool) (string, error) {
-	if _, err := os.Stat(path); err != nil {
+// BackupFile keeps a history copy of the file next to it, named after the time it is made, by moving or
+// copying it.
+func BackupFile(storage Storage, path string, move bool, now time.Time) (string, error) {
+	return backupFileIn(storage, path, filepath.Dir(path), move, now)
+}
+
+// backupFileIn keeps a history copy of the file in the given folder, named as BackupFile names it. The name
+// tells the time in UTC to the millisecond, and is made unique with a counter if a history copy made at the
+// same millisecond exists already, so no history copy is ever overwritten.
+func backupFileIn(storage Storage, path, dir string, move bool, now time.Time) (string, error) {
+	if _, err := storage.Stat(path); err != nil {
 		return "", fmt.Errorf("error accessing file: %w", err)
 	}
 
-	dir := filepath.Dir(path)
 	filename := filepath.Base(path)
 	filenameWithoutExt := strings.TrimSuffix(filename, filepath.Ext(filename))
-	backupName := fmt.Sprintf(
-		"%s-backup-%s%s",
-		filenameWithoutExt,
-		time.Now().Format("2006-01-02-15-04-05-000"),
-		filepath.Ext(filename),
-	)
+	timestamp := formatBackupTime(now)
+
+	var backupPath string
+	for i := 0; ; i++ {
+		backupName := fmt.Sprintf("%s-backup-%s%s", filenameWithoutExt, timestamp, filepath.Ext(filename))
+		if i > 0 {
+			backupName = fmt.Sprintf("%s-backup-%s-%d%s", filenameWithoutExt, timestamp, i, filepath.Ext(filename))
+		}
+
+		backupPath = filepath.Join(dir, backupName)
 
-	backupPath := filepath.Join(dir, backupName)
+		if _, err := storage.Stat(backupPath); os.IsNotExist(err) {
+			break
+		} else if err != nil {
+			return "", fmt.Errorf("error accessing history copy: %w", err)
+		}
+	}
 
 	if move {
-		if err := os.Rename(path, backupPath); err != nil {
+		if err := storage.Rename(path, backupPath); err != nil {
 			return "", fmt.Errorf("error renaming file: %w", err)
 		}
 	} else {
-		if err := copyFile(path, backupPath); err != nil {
+		if err := storage.Copy(path, backupPath); err != nil {
 			return "", fmt.Errorf("error copying file: %w", err)
 		}
 	}
@@ -464,25 +976,10 @@ func BackupFile(path string, move bool) (string, error) {
 	return backupPath, nil
 }
 
-func copyFile(src, dst string) error {
-	srcFile, err := os.Open(src)
-	if err != nil {
-		return err
-	}
-	defer srcFile.Close()
-
-	dstFile, err := os.Create(dst)
-	if err != nil {
-		return err
-	}
-	defer dstFile.Close()
-
-	_, err = io.Copy(dstFile, srcFile)
-	if err != nil {
-		return err
-	}
-
-	return nil
+// formatBackupTime formats the time a history copy is made for its name, e.g. 2023-04-10-12-00-00-123Z.
+func formatBackupTime(t time.Time) string {
+	t = t.UTC()
+	return fmt.Sprintf("%s-%03dZ", t.Format("2006-01-02-15-04-05"), t.Nanosecond()/int(time.Millisecond))
 }
 
 func Normalize(path string) string {
@@ -496,44 +993,15 @@ func Normalize(path string) string {
 	return strings.ReplaceAll(path, `\`, `/`)
 }
 
-func SaveMetadata(backup *codegen.FolderBackup) error {
-	if backup.BackupFolderPath == nil {
-		return fmt.Errorf("backup folder path is not set")
-	}
+// RelativeClientFilePath converts a file path given by the client, either absolute or relative to the
+// client folder, to a Unix path relative to the folder backup.
+func RelativeClientFilePath(clientFolderPathNormalized, clientFile string) string {
+	clientFileNormalized := Normalize(clientFile)
 
-	backupFolderFullPath := filepath.Join(config.AppInfo.DataRootPath, *backup.BackupFolderPath)
-
-	if err := os.MkdirAll(backupFolderFullPath, 0o755); err != nil {
-		return err
-	}
-
-	metadataFilePath := filepath.Join(backupFolderFullPath, common.MetadataFileName)
-	metadataFile, err := os.Create(metadataFilePath)
-	if err != nil {
-		return err
-	}
-	defer metadataFile.Close()
-
-	encoder := json.NewEncoder(metadataFile)
-	encoder.SetIndent("", "  ")
-
-	return encoder.Encode(backup)
-}
-
-func LoadMetadata(path string) (*codegen.FolderBackup, error) {
-	metadataFilePath := filepath.Join(path, common.MetadataFileName)
-
-	metadataFile, err := os.Open(metadataFilePath)
-	if err != nil {
-		return nil, err
+	prefix := strings.TrimRight(clientFolderPathNormalized, "/") + "/"
+	if prefix != "/" && strings.HasPrefix(clientFileNormalized, prefix) {
+		clientFileNormalized = strings.TrimPrefix(clientFileNormalized, prefix)
 	}
-	defer metadataFile.Close()
 
-	decoder := json.NewDecoder(metadataFile)
-	var backup codegen.FolderBackup
-	if err := decoder.Decode(&backup); err != nil {
-		return nil, err
-	}
-
-	return &backup, nil
+	return strings.TrimLeft(clientFileNormalized, "/")
 }
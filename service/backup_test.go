@@ -9,10 +9,10 @@ import (
 	"reflect"
 	"regexp"
 	"testing"
+	"time"
 
 	"github.com/IceWhaleTech/IceWhale-Files-Backup/codegen"
 	"github.com/IceWhaleTech/IceWhale-Files-Backup/common"
-	"github.com/IceWhaleTech/IceWhale-Files-Backup/pkg/config"
 	"github.com/IceWhaleTech/IceWhale-Files-Backup/service"
 	"github.com/samber/lo"
 	"github.com/stretchr/testify/assert"
@@ -33,8 +33,6 @@ func TestGetAllBackups(t *testing.T) {
 	assert.NoError(t, err)
 	defer os.RemoveAll(tmpDataRootDir)
 
-	config.AppInfo.DataRootPath = tmpDataRootDir
-
 	tmpDir := filepath.Join(tmpDataRootDir, common.BackupRootFolder)
 
 	// Create test folders
@@ -73,7 +71,7 @@ func TestGetAllBackups(t *testing.T) {
 
 	// Run test
 	ctx := context.Background()
-	allBackups, err := service.NewBackupService().GetAllBackups(ctx, false)
+	allBackups, err := service.NewBackupServiceWith(service.NewLocalStorage(tmpDataRootDir), service.SystemClock).GetAllBackups(ctx, false)
 	assert.NoError(t, err)
 
 	// Check results
@@ -136,32 +134,32 @@ func TestGetBackupsByPath(t *testing.T) {
 	assert.NoError(t, err)
 	defer os.RemoveAll(dir)
 
-	config.AppInfo.DataRootPath = dir
+	storage := service.NewLocalStorage(dir)
 
 	// create a metadata file for a backup
 	backupFolderPath := "backup"
 	backup := &codegen.FolderBackup{
 		BackupFolderPath: &backupFolderPath,
 	}
-	err = service.SaveMetadata(backup)
+	err = service.SaveMetadata(storage, backup)
 	assert.NoError(t, err)
 
 	// test GetBackupsByPath with full set to false
 	backupFolderFullpath := filepath.Join(dir, backupFolderPath)
-	backups, err := service.GetBackupsByPath(backupFolderFullpath, false)
+	backups, err := service.GetBackupsByPath(storage, backupFolderFullpath, false)
 	assert.NoError(t, err)
 	assert.Len(t, backups, 1)
 	assert.Equal(t, *backup.BackupFolderPath, *backups[0].BackupFolderPath)
 
 	// test GetBackupsByPath with full set to true
-	backups, err = service.GetBackupsByPath(backupFolderFullpath, true)
+	backups, err = service.GetBackupsByPath(storage, backupFolderFullpath, true)
 	assert.NoError(t, err)
 	assert.Len(t, backups, 1)
 	assert.Equal(t, *backup.BackupFolderPath, *backups[0].BackupFolderPath)
 	assert.NotNil(t, backups[0].BackupFolderCount)
 	assert.Equal(t, 1, *backups[0].BackupFolderCount)
 	assert.NotNil(t, backups[0].BackupFolderSize)
-	assert.Equal(t, int64(37), *backups[0].BackupFolderSize)
+	assert.Equal(t, int64(60), *backups[0].BackupFolderSize)
 }
 
 func TestBackup(t *testing.T) {
@@ -172,6 +170,8 @@ func TestBackup(t *testing.T) {
 	assert.Nil(t, err)
 	defer os.RemoveAll(tmpDir)
 
+	storage := service.NewLocalStorage(tmpDir)
+
 	testCases := []struct {
 		name    string
 		move    bool
@@ -198,7 +198,7 @@ func TestBackup(t *testing.T) {
 			srcFilePath := filepath.Join(tmpDir, srcFileName)
 
 			// Backup the file
-			backupPath, err := service.BackupFile(srcFilePath, tc.move)
+			backupPath, err := service.BackupFile(storage, srcFilePath, tc.move, time.Now())
 			assert.Nil(t, err)
 
 			// Check if the backup file exists and has the right naming pattern
@@ -222,6 +222,40 @@ func TestBackup(t *testing.T) {
 	}
 }
 
+func TestBackupFileAtSameMillisecond(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	tmpDir, err := os.MkdirTemp("", "test")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	storage := service.NewLocalStorage(tmpDir)
+	now := time.Date(2023, 4, 10, 20, 0, 0, 123456789, time.FixedZone("CST", 8*60*60))
+
+	// copies made within the same millisecond get their own names instead of overwriting each other
+	backupNames := []string{}
+	for _, content := range []string{"first", "second", "third"} {
+		assert.NoError(t, createFileWithContent(tmpDir, "a.txt", content))
+
+		backupPath, err := service.BackupFile(storage, filepath.Join(tmpDir, "a.txt"), content == "third", now)
+		assert.NoError(t, err)
+
+		backupNames = append(backupNames, filepath.Base(backupPath))
+	}
+
+	assert.Equal(t, []string{
+		"a-backup-2023-04-10-12-00-00-123Z.txt",
+		"a-backup-2023-04-10-12-00-00-123Z-1.txt",
+		"a-backup-2023-04-10-12-00-00-123Z-2.txt",
+	}, backupNames)
+
+	for i, content := range []string{"first", "second", "third"} {
+		buf, err := os.ReadFile(filepath.Join(tmpDir, backupNames[i]))
+		assert.NoError(t, err)
+		assert.Equal(t, content, string(buf))
+	}
+}
+
 func TestFilterBackupFiles(t *testing.T) {
 	defer goleak.VerifyNone(t)
 
@@ -230,6 +264,8 @@ func TestFilterBackupFiles(t *testing.T) {
 	assert.NoError(t, err)
 	defer os.RemoveAll(tempDir)
 
+	storage := service.NewLocalStorage(tempDir)
+
 	// Create non-backup files
 	assert.NoError(t, createFileWithContent(tempDir, "file1.txt", "test content"))
 	assert.NoError(t, createFileWithContent(tempDir, "file2.txt", "test content"))
@@ -248,7 +284,7 @@ func TestFilterBackupFiles(t *testing.T) {
 	// Create backup file in nested folder
 	assert.NoError(t, createFileWithContent(nestedFolder, "nested_file1-backup-2022-08-19-15-30-45-125.txt", "test content"))
 
-	nonBackupFiles, err := service.FilterBackupFiles(tempDir)
+	nonBackupFiles, err := service.FilterBackupFiles(storage, tempDir)
 	assert.NoError(t, err)
 
 	expectedFiles := []string{
@@ -268,6 +304,8 @@ func TestBackupWithFilterBackupFiles(t *testing.T) {
 	assert.Nil(t, err)
 	defer os.RemoveAll(tmpDir)
 
+	storage := service.NewLocalStorage(tmpDir)
+
 	// Create a source file with some content
 	srcFileName := "testfile.txt"
 	err = createFileWithContent(tmpDir, srcFileName, "hello world")
@@ -281,11 +319,11 @@ func TestBackupWithFilterBackupFiles(t *testing.T) {
 	assert.Nil(t, err)
 
 	// Backup the file with 'move' set to true (rename)
-	_, err = service.BackupFile(srcFilePath, true)
+	_, err = service.BackupFile(storage, srcFilePath, true, time.Now())
 	assert.Nil(t, err)
 
 	// Filter backup files
-	nonBackupFiles, err := service.FilterBackupFiles(tmpDir)
+	nonBackupFiles, err := service.FilterBackupFiles(storage, tmpDir)
 	assert.Nil(t, err)
 
 	// Check if there are exactly 2 non-backup files
@@ -316,7 +354,7 @@ func TestSaveAndLoadMetadata(t *testing.T) {
 	assert.NoError(t, err)
 	defer os.RemoveAll(dir)
 
-	config.AppInfo.DataRootPath = dir
+	storage := service.NewLocalStorage(dir)
 
 	// Create a temporary directory to store the test files
 	backupFolderPath := "backup"
@@ -346,12 +384,12 @@ func TestSaveAndLoadMetadata(t *testing.T) {
 	}
 
 	// Save metadata
-	err = service.SaveMetadata(testBackup)
+	err = service.SaveMetadata(storage, testBackup)
 	assert.NoError(t, err)
 
 	// Load metadata
 	backupFolderFullpath := filepath.Join(dir, backupFolderPath)
-	loadedBackup, err := service.LoadMetadata(backupFolderFullpath)
+	loadedBackup, err := service.LoadMetadata(storage, backupFolderFullpath)
 	assert.NoError(t, err)
 
 	// Check that loaded backup matches the original backup
@@ -0,0 +1,17 @@
+package service
+
+import "time"
+
+// Clock tells the time to the backup service, so tests can make it deterministic.
+type Clock interface {
+	Now() time.Time
+}
+
+type systemClock struct{}
+
+// SystemClock tells the time of the system.
+var SystemClock Clock = systemClock{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
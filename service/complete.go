@@ -0,0 +1,187 @@
+package service
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/IceWhaleTech/CasaOS-Common/utils/logger"
+	"github.com/IceWhaleTech/IceWhale-Files-Backup/codegen"
+	"github.com/samber/lo"
+	"go.uber.org/zap"
+)
+
+// Complete verifies the files uploaded by the client against the latest manifest of the folder backup,
+// and marks the run as succeeded or failed accordingly.
+func (b *BackupService) Complete(clientID, clientFolderPath string) (*codegen.FolderBackupVerification, error) {
+	// convert Windows path to Unix path, and look up the folder backup as the client compares paths
+	paths := b.clientPathsOf(clientID, clientFolderPath)
+
+	unlock, err := b.locks.Lock(paths.backupFolderPath, "complete")
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	backupFolderFullPath := paths.backupFolderFullPath
+
+	backup, err := LoadOrRecoverMetadata(b.storage, b.clock, backupFolderFullPath)
+	if err != nil {
+		return nil, err
+	}
+
+	manifest, err := LoadManifest(b.storage, backupFolderFullPath, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	verification, err := verifyManifest(b.storage, paths, manifest)
+	if err != nil {
+		return nil, err
+	}
+
+	// keep track of what is still pending, so the next run can resume from here
+	run := &Run{
+		StartTime:    *manifest.Time,
+		PendingFiles: []string{},
+		Completed:    *verification.Succeeded,
+	}
+
+	for _, clientFile := range append(*verification.MissingFiles, *verification.CorruptFiles...) {
+		run.AddPending(paths.relativePath(clientFile))
+	}
+
+	if err := SaveRun(b.storage, backupFolderFullPath, run); err != nil {
+		return nil, err
+	}
+
+	backup.InProgress = lo.ToPtr(false)
+	backup.LastBackupSucceeded = verification.Succeeded
+
+	if *verification.Succeeded {
+		backup.FailureCount = lo.ToPtr(0)
+	} else {
+		backup.FailureCount = lo.ToPtr(lo.FromPtr(backup.FailureCount) + 1)
+	}
+
+	// checkpoint
+	if err := SaveMetadata(b.storage, backup); err != nil {
+		return nil, err
+	}
+
+	b.updateIndex(func(index *Index) error {
+		if err := index.PutFolderBackup(backup); err != nil {
+			return err
+		}
+
+		if manifest.FileSizes == nil || manifest.FileHashes == nil {
+			return index.PutRun(*backup.BackupFolderPath, run)
+		}
+
+		for clientFile, size := range *manifest.FileSizes {
+			relativePath := paths.relativePath(clientFile)
+			if run.IsPending(relativePath) {
+				continue
+			}
+
+			if err := index.PutFile(*backup.BackupFolderPath, relativePath, (*manifest.FileHashes)[clientFile], size); err != nil {
+				return err
+			}
+		}
+
+		return index.PutRun(*backup.BackupFolderPath, run)
+	})
+
+	if len(*verification.CorruptFiles) > 0 {
+		b.publish(codegen.VerificationFailed, *backup.BackupFolderPath, codegen.BackupEvent{
+			FileCount: lo.ToPtr(len(*verification.CorruptFiles)),
+		})
+	}
+
+	runsTotal.WithLabelValues(lo.Ternary(*verification.Succeeded, "completed", "failed")).Inc()
+
+	if *verification.Succeeded {
+		b.publish(codegen.RunCompleted, *backup.BackupFolderPath, codegen.BackupEvent{
+			FileCount: verification.VerifiedCount,
+		})
+	} else {
+		b.publish(codegen.RunFailed, *backup.BackupFolderPath, codegen.BackupEvent{
+			FileCount: verification.VerifiedCount,
+			Message:   lo.ToPtr(fmt.Sprintf("%d files missing, %d files corrupt", len(*verification.MissingFiles), len(*verification.CorruptFiles))),
+		})
+	}
+
+	backup.ClientFolderFileHashes = nil
+	backup.ClientFolderFileSizes = nil
+
+	verification.FolderBackup = backup
+
+	return verification, nil
+}
+
+// verifyManifest checks every file in the manifest exists under the folder backup with the same size and
+// hash, looking files up as the client compares paths.
+func verifyManifest(storage Storage, paths *clientPaths, manifest *codegen.Manifest) (*codegen.FolderBackupVerification, error) {
+	missingFiles := []string{}
+	corruptFiles := []string{}
+	verifiedCount := 0
+
+	var fileSizes map[string]int64
+	if manifest.FileSizes != nil {
+		fileSizes = *manifest.FileSizes
+	}
+
+	var fileHashes map[string]string
+	if manifest.FileHashes != nil {
+		fileHashes = *manifest.FileHashes
+	}
+
+	for clientFile, size := range fileSizes {
+		file := filepath.Join(paths.backupFolderFullPath, paths.relativePath(clientFile))
+
+		fileInfo, err := storage.Stat(file)
+		if err != nil {
+			if os.IsNotExist(err) {
+				missingFiles = append(missingFiles, clientFile)
+				continue
+			}
+			return nil, err
+		}
+
+		if fileInfo.IsDir() || fileInfo.Size() != size {
+			corruptFiles = append(corruptFiles, clientFile)
+			continue
+		}
+
+		hash, ok := fileHashes[clientFile]
+		if !ok {
+			// nothing to compare with, so trust the size
+			verifiedCount++
+			continue
+		}
+
+		fileHash, err := FileHash(storage, file)
+		if err != nil {
+			return nil, err
+		}
+
+		if fileHash != hash {
+			logger.Info("uploaded file doesn't match the manifest", zap.String("file", file), zap.String("expected", hash), zap.String("actual", fileHash))
+			corruptFiles = append(corruptFiles, clientFile)
+			continue
+		}
+
+		verifiedCount++
+	}
+
+	sort.Strings(missingFiles)
+	sort.Strings(corruptFiles)
+
+	return &codegen.FolderBackupVerification{
+		Succeeded:     lo.ToPtr(len(missingFiles) == 0 && len(corruptFiles) == 0),
+		VerifiedCount: &verifiedCount,
+		MissingFiles:  &missingFiles,
+		CorruptFiles:  &corruptFiles,
+	}, nil
+}
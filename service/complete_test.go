@@ -0,0 +1,102 @@
+package service_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/IceWhaleTech/IceWhale-Files-Backup/codegen"
+	"github.com/IceWhaleTech/IceWhale-Files-Backup/common"
+	"github.com/IceWhaleTech/IceWhale-Files-Backup/pkg/config"
+	"github.com/IceWhaleTech/IceWhale-Files-Backup/service"
+	"github.com/samber/lo"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/goleak"
+)
+
+func TestComplete(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	tmpDataRootDir, err := os.MkdirTemp("", "test")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tmpDataRootDir)
+
+	storage := service.NewLocalStorage(tmpDataRootDir)
+
+	config.AppInfo.DataRootPath = tmpDataRootDir
+
+	clientID := "client1"
+	clientFolderPath := `C:\Users\icewhale\Downloads`
+
+	backupFolderPath := filepath.Join(common.BackupRootFolder, clientID, service.Normalize(clientFolderPath))
+	backupFolderFullPath := filepath.Join(tmpDataRootDir, backupFolderPath)
+
+	assert.NoError(t, service.SaveMetadata(storage, &codegen.FolderBackup{
+		BackupFolderPath: &backupFolderPath,
+		ClientFolderPath: &clientFolderPath,
+		ClientID:         &clientID,
+		InProgress:       lo.ToPtr(true),
+	}))
+
+	assert.NoError(t, os.MkdirAll(filepath.Join(backupFolderFullPath, "Movies"), 0o755))
+	assert.NoError(t, createFileWithContent(backupFolderFullPath, "1.txt", "hello world"))
+	assert.NoError(t, createFileWithContent(backupFolderFullPath, "Movies/2.mp4", "hello world"))
+
+	hash, err := service.XXHash(filepath.Join(backupFolderFullPath, "1.txt"))
+	assert.NoError(t, err)
+
+	assert.NoError(t, service.SaveManifest(storage, backupFolderFullPath, &codegen.Manifest{
+		ClientFolderPath: &clientFolderPath,
+		Time:             lo.ToPtr(int64(1000)),
+		FileSizes: lo.ToPtr(map[string]int64{
+			`C:\Users\icewhale\Downloads\1.txt`:        11,
+			`C:\Users\icewhale\Downloads\Movies\2.mp4`: 11,
+			`C:\Users\icewhale\Downloads\3.txt`:        11,
+		}),
+		FileHashes: lo.ToPtr(map[string]string{
+			`C:\Users\icewhale\Downloads\1.txt`:        hash,
+			`C:\Users\icewhale\Downloads\Movies\2.mp4`: "not the same hash",
+			`C:\Users\icewhale\Downloads\3.txt`:        hash,
+		}),
+	}))
+
+	backupService := service.NewBackupService()
+
+	verification, err := backupService.Complete(clientID, clientFolderPath)
+	assert.NoError(t, err)
+	assert.False(t, *verification.Succeeded)
+	assert.Equal(t, 1, *verification.VerifiedCount)
+	assert.Equal(t, []string{`C:\Users\icewhale\Downloads\3.txt`}, *verification.MissingFiles)
+	assert.Equal(t, []string{`C:\Users\icewhale\Downloads\Movies\2.mp4`}, *verification.CorruptFiles)
+	assert.False(t, *verification.FolderBackup.InProgress)
+	assert.False(t, *verification.FolderBackup.LastBackupSucceeded)
+
+	// the client retries the missing and corrupt files
+	assert.NoError(t, createFileWithContent(backupFolderFullPath, "3.txt", "hello world"))
+	assert.NoError(t, createFileWithContent(backupFolderFullPath, "Movies/2.mp4", "hello earth"))
+
+	verification, err = backupService.Complete(clientID, clientFolderPath)
+	assert.NoError(t, err)
+	assert.False(t, *verification.Succeeded)
+	assert.Empty(t, *verification.MissingFiles)
+
+	assert.NoError(t, createFileWithContent(backupFolderFullPath, "Movies/2.mp4", "hello world"))
+
+	verification, err = backupService.Complete(clientID, clientFolderPath)
+	assert.NoError(t, err)
+	assert.False(t, *verification.Succeeded, "hash of 2.mp4 in the manifest is still different")
+
+	backup, err := service.LoadMetadata(storage, backupFolderFullPath)
+	assert.NoError(t, err)
+	assert.False(t, *backup.LastBackupSucceeded)
+}
+
+func TestRelativeClientFilePath(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	clientFolderPathNormalized := service.Normalize(`C:\Users\icewhale\Downloads`)
+
+	assert.Equal(t, "1.txt", service.RelativeClientFilePath(clientFolderPathNormalized, `C:\Users\icewhale\Downloads\1.txt`))
+	assert.Equal(t, "Movies/2.mp4", service.RelativeClientFilePath(clientFolderPathNormalized, `Movies\2.mp4`))
+	assert.Equal(t, "Movies/2.mp4", service.RelativeClientFilePath(clientFolderPathNormalized, `\Movies\2.mp4`))
+}
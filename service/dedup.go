@@ -0,0 +1,67 @@
+package service
+
+import (
+	"path/filepath"
+
+	"github.com/IceWhaleTech/CasaOS-Common/utils/logger"
+	"go.uber.org/zap"
+)
+
+// copyFromIndex looks the content of the file up in the index, and copies it on the server from any
+// folder backup having it, so the client doesn't need to upload it. It tells whether the file has been
+// copied. Failing to copy only means the file is uploaded as usual, so errors are only logged.
+func (b *BackupService) copyFromIndex(backupFolderFullPath, relativePath string, size int64, hash string) bool {
+	// empty files are not worth looking up
+	if b.index == nil || size == 0 {
+		return false
+	}
+
+	b.indexMutex.RLock()
+	sources, err := b.index.FilesByHash(hash)
+	b.indexMutex.RUnlock()
+
+	if err != nil {
+		logger.Error("failed to look up files by hash", zap.String("hash", hash), zap.Error(err))
+		return false
+	}
+
+	file := filepath.Join(backupFolderFullPath, relativePath)
+
+	for _, source := range sources {
+		sourceFile := filepath.Join(b.storage.Root(), filepath.FromSlash(source))
+		if sourceFile == file {
+			continue
+		}
+
+		// the index might be behind, e.g. if the source has changed over WebDAV since
+		if upToDate, err := isFileUpToDate(b.storage, sourceFile, size, hash); err != nil || !upToDate {
+			continue
+		}
+
+		if err := b.storage.MkdirAll(filepath.Dir(file), 0o755); err != nil {
+			logger.Error("failed to create folder", zap.String("path", filepath.Dir(file)), zap.Error(err))
+			return false
+		}
+
+		if err := b.storage.Copy(sourceFile, file); err != nil {
+			logger.Error("failed to copy file", zap.String("source", sourceFile), zap.String("file", file), zap.Error(err))
+			continue
+		}
+
+		// the source isn't locked, so it might have changed while being copied
+		if upToDate, err := isFileUpToDate(b.storage, file, size, hash); err != nil || !upToDate {
+			if err := b.storage.Remove(file); err != nil {
+				logger.Error("failed to remove file copied wrong", zap.String("file", file), zap.Error(err))
+			}
+			continue
+		}
+
+		logger.Info("file has been copied from the same content backed up before", zap.String("source", sourceFile), zap.String("file", file))
+
+		filesCopiedTotal.Inc()
+
+		return true
+	}
+
+	return false
+}
@@ -0,0 +1,88 @@
+package service_test
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/IceWhaleTech/IceWhale-Files-Backup/codegen"
+	"github.com/IceWhaleTech/IceWhale-Files-Backup/common"
+	"github.com/IceWhaleTech/IceWhale-Files-Backup/service"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/goleak"
+)
+
+func TestProceedWithCopyFromIndex(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	tmpDataRootDir, err := os.MkdirTemp("", "test")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tmpDataRootDir)
+
+	storage := service.NewLocalStorage(tmpDataRootDir)
+
+	index, err := service.OpenIndex(filepath.Join(tmpDataRootDir, common.IndexFileName))
+	assert.NoError(t, err)
+	defer index.Close()
+
+	backupService := service.NewBackupServiceWith(storage, service.SystemClock)
+	backupService.SetIndex(index)
+
+	content := "installer"
+	hash, err := service.XXHashReader(strings.NewReader(content))
+	assert.NoError(t, err)
+
+	request := func(clientID, clientFolderPath, clientFile string) codegen.FolderBackup {
+		return codegen.FolderBackup{
+			ClientID:               &clientID,
+			ClientFolderPath:       &clientFolderPath,
+			ClientFolderFileSizes:  &map[string]int64{clientFile: int64(len(content))},
+			ClientFolderFileHashes: &map[string]string{clientFile: hash},
+		}
+	}
+
+	// the first client uploads the file as usual
+	backup, err := backupService.Proceed(request("client1", "/home/icewhale/Downloads", "setup.bin"))
+	assert.NoError(t, err)
+	assert.Empty(t, *backup.SatisfiedFiles)
+
+	backupFolderFullPath := filepath.Join(tmpDataRootDir, *backup.BackupFolderPath)
+	assert.NoError(t, createFileWithContent(backupFolderFullPath, "setup.bin", content))
+
+	verification, err := backupService.Complete("client1", "/home/icewhale/Downloads")
+	assert.NoError(t, err)
+	assert.True(t, *verification.Succeeded)
+
+	// another client having the same content doesn't need to upload it
+	backup, err = backupService.Proceed(request("client2", `C:\Users\icewhale\Desktop`, `C:\Users\icewhale\Desktop\Tools\setup.bin`))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{`C:\Users\icewhale\Desktop\Tools\setup.bin`}, *backup.SatisfiedFiles)
+
+	backupFolderFullPath = filepath.Join(tmpDataRootDir, *backup.BackupFolderPath)
+
+	run, err := service.LoadRun(storage, backupFolderFullPath)
+	assert.NoError(t, err)
+	assert.Empty(t, run.PendingFiles)
+
+	buf, err := os.ReadFile(filepath.Join(backupFolderFullPath, "Tools", "setup.bin"))
+	assert.NoError(t, err)
+	assert.Equal(t, content, string(buf))
+
+	file, err := index.File(*backup.BackupFolderPath, "Tools/setup.bin")
+	assert.NoError(t, err)
+	assert.Equal(t, hash, file.Hash)
+
+	// nothing is copied from a source that has changed since it was indexed
+	assert.NoError(t, createFileWithContent(filepath.Join(tmpDataRootDir, common.BackupRootFolder, "client1", "home/icewhale/Downloads"), "setup.bin", "changed"))
+	assert.NoError(t, os.Remove(filepath.Join(backupFolderFullPath, "Tools", "setup.bin")))
+	assert.NoError(t, index.DeleteFile(*backup.BackupFolderPath, "Tools/setup.bin"))
+
+	backup, err = backupService.Proceed(request("client3", "/Users/icewhale/Desktop", "setup.bin"))
+	assert.NoError(t, err)
+	assert.Empty(t, *backup.SatisfiedFiles)
+
+	run, err = service.LoadRun(storage, filepath.Join(tmpDataRootDir, *backup.BackupFolderPath))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"setup.bin"}, run.PendingFiles)
+}
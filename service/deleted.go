@@ -0,0 +1,178 @@
+package service
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/IceWhaleTech/CasaOS-Common/utils/logger"
+	"github.com/IceWhaleTech/IceWhale-Files-Backup/codegen"
+	"github.com/IceWhaleTech/IceWhale-Files-Backup/common"
+	"github.com/samber/lo"
+	"go.uber.org/zap"
+)
+
+var ErrFolderBackupNotFound = errors.New("folder backup not found")
+
+// DeletedFiles are the files of a folder backup the client has deleted, by their paths relative to the
+// folder backup. Each is a tombstone pointing at the history copy of the last version of the file.
+type DeletedFiles map[string]codegen.DeletedFile
+
+// GetDeletedFiles returns the files deleted from the folder backup, newest first.
+func (b *BackupService) GetDeletedFiles(clientID, clientFolderPath string) ([]codegen.DeletedFile, error) {
+	backupFolderFullPath := b.clientPathsOf(clientID, clientFolderPath).backupFolderFullPath
+
+	if _, err := b.storage.Stat(backupFolderFullPath); err != nil {
+		if os.IsNotExist(err) {
+			return nil, ErrFolderBackupNotFound
+		}
+		return nil, err
+	}
+
+	deletedFiles, err := LoadDeletedFiles(b.storage, backupFolderFullPath)
+	if err != nil {
+		return nil, err
+	}
+
+	result := lo.Values(deletedFiles)
+	sort.Slice(result, func(i, j int) bool {
+		if *result[i].DeletedTime != *result[j].DeletedTime {
+			return *result[i].DeletedTime > *result[j].DeletedTime
+		}
+		return *result[i].Path < *result[j].Path
+	})
+
+	return result, nil
+}
+
+// SaveDeletedFiles stores the deleted files under the state folder of the folder backup.
+func SaveDeletedFiles(storage Storage, backupFolderFullPath string, deletedFiles DeletedFiles) error {
+	stateFolderPath := filepath.Join(backupFolderFullPath, common.StateFolderName)
+	if err := storage.MkdirAll(stateFolderPath, 0o755); err != nil {
+		return err
+	}
+
+	buf, err := json.Marshal(deletedFiles)
+	if err != nil {
+		return err
+	}
+
+	return storage.WriteFile(filepath.Join(stateFolderPath, common.DeletedFileName), buf, 0o600)
+}
+
+// LoadDeletedFiles returns the deleted files of the folder backup, which are none if nothing has been
+// recorded yet.
+func LoadDeletedFiles(storage Storage, backupFolderFullPath string) (DeletedFiles, error) {
+	buf, err := storage.ReadFile(filepath.Join(backupFolderFullPath, common.StateFolderName, common.DeletedFileName))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return DeletedFiles{}, nil
+		}
+		return nil, err
+	}
+
+	deletedFiles := DeletedFiles{}
+	if err := json.Unmarshal(buf, &deletedFiles); err != nil {
+		return nil, err
+	}
+
+	return deletedFiles, nil
+}
+
+// add records the file as deleted, with the history copy its last version has been moved to.
+func (d DeletedFiles) add(backupFolderFullPath, relativePath, backupFilePath string, size int64, now time.Time) error {
+	relativeBackupFilePath, err := filepath.Rel(backupFolderFullPath, backupFilePath)
+	if err != nil {
+		return err
+	}
+
+	d[filepath.ToSlash(relativePath)] = codegen.DeletedFile{
+		Path:           lo.ToPtr(filepath.ToSlash(relativePath)),
+		DeletedTime:    lo.ToPtr(now.UnixMilli()),
+		BackupFilePath: lo.ToPtr(filepath.ToSlash(relativeBackupFilePath)),
+		Size:           &size,
+	}
+
+	return nil
+}
+
+// forgetBackupFiles removes the records pointing at the given history copies, e.g. once they are pruned,
+// and tells whether any was removed.
+func (d DeletedFiles) forgetBackupFiles(backupFolderFullPath string, backupFilePaths []string) bool {
+	removed := false
+
+	for _, backupFilePath := range backupFilePaths {
+		relativeBackupFilePath, err := filepath.Rel(backupFolderFullPath, backupFilePath)
+		if err != nil {
+			continue
+		}
+
+		for relativePath, deletedFile := range d {
+			if lo.FromPtr(deletedFile.BackupFilePath) == filepath.ToSlash(relativeBackupFilePath) {
+				delete(d, relativePath)
+				removed = true
+			}
+		}
+	}
+
+	return removed
+}
+
+// moveBackupFile points the records at the history copy, relative to the folder backup, at where it has
+// been moved to, and tells whether any record has changed.
+func (d DeletedFiles) moveBackupFile(backupFilePath, newBackupFilePath string) bool {
+	moved := false
+
+	for relativePath, deletedFile := range d {
+		if lo.FromPtr(deletedFile.BackupFilePath) == backupFilePath {
+			deletedFile.BackupFilePath = &newBackupFilePath
+			d[relativePath] = deletedFile
+			moved = true
+		}
+	}
+
+	return moved
+}
+
+// pruneDeletedFiles removes the last versions of the files deleted longer than the retention, along with
+// their records, and returns the number of history copies removed.
+func (b *BackupService) pruneDeletedFiles(backupFolderPath, backupFolderFullPath string, deletedFiles DeletedFiles, retentionDays int, now time.Time) int {
+	if retentionDays <= 0 {
+		return 0
+	}
+
+	deadline := now.Add(-time.Duration(retentionDays) * 24 * time.Hour).UnixMilli()
+	count := 0
+
+	for relativePath, deletedFile := range deletedFiles {
+		if *deletedFile.DeletedTime > deadline {
+			continue
+		}
+
+		backupFilePath := filepath.Join(backupFolderFullPath, filepath.FromSlash(*deletedFile.BackupFilePath))
+		if err := b.storage.Remove(backupFilePath); err != nil && !os.IsNotExist(err) {
+			logger.Error("failed to prune the last version of deleted file", zap.String("file", backupFilePath), zap.Error(err))
+			continue
+		}
+
+		logger.Info("last version of deleted file has been pruned", zap.String("file", backupFilePath))
+
+		delete(deletedFiles, relativePath)
+		count++
+
+		b.updateIndex(func(index *Index) error {
+			return index.DeleteVersion(backupFolderPath, relativePath, *deletedFile.BackupFilePath)
+		})
+	}
+
+	if count > 0 {
+		b.publish(codegen.Pruned, backupFolderPath, codegen.BackupEvent{
+			FileCount: &count,
+		})
+	}
+
+	return count
+}
@@ -0,0 +1,117 @@
+package service_test
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/IceWhaleTech/IceWhale-Files-Backup/codegen"
+	"github.com/IceWhaleTech/IceWhale-Files-Backup/common"
+	"github.com/IceWhaleTech/IceWhale-Files-Backup/service"
+	"github.com/samber/lo"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/goleak"
+)
+
+func TestProceedWithDeletedFiles(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	clock := &fixedClock{now: time.Date(2023, 4, 10, 12, 0, 0, 0, time.UTC)}
+	storage := service.NewMemoryStorage("/DATA", clock)
+
+	clientID := "client1"
+	clientFolderPath := "/home/icewhale/Documents"
+	backupFolderFullPath := filepath.Join(storage.Root(), common.BackupRootFolder, clientID, service.Normalize(clientFolderPath))
+
+	assert.NoError(t, storage.MkdirAll(backupFolderFullPath, 0o755))
+	assert.NoError(t, storage.WriteFile(filepath.Join(backupFolderFullPath, "a.txt"), []byte("a"), 0o644))
+	assert.NoError(t, storage.WriteFile(filepath.Join(backupFolderFullPath, "b.txt"), []byte("b"), 0o644))
+
+	backupService := service.NewBackupServiceWith(storage, clock)
+
+	request := func(retentionDays *int, clientFiles ...string) codegen.FolderBackup {
+		sizes := map[string]int64{}
+		hashes := map[string]string{}
+		for _, name := range clientFiles {
+			hash, err := service.XXHashReader(strings.NewReader(strings.TrimSuffix(name, ".txt")))
+			assert.NoError(t, err)
+
+			sizes[name] = 1
+			hashes[name] = hash
+		}
+
+		return codegen.FolderBackup{
+			ClientID:                 &clientID,
+			ClientFolderPath:         &clientFolderPath,
+			ClientFolderFileSizes:    &sizes,
+			ClientFolderFileHashes:   &hashes,
+			DeletedFileRetentionDays: retentionDays,
+		}
+	}
+
+	_, err := backupService.GetDeletedFiles(clientID, "/home/icewhale/Music")
+	assert.ErrorIs(t, err, service.ErrFolderBackupNotFound)
+
+	// the deleted file is recorded along with its last version
+	_, err = backupService.Proceed(request(lo.ToPtr(30), "a.txt"))
+	assert.NoError(t, err)
+
+	deletedFiles, err := backupService.GetDeletedFiles(clientID, clientFolderPath)
+	assert.NoError(t, err)
+	assert.Equal(t, []codegen.DeletedFile{{
+		Path:           lo.ToPtr("b.txt"),
+		DeletedTime:    lo.ToPtr(clock.now.UnixMilli()),
+		BackupFilePath: lo.ToPtr("b-backup-2023-04-10-12-00-00-000Z.txt"),
+		Size:           lo.ToPtr(int64(1)),
+	}}, deletedFiles)
+
+	// and forgotten once the client has the file again
+	clock.now = clock.now.Add(time.Hour)
+
+	_, err = backupService.Proceed(request(nil, "a.txt", "b.txt"))
+	assert.NoError(t, err)
+
+	deletedFiles, err = backupService.GetDeletedFiles(clientID, clientFolderPath)
+	assert.NoError(t, err)
+	assert.Empty(t, deletedFiles)
+
+	assert.NoError(t, storage.WriteFile(filepath.Join(backupFolderFullPath, "b.txt"), []byte("b"), 0o644))
+
+	verification, err := backupService.Complete(clientID, clientFolderPath)
+	assert.NoError(t, err)
+	assert.True(t, *verification.Succeeded)
+
+	// the last version is pruned after the retention, which is kept from the first run
+	clock.now = clock.now.Add(time.Hour)
+
+	_, err = backupService.Proceed(request(nil, "a.txt"))
+	assert.NoError(t, err)
+
+	deletedFiles, err = backupService.GetDeletedFiles(clientID, clientFolderPath)
+	assert.NoError(t, err)
+	assert.Len(t, deletedFiles, 1)
+
+	clock.now = clock.now.Add(29 * 24 * time.Hour)
+
+	_, err = backupService.Proceed(request(nil, "a.txt"))
+	assert.NoError(t, err)
+
+	deletedFiles, err = backupService.GetDeletedFiles(clientID, clientFolderPath)
+	assert.NoError(t, err)
+	assert.Len(t, deletedFiles, 1)
+
+	clock.now = clock.now.Add(24 * time.Hour)
+
+	_, err = backupService.Proceed(request(nil, "a.txt"))
+	assert.NoError(t, err)
+
+	deletedFiles, err = backupService.GetDeletedFiles(clientID, clientFolderPath)
+	assert.NoError(t, err)
+	assert.Empty(t, deletedFiles)
+
+	// versions other than the last one of a deleted file are kept
+	entries, err := storage.ReadDir(backupFolderFullPath)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{common.MetadataFileName, common.StateFolderName, "a.txt", "b-backup-2023-04-10-12-00-00-000Z.txt"}, entryNames(entries))
+}
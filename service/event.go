@@ -0,0 +1,152 @@
+package service
+
+import (
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/IceWhaleTech/CasaOS-Common/utils/logger"
+	"github.com/IceWhaleTech/IceWhale-Files-Backup/codegen"
+	"github.com/samber/lo"
+	"go.uber.org/zap"
+)
+
+// eventBufferSize is how many progress events, e.g. of a single file, wait for a slow subscriber before
+// further ones are dropped. Events of runs are never dropped.
+const eventBufferSize = 64
+
+// EventBus fans out events of folder backups to all subscribers, e.g. the event stream of the API.
+type EventBus struct {
+	mutex       *sync.Mutex
+	subscribers map[*subscriber]struct{}
+}
+
+// subscriber queues the events for one subscriber, so publishing never waits for it.
+type subscriber struct {
+	events  chan codegen.BackupEvent
+	notify  chan struct{}
+	done    chan struct{}
+	stopped chan struct{}
+
+	mutex   *sync.Mutex
+	pending []codegen.BackupEvent
+}
+
+func NewEventBus() *EventBus {
+	return &EventBus{
+		mutex:       &sync.Mutex{},
+		subscribers: map[*subscriber]struct{}{},
+	}
+}
+
+// Subscribe returns the channel receiving events from now on, and the function to stop receiving them.
+func (e *EventBus) Subscribe() (<-chan codegen.BackupEvent, func()) {
+	s := &subscriber{
+		events:  make(chan codegen.BackupEvent),
+		notify:  make(chan struct{}, 1),
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+		mutex:   &sync.Mutex{},
+	}
+
+	e.mutex.Lock()
+	e.subscribers[s] = struct{}{}
+	e.mutex.Unlock()
+
+	go s.forward()
+
+	var once sync.Once
+
+	return s.events, func() {
+		once.Do(func() {
+			e.mutex.Lock()
+			delete(e.subscribers, s)
+			e.mutex.Unlock()
+
+			close(s.done)
+			<-s.stopped
+		})
+	}
+}
+
+// Publish queues the event for all subscribers without waiting, so a slow subscriber does not hold up
+// the backup. Progress events are dropped for a subscriber that is too far behind.
+func (e *EventBus) Publish(event codegen.BackupEvent) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	for s := range e.subscribers {
+		s.push(event)
+	}
+}
+
+func (s *subscriber) push(event codegen.BackupEvent) {
+	s.mutex.Lock()
+
+	if isProgressEvent(event) && len(s.pending) >= eventBufferSize {
+		s.mutex.Unlock()
+		logger.Info("subscriber is too slow, dropping event", zap.String("type", string(*event.Type)))
+		return
+	}
+
+	s.pending = append(s.pending, event)
+	s.mutex.Unlock()
+
+	select {
+	case s.notify <- struct{}{}:
+	default:
+	}
+}
+
+// forward sends the queued events to the subscriber in order until it unsubscribes.
+func (s *subscriber) forward() {
+	defer close(s.stopped)
+	defer close(s.events)
+
+	for {
+		s.mutex.Lock()
+		if len(s.pending) == 0 {
+			s.mutex.Unlock()
+
+			select {
+			case <-s.notify:
+				continue
+			case <-s.done:
+				return
+			}
+		}
+
+		event := s.pending[0]
+		s.pending = s.pending[1:]
+		s.mutex.Unlock()
+
+		select {
+		case s.events <- event:
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// isProgressEvent tells whether the event is about a single file of a run, which a subscriber can miss
+// without missing how the run went.
+func isProgressEvent(event codegen.BackupEvent) bool {
+	return *event.Type == codegen.FileUploaded || *event.Type == codegen.FileVersioned
+}
+
+// publish sends an event of the folder backup, filling in the time and the client ID.
+func (b *BackupService) publish(eventType codegen.BackupEventType, backupFolderPath string, event codegen.BackupEvent) {
+	event.Type = &eventType
+	event.Time = lo.ToPtr(b.clock.Now().UnixMilli())
+
+	if backupFolderPath != "" {
+		event.BackupFolderPath = lo.ToPtr(filepath.ToSlash(backupFolderPath))
+
+		// the backup folder path is the backup root, the client ID, then the normalized client folder path
+		if parts := strings.SplitN(filepath.ToSlash(backupFolderPath), "/", 3); len(parts) == 3 {
+			event.ClientID = &parts[1]
+		}
+	}
+
+	b.events.Publish(event)
+}
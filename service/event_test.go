@@ -0,0 +1,107 @@
+package service_test
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/IceWhaleTech/IceWhale-Files-Backup/codegen"
+	"github.com/IceWhaleTech/IceWhale-Files-Backup/common"
+	"github.com/IceWhaleTech/IceWhale-Files-Backup/pkg/config"
+	"github.com/IceWhaleTech/IceWhale-Files-Backup/service"
+	"github.com/samber/lo"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/goleak"
+)
+
+func TestEvents(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	tmpDataRootDir, err := os.MkdirTemp("", "test")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tmpDataRootDir)
+
+	config.AppInfo.DataRootPath = tmpDataRootDir
+
+	clientID := "client1"
+	clientFolderPath := `C:\Users\icewhale\Downloads`
+	backupFolderFullPath := filepath.Join(tmpDataRootDir, common.BackupRootFolder, clientID, service.Normalize(clientFolderPath))
+
+	assert.NoError(t, os.MkdirAll(backupFolderFullPath, 0o755))
+	assert.NoError(t, createFileWithContent(backupFolderFullPath, "a.txt", "old a"))
+
+	content := "new a"
+	hash, err := service.XXHashReader(strings.NewReader(content))
+	assert.NoError(t, err)
+
+	backupService := service.NewBackupService()
+
+	events, unsubscribe := backupService.Events().Subscribe()
+	defer unsubscribe()
+
+	_, err = backupService.Proceed(codegen.FolderBackup{
+		ClientID:               &clientID,
+		ClientFolderPath:       &clientFolderPath,
+		ClientFolderFileSizes:  &map[string]int64{"a.txt": int64(len(content))},
+		ClientFolderFileHashes: &map[string]string{"a.txt": hash},
+	})
+	assert.NoError(t, err)
+
+	assert.NoError(t, os.WriteFile(filepath.Join(backupFolderFullPath, "a.txt"), []byte(content), 0o644))
+
+	_, err = backupService.Complete(clientID, clientFolderPath)
+	assert.NoError(t, err)
+
+	event := <-events
+	assert.Equal(t, codegen.FileVersioned, *event.Type)
+	assert.Equal(t, clientID, *event.ClientID)
+	assert.Equal(t, "a.txt", *event.Path)
+
+	event = <-events
+	assert.Equal(t, codegen.RunStarted, *event.Type)
+	assert.Equal(t, 1, *event.FileCount)
+
+	event = <-events
+	assert.Equal(t, codegen.RunCompleted, *event.Type)
+	assert.Equal(t, 1, *event.FileCount)
+
+	// no events after unsubscribing
+	unsubscribe()
+
+	_, err = backupService.Complete(clientID, clientFolderPath)
+	assert.NoError(t, err)
+
+	_, ok := <-events
+	assert.False(t, ok)
+}
+
+func TestEventsOfRunsNotDropped(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	bus := service.NewEventBus()
+
+	events, unsubscribe := bus.Subscribe()
+	defer unsubscribe()
+
+	// nobody reads while the events are published
+	for i := 0; i < 1000; i++ {
+		bus.Publish(codegen.BackupEvent{Type: lo.ToPtr(codegen.FileVersioned)})
+		bus.Publish(codegen.BackupEvent{Type: lo.ToPtr(codegen.RunCompleted), FileCount: lo.ToPtr(i)})
+	}
+
+	fileEventCount, runEventCount := 0, 0
+	for runEventCount < 1000 {
+		event := <-events
+		switch *event.Type {
+		case codegen.FileVersioned:
+			fileEventCount++
+		case codegen.RunCompleted:
+			assert.Equal(t, runEventCount, *event.FileCount)
+			runEventCount++
+		}
+	}
+
+	// progress events are dropped rather than queued without limit
+	assert.Less(t, fileEventCount, 1000)
+}
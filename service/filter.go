@@ -0,0 +1,198 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/IceWhaleTech/IceWhale-Files-Backup/codegen"
+	"github.com/samber/lo"
+)
+
+var ErrInvalidFilterPattern = errors.New("invalid filter pattern")
+
+// Filter tells which files of a folder backup are ignored, by the exclude and include patterns of the
+// folder backup in the syntax of .gitignore. Paths are relative to the folder backup, separated by /.
+type Filter struct {
+	excludes filterPatterns
+	includes filterPatterns
+}
+
+// filterPatterns are matched in order, so the last pattern matching a path decides.
+type filterPatterns []filterPattern
+
+type filterPattern struct {
+	regexp *regexp.Regexp
+
+	// negated patterns, starting with !, undo the match of earlier patterns
+	negated bool
+
+	// patterns ending with / only match folders
+	dirOnly bool
+}
+
+// NewFilter returns the filter of the folder backup, ignoring nothing if it has no patterns.
+func NewFilter(backup *codegen.FolderBackup) (*Filter, error) {
+	excludes, err := compileFilterPatterns(lo.FromPtr(backup.ExcludePatterns))
+	if err != nil {
+		return nil, err
+	}
+
+	includes, err := compileFilterPatterns(lo.FromPtr(backup.IncludePatterns))
+	if err != nil {
+		return nil, err
+	}
+
+	return &Filter{excludes: excludes, includes: includes}, nil
+}
+
+// IsIgnored returns whether the file is excluded, or not included while there are include patterns.
+func (f *Filter) IsIgnored(relativePath string) bool {
+	if len(f.includes) > 0 && !f.includes.matchTree(relativePath) {
+		return true
+	}
+
+	return f.excludes.matchTree(relativePath)
+}
+
+// matchTree returns whether the file, or any folder it is under, is matched. As with .gitignore, a file
+// under a matched folder can't be unmatched by a negated pattern.
+func (p filterPatterns) matchTree(relativePath string) bool {
+	parts := strings.Split(strings.Trim(relativePath, "/"), "/")
+
+	for i := 1; i < len(parts); i++ {
+		if p.match(strings.Join(parts[:i], "/"), true) {
+			return true
+		}
+	}
+
+	return p.match(strings.Join(parts, "/"), false)
+}
+
+func (p filterPatterns) match(relativePath string, isDir bool) bool {
+	matched := false
+
+	for _, pattern := range p {
+		if pattern.dirOnly && !isDir {
+			continue
+		}
+
+		if pattern.regexp.MatchString(relativePath) {
+			matched = !pattern.negated
+		}
+	}
+
+	return matched
+}
+
+func compileFilterPatterns(patterns []string) (filterPatterns, error) {
+	compiled := filterPatterns{}
+
+	for _, pattern := range patterns {
+		// blank lines and comments are skipped, as in .gitignore
+		if strings.TrimSpace(pattern) == "" || strings.HasPrefix(pattern, "#") {
+			continue
+		}
+
+		filterPattern, err := compileFilterPattern(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("%w %q: %s", ErrInvalidFilterPattern, pattern, err.Error())
+		}
+
+		compiled = append(compiled, *filterPattern)
+	}
+
+	return compiled, nil
+}
+
+func compileFilterPattern(pattern string) (*filterPattern, error) {
+	result := &filterPattern{}
+
+	pattern = strings.TrimRight(pattern, " ")
+
+	if strings.HasPrefix(pattern, "!") {
+		result.negated = true
+		pattern = pattern[1:]
+	} else if strings.HasPrefix(pattern, `\!`) || strings.HasPrefix(pattern, `\#`) {
+		pattern = pattern[1:]
+	}
+
+	if strings.HasSuffix(pattern, "/") {
+		result.dirOnly = true
+		pattern = strings.TrimRight(pattern, "/")
+	}
+
+	if pattern == "" {
+		return nil, errors.New("pattern is empty")
+	}
+
+	// a pattern with a / other than at the end is relative to the folder, otherwise it matches at any level
+	anchored := strings.Contains(pattern, "/")
+	pattern = strings.TrimPrefix(pattern, "/")
+
+	expr := &strings.Builder{}
+	expr.WriteString("^")
+
+	if !anchored && !strings.HasPrefix(pattern, "**") {
+		expr.WriteString("(?:.*/)?")
+	}
+
+	for i := 0; i < len(pattern); i++ {
+		c := pattern[i]
+
+		switch {
+		case strings.HasPrefix(pattern[i:], "**/"):
+			// any number of folders, including none
+			expr.WriteString("(?:.*/)?")
+			i += 2
+
+		case strings.HasPrefix(pattern[i:], "/**") && i+3 == len(pattern):
+			// everything under the folder
+			expr.WriteString("/.*")
+			i += 2
+
+		case strings.HasPrefix(pattern[i:], "**"):
+			expr.WriteString(".*")
+			i++
+
+		case c == '*':
+			expr.WriteString("[^/]*")
+
+		case c == '?':
+			expr.WriteString("[^/]")
+
+		case c == '[':
+			end := strings.IndexByte(pattern[i+1:], ']')
+			if end < 0 {
+				return nil, errors.New("unterminated character class")
+			}
+
+			class := pattern[i+1 : i+1+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+
+			expr.WriteString("[" + class + "]")
+			i += end + 1
+
+		case c == '\\' && i+1 < len(pattern):
+			i++
+			expr.WriteString(regexp.QuoteMeta(string(pattern[i])))
+
+		default:
+			expr.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+
+	expr.WriteString("$")
+
+	compiled, err := regexp.Compile(expr.String())
+	if err != nil {
+		return nil, err
+	}
+
+	result.regexp = compiled
+
+	return result, nil
+}
@@ -0,0 +1,186 @@
+package service_test
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/IceWhaleTech/IceWhale-Files-Backup/codegen"
+	"github.com/IceWhaleTech/IceWhale-Files-Backup/common"
+	"github.com/IceWhaleTech/IceWhale-Files-Backup/service"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/goleak"
+)
+
+func TestFilter(t *testing.T) {
+	testCases := []struct {
+		name     string
+		excludes []string
+		includes []string
+		ignored  []string
+		kept     []string
+	}{
+		{
+			name:     "no patterns",
+			excludes: nil,
+			kept:     []string{"a.txt", "node_modules/a/index.js"},
+		},
+		{
+			name:     "folders and names at any level",
+			excludes: []string{"# dependencies", "", "node_modules/", ".git", "Thumbs.db"},
+			ignored:  []string{"node_modules/a/index.js", "src/node_modules/a.js", ".git/HEAD", "Photos/Thumbs.db"},
+			kept:     []string{"node_modules", "src/a.js", "Photos/a.jpg"},
+		},
+		{
+			name:     "wildcards",
+			excludes: []string{"*.tmp", "~$*", "cache?/"},
+			ignored:  []string{"a.tmp", "docs/b.tmp", "~$report.docx", "cache1/a.txt"},
+			kept:     []string{"a.tmp.txt", "report.docx", "cache12/a.txt"},
+		},
+		{
+			name:     "anchored to the folder",
+			excludes: []string{"/build", "docs/*.pdf"},
+			ignored:  []string{"build/a.o", "docs/a.pdf"},
+			kept:     []string{"src/build/a.o", "docs/sub/a.pdf", "other/docs/a.pdf"},
+		},
+		{
+			name:     "double asterisks",
+			excludes: []string{"**/logs/*.log", "tmp/**", "a/**/z"},
+			ignored:  []string{"logs/a.log", "x/y/logs/b.log", "tmp/x/y", "a/z", "a/b/c/z"},
+			kept:     []string{"logs/sub/a.log", "tmp", "b/z"},
+		},
+		{
+			name:     "negation",
+			excludes: []string{"*.log", "!important.log", "secret/", "!secret/keep.txt"},
+			ignored:  []string{"a.log", "secret/keep.txt"},
+			kept:     []string{"important.log", "logs/important.log"},
+		},
+		{
+			name:     "character classes",
+			excludes: []string{"*.[oa]", "[!a]*.bak"},
+			ignored:  []string{"main.o", "lib.a", "b.bak"},
+			kept:     []string{"main.c", "a.bak"},
+		},
+		{
+			name:     "include patterns",
+			includes: []string{"Documents/", "*.docx"},
+			excludes: []string{"Documents/drafts/"},
+			ignored:  []string{"Music/a.mp3", "Documents/drafts/a.txt"},
+			kept:     []string{"Documents/a.txt", "Desktop/report.docx"},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			filter, err := service.NewFilter(&codegen.FolderBackup{ExcludePatterns: &tc.excludes, IncludePatterns: &tc.includes})
+			assert.NoError(t, err)
+
+			for _, path := range tc.ignored {
+				assert.True(t, filter.IsIgnored(path), path)
+			}
+
+			for _, path := range tc.kept {
+				assert.False(t, filter.IsIgnored(path), path)
+			}
+		})
+	}
+
+	_, err := service.NewFilter(&codegen.FolderBackup{ExcludePatterns: &[]string{"[abc"}})
+	assert.ErrorIs(t, err, service.ErrInvalidFilterPattern)
+
+	_, err = service.NewFilter(&codegen.FolderBackup{IncludePatterns: &[]string{"!"}})
+	assert.ErrorIs(t, err, service.ErrInvalidFilterPattern)
+}
+
+func TestProceedWithFilter(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	tmpDataRootDir, err := os.MkdirTemp("", "test")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tmpDataRootDir)
+
+	storage := service.NewLocalStorage(tmpDataRootDir)
+
+	clientID := "client1"
+	clientFolderPath := `C:\Users\icewhale\Projects`
+
+	backupFolderFullPath := filepath.Join(tmpDataRootDir, common.BackupRootFolder, clientID, service.Normalize(clientFolderPath))
+	assert.NoError(t, os.MkdirAll(filepath.Join(backupFolderFullPath, "node_modules"), 0o755))
+
+	// files from the last backup, before the patterns were set
+	assert.NoError(t, createFileWithContent(backupFolderFullPath, "main.go", "old main"))
+	assert.NoError(t, createFileWithContent(filepath.Join(backupFolderFullPath, "node_modules"), "index.js", "old index"))
+
+	clientFiles := map[string]string{
+		`C:\Users\icewhale\Projects\main.go`:               "new main",
+		`C:\Users\icewhale\Projects\a.tmp`:                 "temp",
+		`C:\Users\icewhale\Projects\node_modules\index.js`: "new index",
+	}
+
+	request := func(excludePatterns *[]string) codegen.FolderBackup {
+		sizes := map[string]int64{}
+		hashes := map[string]string{}
+		for name, content := range clientFiles {
+			hash, err := service.XXHashReader(strings.NewReader(content))
+			assert.NoError(t, err)
+
+			sizes[name] = int64(len(content))
+			hashes[name] = hash
+		}
+
+		return codegen.FolderBackup{
+			ClientID:               &clientID,
+			ClientFolderPath:       &clientFolderPath,
+			ClientFolderFileSizes:  &sizes,
+			ClientFolderFileHashes: &hashes,
+			ExcludePatterns:        excludePatterns,
+		}
+	}
+
+	backupService := service.NewBackupServiceWith(storage, service.SystemClock)
+
+	_, err = backupService.Proceed(request(&[]string{"[invalid"}))
+	assert.ErrorIs(t, err, service.ErrInvalidFilterPattern)
+
+	backup, err := backupService.Proceed(request(&[]string{"node_modules/", "*.tmp"}))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"node_modules/", "*.tmp"}, *backup.ExcludePatterns)
+
+	// ignored files are neither versioned nor expected
+	run, err := service.LoadRun(storage, backupFolderFullPath)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"main.go"}, run.PendingFiles)
+
+	entries, err := os.ReadDir(filepath.Join(backupFolderFullPath, "node_modules"))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"index.js"}, entryNames(entries))
+
+	manifest, err := service.LoadManifest(storage, backupFolderFullPath, 0)
+	assert.NoError(t, err)
+	assert.Len(t, *manifest.FileSizes, 1)
+
+	// the patterns are kept for later runs
+	assert.NoError(t, createFileWithContent(backupFolderFullPath, "main.go", "new main"))
+
+	backup, err = backupService.Proceed(request(nil))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"node_modules/", "*.tmp"}, *backup.ExcludePatterns)
+
+	metadata, err := service.LoadMetadata(storage, backupFolderFullPath)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"node_modules/", "*.tmp"}, *metadata.ExcludePatterns)
+
+	run, err = service.LoadRun(storage, backupFolderFullPath)
+	assert.NoError(t, err)
+	assert.Empty(t, run.PendingFiles)
+
+	// and cleared with an empty list
+	backup, err = backupService.Proceed(request(&[]string{}))
+	assert.NoError(t, err)
+	assert.Empty(t, *backup.ExcludePatterns)
+
+	run, err = service.LoadRun(storage, backupFolderFullPath)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a.tmp", "node_modules/index.js"}, run.PendingFiles)
+}
@@ -0,0 +1,71 @@
+package service
+
+import (
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	hashCacheSize = 100000
+
+	// hashCacheMinAge is how long a file must have been left unmodified before its hash is cached.
+	// A file modified again within the granularity of modification times would otherwise keep its
+	// modification time, and the stale hash would be returned.
+	hashCacheMinAge = 2 * time.Second
+)
+
+type hashCacheEntry struct {
+	size    int64
+	modTime time.Time
+	hash    string
+}
+
+// hashCache keeps the hashes of files by path, valid as long as their sizes and modification times match.
+type hashCache struct {
+	mutex   *sync.Mutex
+	entries map[string]hashCacheEntry
+}
+
+var fileHashCache = &hashCache{
+	mutex:   &sync.Mutex{},
+	entries: map[string]hashCacheEntry{},
+}
+
+func (c *hashCache) get(path string, info os.FileInfo) (string, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	entry, ok := c.entries[path]
+	if !ok || entry.size != info.Size() || !entry.modTime.Equal(info.ModTime()) {
+		hashCacheLookupsTotal.WithLabelValues("miss").Inc()
+		return "", false
+	}
+
+	hashCacheLookupsTotal.WithLabelValues("hit").Inc()
+	return entry.hash, true
+}
+
+func (c *hashCache) put(path string, info os.FileInfo, hash string) {
+	if time.Since(info.ModTime()) < hashCacheMinAge {
+		return
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if _, ok := c.entries[path]; !ok && len(c.entries) >= hashCacheSize {
+		// evict an arbitrary entry, which is good enough as the cache is only to save rehashing
+		// files that haven't changed between runs
+		for evicted := range c.entries {
+			delete(c.entries, evicted)
+			break
+		}
+	}
+
+	c.entries[path] = hashCacheEntry{
+		size:    info.Size(),
+		modTime: info.ModTime(),
+		hash:    hash,
+	}
+}
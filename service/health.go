@@ -0,0 +1,235 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/IceWhaleTech/CasaOS-Common/utils/logger"
+	"github.com/IceWhaleTech/IceWhale-Files-Backup/common"
+	"github.com/IceWhaleTech/IceWhale-Files-Backup/internal/utils"
+	"github.com/IceWhaleTech/IceWhale-Files-Backup/pkg/config"
+	"github.com/coreos/go-systemd/daemon"
+	"github.com/samber/lo"
+	"go.uber.org/zap"
+)
+
+const healthCheckTimeout = 5 * time.Second
+
+// Health checks whether the service is alive and ready to take backups.
+type Health struct {
+	mutex             *sync.Mutex
+	gatewayRegistered bool
+	webDAVAddress     string
+}
+
+// HealthReport is the result of all health checks. The service is healthy if all critical checks pass,
+// and ready if all checks pass.
+type HealthReport struct {
+	Healthy bool          `json:"healthy"`
+	Ready   bool          `json:"ready"`
+	Checks  []HealthCheck `json:"checks"`
+}
+
+type HealthCheck struct {
+	Name string `json:"name"`
+	OK   bool   `json:"ok"`
+
+	// Critical tells if the service can't recover from a failure of the check without being restarted.
+	Critical bool   `json:"critical"`
+	Message  string `json:"message,omitempty"`
+}
+
+func NewHealth() *Health {
+	return &Health{
+		mutex: &sync.Mutex{},
+	}
+}
+
+// SetGatewayRegistered records whether the routes of the API have been registered at the gateway.
+func (h *Health) SetGatewayRegistered(registered bool) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	h.gatewayRegistered = registered
+}
+
+// SetWebDAVAddress records the address the WebDAV service listens at, to be checked for connections.
+func (h *Health) SetWebDAVAddress(address string) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	h.webDAVAddress = address
+}
+
+func (h *Health) Check(ctx context.Context) HealthReport {
+	h.mutex.Lock()
+	gatewayRegistered := h.gatewayRegistered
+	webDAVAddress := h.webDAVAddress
+	h.mutex.Unlock()
+
+	checks := []HealthCheck{
+		checkDataRootWritable(ctx),
+		checkFreeSpace(),
+		{
+			Name:    "gateway",
+			OK:      gatewayRegistered,
+			Message: lo.Ternary(gatewayRegistered, "", "routes are not registered at the gateway"),
+		},
+		checkWebDAV(ctx, webDAVAddress),
+	}
+
+	report := HealthReport{
+		Healthy: true,
+		Ready:   true,
+		Checks:  checks,
+	}
+
+	for _, check := range checks {
+		if !check.OK {
+			report.Ready = false
+
+			if check.Critical {
+				report.Healthy = false
+			}
+		}
+	}
+
+	return report
+}
+
+// Watchdog notifies systemd at half of the watchdog interval as long as the service is healthy, so
+// systemd restarts the service once it is not, or is too wedged to tell. It returns right away if
+// the watchdog is not enabled.
+func (h *Health) Watchdog(ctx context.Context) {
+	interval, err := daemon.SdWatchdogEnabled(false)
+	if err != nil {
+		logger.Error("failed to check if systemd watchdog is enabled", zap.Error(err))
+		return
+	}
+
+	if interval <= 0 {
+		logger.Info("systemd watchdog is not enabled")
+		return
+	}
+
+	ticker := time.NewTicker(interval / 2)
+	defer ticker.Stop()
+
+	for {
+		checkCtx, cancel := context.WithTimeout(ctx, interval/2)
+		report := h.Check(checkCtx)
+		cancel()
+
+		if report.Healthy {
+			if _, err := daemon.SdNotify(false, daemon.SdNotifyWatchdog); err != nil {
+				logger.Error("failed to notify systemd watchdog", zap.Error(err))
+			}
+		} else {
+			logger.Error("service is unhealthy, not notifying systemd watchdog", zap.Any("checks", report.Checks))
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// checkDataRootWritable writes, syncs and removes a file under the backup root. A hung file system is
+// reported as a critical failure once the context or the check times out. A write that fails, e.g. on
+// a full or read-only disk, only makes the service not ready, since a restart would not fix it.
+func checkDataRootWritable(ctx context.Context) HealthCheck {
+	check := HealthCheck{Name: "data_root_writable"}
+
+	ctx, cancel := context.WithTimeout(ctx, healthCheckTimeout)
+	defer cancel()
+
+	result := make(chan error, 1)
+
+	go func() {
+		result <- writeHealthFile(filepath.Join(config.AppInfo.DataRootPath, common.BackupRootFolder, common.StateFolderName))
+	}()
+
+	select {
+	case err := <-result:
+		check.OK = err == nil
+		if err != nil {
+			check.Message = err.Error()
+		}
+	case <-ctx.Done():
+		check.Critical = true
+		check.Message = "data root did not respond in time"
+	}
+
+	return check
+}
+
+func writeHealthFile(dir string) error {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+
+	file, err := os.CreateTemp(dir, ".health-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	if _, err := file.Write([]byte(time.Now().Format(time.RFC3339))); err != nil {
+		return err
+	}
+
+	return file.Sync()
+}
+
+func checkFreeSpace() HealthCheck {
+	check := HealthCheck{Name: "free_space"}
+
+	freeSpace, err := utils.FreeSpace(config.AppInfo.DataRootPath)
+	if err != nil {
+		check.Message = err.Error()
+		return check
+	}
+
+	check.OK = int64(freeSpace) >= config.AppInfo.FreeSpaceReserve
+	check.Message = fmt.Sprintf("%d bytes free, %d bytes reserved", freeSpace, config.AppInfo.FreeSpaceReserve)
+
+	return check
+}
+
+func checkWebDAV(ctx context.Context, address string) HealthCheck {
+	check := HealthCheck{Name: "webdav", Critical: true}
+
+	if address == "" {
+		check.Message = "WebDAV service is not started"
+		return check
+	}
+
+	// a service listening at all addresses is reached through the loopback
+	if host, port, err := net.SplitHostPort(address); err == nil {
+		if ip := net.ParseIP(host); host == "" || (ip != nil && ip.IsUnspecified()) {
+			address = net.JoinHostPort("localhost", port)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, healthCheckTimeout)
+	defer cancel()
+
+	conn, err := (&net.Dialer{}).DialContext(ctx, "tcp", address)
+	if err != nil {
+		check.Message = err.Error()
+		return check
+	}
+	conn.Close()
+
+	check.OK = true
+
+	return check
+}
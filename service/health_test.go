@@ -0,0 +1,85 @@
+package service_test
+
+import (
+	"context"
+	"math"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/IceWhaleTech/IceWhale-Files-Backup/pkg/config"
+	"github.com/IceWhaleTech/IceWhale-Files-Backup/service"
+	"github.com/samber/lo"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/goleak"
+)
+
+func TestHealth(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	tmpDataRootDir, err := os.MkdirTemp("", "test")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tmpDataRootDir)
+
+	config.AppInfo.DataRootPath = tmpDataRootDir
+	config.AppInfo.FreeSpaceReserve = 0
+
+	failedChecks := func(report service.HealthReport) []string {
+		return lo.FilterMap(report.Checks, func(check service.HealthCheck, _ int) (string, bool) {
+			return check.Name, !check.OK
+		})
+	}
+
+	health := service.NewHealth()
+
+	// nothing has been started yet
+	report := health.Check(context.Background())
+	assert.False(t, report.Healthy)
+	assert.False(t, report.Ready)
+	assert.ElementsMatch(t, []string{"gateway", "webdav"}, failedChecks(report))
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+
+	health.SetGatewayRegistered(true)
+	health.SetWebDAVAddress(listener.Addr().String())
+
+	report = health.Check(context.Background())
+	assert.True(t, report.Healthy)
+	assert.True(t, report.Ready)
+
+	// running low on space is not something a restart would fix
+	config.AppInfo.FreeSpaceReserve = math.MaxInt64
+
+	report = health.Check(context.Background())
+	assert.True(t, report.Healthy)
+	assert.False(t, report.Ready)
+	assert.Equal(t, []string{"free_space"}, failedChecks(report))
+
+	config.AppInfo.FreeSpaceReserve = 0
+
+	// the listener is gone
+	assert.NoError(t, listener.Close())
+
+	report = health.Check(context.Background())
+	assert.False(t, report.Healthy)
+	assert.Equal(t, []string{"webdav"}, failedChecks(report))
+
+	listener, err = net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer listener.Close()
+
+	health.SetWebDAVAddress(listener.Addr().String())
+
+	// the data root can't be written to, e.g. on a full or read-only disk, which a restart would not fix
+	dataRootFile := filepath.Join(tmpDataRootDir, "file")
+	assert.NoError(t, os.WriteFile(dataRootFile, []byte("not a folder"), 0o644))
+
+	config.AppInfo.DataRootPath = dataRootFile
+
+	report = health.Check(context.Background())
+	assert.True(t, report.Healthy)
+	assert.False(t, report.Ready)
+	assert.Contains(t, failedChecks(report), "data_root_writable")
+}
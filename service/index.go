@@ -0,0 +1,765 @@
+package service
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/IceWhaleTech/CasaOS-Common/utils/logger"
+	"github.com/IceWhaleTech/IceWhale-Files-Backup/codegen"
+	"github.com/IceWhaleTech/IceWhale-Files-Backup/common"
+	"github.com/IceWhaleTech/IceWhale-Files-Backup/pkg/config"
+	"github.com/samber/lo"
+	"go.etcd.io/bbolt"
+	"go.uber.org/zap"
+)
+
+var (
+	clientsBucket       = []byte("clients")
+	folderBackupsBucket = []byte("folder_backups")
+	runsBucket          = []byte("runs")
+	versionsBucket      = []byte("versions")
+	filesBucket         = []byte("files")
+	hashesBucket        = []byte("hashes")
+
+	indexBuckets = [][]byte{clientsBucket, folderBackupsBucket, runsBucket, versionsBucket, filesBucket, hashesBucket}
+)
+
+// Index is an embedded database indexing clients, folder backups, runs, file versions and hashes,
+// so they can be queried without walking the backup root.
+//
+// The metadata files under each folder backup remain the portable source of truth, and the index can
+// always be rebuilt from them with BackupService.RebuildIndex.
+//
+// Paths in the index are slash-separated. Folder backups are keyed by their backup folder path, i.e.
+// relative to the data root, and files by their path relative to the folder backup.
+type Index struct {
+	db *bbolt.DB
+}
+
+type IndexedClient struct {
+	ClientID       string `json:"client_id"`
+	ClientName     string `json:"client_name,omitempty"`
+	ClientType     string `json:"client_type,omitempty"`
+	LastBackupTime int64  `json:"last_backup_time,omitempty"`
+}
+
+// FileVersion is a history copy of a file in a folder backup.
+type FileVersion struct {
+	// Path is the path of the file the version was made of.
+	Path string `json:"path"`
+
+	// BackupFilePath is the path of the history copy.
+	BackupFilePath string `json:"backup_file_path"`
+
+	// Time is the time in milliseconds when the version was made.
+	Time int64 `json:"time"`
+
+	// Moved tells whether the file was moved, i.e. it no longer existed or had to be transferred again.
+	Moved bool `json:"moved"`
+}
+
+type IndexedFile struct {
+	Hash string `json:"hash"`
+	Size int64  `json:"size"`
+}
+
+func OpenIndex(path string) (*Index, error) {
+	db, err := bbolt.Open(path, 0o600, &bbolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := db.Update(func(tx *bbolt.Tx) error {
+		for _, bucket := range indexBuckets {
+			if _, err := tx.CreateBucketIfNotExists(bucket); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &Index{db: db}, nil
+}
+
+func (i *Index) Close() error {
+	return i.db.Close()
+}
+
+func (i *Index) IsEmpty() (bool, error) {
+	empty := true
+
+	err := i.db.View(func(tx *bbolt.Tx) error {
+		key, _ := tx.Bucket(folderBackupsBucket).Cursor().First()
+		empty = key == nil
+		return nil
+	})
+
+	return empty, err
+}
+
+// Reset removes everything from the index.
+func (i *Index) Reset() error {
+	return i.db.Update(func(tx *bbolt.Tx) error {
+		for _, bucket := range indexBuckets {
+			if err := tx.DeleteBucket(bucket); err != nil && !errors.Is(err, bbolt.ErrBucketNotFound) {
+				return err
+			}
+
+			if _, err := tx.CreateBucket(bucket); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// PutFolderBackup indexes the folder backup and its client. Client file sizes and hashes are not indexed.
+func (i *Index) PutFolderBackup(backup *codegen.FolderBackup) error {
+	if backup.BackupFolderPath == nil || backup.ClientID == nil {
+		return errors.New("backup folder path or client id is not set")
+	}
+
+	folderBackup := *backup
+	folderBackup.ClientFolderFileHashes = nil
+	folderBackup.ClientFolderFileSizes = nil
+	folderBackup.BackupFolderCount = nil
+	folderBackup.BackupFolderSize = nil
+
+	return i.db.Update(func(tx *bbolt.Tx) error {
+		if err := putJSON(tx.Bucket(folderBackupsBucket), []byte(path.Clean(*backup.BackupFolderPath)), folderBackup); err != nil {
+			return err
+		}
+
+		client := IndexedClient{}
+		if buf := tx.Bucket(clientsBucket).Get([]byte(*backup.ClientID)); buf != nil {
+			if err := json.Unmarshal(buf, &client); err != nil {
+				return err
+			}
+		}
+
+		client.ClientID = *backup.ClientID
+		if backup.ClientName != nil {
+			client.ClientName = *backup.ClientName
+		}
+		if backup.ClientType != nil {
+			client.ClientType = *backup.ClientType
+		}
+		if backup.LastBackupTime != nil && *backup.LastBackupTime > client.LastBackupTime {
+			client.LastBackupTime = *backup.LastBackupTime
+		}
+
+		return putJSON(tx.Bucket(clientsBucket), []byte(client.ClientID), client)
+	})
+}
+
+// DeleteFolderBackup removes the folder backup along with its runs, versions and files from the index.
+func (i *Index) DeleteFolderBackup(backupFolderPath string) error {
+	backupFolderPath = path.Clean(backupFolderPath)
+
+	return i.db.Update(func(tx *bbolt.Tx) error {
+		if err := tx.Bucket(folderBackupsBucket).Delete([]byte(backupFolderPath)); err != nil {
+			return err
+		}
+
+		if err := deletePrefix(tx.Bucket(runsBucket), []byte(backupFolderPath+"\x00")); err != nil {
+			return err
+		}
+
+		if err := deletePrefix(tx.Bucket(versionsBucket), []byte(backupFolderPath+"/")); err != nil {
+			return err
+		}
+
+		files := tx.Bucket(filesBucket)
+		prefix := []byte(backupFolderPath + "/")
+
+		var keys [][]byte
+		cursor := files.Cursor()
+		for key, _ := cursor.Seek(prefix); key != nil && bytes.HasPrefix(key, prefix); key, _ = cursor.Next() {
+			keys = append(keys, append([]byte{}, key...))
+		}
+
+		for _, key := range keys {
+			if err := deleteFile(tx, key); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// FolderBackups returns the indexed folder backups of the client, or of all clients if clientID is empty.
+func (i *Index) FolderBackups(clientID string) ([]codegen.FolderBackup, error) {
+	backups := []codegen.FolderBackup{}
+
+	err := i.db.View(func(tx *bbolt.Tx) error {
+		return tx.Bucket(folderBackupsBucket).ForEach(func(_, value []byte) error {
+			var backup codegen.FolderBackup
+			if err := json.Unmarshal(value, &backup); err != nil {
+				return err
+			}
+
+			if clientID == "" || (backup.ClientID != nil && *backup.ClientID == clientID) {
+				backups = append(backups, backup)
+			}
+
+			return nil
+		})
+	})
+
+	return backups, err
+}
+
+func (i *Index) Clients() ([]IndexedClient, error) {
+	clients := []IndexedClient{}
+
+	err := i.db.View(func(tx *bbolt.Tx) error {
+		return tx.Bucket(clientsBucket).ForEach(func(_, value []byte) error {
+			var client IndexedClient
+			if err := json.Unmarshal(value, &client); err != nil {
+				return err
+			}
+
+			clients = append(clients, client)
+			return nil
+		})
+	})
+
+	return clients, err
+}
+
+func (i *Index) PutRun(backupFolderPath string, run *Run) error {
+	return i.db.Update(func(tx *bbolt.Tx) error {
+		return putJSON(tx.Bucket(runsBucket), timeKey(path.Clean(backupFolderPath)+"\x00", run.StartTime), run)
+	})
+}
+
+// Runs returns the runs of the folder backup in ascending order of their start time.
+func (i *Index) Runs(backupFolderPath string) ([]Run, error) {
+	runs := []Run{}
+
+	err := i.db.View(func(tx *bbolt.Tx) error {
+		return forEachPrefix(tx.Bucket(runsBucket), []byte(path.Clean(backupFolderPath)+"\x00"), func(value []byte) error {
+			var run Run
+			if err := json.Unmarshal(value, &run); err != nil {
+				return err
+			}
+
+			runs = append(runs, run)
+			return nil
+		})
+	})
+
+	return runs, err
+}
+
+func (i *Index) PutVersion(backupFolderPath string, version *FileVersion) error {
+	return i.db.Update(func(tx *bbolt.Tx) error {
+		// versions made at the same millisecond are told apart by their history copies
+		key := append(timeKey(path.Join(backupFolderPath, version.Path)+"\x00", version.Time), version.BackupFilePath...)
+
+		return putJSON(tx.Bucket(versionsBucket), key, version)
+	})
+}
+
+// Versions returns the versions of the file in the folder backup in ascending order of their time.
+func (i *Index) Versions(backupFolderPath, relativePath string) ([]FileVersion, error) {
+	versions := []FileVersion{}
+
+	err := i.db.View(func(tx *bbolt.Tx) error {
+		return forEachPrefix(tx.Bucket(versionsBucket), []byte(path.Join(backupFolderPath, relativePath)+"\x00"), func(value []byte) error {
+			var version FileVersion
+			if err := json.Unmarshal(value, &version); err != nil {
+				return err
+			}
+
+			versions = append(versions, version)
+			return nil
+		})
+	})
+
+	return versions, err
+}
+
+// DeleteVersion removes the version of the file kept as the given history copy.
+func (i *Index) DeleteVersion(backupFolderPath, relativePath, backupFilePath string) error {
+	return i.db.Update(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket(versionsBucket)
+		prefix := []byte(path.Join(backupFolderPath, relativePath) + "\x00")
+
+		keys := [][]byte{}
+
+		if err := forEachPrefixKey(bucket, prefix, func(key, value []byte) error {
+			var version FileVersion
+			if err := json.Unmarshal(value, &version); err != nil {
+				return err
+			}
+
+			if version.BackupFilePath == backupFilePath {
+				keys = append(keys, append([]byte{}, key...))
+			}
+			return nil
+		}); err != nil {
+			return err
+		}
+
+		for _, key := range keys {
+			if err := bucket.Delete(key); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// PutFile indexes the hash and size of the current content of a file in the folder backup.
+func (i *Index) PutFile(backupFolderPath, relativePath, hash string, size int64) error {
+	filePath := []byte(path.Join(backupFolderPath, relativePath))
+
+	return i.db.Update(func(tx *bbolt.Tx) error {
+		if err := deleteFile(tx, filePath); err != nil {
+			return err
+		}
+
+		if err := putJSON(tx.Bucket(filesBucket), filePath, IndexedFile{Hash: hash, Size: size}); err != nil {
+			return err
+		}
+
+		return tx.Bucket(hashesBucket).Put(append([]byte(hash+"\x00"), filePath...), []byte{})
+	})
+}
+
+func (i *Index) DeleteFile(backupFolderPath, relativePath string) error {
+	return i.db.Update(func(tx *bbolt.Tx) error {
+		return deleteFile(tx, []byte(path.Join(backupFolderPath, relativePath)))
+	})
+}
+
+func (i *Index) File(backupFolderPath, relativePath string) (*IndexedFile, error) {
+	var file *IndexedFile
+
+	err := i.db.View(func(tx *bbolt.Tx) error {
+		buf := tx.Bucket(filesBucket).Get([]byte(path.Join(backupFolderPath, relativePath)))
+		if buf == nil {
+			return nil
+		}
+
+		file = &IndexedFile{}
+		return json.Unmarshal(buf, file)
+	})
+
+	return file, err
+}
+
+// FilesByHash returns the paths, relative to the data root, of all files with the given hash.
+func (i *Index) FilesByHash(hash string) ([]string, error) {
+	files := []string{}
+	prefix := []byte(hash + "\x00")
+
+	err := i.db.View(func(tx *bbolt.Tx) error {
+		cursor := tx.Bucket(hashesBucket).Cursor()
+		for key, _ := cursor.Seek(prefix); key != nil && bytes.HasPrefix(key, prefix); key, _ = cursor.Next() {
+			files = append(files, string(key[len(prefix):]))
+		}
+		return nil
+	})
+
+	return files, err
+}
+
+func deleteFile(tx *bbolt.Tx, filePath []byte) error {
+	files := tx.Bucket(filesBucket)
+
+	buf := files.Get(filePath)
+	if buf == nil {
+		return nil
+	}
+
+	var file IndexedFile
+	if err := json.Unmarshal(buf, &file); err != nil {
+		return err
+	}
+
+	if err := tx.Bucket(hashesBucket).Delete(append([]byte(file.Hash+"\x00"), filePath...)); err != nil {
+		return err
+	}
+
+	return files.Delete(filePath)
+}
+
+func putJSON(bucket *bbolt.Bucket, key []byte, value interface{}) error {
+	buf, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+
+	return bucket.Put(key, buf)
+}
+
+func forEachPrefix(bucket *bbolt.Bucket, prefix []byte, fn func(value []byte) error) error {
+	cursor := bucket.Cursor()
+	for key, value := cursor.Seek(prefix); key != nil && bytes.HasPrefix(key, prefix); key, value = cursor.Next() {
+		if err := fn(value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func forEachPrefixKey(bucket *bbolt.Bucket, prefix []byte, fn func(key, value []byte) error) error {
+	cursor := bucket.Cursor()
+	for key, value := cursor.Seek(prefix); key != nil && bytes.HasPrefix(key, prefix); key, value = cursor.Next() {
+		if err := fn(key, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func deletePrefix(bucket *bbolt.Bucket, prefix []byte) error {
+	var keys [][]byte
+
+	cursor := bucket.Cursor()
+	for key, _ := cursor.Seek(prefix); key != nil && bytes.HasPrefix(key, prefix); key, _ = cursor.Next() {
+		keys = append(keys, append([]byte{}, key...))
+	}
+
+	for _, key := range keys {
+		if err := bucket.Delete(key); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// timeKey appends the time in big endian so keys sharing the prefix are sorted by time.
+func timeKey(prefix string, t int64) []byte {
+	return binary.BigEndian.AppendUint64([]byte(prefix), uint64(t))
+}
+
+// IndexFilePath returns where the index is stored.
+func IndexFilePath() string {
+	return filepath.Join(config.AppInfo.DBPath, common.IndexFileName)
+}
+
+// RebuildIndex replaces the index with what is found under the backup root.
+func (b *BackupService) RebuildIndex() error {
+	if b.index == nil {
+		return errors.New("index is not set")
+	}
+
+	// hold off updates until the rebuild is done, so none of them is lost by the reset
+	b.indexMutex.Lock()
+	defer b.indexMutex.Unlock()
+
+	if err := b.index.Reset(); err != nil {
+		return err
+	}
+
+	backups, err := getBackupsByPath(b.storage, b.clock, b.backupRoot, false)
+	if err != nil {
+		return err
+	}
+
+	for i := range backups {
+		backup := &backups[i]
+
+		if err := b.index.PutFolderBackup(backup); err != nil {
+			return err
+		}
+
+		if err := b.rebuildFolderBackupIndex(*backup.BackupFolderPath); err != nil {
+			logger.Error("failed to index folder backup", zap.String("path", *backup.BackupFolderPath), zap.Error(err))
+		}
+	}
+
+	logger.Info("index has been rebuilt", zap.Int("folder_backups", len(backups)))
+
+	return nil
+}
+
+// ReconcileIndex brings the index in line with the folder backups under the backup root, e.g. after they
+// have been changed by another process sharing the data root. Folder backups missing from the index are
+// indexed, and ones no longer under the backup root are dropped from it.
+func (b *BackupService) ReconcileIndex() error {
+	if b.index == nil {
+		return errors.New("index is not set")
+	}
+
+	b.indexMutex.RLock()
+	defer b.indexMutex.RUnlock()
+
+	// read before walking, so folder backups created meanwhile are not taken as gone
+	indexedBackups, err := b.index.FolderBackups("")
+	if err != nil {
+		return err
+	}
+
+	indexed := map[string]bool{}
+	for _, backup := range indexedBackups {
+		indexed[path.Clean(filepath.ToSlash(*backup.BackupFolderPath))] = true
+	}
+
+	backups, err := getBackupsByPath(b.storage, b.clock, b.backupRoot, false)
+	if err != nil {
+		return err
+	}
+
+	added, removed := 0, 0
+	found := map[string]bool{}
+
+	for i := range backups {
+		backup := &backups[i]
+		backupFolderPath := path.Clean(filepath.ToSlash(*backup.BackupFolderPath))
+		found[backupFolderPath] = true
+
+		if err := b.index.PutFolderBackup(backup); err != nil {
+			return err
+		}
+
+		if indexed[backupFolderPath] {
+			continue
+		}
+
+		if err := b.rebuildFolderBackupIndex(*backup.BackupFolderPath); err != nil {
+			logger.Error("failed to index folder backup", zap.String("path", *backup.BackupFolderPath), zap.Error(err))
+		}
+		added++
+	}
+
+	for backupFolderPath := range indexed {
+		if found[backupFolderPath] {
+			continue
+		}
+
+		if err := b.index.DeleteFolderBackup(backupFolderPath); err != nil {
+			return err
+		}
+		removed++
+	}
+
+	if added > 0 || removed > 0 {
+		logger.Info("index has been reconciled", zap.Int("added", added), zap.Int("removed", removed))
+	}
+
+	return nil
+}
+
+// indexedFolderBackups returns the folder backups of the client, or of all clients if clientID is empty, from
+// the index. The index is reconciled first if it tells other clients than the backup root, or folder backups
+// no longer there.
+func (b *BackupService) indexedFolderBackups(clientID string) ([]codegen.FolderBackup, error) {
+	backups, err := b.index.FolderBackups(clientID)
+	if err != nil {
+		return nil, err
+	}
+
+	if agrees, err := b.indexAgreesWithBackupRoot(clientID, backups); err != nil {
+		return nil, err
+	} else if agrees {
+		return backups, nil
+	}
+
+	logger.Info("index is out of date, reconciling it with the backup root", zap.String("client_id", clientID))
+
+	if err := b.ReconcileIndex(); err != nil {
+		return nil, err
+	}
+
+	return b.index.FolderBackups(clientID)
+}
+
+// indexAgreesWithBackupRoot tells whether the indexed folder backups are all still there, and are of the
+// clients having folder backups under the backup root, without walking it.
+func (b *BackupService) indexAgreesWithBackupRoot(clientID string, backups []codegen.FolderBackup) (bool, error) {
+	indexedClients := map[string]bool{}
+
+	for _, backup := range backups {
+		if _, err := b.storage.Stat(filepath.Join(b.storage.Root(), *backup.BackupFolderPath)); err != nil {
+			if os.IsNotExist(err) {
+				return false, nil
+			}
+			return false, err
+		}
+
+		indexedClients[lo.FromPtr(backup.ClientID)] = true
+	}
+
+	clientIDs := []string{clientID}
+	if clientID == "" {
+		entries, err := b.storage.ReadDir(b.backupRoot)
+		if err != nil {
+			return false, err
+		}
+
+		clientIDs = lo.FilterMap(entries, func(entry fs.DirEntry, _ int) (string, bool) {
+			return entry.Name(), entry.IsDir() && entry.Name() != common.StateFolderName
+		})
+	}
+
+	for _, clientID := range clientIDs {
+		entries, err := b.storage.ReadDir(filepath.Join(b.backupRoot, clientID))
+		if err != nil && !os.IsNotExist(err) {
+			return false, err
+		}
+
+		// the state folder of the client alone, e.g. with its settings, holds no folder backup
+		hasFolderBackups := lo.ContainsBy(entries, func(entry fs.DirEntry) bool {
+			return entry.Name() != common.StateFolderName
+		})
+
+		if hasFolderBackups != indexedClients[clientID] {
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
+
+func (b *BackupService) rebuildFolderBackupIndex(backupFolderPath string) error {
+	backupFolderFullPath := filepath.Join(b.storage.Root(), backupFolderPath)
+
+	run, err := LoadRun(b.storage, backupFolderFullPath)
+	if err != nil {
+		return err
+	}
+
+	if run != nil {
+		if err := b.index.PutRun(backupFolderPath, run); err != nil {
+			return err
+		}
+	}
+
+	if err := walkHistoryCopies(b.storage, backupFolderFullPath, func(_ string, _ fs.DirEntry, version *FileVersion) error {
+		return b.index.PutVersion(backupFolderPath, version)
+	}); err != nil {
+		return err
+	}
+
+	manifest, err := LoadManifest(b.storage, backupFolderFullPath, 0)
+	if err != nil {
+		if errors.Is(err, ErrManifestNotFound) {
+			return nil
+		}
+		return err
+	}
+
+	if manifest.FileSizes == nil || manifest.FileHashes == nil {
+		return nil
+	}
+
+	paths := b.clientPathsAt(backupFolderPath, lo.FromPtr(manifest.ClientFolderPath))
+
+	// hashing every file would take too long, so trust the manifest for files of the expected size
+	for clientFile, size := range *manifest.FileSizes {
+		relativePath := paths.relativePath(clientFile)
+		if run != nil && run.IsPending(relativePath) {
+			continue
+		}
+
+		fileInfo, err := b.storage.Stat(filepath.Join(backupFolderFullPath, relativePath))
+		if err != nil || fileInfo.IsDir() || fileInfo.Size() != size {
+			continue
+		}
+
+		if err := b.index.PutFile(backupFolderPath, relativePath, (*manifest.FileHashes)[clientFile], size); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// updateIndex applies the update if the index is set. The index can always be rebuilt, so failures
+// are only logged.
+func (b *BackupService) updateIndex(update func(index *Index) error) {
+	if b.index == nil {
+		return
+	}
+
+	b.indexMutex.RLock()
+	defer b.indexMutex.RUnlock()
+
+	if err := update(b.index); err != nil {
+		logger.Error("failed to update index", zap.Error(err))
+	}
+}
+
+func (b *BackupService) indexVersion(backupFolderPath, backupFolderFullPath, relativePath, backupFilePath string, moved bool) {
+	b.updateIndex(func(index *Index) error {
+		relativeBackupFilePath, err := filepath.Rel(backupFolderFullPath, backupFilePath)
+		if err != nil {
+			return err
+		}
+
+		// the time the history copy is named after, so the index agrees with a rebuild
+		versionTime := b.clock.Now().UnixMilli()
+		if version := parseBackupFileName(filepath.Base(backupFilePath)); version != nil {
+			versionTime = version.Time
+		}
+
+		if err := index.PutVersion(backupFolderPath, &FileVersion{
+			Path:           filepath.ToSlash(relativePath),
+			BackupFilePath: filepath.ToSlash(relativeBackupFilePath),
+			Time:           versionTime,
+			Moved:          moved,
+		}); err != nil {
+			return err
+		}
+
+		if moved {
+			return index.DeleteFile(backupFolderPath, relativePath)
+		}
+
+		return nil
+	})
+}
+
+// backupFileNamePattern matches names of history copies, which tell the time in UTC to the millisecond
+// followed by a counter if made at the same millisecond, or the local time to the second for history copies
+// made by earlier versions.
+var backupFileNamePattern = regexp.MustCompile(`^(.*)-backup-(\d{4}-\d{2}-\d{2}-\d{2}-\d{2}-\d{2})-(\d{3})(?:(Z)(?:-\d+)?)?(.*)$`)
+
+// parseBackupFileName returns the version a history copy was made for, with the file name as path,
+// or nil if the name is not of a history copy.
+func parseBackupFileName(name string) *FileVersion {
+	matches := backupFileNamePattern.FindStringSubmatch(name)
+	if matches == nil {
+		return nil
+	}
+
+	location := time.Local
+	if matches[4] == "Z" {
+		location = time.UTC
+	}
+
+	t, err := time.ParseInLocation("2006-01-02-15-04-05", matches[2], location)
+	if err != nil {
+		return nil
+	}
+
+	milliseconds, err := strconv.Atoi(matches[3])
+	if err != nil {
+		return nil
+	}
+
+	return &FileVersion{
+		Path:           matches[1] + matches[5],
+		BackupFilePath: name,
+		Time:           t.Add(time.Duration(milliseconds) * time.Millisecond).UnixMilli(),
+	}
+}
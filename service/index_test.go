@@ -0,0 +1,238 @@
+package service_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/IceWhaleTech/IceWhale-Files-Backup/codegen"
+	"github.com/IceWhaleTech/IceWhale-Files-Backup/common"
+	"github.com/IceWhaleTech/IceWhale-Files-Backup/pkg/config"
+	"github.com/IceWhaleTech/IceWhale-Files-Backup/service"
+	"github.com/samber/lo"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/goleak"
+)
+
+func TestIndex(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	tmpDataRootDir, err := os.MkdirTemp("", "test")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tmpDataRootDir)
+
+	config.AppInfo.DataRootPath = tmpDataRootDir
+
+	index, err := service.OpenIndex(filepath.Join(tmpDataRootDir, common.IndexFileName))
+	assert.NoError(t, err)
+	defer index.Close()
+
+	empty, err := index.IsEmpty()
+	assert.NoError(t, err)
+	assert.True(t, empty)
+
+	clientID := "client1"
+	clientFolderPath := `C:\Users\icewhale\Downloads`
+	backupFolderPath := filepath.Join(common.BackupRootFolder, clientID, service.Normalize(clientFolderPath))
+	backupFolderFullPath := filepath.Join(tmpDataRootDir, backupFolderPath)
+
+	assert.NoError(t, os.MkdirAll(backupFolderFullPath, 0o755))
+	assert.NoError(t, createFileWithContent(backupFolderFullPath, "a.txt", "old a"))
+
+	content := "new a"
+	hash, err := service.XXHashReader(strings.NewReader(content))
+	assert.NoError(t, err)
+
+	backupService := service.NewBackupService()
+	backupService.SetIndex(index)
+
+	_, err = backupService.Proceed(codegen.FolderBackup{
+		ClientID:               &clientID,
+		ClientFolderPath:       &clientFolderPath,
+		ClientFolderFileSizes:  &map[string]int64{"a.txt": int64(len(content))},
+		ClientFolderFileHashes: &map[string]string{"a.txt": hash},
+	})
+	assert.NoError(t, err)
+
+	// the client uploads the new content
+	assert.NoError(t, os.WriteFile(filepath.Join(backupFolderFullPath, "a.txt"), []byte(content), 0o644))
+
+	verification, err := backupService.Complete(clientID, clientFolderPath)
+	assert.NoError(t, err)
+	assert.True(t, *verification.Succeeded)
+
+	check := func() {
+		backups, err := backupService.GetBackupsByClientID(context.Background(), clientID, false)
+		assert.NoError(t, err)
+		assert.Len(t, backups, 1)
+		assert.Equal(t, backupFolderPath, *backups[0].BackupFolderPath)
+
+		clients, err := index.Clients()
+		assert.NoError(t, err)
+		assert.Len(t, clients, 1)
+		assert.Equal(t, clientID, clients[0].ClientID)
+
+		runs, err := index.Runs(backupFolderPath)
+		assert.NoError(t, err)
+		assert.NotEmpty(t, runs)
+		assert.True(t, runs[len(runs)-1].Completed)
+
+		versions, err := index.Versions(backupFolderPath, "a.txt")
+		assert.NoError(t, err)
+		assert.Len(t, versions, 1)
+		assert.True(t, strings.HasPrefix(versions[0].BackupFilePath, "a-backup-"))
+
+		file, err := index.File(backupFolderPath, "a.txt")
+		assert.NoError(t, err)
+		assert.NotNil(t, file)
+		assert.Equal(t, hash, file.Hash)
+
+		files, err := index.FilesByHash(hash)
+		assert.NoError(t, err)
+		assert.Equal(t, []string{filepath.ToSlash(filepath.Join(backupFolderPath, "a.txt"))}, files)
+	}
+
+	check()
+
+	// the index can be rebuilt from the backup root alone
+	assert.NoError(t, index.Reset())
+
+	empty, err = index.IsEmpty()
+	assert.NoError(t, err)
+	assert.True(t, empty)
+
+	assert.NoError(t, backupService.RebuildIndex())
+
+	check()
+
+	assert.NoError(t, backupService.DeleteBackupsByClientID(context.Background(), clientID, clientFolderPath))
+
+	empty, err = index.IsEmpty()
+	assert.NoError(t, err)
+	assert.True(t, empty)
+
+	files, err := index.FilesByHash(hash)
+	assert.NoError(t, err)
+	assert.Empty(t, files)
+}
+
+func TestRebuildIndexWithVersionTimes(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	tmpDataRootDir, err := os.MkdirTemp("", "test")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tmpDataRootDir)
+
+	index, err := service.OpenIndex(filepath.Join(tmpDataRootDir, common.IndexFileName))
+	assert.NoError(t, err)
+	defer index.Close()
+
+	clock := &fixedClock{now: time.Date(2023, 4, 10, 12, 0, 0, 123000000, time.UTC)}
+
+	backupService := service.NewBackupServiceWith(service.NewLocalStorage(tmpDataRootDir), clock)
+	backupService.SetIndex(index)
+
+	clientID := "client1"
+	clientFolderPath := "/home/icewhale/Documents"
+	backupFolderPath := filepath.Join(common.BackupRootFolder, clientID, service.Normalize(clientFolderPath))
+	backupFolderFullPath := filepath.Join(tmpDataRootDir, backupFolderPath)
+
+	assert.NoError(t, os.MkdirAll(backupFolderFullPath, 0o755))
+
+	assert.NoError(t, createFileWithContent(backupFolderFullPath, "a.txt", "first"))
+
+	// the file changes twice within the same millisecond, and both versions are kept
+	for _, content := range []string{"second", "third"} {
+		hash, err := service.XXHashReader(strings.NewReader(content))
+		assert.NoError(t, err)
+
+		_, err = backupService.Proceed(codegen.FolderBackup{
+			ClientID:               &clientID,
+			ClientFolderPath:       &clientFolderPath,
+			ClientFolderFileSizes:  &map[string]int64{"a.txt": int64(len(content))},
+			ClientFolderFileHashes: &map[string]string{"a.txt": hash},
+		})
+		assert.NoError(t, err)
+
+		assert.NoError(t, createFileWithContent(backupFolderFullPath, "a.txt", content))
+
+		verification, err := backupService.Complete(clientID, clientFolderPath)
+		assert.NoError(t, err)
+		assert.True(t, *verification.Succeeded)
+	}
+
+	check := func() {
+		versions, err := index.Versions(backupFolderPath, "a.txt")
+		assert.NoError(t, err)
+		assert.Len(t, versions, 2)
+
+		for _, version := range versions {
+			assert.Equal(t, clock.now.UnixMilli(), version.Time)
+		}
+	}
+
+	check()
+
+	// the time is told by the names of the history copies alone
+	assert.NoError(t, index.Reset())
+	assert.NoError(t, backupService.RebuildIndex())
+
+	check()
+}
+
+func TestIndexReconciledWithBackupRoot(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	tmpDir, err := os.MkdirTemp("", "test")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	index, err := service.OpenIndex(filepath.Join(tmpDir, common.IndexFileName))
+	assert.NoError(t, err)
+	defer index.Close()
+
+	clock := &fixedClock{now: time.Date(2023, 4, 10, 12, 0, 0, 0, time.UTC)}
+	storage := service.NewMemoryStorage("/DATA", clock)
+
+	backupService := service.NewBackupServiceWith(storage, clock)
+	backupService.SetIndex(index)
+
+	clientFolderPaths := []string{"/home/icewhale/Documents", "/home/icewhale/Pictures"}
+
+	backupFolderPathOf := func(clientID, clientFolderPath string) string {
+		return filepath.Join(common.BackupRootFolder, clientID, service.Normalize(clientFolderPath))
+	}
+
+	// a run interrupted before it is completed still lists its folder backup
+	_, err = backupService.Proceed(folderBackupRequest(t, "client1", clientFolderPaths[0], "a.txt"))
+	assert.NoError(t, err)
+
+	backups, err := backupService.GetBackupsByClientID(context.Background(), "client1", false)
+	assert.NoError(t, err)
+	assert.Len(t, backups, 1)
+
+	// folder backups changed by another process sharing the data root
+	for _, clientID := range []string{"client1", "client2"} {
+		backupFolderPath := backupFolderPathOf(clientID, clientFolderPaths[1])
+		assert.NoError(t, service.SaveMetadata(storage, &codegen.FolderBackup{
+			BackupFolderPath: &backupFolderPath,
+			ClientFolderPath: &clientFolderPaths[1],
+			ClientID:         lo.ToPtr(clientID),
+		}))
+	}
+
+	allBackups, err := backupService.GetAllBackups(context.Background(), false)
+	assert.NoError(t, err)
+	assert.Len(t, allBackups["client1"], 2)
+	assert.Len(t, allBackups["client2"], 1)
+
+	assert.NoError(t, storage.RemoveAll(filepath.Join(storage.Root(), backupFolderPathOf("client1", clientFolderPaths[0]))))
+
+	backups, err = backupService.GetBackupsByClientID(context.Background(), "client1", false)
+	assert.NoError(t, err)
+	assert.Len(t, backups, 1)
+	assert.Equal(t, backupFolderPathOf("client1", clientFolderPaths[1]), *backups[0].BackupFolderPath)
+}
@@ -0,0 +1,272 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/IceWhaleTech/CasaOS-Common/utils/logger"
+	"github.com/IceWhaleTech/IceWhale-Files-Backup/codegen"
+	"github.com/cespare/xxhash/v2"
+	"github.com/samber/lo"
+	"go.uber.org/zap"
+)
+
+const (
+	lockFolderName = "locks"
+	lockFileExt    = ".lock"
+)
+
+var ErrFolderLocked = errors.New("folder backup is locked")
+
+// LockManager hands out read and write locks on folder backups, keyed by their backup folder path.
+//
+// Each lock is held both in memory, for operations within this process, and, on Linux, as a lock on a lock
+// file, so another process sharing the same data folder, such as a second instance of the service, waits too.
+type LockManager struct {
+	lockFolderPath string
+
+	mutex *sync.Mutex
+	locks map[string]*folderLock
+}
+
+type folderLock struct {
+	rw *sync.RWMutex
+
+	// refs counts operations holding or waiting for the lock, so it is only dropped when unused.
+	refs    int
+	holders map[*lockHolder]struct{}
+}
+
+type lockHolder struct {
+	mode      codegen.FolderBackupLockMode
+	operation string
+	since     time.Time
+}
+
+func NewLockManager(lockFolderPath string) *LockManager {
+	return &LockManager{
+		lockFolderPath: lockFolderPath,
+
+		mutex: &sync.Mutex{},
+		locks: map[string]*folderLock{},
+	}
+}
+
+// Lock waits for an exclusive lock on the folder backup and returns the function releasing it.
+func (m *LockManager) Lock(backupFolderPath, operation string) (func(), error) {
+	return m.lock(backupFolderPath, operation, codegen.Write, true)
+}
+
+// TryLock is Lock without waiting. It returns ErrFolderLocked if the lock is held by another operation.
+func (m *LockManager) TryLock(backupFolderPath, operation string) (func(), error) {
+	return m.lock(backupFolderPath, operation, codegen.Write, false)
+}
+
+// RLock waits for a shared lock on the folder backup and returns the function releasing it.
+func (m *LockManager) RLock(backupFolderPath, operation string) (func(), error) {
+	return m.lock(backupFolderPath, operation, codegen.Read, true)
+}
+
+// TryRLock is RLock without waiting. It returns ErrFolderLocked if a write lock is held by another operation.
+func (m *LockManager) TryRLock(backupFolderPath, operation string) (func(), error) {
+	return m.lock(backupFolderPath, operation, codegen.Read, false)
+}
+
+// IsActive tells whether any operation of this process holds or waits for a lock on the folder backup.
+func (m *LockManager) IsActive(backupFolderPath string) bool {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	_, ok := m.locks[filepath.Clean(backupFolderPath)]
+	return ok
+}
+
+// IsWriteLocked tells whether an exclusive lock on the folder backup is held, by this process or by any
+// other process.
+func (m *LockManager) IsWriteLocked(backupFolderPath string) bool {
+	backupFolderPath = filepath.Clean(backupFolderPath)
+
+	m.mutex.Lock()
+	if state, ok := m.locks[backupFolderPath]; ok {
+		for holder := range state.holders {
+			if holder.mode == codegen.Write {
+				m.mutex.Unlock()
+				return true
+			}
+		}
+
+		if len(state.holders) > 0 {
+			// held for reading by this process, so no other process can hold it for writing
+			m.mutex.Unlock()
+			return false
+		}
+	}
+	m.mutex.Unlock()
+
+	_, mode, err := probeLockFile(m.lockFilePath(backupFolderPath))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logger.Error("failed to probe lock file", zap.String("path", backupFolderPath), zap.Error(err))
+		}
+		return false
+	}
+
+	return mode == codegen.Write
+}
+
+// Locks returns the locks currently held, by this process or by any other process.
+func (m *LockManager) Locks() ([]codegen.FolderBackupLock, error) {
+	locks := []codegen.FolderBackupLock{}
+	held := map[string]bool{}
+
+	m.mutex.Lock()
+	for backupFolderPath, state := range m.locks {
+		if len(state.holders) == 0 {
+			// only waiting, which the lock file below tells about if another process holds the lock
+			continue
+		}
+
+		lock := codegen.FolderBackupLock{
+			BackupFolderPath: lo.ToPtr(backupFolderPath),
+			Operations:       &[]string{},
+			External:         lo.ToPtr(false),
+		}
+
+		var since time.Time
+		for holder := range state.holders {
+			lock.Mode = lo.ToPtr(holder.mode)
+			*lock.Operations = append(*lock.Operations, holder.operation)
+
+			if since.IsZero() || holder.since.Before(since) {
+				since = holder.since
+			}
+		}
+
+		sort.Strings(*lock.Operations)
+		lock.Since = lo.ToPtr(since.UnixMilli())
+
+		locks = append(locks, lock)
+		held[backupFolderPath] = true
+	}
+	m.mutex.Unlock()
+
+	entries, err := os.ReadDir(m.lockFolderPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return locks, nil
+		}
+		return nil, err
+	}
+
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), lockFileExt) {
+			continue
+		}
+
+		backupFolderPath, mode, err := probeLockFile(filepath.Join(m.lockFolderPath, entry.Name()))
+		if err != nil {
+			if os.IsNotExist(err) {
+				// released and deleted in the meantime
+				continue
+			}
+			logger.Error("failed to probe lock file", zap.String("name", entry.Name()), zap.Error(err))
+			continue
+		}
+
+		if mode == "" || backupFolderPath == "" || held[backupFolderPath] {
+			continue
+		}
+
+		locks = append(locks, codegen.FolderBackupLock{
+			BackupFolderPath: lo.ToPtr(backupFolderPath),
+			Mode:             lo.ToPtr(mode),
+			Operations:       &[]string{},
+			Since:            lo.ToPtr(int64(0)),
+			External:         lo.ToPtr(true),
+		})
+	}
+
+	sort.Slice(locks, func(i, j int) bool { return *locks[i].BackupFolderPath < *locks[j].BackupFolderPath })
+
+	return locks, nil
+}
+
+func (m *LockManager) lock(backupFolderPath, operation string, mode codegen.FolderBackupLockMode, wait bool) (func(), error) {
+	backupFolderPath = filepath.Clean(backupFolderPath)
+
+	m.mutex.Lock()
+	state, ok := m.locks[backupFolderPath]
+	if !ok {
+		state = &folderLock{
+			rw:      &sync.RWMutex{},
+			holders: map[*lockHolder]struct{}{},
+		}
+		m.locks[backupFolderPath] = state
+	}
+	state.refs++
+	m.mutex.Unlock()
+
+	release := func() {
+		m.mutex.Lock()
+		defer m.mutex.Unlock()
+
+		state.refs--
+		if state.refs == 0 {
+			delete(m.locks, backupFolderPath)
+		}
+	}
+
+	lock, unlock := state.rw.Lock, state.rw.Unlock
+	tryLock := state.rw.TryLock
+	if mode == codegen.Read {
+		lock, unlock = state.rw.RLock, state.rw.RUnlock
+		tryLock = state.rw.TryRLock
+	}
+
+	if wait {
+		lock()
+	} else if !tryLock() {
+		release()
+		return nil, fmt.Errorf("%w: %s", ErrFolderLocked, backupFolderPath)
+	}
+
+	lockFile, err := m.flock(backupFolderPath, mode, wait)
+	if err != nil {
+		unlock()
+		release()
+		return nil, err
+	}
+
+	holder := &lockHolder{mode: mode, operation: operation, since: time.Now()}
+
+	m.mutex.Lock()
+	state.holders[holder] = struct{}{}
+	m.mutex.Unlock()
+
+	var once sync.Once
+
+	return func() {
+		once.Do(func() {
+			m.mutex.Lock()
+			delete(state.holders, holder)
+			m.mutex.Unlock()
+
+			unflock(lockFile)
+
+			unlock()
+			release()
+		})
+	}, nil
+}
+
+// lockFilePath returns the path of the lock file of the folder backup. Backup folder paths can be too long
+// for a file name, so the lock file is named by its hash and keeps the path as its content for Locks.
+func (m *LockManager) lockFilePath(backupFolderPath string) string {
+	return filepath.Join(m.lockFolderPath, fmt.Sprintf("%x%s", xxhash.Sum64String(backupFolderPath), lockFileExt))
+}
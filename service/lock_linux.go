@@ -0,0 +1,136 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/IceWhaleTech/CasaOS-Common/utils/logger"
+	"github.com/IceWhaleTech/IceWhale-Files-Backup/codegen"
+	"go.uber.org/zap"
+	"golang.org/x/sys/unix"
+)
+
+// flock opens the lock file of the folder backup and locks it, so other processes see the lock.
+func (m *LockManager) flock(backupFolderPath string, mode codegen.FolderBackupLockMode, wait bool) (*os.File, error) {
+	if err := os.MkdirAll(m.lockFolderPath, 0o755); err != nil {
+		return nil, err
+	}
+
+	lockFilePath := m.lockFilePath(backupFolderPath)
+
+	lockType := int16(unix.F_WRLCK)
+	if mode == codegen.Read {
+		lockType = unix.F_RDLCK
+	}
+
+	for {
+		lockFile, err := os.OpenFile(lockFilePath, os.O_RDWR|os.O_CREATE, 0o644)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := setLock(lockFile, lockType, wait); err != nil {
+			lockFile.Close()
+
+			if errors.Is(err, unix.EAGAIN) || errors.Is(err, unix.EACCES) {
+				return nil, fmt.Errorf("%w by another process: %s", ErrFolderLocked, backupFolderPath)
+			}
+			return nil, err
+		}
+
+		// the lock file may have been deleted by its last holder while waiting, in which case the lock is
+		// on a file no one else sees, so it is taken again on the lock file now in place
+		if !isLockFileInPlace(lockFile) {
+			lockFile.Close()
+			continue
+		}
+
+		if fileInfo, err := lockFile.Stat(); err == nil && fileInfo.Size() == 0 {
+			if _, err := lockFile.WriteString(backupFolderPath); err != nil {
+				logger.Error("failed to write lock file", zap.String("path", lockFilePath), zap.Error(err))
+			}
+		}
+
+		return lockFile, nil
+	}
+}
+
+// unflock releases the lock on the lock file, deleting the lock file unless another operation holds or
+// waits for the lock, so lock files do not pile up for folder backups no longer in use.
+func unflock(lockFile *os.File) {
+	// upgrading to a write lock only succeeds if no one else holds the lock
+	if err := setLock(lockFile, unix.F_WRLCK, false); err == nil {
+		if err := os.Remove(lockFile.Name()); err != nil && !os.IsNotExist(err) {
+			logger.Error("failed to remove lock file", zap.String("path", lockFile.Name()), zap.Error(err))
+		}
+	}
+
+	// closing the file releases the lock
+	if err := lockFile.Close(); err != nil {
+		logger.Error("failed to close lock file", zap.String("path", lockFile.Name()), zap.Error(err))
+	}
+}
+
+// setLock takes a lock of the type on the whole lock file. Locks are held by the open file rather than by
+// the process, as flock does, so they are released by closing the file and can also be probed by others.
+func setLock(lockFile *os.File, lockType int16, wait bool) error {
+	cmd := unix.F_OFD_SETLK
+	if wait {
+		cmd = unix.F_OFD_SETLKW
+	}
+
+	for {
+		err := unix.FcntlFlock(lockFile.Fd(), cmd, &unix.Flock_t{Type: lockType})
+		if !errors.Is(err, unix.EINTR) {
+			return err
+		}
+	}
+}
+
+// isLockFileInPlace tells whether the lock file is still the one at its path.
+func isLockFileInPlace(lockFile *os.File) bool {
+	fileInfo, err := lockFile.Stat()
+	if err != nil {
+		return false
+	}
+
+	pathInfo, err := os.Stat(lockFile.Name())
+	if err != nil {
+		return false
+	}
+
+	return os.SameFile(fileInfo, pathInfo)
+}
+
+// probeLockFile returns the backup folder path of the lock file and the mode of the lock held on it
+// by another process, or an empty mode if it is not locked. The lock is only queried, never taken, so
+// probing does not get in the way of others locking the folder backup.
+func probeLockFile(lockFilePath string) (string, codegen.FolderBackupLockMode, error) {
+	lockFile, err := os.Open(lockFilePath)
+	if err != nil {
+		return "", "", err
+	}
+	defer lockFile.Close()
+
+	buf, err := io.ReadAll(lockFile)
+	if err != nil {
+		return "", "", err
+	}
+
+	// reports the lock that would conflict with a write lock, i.e. any lock held
+	lock := unix.Flock_t{Type: unix.F_WRLCK}
+	if err := unix.FcntlFlock(lockFile.Fd(), unix.F_OFD_GETLK, &lock); err != nil {
+		return "", "", err
+	}
+
+	switch lock.Type {
+	case unix.F_WRLCK:
+		return string(buf), codegen.Write, nil
+	case unix.F_RDLCK:
+		return string(buf), codegen.Read, nil
+	default:
+		return string(buf), "", nil
+	}
+}
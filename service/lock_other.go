@@ -0,0 +1,22 @@
+//go:build !linux
+
+package service
+
+import (
+	"os"
+
+	"github.com/IceWhaleTech/IceWhale-Files-Backup/codegen"
+)
+
+// flock does nothing, since locks are only held in memory where open file locks are not supported, so
+// the data folder must not be shared with another process.
+func (m *LockManager) flock(backupFolderPath string, mode codegen.FolderBackupLockMode, wait bool) (*os.File, error) {
+	return nil, nil
+}
+
+func unflock(lockFile *os.File) {}
+
+// probeLockFile finds no lock file, since none is written.
+func probeLockFile(lockFilePath string) (string, codegen.FolderBackupLockMode, error) {
+	return "", "", os.ErrNotExist
+}
@@ -0,0 +1,180 @@
+package service_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/IceWhaleTech/IceWhale-Files-Backup/codegen"
+	"github.com/IceWhaleTech/IceWhale-Files-Backup/common"
+	"github.com/IceWhaleTech/IceWhale-Files-Backup/pkg/config"
+	"github.com/IceWhaleTech/IceWhale-Files-Backup/service"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/goleak"
+)
+
+func TestLockManager(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	tmpDir, err := os.MkdirTemp("", "test")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	backupFolderPath := filepath.Join(common.BackupRootFolder, "client1", "C/Users/icewhale/Downloads")
+
+	locks := service.NewLockManager(tmpDir)
+
+	// reads are shared
+	unlockRead1, err := locks.TryRLock(backupFolderPath, "read1")
+	assert.NoError(t, err)
+
+	unlockRead2, err := locks.TryRLock(backupFolderPath, "read2")
+	assert.NoError(t, err)
+
+	_, err = locks.TryLock(backupFolderPath, "write")
+	assert.ErrorIs(t, err, service.ErrFolderLocked)
+
+	status, err := locks.Locks()
+	assert.NoError(t, err)
+	assert.Len(t, status, 1)
+	assert.Equal(t, codegen.Read, *status[0].Mode)
+	assert.Equal(t, []string{"read1", "read2"}, *status[0].Operations)
+	assert.False(t, *status[0].External)
+
+	unlockRead1()
+	unlockRead2()
+
+	// another process is simulated by another lock manager sharing the lock files
+	otherLocks := service.NewLockManager(tmpDir)
+
+	unlockWrite, err := otherLocks.TryLock(backupFolderPath, "write")
+	assert.NoError(t, err)
+
+	_, err = locks.TryRLock(backupFolderPath, "read")
+	assert.ErrorIs(t, err, service.ErrFolderLocked)
+
+	status, err = locks.Locks()
+	assert.NoError(t, err)
+	assert.Len(t, status, 1)
+	assert.Equal(t, backupFolderPath, *status[0].BackupFolderPath)
+	assert.Equal(t, codegen.Write, *status[0].Mode)
+	assert.True(t, *status[0].External)
+
+	unlockWrite()
+
+	status, err = locks.Locks()
+	assert.NoError(t, err)
+	assert.Empty(t, status)
+
+	// lock files are deleted once no one holds them
+	entries, err := os.ReadDir(tmpDir)
+	assert.NoError(t, err)
+	assert.Empty(t, entries)
+}
+
+func TestLockFileKeptWhileHeldByAnotherProcess(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	tmpDir, err := os.MkdirTemp("", "test")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	backupFolderPath := filepath.Join(common.BackupRootFolder, "client1", "C/Users/icewhale/Downloads")
+
+	locks := service.NewLockManager(tmpDir)
+	otherLocks := service.NewLockManager(tmpDir)
+
+	unlockRead, err := locks.TryRLock(backupFolderPath, "read")
+	assert.NoError(t, err)
+
+	unlockOtherRead, err := otherLocks.TryRLock(backupFolderPath, "read")
+	assert.NoError(t, err)
+
+	unlockRead()
+
+	// the other process still holds the lock, which probing leaves alone
+	status, err := locks.Locks()
+	assert.NoError(t, err)
+	assert.Len(t, status, 1)
+	assert.Equal(t, codegen.Read, *status[0].Mode)
+	assert.True(t, *status[0].External)
+	assert.False(t, locks.IsWriteLocked(backupFolderPath))
+
+	unlockOtherRead2, err := otherLocks.TryRLock(backupFolderPath, "read2")
+	assert.NoError(t, err)
+
+	_, err = locks.TryLock(backupFolderPath, "write")
+	assert.ErrorIs(t, err, service.ErrFolderLocked)
+
+	unlockOtherRead()
+	unlockOtherRead2()
+
+	unlockWrite, err := locks.TryLock(backupFolderPath, "write")
+	assert.NoError(t, err)
+
+	assert.True(t, otherLocks.IsWriteLocked(backupFolderPath))
+
+	unlockWrite()
+
+	entries, err := os.ReadDir(tmpDir)
+	assert.NoError(t, err)
+	assert.Empty(t, entries)
+}
+
+func TestWebDAVWriteWaitsForProceed(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	tmpDataRootDir, err := os.MkdirTemp("", "test")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tmpDataRootDir)
+
+	config.AppInfo.DataRootPath = tmpDataRootDir
+
+	backupFolderPath := filepath.Join(common.BackupRootFolder, "client1", "C/Users/icewhale/Downloads")
+	assert.NoError(t, os.MkdirAll(filepath.Join(tmpDataRootDir, backupFolderPath), 0o755))
+
+	backupService := service.NewBackupService()
+	fs := backupService.WebDAVFileSystem()
+
+	// as if versioning is in progress
+	unlock, err := backupService.Locks().Lock(backupFolderPath, "proceed")
+	assert.NoError(t, err)
+
+	written := make(chan error, 1)
+	go func() {
+		file, err := fs.OpenFile(context.Background(), "/"+filepath.ToSlash(backupFolderPath)+"/a.txt", os.O_CREATE|os.O_WRONLY, 0o644)
+		if err != nil {
+			written <- err
+			return
+		}
+
+		if _, err := file.Write([]byte("a")); err != nil {
+			written <- err
+			return
+		}
+
+		written <- file.Close()
+	}()
+
+	select {
+	case <-written:
+		t.Fatal("write should wait for the lock")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	unlock()
+
+	select {
+	case err := <-written:
+		assert.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("write should proceed after the lock is released")
+	}
+
+	// nothing is left locked once the file is closed
+	status, err := backupService.Locks().Locks()
+	assert.NoError(t, err)
+	assert.Empty(t, status)
+}
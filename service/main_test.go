@@ -0,0 +1,14 @@
+package service_test
+
+import (
+	"os"
+	"testing"
+
+	"github.com/IceWhaleTech/CasaOS-Common/utils/logger"
+)
+
+func TestMain(m *testing.M) {
+	logger.LogInitConsoleOnly()
+
+	os.Exit(m.Run())
+}
@@ -0,0 +1,148 @@
+package service
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/IceWhaleTech/CasaOS-Common/utils/logger"
+	"github.com/IceWhaleTech/IceWhale-Files-Backup/codegen"
+	"github.com/IceWhaleTech/IceWhale-Files-Backup/common"
+	"go.uber.org/zap"
+)
+
+const manifestFileExt = ".json.gz"
+
+var ErrManifestNotFound = errors.New("manifest not found")
+
+func (b *BackupService) GetManifest(clientID, clientFolderPath string, at int64) (*codegen.Manifest, error) {
+	// convert Windows path to Unix path, and look up the folder backup as the client compares paths
+	backupFolderFullPath := b.clientPathsOf(clientID, clientFolderPath).backupFolderFullPath
+
+	return LoadManifest(b.storage, backupFolderFullPath, at)
+}
+
+// SaveManifest stores the manifest compressed under the state folder of the folder backup, named by
+// its time, and removes the oldest manifests beyond common.MaxManifestCount.
+func SaveManifest(storage Storage, backupFolderFullPath string, manifest *codegen.Manifest) error {
+	if manifest.Time == nil {
+		return fmt.Errorf("manifest time is not set")
+	}
+
+	manifestFolderPath := filepath.Join(backupFolderFullPath, common.StateFolderName, common.ManifestFolderName)
+	if err := storage.MkdirAll(manifestFolderPath, 0o755); err != nil {
+		return err
+	}
+
+	manifestFilePath := filepath.Join(manifestFolderPath, strconv.FormatInt(*manifest.Time, 10)+manifestFileExt)
+
+	var buf bytes.Buffer
+
+	gzipWriter := gzip.NewWriter(&buf)
+	if err := json.NewEncoder(gzipWriter).Encode(manifest); err != nil {
+		return err
+	}
+
+	if err := gzipWriter.Close(); err != nil {
+		return err
+	}
+
+	if err := storage.WriteFile(manifestFilePath, buf.Bytes(), 0o644); err != nil {
+		return err
+	}
+
+	times, err := ListManifests(storage, backupFolderFullPath)
+	if err != nil {
+		return err
+	}
+
+	for len(times) > common.MaxManifestCount {
+		oldest := filepath.Join(manifestFolderPath, strconv.FormatInt(times[0], 10)+manifestFileExt)
+		if err := storage.Remove(oldest); err != nil {
+			logger.Error("failed to remove old manifest", zap.String("path", oldest), zap.Error(err))
+		}
+		times = times[1:]
+	}
+
+	return nil
+}
+
+// LoadManifest returns the latest manifest accepted at or before the given time in milliseconds.
+// If at is not positive, the latest manifest is returned.
+func LoadManifest(storage Storage, backupFolderFullPath string, at int64) (*codegen.Manifest, error) {
+	times, err := ListManifests(storage, backupFolderFullPath)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := len(times) - 1; i >= 0; i-- {
+		if at > 0 && times[i] > at {
+			continue
+		}
+
+		manifestFilePath := filepath.Join(backupFolderFullPath, common.StateFolderName, common.ManifestFolderName, strconv.FormatInt(times[i], 10)+manifestFileExt)
+
+		return loadManifestFile(storage, manifestFilePath)
+	}
+
+	return nil, ErrManifestNotFound
+}
+
+// ListManifests returns the times of all stored manifests in ascending order.
+func ListManifests(storage Storage, backupFolderFullPath string) ([]int64, error) {
+	manifestFolderPath := filepath.Join(backupFolderFullPath, common.StateFolderName, common.ManifestFolderName)
+
+	entries, err := storage.ReadDir(manifestFolderPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []int64{}, nil
+		}
+		return nil, err
+	}
+
+	times := []int64{}
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), manifestFileExt) {
+			continue
+		}
+
+		t, err := strconv.ParseInt(strings.TrimSuffix(entry.Name(), manifestFileExt), 10, 64)
+		if err != nil {
+			continue
+		}
+
+		times = append(times, t)
+	}
+
+	sort.Slice(times, func(i, j int) bool { return times[i] < times[j] })
+
+	return times, nil
+}
+
+func loadManifestFile(storage Storage, path string) (*codegen.Manifest, error) {
+	manifestFile, err := storage.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer manifestFile.Close()
+
+	gzipReader, err := gzip.NewReader(manifestFile)
+	if err != nil {
+		return nil, err
+	}
+	defer gzipReader.Close()
+
+	var manifest codegen.Manifest
+	if err := json.NewDecoder(gzipReader).Decode(&manifest); err != nil {
+		return nil, err
+	}
+
+	return &manifest, nil
+}
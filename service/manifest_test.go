@@ -0,0 +1,67 @@
+package service_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/IceWhaleTech/IceWhale-Files-Backup/codegen"
+	"github.com/IceWhaleTech/IceWhale-Files-Backup/common"
+	"github.com/IceWhaleTech/IceWhale-Files-Backup/service"
+	"github.com/samber/lo"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/goleak"
+)
+
+func TestSaveAndLoadManifest(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	tmpDir, err := os.MkdirTemp("", "test")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	storage := service.NewLocalStorage(tmpDir)
+
+	// no manifest yet
+	_, err = service.LoadManifest(storage, tmpDir, 0)
+	assert.ErrorIs(t, err, service.ErrManifestNotFound)
+
+	for _, at := range []int64{1000, 2000, 3000} {
+		err := service.SaveManifest(storage, tmpDir, &codegen.Manifest{
+			ClientFolderPath: lo.ToPtr(`C:\Users\icewhale\Downloads`),
+			Time:             lo.ToPtr(at),
+			FileSizes:        lo.ToPtr(map[string]int64{`C:\Users\icewhale\Downloads\1.txt`: at}),
+			FileHashes:       lo.ToPtr(map[string]string{`C:\Users\icewhale\Downloads\1.txt`: "hash"}),
+		})
+		assert.NoError(t, err)
+	}
+
+	times, err := service.ListManifests(storage, tmpDir)
+	assert.NoError(t, err)
+	assert.Equal(t, []int64{1000, 2000, 3000}, times)
+
+	// latest
+	manifest, err := service.LoadManifest(storage, tmpDir, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(3000), *manifest.Time)
+
+	// at a point in time
+	manifest, err = service.LoadManifest(storage, tmpDir, 2500)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(2000), *manifest.Time)
+	assert.Equal(t, int64(2000), (*manifest.FileSizes)[`C:\Users\icewhale\Downloads\1.txt`])
+
+	// before the first manifest
+	_, err = service.LoadManifest(storage, tmpDir, 500)
+	assert.ErrorIs(t, err, service.ErrManifestNotFound)
+
+	// manifests are not considered as files to backup
+	assert.NoError(t, createFileWithContent(tmpDir, "file1.txt", "test content"))
+
+	nonBackupFiles, err := service.FilterBackupFiles(storage, tmpDir)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{filepath.Join(tmpDir, "file1.txt")}, nonBackupFiles)
+
+	_, err = os.Stat(filepath.Join(tmpDir, common.StateFolderName, common.ManifestFolderName))
+	assert.NoError(t, err)
+}
@@ -0,0 +1,166 @@
+package service
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/IceWhaleTech/CasaOS-Common/external"
+	"github.com/IceWhaleTech/CasaOS-Common/utils/logger"
+	"github.com/IceWhaleTech/IceWhale-Files-Backup/codegen"
+	"github.com/IceWhaleTech/IceWhale-Files-Backup/common"
+	"go.uber.org/zap"
+)
+
+const messageBusTimeout = 5 * time.Second
+
+// messageBusEventNames maps the events of folder backups to the events published to the CasaOS message bus.
+// Events not in here, e.g. progress of files, are too chatty for other apps.
+var messageBusEventNames = map[codegen.BackupEventType]string{
+	codegen.RunCompleted:       common.FilesBackupServiceName + ":run:completed",
+	codegen.RunFailed:          common.FilesBackupServiceName + ":run:failed",
+	codegen.VerificationFailed: common.FilesBackupServiceName + ":verification:failed",
+	codegen.QuotaWarning:       common.FilesBackupServiceName + ":quota:exceeded",
+	codegen.ClientRegistered:   common.FilesBackupServiceName + ":client:registered",
+	codegen.BackupUnhealthy:    common.FilesBackupServiceName + ":backup:unhealthy",
+	codegen.BackupDeleted:      common.FilesBackupServiceName + ":backup:deleted",
+}
+
+var messageBusPropertyTypes = []messageBusPropertyType{
+	{Name: "client_id", Description: "ID of the client"},
+	{Name: "client_name", Description: "name of the client"},
+	{Name: "backup_folder_path", Description: "relative path of the folder backup from the data folder"},
+	{Name: "path", Description: "path of the file relative to the folder backup"},
+	{Name: "file_count", Description: "number of files, depending on the event"},
+	{Name: "message", Description: "details of the event"},
+}
+
+// MessageBus publishes events of folder backups to the CasaOS message bus, so other apps and the
+// notification center can react to them.
+type MessageBus struct {
+	runtimePath string
+	client      *http.Client
+
+	registered bool
+}
+
+type messageBusEventType struct {
+	SourceID         string                   `json:"sourceID"`
+	Name             string                   `json:"name"`
+	PropertyTypeList []messageBusPropertyType `json:"propertyTypeList"`
+}
+
+type messageBusPropertyType struct {
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+}
+
+func NewMessageBus(runtimePath string) *MessageBus {
+	return &MessageBus{
+		runtimePath: runtimePath,
+		client:      &http.Client{Timeout: messageBusTimeout},
+	}
+}
+
+// Forward publishes the events received until the channel is closed.
+func (m *MessageBus) Forward(events <-chan codegen.BackupEvent) {
+	for event := range events {
+		name, ok := messageBusEventNames[*event.Type]
+		if !ok {
+			continue
+		}
+
+		if err := m.publish(name, messageBusProperties(event)); err != nil {
+			logger.Error("failed to publish event to message bus", zap.String("name", name), zap.Error(err))
+		}
+	}
+}
+
+func (m *MessageBus) publish(name string, properties map[string]string) error {
+	// the message bus might have been restarted at another address, so it is looked up every time
+	address, err := external.GetMessageBusAddress(m.runtimePath)
+	if err != nil {
+		return err
+	}
+
+	if !m.registered {
+		if err := m.registerEventTypes(address); err != nil {
+			return err
+		}
+		m.registered = true
+	}
+
+	return m.post(fmt.Sprintf("%s/event/%s/%s", address, url.PathEscape(common.FilesBackupServiceName), url.PathEscape(name)), properties)
+}
+
+func (m *MessageBus) registerEventTypes(address string) error {
+	eventTypes := []messageBusEventType{}
+	for _, name := range messageBusEventNames {
+		eventTypes = append(eventTypes, messageBusEventType{
+			SourceID:         common.FilesBackupServiceName,
+			Name:             name,
+			PropertyTypeList: messageBusPropertyTypes,
+		})
+	}
+
+	if err := m.post(address+"/event_type", eventTypes); err != nil {
+		return fmt.Errorf("failed to register event types: %w", err)
+	}
+
+	logger.Info("event types have been registered to message bus", zap.Int("count", len(eventTypes)))
+
+	return nil
+}
+
+func (m *MessageBus) post(url string, body interface{}) error {
+	buf, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+
+	response, err := m.client.Post(url, "application/json", bytes.NewReader(buf))
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("message bus replied %s", response.Status)
+	}
+
+	return nil
+}
+
+func messageBusProperties(event codegen.BackupEvent) map[string]string {
+	properties := map[string]string{}
+
+	if event.ClientID != nil {
+		properties["client_id"] = *event.ClientID
+	}
+
+	if event.ClientName != nil {
+		properties["client_name"] = *event.ClientName
+	}
+
+	if event.BackupFolderPath != nil {
+		properties["backup_folder_path"] = *event.BackupFolderPath
+	}
+
+	if event.Path != nil {
+		properties["path"] = *event.Path
+	}
+
+	if event.FileCount != nil {
+		properties["file_count"] = strconv.Itoa(*event.FileCount)
+	}
+
+	if event.Message != nil {
+		properties["message"] = *event.Message
+	}
+
+	return properties
+}
@@ -0,0 +1,67 @@
+package service_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/IceWhaleTech/CasaOS-Common/external"
+	"github.com/IceWhaleTech/IceWhale-Files-Backup/codegen"
+	"github.com/IceWhaleTech/IceWhale-Files-Backup/service"
+	"github.com/samber/lo"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/goleak"
+)
+
+func TestMessageBus(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	var mutex sync.Mutex
+	requests := map[string]interface{}{}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body interface{}
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+
+		mutex.Lock()
+		requests[r.URL.Path] = body
+		mutex.Unlock()
+	}))
+	defer server.Close()
+
+	tmpRuntimeDir, err := os.MkdirTemp("", "test")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tmpRuntimeDir)
+
+	assert.NoError(t, os.WriteFile(filepath.Join(tmpRuntimeDir, external.MessageBusAddressFilename), []byte(server.URL), 0o644))
+
+	events := make(chan codegen.BackupEvent, 2)
+	events <- codegen.BackupEvent{
+		Type:     lo.ToPtr(codegen.FileUploaded),
+		ClientID: lo.ToPtr("client1"),
+	}
+	events <- codegen.BackupEvent{
+		Type:      lo.ToPtr(codegen.RunCompleted),
+		ClientID:  lo.ToPtr("client1"),
+		FileCount: lo.ToPtr(3),
+	}
+	close(events)
+
+	service.NewMessageBus(tmpRuntimeDir).Forward(events)
+
+	// event types are registered before the first event
+	eventTypes, ok := requests[external.APIMessageBus+"/event_type"].([]interface{})
+	assert.True(t, ok)
+	assert.NotEmpty(t, eventTypes)
+
+	// progress of files is not published
+	assert.Len(t, requests, 2)
+	assert.Equal(t, map[string]interface{}{
+		"client_id":  "client1",
+		"file_count": "3",
+	}, requests[external.APIMessageBus+"/event/files-backup/files-backup:run:completed"])
+}
@@ -0,0 +1,170 @@
+package service
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/IceWhaleTech/CasaOS-Common/utils/logger"
+	"github.com/IceWhaleTech/IceWhale-Files-Backup/codegen"
+	"github.com/IceWhaleTech/IceWhale-Files-Backup/common"
+	"github.com/samber/lo"
+	"go.uber.org/zap"
+)
+
+var ErrMetadataCorrupt = errors.New("metadata is corrupt")
+
+// metadata is what is stored in the metadata file of each folder backup.
+type metadata struct {
+	// SchemaVersion is missing, i.e. 0, in metadata files written before the schema was versioned.
+	SchemaVersion int `json:"schema_version"`
+
+	codegen.FolderBackup
+}
+
+// metadataMigrations upgrade metadata from the schema version of the key to the next version.
+var metadataMigrations = map[int]func(m *metadata){
+	// last backup time was in seconds instead of milliseconds
+	0: func(m *metadata) {
+		if m.LastBackupTime != nil {
+			m.LastBackupTime = lo.ToPtr(*m.LastBackupTime * 1000)
+		}
+	},
+}
+
+func SaveMetadata(storage Storage, backup *codegen.FolderBackup) error {
+	if backup.BackupFolderPath == nil {
+		return fmt.Errorf("backup folder path is not set")
+	}
+
+	backupFolderFullPath := filepath.Join(storage.Root(), *backup.BackupFolderPath)
+
+	if err := storage.MkdirAll(backupFolderFullPath, 0o755); err != nil {
+		return err
+	}
+
+	buf, err := json.MarshalIndent(metadata{
+		SchemaVersion: common.MetadataSchemaVersion,
+		FolderBackup:  *backup,
+	}, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	metadataFilePath := filepath.Join(backupFolderFullPath, common.MetadataFileName)
+
+	return storage.WriteFile(metadataFilePath, append(buf, '\n'), 0o644)
+}
+
+func LoadMetadata(storage Storage, path string) (*codegen.FolderBackup, error) {
+	metadataFilePath := filepath.Join(path, common.MetadataFileName)
+
+	buf, err := storage.ReadFile(metadataFilePath)
+	if err != nil {
+		return nil, err
+	}
+
+	var m metadata
+	if err := json.Unmarshal(buf, &m); err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrMetadataCorrupt, err.Error())
+	}
+
+	if m.SchemaVersion > common.MetadataSchemaVersion {
+		return nil, fmt.Errorf("metadata schema version %d is newer than supported version %d", m.SchemaVersion, common.MetadataSchemaVersion)
+	}
+
+	for ; m.SchemaVersion < common.MetadataSchemaVersion; m.SchemaVersion++ {
+		if migrate, ok := metadataMigrations[m.SchemaVersion]; ok {
+			migrate(&m)
+		}
+	}
+
+	return &m.FolderBackup, nil
+}
+
+// LoadOrRecoverMetadata loads the metadata of the folder backup, or rebuilds it from the folder contents
+// if the metadata file is corrupt.
+func LoadOrRecoverMetadata(storage Storage, clock Clock, path string) (*codegen.FolderBackup, error) {
+	backup, err := LoadMetadata(storage, path)
+	if err == nil || !errors.Is(err, ErrMetadataCorrupt) {
+		return backup, err
+	}
+
+	logger.Error("metadata is corrupt, recovering from the folder contents", zap.String("path", path), zap.Error(err))
+
+	return RecoverMetadata(storage, clock, path)
+}
+
+// RecoverMetadata rebuilds the metadata of the folder backup from its path, its latest manifest and
+// its latest run, and saves it in place of the existing metadata file, which is kept under the state
+// folder for investigation.
+func RecoverMetadata(storage Storage, clock Clock, path string) (*codegen.FolderBackup, error) {
+	backupRoot := filepath.Join(storage.Root(), common.BackupRootFolder)
+
+	relativePath, err := filepath.Rel(backupRoot, path)
+	if err != nil || strings.HasPrefix(relativePath, "..") {
+		return nil, fmt.Errorf("%s is not under backup root %s", path, backupRoot)
+	}
+
+	// the first part of the path is the client ID, and the rest is the normalized client folder path
+	parts := strings.SplitN(filepath.ToSlash(relativePath), "/", 2)
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("%s is not a folder backup", path)
+	}
+
+	backupFolderPath := filepath.Join(common.BackupRootFolder, relativePath)
+
+	backup := &codegen.FolderBackup{
+		BackupFolderPath: &backupFolderPath,
+		ClientID:         lo.ToPtr(parts[0]),
+		ClientFolderPath: lo.ToPtr(parts[1]),
+		KeepHistoryCopy:  lo.ToPtr(true),
+	}
+
+	// the manifest keeps the client folder path as given by the client
+	if manifest, err := LoadManifest(storage, path, 0); err == nil {
+		if manifest.ClientFolderPath != nil {
+			backup.ClientFolderPath = manifest.ClientFolderPath
+		}
+		backup.LastBackupTime = manifest.Time
+	} else if !errors.Is(err, ErrManifestNotFound) {
+		logger.Error("failed to load manifest while recovering metadata", zap.String("path", path), zap.Error(err))
+	}
+
+	// a version folder tells the folder backup has been using the hidden store
+	if _, err := storage.Stat(filepath.Join(path, common.VersionFolderName)); err == nil {
+		backup.VersionStore = lo.ToPtr(codegen.Hidden)
+	}
+
+	if run, err := LoadRun(storage, path); err == nil && run != nil {
+		backup.InProgress = lo.ToPtr(!run.Completed)
+		backup.LastBackupSucceeded = lo.ToPtr(run.Completed)
+	} else if err != nil {
+		logger.Error("failed to load run while recovering metadata", zap.String("path", path), zap.Error(err))
+	}
+
+	metadataFilePath := filepath.Join(path, common.MetadataFileName)
+	if _, err := storage.Stat(metadataFilePath); err == nil {
+		stateFolderPath := filepath.Join(path, common.StateFolderName)
+		if err := storage.MkdirAll(stateFolderPath, 0o755); err != nil {
+			return nil, err
+		}
+
+		corruptFilePath := filepath.Join(stateFolderPath, fmt.Sprintf("%s.corrupt-%d", common.MetadataFileName, clock.Now().UnixMilli()))
+		if err := storage.Rename(metadataFilePath, corruptFilePath); err != nil {
+			return nil, err
+		}
+
+		logger.Info("corrupt metadata has been kept", zap.String("path", corruptFilePath))
+	}
+
+	if err := SaveMetadata(storage, backup); err != nil {
+		return nil, err
+	}
+
+	logger.Info("metadata has been recovered", zap.String("path", path))
+
+	return backup, nil
+}
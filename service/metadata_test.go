@@ -0,0 +1,90 @@
+package service_test
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/IceWhaleTech/IceWhale-Files-Backup/codegen"
+	"github.com/IceWhaleTech/IceWhale-Files-Backup/common"
+	"github.com/IceWhaleTech/IceWhale-Files-Backup/service"
+	"github.com/samber/lo"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/goleak"
+)
+
+func TestLoadMetadataMigratesOldSchema(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	dir, err := os.MkdirTemp("", "DATA")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	storage := service.NewLocalStorage(dir)
+
+	// metadata written before the schema was versioned has last backup time in seconds
+	assert.NoError(t, createFileWithContent(dir, common.MetadataFileName, `{"backup_folder_path": "backup", "last_backup_time": 1681159361}`))
+
+	backup, err := service.LoadMetadata(storage, dir)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1681159361000), *backup.LastBackupTime)
+
+	// metadata written by a newer version is refused
+	assert.NoError(t, createFileWithContent(dir, common.MetadataFileName, `{"schema_version": 999, "backup_folder_path": "backup"}`))
+
+	_, err = service.LoadMetadata(storage, dir)
+	assert.Error(t, err)
+	assert.NotErrorIs(t, err, service.ErrMetadataCorrupt)
+}
+
+func TestRecoverCorruptMetadata(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	dir, err := os.MkdirTemp("", "DATA")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	storage := service.NewLocalStorage(dir)
+
+	clientFolderPath := `C:\Users\icewhale\Downloads`
+	backupFolderPath := filepath.Join(common.BackupRootFolder, "client1", service.Normalize(clientFolderPath))
+	backupFolderFullPath := filepath.Join(dir, backupFolderPath)
+
+	assert.NoError(t, service.SaveMetadata(storage, &codegen.FolderBackup{
+		BackupFolderPath: &backupFolderPath,
+		ClientFolderPath: &clientFolderPath,
+		ClientID:         lo.ToPtr("client1"),
+	}))
+
+	assert.NoError(t, service.SaveManifest(storage, backupFolderFullPath, &codegen.Manifest{
+		ClientFolderPath: &clientFolderPath,
+		Time:             lo.ToPtr(int64(1681159361000)),
+	}))
+
+	// simulate a crash in the middle of writing metadata
+	assert.NoError(t, createFileWithContent(backupFolderFullPath, common.MetadataFileName, `{"backup_folder_path": "Bac`))
+
+	_, err = service.LoadMetadata(storage, backupFolderFullPath)
+	assert.ErrorIs(t, err, service.ErrMetadataCorrupt)
+
+	backups, err := service.GetBackupsByPath(storage, filepath.Join(dir, common.BackupRootFolder, "client1"), false)
+	assert.NoError(t, err)
+	assert.Len(t, backups, 1)
+	assert.Equal(t, backupFolderPath, *backups[0].BackupFolderPath)
+	assert.Equal(t, "client1", *backups[0].ClientID)
+	assert.Equal(t, clientFolderPath, *backups[0].ClientFolderPath)
+	assert.Equal(t, int64(1681159361000), *backups[0].LastBackupTime)
+
+	// the recovered metadata has been saved
+	backup, err := service.LoadMetadata(storage, backupFolderFullPath)
+	assert.NoError(t, err)
+	assert.Equal(t, clientFolderPath, *backup.ClientFolderPath)
+
+	// and the corrupt one has been kept
+	entries, err := os.ReadDir(filepath.Join(backupFolderFullPath, common.StateFolderName))
+	assert.NoError(t, err)
+	assert.True(t, lo.ContainsBy(entries, func(entry os.DirEntry) bool {
+		return strings.HasPrefix(entry.Name(), common.MetadataFileName+".corrupt-")
+	}))
+}
@@ -0,0 +1,222 @@
+package service
+
+import (
+	"io"
+	"net/http"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/IceWhaleTech/CasaOS-Common/utils/logger"
+	"github.com/IceWhaleTech/IceWhale-Files-Backup/common"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/samber/lo"
+	"go.uber.org/zap"
+)
+
+const (
+	metricsNamespace = "files_backup"
+
+	// storageUsageTTL is how long the storage usage is reused between scrapes, since walking the backup
+	// root is too slow to do on every scrape.
+	storageUsageTTL = 5 * time.Minute
+)
+
+// webDAVMethods are the methods counted by name. Anything else is counted as "other", so clients can't
+// grow the number of series at will.
+var webDAVMethods = []string{
+	http.MethodOptions, http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodDelete,
+	"MKCOL", "COPY", "MOVE", "LOCK", "UNLOCK", "PROPFIND", "PROPPATCH",
+}
+
+var (
+	// MetricsRegistry holds all metrics of the service, to be exposed for Prometheus.
+	MetricsRegistry = prometheus.NewRegistry()
+
+	runsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "runs_total",
+		Help:      "Number of folder backup runs by result, which is started when proceeding, then completed or failed.",
+	}, []string{"result"})
+
+	filesVersionedTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "files_versioned_total",
+		Help:      "Number of files kept as history copies, by whether the file was copied or moved.",
+	}, []string{"mode"})
+
+	filesMovedTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "files_moved_total",
+		Help:      "Number of files moved along with the client, instead of being uploaded again.",
+	})
+
+	filesCopiedTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "files_copied_total",
+		Help:      "Number of files copied on the server from the same content backed up before, instead of being uploaded.",
+	})
+
+	hashedBytesTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "hashed_bytes_total",
+		Help:      "Number of bytes hashed.",
+	})
+
+	hashCacheLookupsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "hash_cache_lookups_total",
+		Help:      "Number of lookups in the hash cache of files, by whether it was a hit or a miss.",
+	}, []string{"result"})
+
+	webDAVRequestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "webdav_requests_total",
+		Help:      "Number of WebDAV requests by method.",
+	}, []string{"method"})
+
+	webDAVBytesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "webdav_bytes_total",
+		Help:      "Number of bytes of WebDAV requests and responses by method and direction, which is in or out.",
+	}, []string{"method", "direction"})
+
+	proceedDurationSeconds = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "proceed_duration_seconds",
+		Help:      "Time taken to proceed a folder backup run, by whether it succeeded.",
+		Buckets:   prometheus.ExponentialBuckets(0.1, 2, 12),
+	}, []string{"result"})
+)
+
+func init() {
+	MetricsRegistry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		runsTotal,
+		filesVersionedTotal,
+		filesMovedTotal,
+		filesCopiedTotal,
+		hashedBytesTotal,
+		hashCacheLookupsTotal,
+		webDAVRequestsTotal,
+		webDAVBytesTotal,
+		proceedDurationSeconds,
+	)
+}
+
+// storageCollector reports the storage used by each client under the backup root.
+type storageCollector struct {
+	backup *BackupService
+	desc   *prometheus.Desc
+
+	mutex     *sync.Mutex
+	usage     map[string]int64
+	usageTime time.Time
+}
+
+// NewStorageCollector returns the collector of the storage used by each client, to be registered once
+// along with the backup service.
+func NewStorageCollector(backup *BackupService) prometheus.Collector {
+	return &storageCollector{
+		backup: backup,
+		desc: prometheus.NewDesc(
+			prometheus.BuildFQName(metricsNamespace, "", "client_storage_bytes"),
+			"Storage used by the folder backups of each client, including history copies.",
+			[]string{"client_id"}, nil,
+		),
+
+		mutex: &sync.Mutex{},
+	}
+}
+
+func (c *storageCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+}
+
+func (c *storageCollector) Collect(ch chan<- prometheus.Metric) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.usage == nil || time.Since(c.usageTime) > storageUsageTTL {
+		usage, err := c.backup.StorageUsage()
+		if err != nil {
+			logger.Error("failed to get storage usage", zap.Error(err))
+			ch <- prometheus.NewInvalidMetric(c.desc, err)
+			return
+		}
+
+		c.usage = usage
+		c.usageTime = time.Now()
+	}
+
+	for clientID, size := range c.usage {
+		ch <- prometheus.MustNewConstMetric(c.desc, prometheus.GaugeValue, float64(size), clientID)
+	}
+}
+
+// StorageUsage returns the bytes used under the backup root by each client.
+func (b *BackupService) StorageUsage() (map[string]int64, error) {
+	entries, err := b.storage.ReadDir(b.backupRoot)
+	if err != nil {
+		return nil, err
+	}
+
+	usage := map[string]int64{}
+
+	for _, entry := range entries {
+		if !entry.IsDir() || entry.Name() == common.StateFolderName {
+			continue
+		}
+
+		size, _, err := b.storage.SizeAndCount(filepath.Join(b.backupRoot, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+
+		usage[entry.Name()] = size
+	}
+
+	return usage, nil
+}
+
+// InstrumentWebDAV counts the requests and bytes handled by the WebDAV handler.
+func InstrumentWebDAV(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		method := lo.Ternary(lo.Contains(webDAVMethods, r.Method), r.Method, "other")
+
+		body := &countingReader{ReadCloser: r.Body}
+		r.Body = body
+
+		writer := &countingResponseWriter{ResponseWriter: w}
+
+		handler.ServeHTTP(writer, r)
+
+		webDAVRequestsTotal.WithLabelValues(method).Inc()
+		webDAVBytesTotal.WithLabelValues(method, "in").Add(float64(body.count))
+		webDAVBytesTotal.WithLabelValues(method, "out").Add(float64(writer.count))
+	})
+}
+
+type countingReader struct {
+	io.ReadCloser
+	count int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.count += int64(n)
+	return n, err
+}
+
+type countingResponseWriter struct {
+	http.ResponseWriter
+	count int64
+}
+
+func (w *countingResponseWriter) Write(p []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(p)
+	w.count += int64(n)
+	return n, err
+}
@@ -0,0 +1,111 @@
+package service_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/IceWhaleTech/IceWhale-Files-Backup/codegen"
+	"github.com/IceWhaleTech/IceWhale-Files-Backup/common"
+	"github.com/IceWhaleTech/IceWhale-Files-Backup/pkg/config"
+	"github.com/IceWhaleTech/IceWhale-Files-Backup/service"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/goleak"
+)
+
+// metricValue returns the value of the counter with the labels, or 0 if it has not been counted yet.
+func metricValue(t *testing.T, name string, labels map[string]string) float64 {
+	families, err := service.MetricsRegistry.Gather()
+	assert.NoError(t, err)
+
+	for _, family := range families {
+		if family.GetName() != name {
+			continue
+		}
+
+		for _, metric := range family.GetMetric() {
+			matched := 0
+			for _, label := range metric.GetLabel() {
+				if labels[label.GetName()] == label.GetValue() {
+					matched++
+				}
+			}
+
+			if matched == len(labels) {
+				return metric.GetCounter().GetValue()
+			}
+		}
+	}
+
+	return 0
+}
+
+func TestMetrics(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	tmpDataRootDir, err := os.MkdirTemp("", "test")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tmpDataRootDir)
+
+	config.AppInfo.DataRootPath = tmpDataRootDir
+
+	clientID := "client1"
+	clientFolderPath := `C:\Users\icewhale\Downloads`
+	backupFolderFullPath := filepath.Join(tmpDataRootDir, common.BackupRootFolder, clientID, service.Normalize(clientFolderPath))
+
+	assert.NoError(t, os.MkdirAll(backupFolderFullPath, 0o755))
+	assert.NoError(t, createFileWithContent(backupFolderFullPath, "changed.txt", "old"))
+	assert.NoError(t, createFileWithContent(backupFolderFullPath, "deleted.txt", "gone"))
+
+	started := metricValue(t, "files_backup_runs_total", map[string]string{"result": "started"})
+	copied := metricValue(t, "files_backup_files_versioned_total", map[string]string{"mode": "copy"})
+	moved := metricValue(t, "files_backup_files_versioned_total", map[string]string{"mode": "move"})
+
+	backupService := service.NewBackupService()
+
+	_, err = backupService.Proceed(codegen.FolderBackup{
+		ClientID:               &clientID,
+		ClientFolderPath:       &clientFolderPath,
+		ClientFolderFileSizes:  &map[string]int64{"changed.txt": 5},
+		ClientFolderFileHashes: &map[string]string{"changed.txt": "hash"},
+	})
+	assert.NoError(t, err)
+
+	assert.Equal(t, started+1, metricValue(t, "files_backup_runs_total", map[string]string{"result": "started"}))
+	assert.Equal(t, copied+1, metricValue(t, "files_backup_files_versioned_total", map[string]string{"mode": "copy"}))
+	assert.Equal(t, moved+1, metricValue(t, "files_backup_files_versioned_total", map[string]string{"mode": "move"}))
+
+	// a run failing to proceed is counted as started and failed
+	failed := metricValue(t, "files_backup_runs_total", map[string]string{"result": "failed"})
+
+	_, err = backupService.Proceed(codegen.FolderBackup{ClientID: &clientID})
+	assert.Error(t, err)
+
+	assert.Equal(t, started+2, metricValue(t, "files_backup_runs_total", map[string]string{"result": "started"}))
+	assert.Equal(t, failed+1, metricValue(t, "files_backup_runs_total", map[string]string{"result": "failed"}))
+
+	// the history copies of both files count, along with the metadata and state of the folder backup
+	usage, err := backupService.StorageUsage()
+	assert.NoError(t, err)
+	assert.Len(t, usage, 1)
+	assert.GreaterOrEqual(t, usage[clientID], int64(len("old")+len("gone")))
+
+	requests := metricValue(t, "files_backup_webdav_requests_total", map[string]string{"method": "PUT"})
+	bytesIn := metricValue(t, "files_backup_webdav_bytes_total", map[string]string{"method": "PUT", "direction": "in"})
+	bytesOut := metricValue(t, "files_backup_webdav_bytes_total", map[string]string{"method": "PUT", "direction": "out"})
+
+	handler := service.InstrumentWebDAV(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		buf := make([]byte, 64)
+		n, _ := r.Body.Read(buf)
+		_, _ = w.Write(buf[:n])
+	}))
+
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPut, "/a.txt", strings.NewReader("content")))
+
+	assert.Equal(t, requests+1, metricValue(t, "files_backup_webdav_requests_total", map[string]string{"method": "PUT"}))
+	assert.Equal(t, bytesIn+7, metricValue(t, "files_backup_webdav_bytes_total", map[string]string{"method": "PUT", "direction": "in"}))
+	assert.Equal(t, bytesOut+7, metricValue(t, "files_backup_webdav_bytes_total", map[string]string{"method": "PUT", "direction": "out"}))
+}
@@ -0,0 +1,240 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/smtp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/IceWhaleTech/CasaOS-Common/utils/logger"
+	"github.com/IceWhaleTech/IceWhale-Files-Backup/codegen"
+	"github.com/IceWhaleTech/IceWhale-Files-Backup/common"
+	"github.com/IceWhaleTech/IceWhale-Files-Backup/model"
+	"github.com/samber/lo"
+	"go.uber.org/zap"
+)
+
+const notificationTimeout = 10 * time.Second
+
+// Notifier tells someone about a folder backup that became unhealthy.
+type Notifier interface {
+	Notify(unhealthy codegen.UnhealthyFolderBackup) error
+}
+
+// Monitor checks the folder backups are backed up in time and succeed, and notifies when they no longer do.
+type Monitor struct {
+	backup    *BackupService
+	config    model.MonitorModel
+	notifiers []Notifier
+
+	mutex *sync.Mutex
+
+	// notified keeps the reasons already notified for each folder backup, so each is notified once
+	// until the folder backup recovers.
+	notified map[string][]codegen.UnhealthyFolderBackupReasons
+}
+
+type webhookNotifier struct {
+	url    string
+	client *http.Client
+}
+
+type emailNotifier struct {
+	address string
+	from    string
+	to      []string
+}
+
+// NewMonitor returns a monitor notifying through the event bus of the backup service, which reaches the
+// event stream and the message bus, and through a webhook and email if they are configured.
+func NewMonitor(backup *BackupService, config model.MonitorModel) *Monitor {
+	notifiers := []Notifier{}
+
+	if config.WebhookURL != "" {
+		notifiers = append(notifiers, &webhookNotifier{
+			url:    config.WebhookURL,
+			client: &http.Client{Timeout: notificationTimeout},
+		})
+	}
+
+	if to := lo.Compact(config.EmailTo); config.SMTPAddress != "" && len(to) > 0 {
+		notifiers = append(notifiers, &emailNotifier{
+			address: config.SMTPAddress,
+			from:    config.EmailFrom,
+			to:      to,
+		})
+	}
+
+	return &Monitor{
+		backup:    backup,
+		config:    config,
+		notifiers: notifiers,
+
+		mutex:    &sync.Mutex{},
+		notified: map[string][]codegen.UnhealthyFolderBackupReasons{},
+	}
+}
+
+// Start checks the folder backups every check interval until the context is done.
+func (m *Monitor) Start(ctx context.Context) {
+	if m.config.CheckInterval <= 0 {
+		logger.Info("check interval is not set, folder backups are not monitored")
+		return
+	}
+
+	ticker := time.NewTicker(m.config.CheckInterval)
+	defer ticker.Stop()
+
+	for {
+		if err := m.CheckAndNotify(ctx); err != nil {
+			logger.Error("failed to check folder backups", zap.Error(err))
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Check returns the folder backups that are overdue or failing.
+func (m *Monitor) Check(ctx context.Context) ([]codegen.UnhealthyFolderBackup, error) {
+	allBackups, err := m.backup.GetAllBackups(ctx, false)
+	if err != nil {
+		return nil, err
+	}
+
+	now := m.backup.clock.Now()
+	unhealthyBackups := []codegen.UnhealthyFolderBackup{}
+
+	for _, backups := range allBackups {
+		for i := range backups {
+			backup := backups[i]
+			unhealthy := codegen.UnhealthyFolderBackup{
+				FolderBackup: &backup,
+				Reasons:      &[]codegen.UnhealthyFolderBackupReasons{},
+			}
+
+			if backup.LastBackupTime != nil {
+				overdueSince := time.UnixMilli(*backup.LastBackupTime).Add(m.config.ExpectedInterval)
+				if now.After(overdueSince) {
+					*unhealthy.Reasons = append(*unhealthy.Reasons, codegen.Overdue)
+					unhealthy.OverdueSince = lo.ToPtr(overdueSince.UnixMilli())
+				}
+			}
+
+			if lo.FromPtr(backup.FailureCount) >= m.config.MaxFailureCount {
+				*unhealthy.Reasons = append(*unhealthy.Reasons, codegen.Failing)
+			}
+
+			if len(*unhealthy.Reasons) > 0 {
+				unhealthyBackups = append(unhealthyBackups, unhealthy)
+			}
+		}
+	}
+
+	sort.Slice(unhealthyBackups, func(i, j int) bool {
+		return *unhealthyBackups[i].FolderBackup.BackupFolderPath < *unhealthyBackups[j].FolderBackup.BackupFolderPath
+	})
+
+	return unhealthyBackups, nil
+}
+
+// CheckAndNotify checks the folder backups and notifies about those that became unhealthy, or
+// unhealthy for another reason, since the last check.
+func (m *Monitor) CheckAndNotify(ctx context.Context) error {
+	unhealthyBackups, err := m.Check(ctx)
+	if err != nil {
+		return err
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	notified := map[string][]codegen.UnhealthyFolderBackupReasons{}
+
+	for _, unhealthy := range unhealthyBackups {
+		backupFolderPath := *unhealthy.FolderBackup.BackupFolderPath
+		notified[backupFolderPath] = *unhealthy.Reasons
+
+		if newReasons, _ := lo.Difference(*unhealthy.Reasons, m.notified[backupFolderPath]); len(newReasons) == 0 {
+			continue
+		}
+
+		logger.Info("folder backup is unhealthy", zap.String("path", backupFolderPath), zap.Any("reasons", *unhealthy.Reasons))
+
+		m.backup.publish(codegen.BackupUnhealthy, backupFolderPath, codegen.BackupEvent{
+			ClientName: unhealthy.FolderBackup.ClientName,
+			Message:    lo.ToPtr(unhealthyMessage(unhealthy)),
+		})
+
+		for _, notifier := range m.notifiers {
+			if err := notifier.Notify(unhealthy); err != nil {
+				logger.Error("failed to notify", zap.String("path", backupFolderPath), zap.Error(err))
+			}
+		}
+	}
+
+	m.notified = notified
+
+	return nil
+}
+
+func (n *webhookNotifier) Notify(unhealthy codegen.UnhealthyFolderBackup) error {
+	buf, err := json.Marshal(unhealthy)
+	if err != nil {
+		return err
+	}
+
+	response, err := n.client.Post(n.url, "application/json", bytes.NewReader(buf))
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode < 200 || response.StatusCode >= 300 {
+		return fmt.Errorf("webhook replied %s", response.Status)
+	}
+
+	return nil
+}
+
+func (n *emailNotifier) Notify(unhealthy codegen.UnhealthyFolderBackup) error {
+	subject := fmt.Sprintf("Backup of %s is unhealthy", lo.FromPtr(unhealthy.FolderBackup.ClientFolderPath))
+
+	var body strings.Builder
+	fmt.Fprintf(&body, "From: %s\r\n", n.from)
+	fmt.Fprintf(&body, "To: %s\r\n", strings.Join(n.to, ", "))
+	fmt.Fprintf(&body, "Subject: %s\r\n", subject)
+	fmt.Fprintf(&body, "Content-Type: text/plain; charset=UTF-8\r\n\r\n")
+	fmt.Fprintf(&body, "Client: %s (%s)\r\n", lo.FromPtr(unhealthy.FolderBackup.ClientName), lo.FromPtr(unhealthy.FolderBackup.ClientID))
+	fmt.Fprintf(&body, "Folder: %s\r\n", lo.FromPtr(unhealthy.FolderBackup.ClientFolderPath))
+	fmt.Fprintf(&body, "Backup: %s\r\n\r\n", lo.FromPtr(unhealthy.FolderBackup.BackupFolderPath))
+	fmt.Fprintf(&body, "%s\r\n\r\n-- \r\n%s %s\r\n", unhealthyMessage(unhealthy), common.FilesBackupServiceName, common.FilesBackupVersion)
+
+	// a local relay is expected, so no authentication
+	return smtp.SendMail(n.address, nil, n.from, n.to, []byte(body.String()))
+}
+
+func unhealthyMessage(unhealthy codegen.UnhealthyFolderBackup) string {
+	messages := []string{}
+
+	for _, reason := range *unhealthy.Reasons {
+		switch reason {
+		case codegen.Overdue:
+			lastBackupTime := time.UnixMilli(lo.FromPtr(unhealthy.FolderBackup.LastBackupTime))
+			messages = append(messages, fmt.Sprintf("not backed up since %s", lastBackupTime.Format(time.RFC1123)))
+		case codegen.Failing:
+			messages = append(messages, fmt.Sprintf("last %d runs failed", lo.FromPtr(unhealthy.FolderBackup.FailureCount)))
+		}
+	}
+
+	return strings.Join(messages, ", ")
+}
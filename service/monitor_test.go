@@ -0,0 +1,94 @@
+package service_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/IceWhaleTech/IceWhale-Files-Backup/codegen"
+	"github.com/IceWhaleTech/IceWhale-Files-Backup/common"
+	"github.com/IceWhaleTech/IceWhale-Files-Backup/model"
+	"github.com/IceWhaleTech/IceWhale-Files-Backup/pkg/config"
+	"github.com/IceWhaleTech/IceWhale-Files-Backup/service"
+	"github.com/samber/lo"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/goleak"
+)
+
+func TestMonitor(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	tmpDataRootDir, err := os.MkdirTemp("", "test")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tmpDataRootDir)
+
+	storage := service.NewLocalStorage(tmpDataRootDir)
+
+	config.AppInfo.DataRootPath = tmpDataRootDir
+
+	var mutex sync.Mutex
+	notifications := []codegen.UnhealthyFolderBackup{}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var unhealthy codegen.UnhealthyFolderBackup
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&unhealthy))
+
+		mutex.Lock()
+		notifications = append(notifications, unhealthy)
+		mutex.Unlock()
+	}))
+	defer server.Close()
+
+	// a time long past, so the monitor can only tell overdue backups by the clock it is given
+	now := time.Date(2023, 4, 10, 12, 0, 0, 0, time.UTC)
+
+	saveBackup := func(clientFolderPath string, lastBackupTime time.Time, failureCount int) {
+		assert.NoError(t, service.SaveMetadata(storage, &codegen.FolderBackup{
+			ClientID:         lo.ToPtr("client1"),
+			ClientFolderPath: &clientFolderPath,
+			BackupFolderPath: lo.ToPtr(filepath.Join(common.BackupRootFolder, "client1", clientFolderPath)),
+			LastBackupTime:   lo.ToPtr(lastBackupTime.UnixMilli()),
+			FailureCount:     &failureCount,
+		}))
+	}
+
+	saveBackup("healthy", now.Add(-time.Hour), 0)
+	saveBackup("overdue", now.Add(-48*time.Hour), 0)
+	saveBackup("failing", now.Add(-time.Hour), 3)
+
+	monitor := service.NewMonitor(service.NewBackupServiceWith(storage, &fixedClock{now: now}), model.MonitorModel{
+		ExpectedInterval: 24 * time.Hour,
+		MaxFailureCount:  3,
+		WebhookURL:       server.URL,
+	})
+
+	unhealthyBackups, err := monitor.Check(context.Background())
+	assert.NoError(t, err)
+	assert.Len(t, unhealthyBackups, 2)
+
+	assert.Equal(t, "failing", *unhealthyBackups[0].FolderBackup.ClientFolderPath)
+	assert.Equal(t, []codegen.UnhealthyFolderBackupReasons{codegen.Failing}, *unhealthyBackups[0].Reasons)
+
+	assert.Equal(t, "overdue", *unhealthyBackups[1].FolderBackup.ClientFolderPath)
+	assert.Equal(t, []codegen.UnhealthyFolderBackupReasons{codegen.Overdue}, *unhealthyBackups[1].Reasons)
+	assert.Equal(t, now.Add(-24*time.Hour).UnixMilli(), *unhealthyBackups[1].OverdueSince)
+
+	// each is notified once until it recovers
+	assert.NoError(t, monitor.CheckAndNotify(context.Background()))
+	assert.NoError(t, monitor.CheckAndNotify(context.Background()))
+	assert.Len(t, notifications, 2)
+
+	saveBackup("overdue", now, 0)
+	assert.NoError(t, monitor.CheckAndNotify(context.Background()))
+	assert.Len(t, notifications, 2)
+
+	saveBackup("overdue", now.Add(-48*time.Hour), 0)
+	assert.NoError(t, monitor.CheckAndNotify(context.Background()))
+	assert.Len(t, notifications, 3)
+}
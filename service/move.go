@@ -0,0 +1,118 @@
+package service
+
+import (
+	"path/filepath"
+	"sort"
+
+	"github.com/IceWhaleTech/CasaOS-Common/utils/logger"
+	"github.com/IceWhaleTech/IceWhale-Files-Backup/codegen"
+	"go.uber.org/zap"
+)
+
+// move is a file the client has moved or renamed since the last run, found by its content.
+type move struct {
+	file            string
+	relativePath    string
+	newRelativePath string
+}
+
+// findMoves matches the files the client no longer has with the files new to the folder backup, by size
+// first and then by hash, so files moved or renamed by the client can be moved along instead of being
+// kept as history copies and uploaded again. The versionings not turned into moves are returned as well.
+func findMoves(storage Storage, backup *codegen.FolderBackup, clientFileMap map[string]string, existingFiles map[string]bool, versionings []versioning) ([]move, []versioning, error) {
+	newFilesBySize := map[int64][]string{}
+	for relativePath, clientFile := range clientFileMap {
+		if !existingFiles[relativePath] {
+			size := (*backup.ClientFolderFileSizes)[clientFile]
+			newFilesBySize[size] = append(newFilesBySize[size], relativePath)
+		}
+	}
+
+	if len(newFilesBySize) == 0 {
+		return nil, versionings, nil
+	}
+
+	for _, newFiles := range newFilesBySize {
+		sort.Strings(newFiles)
+	}
+
+	moves := []move{}
+	remaining := []versioning{}
+	claimed := map[string]bool{}
+
+	for _, v := range versionings {
+		if !v.deleted {
+			remaining = append(remaining, v)
+			continue
+		}
+
+		fileInfo, err := storage.Stat(v.file)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		newFiles := newFilesBySize[fileInfo.Size()]
+		if len(newFiles) == 0 {
+			remaining = append(remaining, v)
+			continue
+		}
+
+		fileHash, err := FileHash(storage, v.file)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		found := false
+		for _, newRelativePath := range newFiles {
+			if claimed[newRelativePath] || (*backup.ClientFolderFileHashes)[clientFileMap[newRelativePath]] != fileHash {
+				continue
+			}
+
+			claimed[newRelativePath] = true
+			moves = append(moves, move{file: v.file, relativePath: v.relativePath, newRelativePath: newRelativePath})
+			found = true
+			break
+		}
+
+		if !found {
+			remaining = append(remaining, v)
+		}
+	}
+
+	return moves, remaining, nil
+}
+
+// applyMove moves the file to where the client has it now, and removes the folders it leaves empty.
+func (b *BackupService) applyMove(backupFolderPath, backupFolderFullPath string, m move) error {
+	newFile := filepath.Join(backupFolderFullPath, m.newRelativePath)
+
+	if err := b.storage.MkdirAll(filepath.Dir(newFile), 0o755); err != nil {
+		return err
+	}
+
+	if err := b.storage.Rename(m.file, newFile); err != nil {
+		return err
+	}
+
+	logger.Info("file has been moved along with the client", zap.String("file", m.file), zap.String("new_file", newFile))
+
+	filesMovedTotal.Inc()
+
+	b.updateIndex(func(index *Index) error {
+		return index.DeleteFile(backupFolderPath, m.relativePath)
+	})
+
+	for dir := filepath.Dir(m.file); dir != backupFolderFullPath && len(dir) > len(backupFolderFullPath); dir = filepath.Dir(dir) {
+		entries, err := b.storage.ReadDir(dir)
+		if err != nil || len(entries) > 0 {
+			break
+		}
+
+		if err := b.storage.Remove(dir); err != nil {
+			logger.Error("failed to remove empty folder", zap.String("path", dir), zap.Error(err))
+			break
+		}
+	}
+
+	return nil
+}
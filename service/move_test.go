@@ -0,0 +1,82 @@
+package service_test
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/IceWhaleTech/IceWhale-Files-Backup/codegen"
+	"github.com/IceWhaleTech/IceWhale-Files-Backup/common"
+	"github.com/IceWhaleTech/IceWhale-Files-Backup/service"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/goleak"
+)
+
+func TestProceedWithMoves(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	tmpDataRootDir, err := os.MkdirTemp("", "test")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tmpDataRootDir)
+
+	storage := service.NewLocalStorage(tmpDataRootDir)
+
+	clientID := "client1"
+	clientFolderPath := "/home/icewhale/Documents"
+
+	backupFolderFullPath := filepath.Join(tmpDataRootDir, common.BackupRootFolder, clientID, service.Normalize(clientFolderPath))
+	assert.NoError(t, os.MkdirAll(filepath.Join(backupFolderFullPath, "Photos", "2023"), 0o755))
+
+	// files from the last backup
+	assert.NoError(t, createFileWithContent(filepath.Join(backupFolderFullPath, "Photos", "2023"), "a.jpg", "photo a"))
+	assert.NoError(t, createFileWithContent(filepath.Join(backupFolderFullPath, "Photos", "2023"), "b.jpg", "photo b"))
+	assert.NoError(t, createFileWithContent(backupFolderFullPath, "notes.txt", "old notes"))
+
+	// the client has renamed the folder of photos, and renamed the notes after changing them
+	clientFiles := map[string]string{
+		"/home/icewhale/Documents/Pictures/2023/a.jpg": "photo a",
+		"/home/icewhale/Documents/Pictures/2023/b.jpg": "photo b",
+		"/home/icewhale/Documents/notes-2023.txt":      "new notes",
+	}
+
+	sizes := map[string]int64{}
+	hashes := map[string]string{}
+	for name, content := range clientFiles {
+		hash, err := service.XXHashReader(strings.NewReader(content))
+		assert.NoError(t, err)
+
+		sizes[name] = int64(len(content))
+		hashes[name] = hash
+	}
+
+	backupService := service.NewBackupServiceWith(storage, service.SystemClock)
+
+	backup, err := backupService.Proceed(codegen.FolderBackup{
+		ClientID:               &clientID,
+		ClientFolderPath:       &clientFolderPath,
+		ClientFolderFileSizes:  &sizes,
+		ClientFolderFileHashes: &hashes,
+	})
+	assert.NoError(t, err)
+
+	// moved files are up to date, so only the changed notes are expected
+	assert.Equal(t, []string{"/home/icewhale/Documents/Pictures/2023/a.jpg", "/home/icewhale/Documents/Pictures/2023/b.jpg"}, *backup.SatisfiedFiles)
+
+	run, err := service.LoadRun(storage, backupFolderFullPath)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"notes-2023.txt"}, run.PendingFiles)
+
+	entries, err := os.ReadDir(filepath.Join(backupFolderFullPath, "Pictures", "2023"))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a.jpg", "b.jpg"}, entryNames(entries))
+
+	// the folder left empty is gone, while the notes are kept as a history copy
+	_, err = os.Stat(filepath.Join(backupFolderFullPath, "Photos"))
+	assert.True(t, os.IsNotExist(err))
+
+	entries, err = os.ReadDir(backupFolderFullPath)
+	assert.NoError(t, err)
+	assert.Len(t, entries, 4)
+	assert.True(t, strings.HasPrefix(entryNames(entries)[3], "notes-backup-"), entryNames(entries))
+}
@@ -0,0 +1,383 @@
+package service
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/IceWhaleTech/IceWhale-Files-Backup/codegen"
+	"github.com/IceWhaleTech/IceWhale-Files-Backup/common"
+	"github.com/samber/lo"
+	"golang.org/x/text/cases"
+	"golang.org/x/text/unicode/norm"
+)
+
+var (
+	ErrInvalidPathPolicy = errors.New("invalid path policy")
+	ErrReservedPath      = errors.New("path is reserved")
+)
+
+// windowsReservedName matches the device names Windows reserves, with or without an extension.
+var windowsReservedName = regexp.MustCompile(`(?i)^(con|prn|aux|nul|com[1-9]|lpt[1-9])(\..*)?$`)
+
+// clientSettings is what is kept in common.ClientFileName for each client.
+type clientSettings struct {
+	PathPolicy codegen.PathPolicy `json:"path_policy"`
+}
+
+// clientPaths maps the paths given by a client for one of its folders to where the files are kept, following
+// the path policy of the client.
+type clientPaths struct {
+	policy codegen.PathPolicy
+
+	// clientFolderPath is the folder path as given by the client, normalized
+	clientFolderPath string
+
+	// backupFolderPath is relative to the data root, naming the existing folder backup if there is one
+	backupFolderPath     string
+	backupFolderFullPath string
+
+	resolver *pathResolver
+}
+
+// pathResolver looks up existing files and folders by their names as compared under the path policy, so a
+// path differing only in case or in Unicode normalization refers to the existing file instead of a new one.
+// The names of each folder are read once, so a resolver is meant for a single operation.
+type pathResolver struct {
+	storage Storage
+	policy  codegen.PathPolicy
+
+	// folders keeps the names in each folder read so far, or nil for a missing folder
+	folders map[string]*resolvedFolder
+}
+
+type resolvedFolder struct {
+	names map[string]bool
+
+	// byKey keeps the first name of each key, since names differing only in how they are written might
+	// have been kept before the policy was set
+	byKey map[string]string
+}
+
+// PathPolicyOf returns the path policy for a client of the given type, for when it doesn't tell its own.
+func PathPolicyOf(clientType string) codegen.PathPolicy {
+	switch strings.ToLower(clientType) {
+	case "windows":
+		return codegen.Windows
+	case "macos", "darwin":
+		return codegen.Macos
+	default:
+		return codegen.Posix
+	}
+}
+
+// NormalizePath converts the path as Normalize does, and composes Unicode characters under the policies
+// comparing names regardless of Unicode normalization.
+func NormalizePath(policy codegen.PathPolicy, path string) string {
+	path = Normalize(path)
+
+	if policy != codegen.Posix {
+		path = norm.NFC.String(path)
+	}
+
+	return path
+}
+
+// pathKey returns what the name is compared by under the policy.
+func pathKey(policy codegen.PathPolicy, name string) string {
+	if policy == codegen.Posix {
+		return name
+	}
+
+	// a caser keeps state, so it can't be shared between goroutines
+	return cases.Fold().String(norm.NFC.String(name))
+}
+
+// CheckPath returns ErrReservedPath if any name in the path, relative to the client, can't be kept under
+// the policy: names of files kept by the service, and under the windows policy names Windows reserves.
+func CheckPath(policy codegen.PathPolicy, relativePath string) error {
+	metadataKey := pathKey(policy, common.MetadataFileName)
+
+	for _, name := range strings.Split(relativePath, "/") {
+		if strings.HasPrefix(pathKey(policy, name), metadataKey) {
+			return fmt.Errorf("%w: %s is kept by the service", ErrReservedPath, name)
+		}
+
+		if policy != codegen.Windows {
+			continue
+		}
+
+		if windowsReservedName.MatchString(name) {
+			return fmt.Errorf("%w: %s is reserved by Windows", ErrReservedPath, name)
+		}
+
+		if strings.ContainsAny(name, `<>:"|?*`) || strings.IndexFunc(name, func(r rune) bool { return r < 0x20 }) >= 0 {
+			return fmt.Errorf("%w: %s has characters Windows doesn't allow", ErrReservedPath, name)
+		}
+	}
+
+	return nil
+}
+
+func newPathResolver(storage Storage, policy codegen.PathPolicy) *pathResolver {
+	return &pathResolver{
+		storage: storage,
+		policy:  policy,
+		folders: map[string]*resolvedFolder{},
+	}
+}
+
+// resolve returns the path relative to the folder, separated by /, with the names of the files and folders
+// already there. Names not found are kept as they are given.
+func (r *pathResolver) resolve(folderFullPath, relativePath string) string {
+	if r.policy == codegen.Posix || relativePath == "" {
+		return relativePath
+	}
+
+	names := strings.Split(relativePath, "/")
+	current := folderFullPath
+
+	for i, name := range names {
+		folder := r.folder(current)
+		if folder == nil {
+			// nothing further down exists either
+			break
+		}
+
+		// a name kept exactly as given is preferred over others compared equal to it
+		if !folder.names[name] {
+			if existing, ok := folder.byKey[pathKey(r.policy, name)]; ok {
+				names[i] = existing
+			}
+		}
+
+		current = filepath.Join(current, names[i])
+	}
+
+	return strings.Join(names, "/")
+}
+
+func (r *pathResolver) folder(folderFullPath string) *resolvedFolder {
+	if folder, ok := r.folders[folderFullPath]; ok {
+		return folder
+	}
+
+	var folder *resolvedFolder
+
+	if entries, err := r.storage.ReadDir(folderFullPath); err == nil {
+		folder = &resolvedFolder{names: map[string]bool{}, byKey: map[string]string{}}
+
+		for _, entry := range entries {
+			folder.names[entry.Name()] = true
+
+			key := pathKey(r.policy, entry.Name())
+			if _, ok := folder.byKey[key]; !ok {
+				folder.byKey[key] = entry.Name()
+			}
+		}
+	}
+
+	r.folders[folderFullPath] = folder
+
+	return folder
+}
+
+// relativePath returns the path of the client file relative to the folder backup, as kept by the storage.
+func (p *clientPaths) relativePath(clientFile string) string {
+	return p.resolver.resolve(p.backupFolderFullPath, p.clientRelativePath(clientFile))
+}
+
+// clientRelativePath returns the path of the client file relative to the client folder, as given by the
+// client, comparing the client folder by the policy.
+func (p *clientPaths) clientRelativePath(clientFile string) string {
+	if p.policy == codegen.Posix {
+		return RelativeClientFilePath(p.clientFolderPath, clientFile)
+	}
+
+	clientFileNormalized := strings.TrimLeft(NormalizePath(p.policy, clientFile), "/")
+	folderNames := strings.Split(strings.Trim(p.clientFolderPath, "/"), "/")
+	fileNames := strings.Split(clientFileNormalized, "/")
+
+	if len(fileNames) > len(folderNames) && lo.EveryBy(lo.Range(len(folderNames)), func(i int) bool {
+		return pathKey(p.policy, folderNames[i]) == pathKey(p.policy, fileNames[i])
+	}) {
+		fileNames = fileNames[len(folderNames):]
+	}
+
+	return strings.Join(fileNames, "/")
+}
+
+// clientPathsOf returns the paths of the client folder under the path policy of the client.
+func (b *BackupService) clientPathsOf(clientID, clientFolderPath string) *clientPaths {
+	return b.clientPathsWith(clientID, clientFolderPath, b.pathPolicy(clientID))
+}
+
+func (b *BackupService) clientPathsWith(clientID, clientFolderPath string, policy codegen.PathPolicy) *clientPaths {
+	resolver := newPathResolver(b.storage, policy)
+	clientFolderPathNormalized := NormalizePath(policy, clientFolderPath)
+
+	backupFolderPath := filepath.Join(
+		common.BackupRootFolder,
+		clientID,
+		resolver.resolve(filepath.Join(b.backupRoot, clientID), strings.Trim(clientFolderPathNormalized, "/")),
+	)
+
+	return &clientPaths{
+		policy:               policy,
+		clientFolderPath:     clientFolderPathNormalized,
+		backupFolderPath:     backupFolderPath,
+		backupFolderFullPath: filepath.Join(b.storage.Root(), backupFolderPath),
+		resolver:             resolver,
+	}
+}
+
+// clientPathsAt returns the paths of the client folder backed up at the folder backup, given relative to the
+// data root, where there is no need to look the folder backup up.
+func (b *BackupService) clientPathsAt(backupFolderPath, clientFolderPath string) *clientPaths {
+	policy := codegen.Posix
+
+	// folder backups are under the folder of the client, under the backup root
+	if parts := strings.Split(filepath.ToSlash(backupFolderPath), "/"); len(parts) > 2 {
+		policy = b.pathPolicy(parts[1])
+	}
+
+	return &clientPaths{
+		policy:               policy,
+		clientFolderPath:     NormalizePath(policy, clientFolderPath),
+		backupFolderPath:     backupFolderPath,
+		backupFolderFullPath: filepath.Join(b.storage.Root(), backupFolderPath),
+		resolver:             newPathResolver(b.storage, policy),
+	}
+}
+
+// pathPolicy returns the path policy of the client, which is posix unless the client has been given another.
+func (b *BackupService) pathPolicy(clientID string) codegen.PathPolicy {
+	b.pathPolicyMutex.Lock()
+	defer b.pathPolicyMutex.Unlock()
+
+	if policy, ok := b.pathPolicies[clientID]; ok {
+		return policy
+	}
+
+	policy := codegen.Posix
+
+	if settings, err := b.loadClientSettings(clientID); err == nil && settings.PathPolicy != "" {
+		policy = settings.PathPolicy
+	}
+
+	b.pathPolicies[clientID] = policy
+
+	return policy
+}
+
+// pathPolicyFor returns the path policy the folder backup is to be run with: the one it tells, otherwise the
+// one kept for the client, otherwise the default for the type of the client.
+func (b *BackupService) pathPolicyFor(backup *codegen.FolderBackup) (codegen.PathPolicy, error) {
+	if backup.PathPolicy != nil {
+		if !lo.Contains([]codegen.PathPolicy{codegen.Posix, codegen.Windows, codegen.Macos}, *backup.PathPolicy) {
+			return "", fmt.Errorf("%w: %s", ErrInvalidPathPolicy, *backup.PathPolicy)
+		}
+
+		return *backup.PathPolicy, nil
+	}
+
+	if settings, err := b.loadClientSettings(*backup.ClientID); err == nil && settings.PathPolicy != "" {
+		return settings.PathPolicy, nil
+	}
+
+	return PathPolicyOf(lo.FromPtr(backup.ClientType)), nil
+}
+
+// setPathPolicy keeps the path policy for the client, applying to all its folder backups from now on.
+func (b *BackupService) setPathPolicy(clientID string, policy codegen.PathPolicy) error {
+	b.pathPolicyMutex.Lock()
+	defer b.pathPolicyMutex.Unlock()
+
+	settings, err := b.loadClientSettings(clientID)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			return err
+		}
+		settings = &clientSettings{}
+	}
+
+	if settings.PathPolicy != policy {
+		settings.PathPolicy = policy
+
+		buf, err := json.Marshal(settings)
+		if err != nil {
+			return err
+		}
+
+		stateFolderPath := filepath.Join(b.backupRoot, clientID, common.StateFolderName)
+		if err := b.storage.MkdirAll(stateFolderPath, 0o755); err != nil {
+			return err
+		}
+
+		if err := b.storage.WriteFile(filepath.Join(stateFolderPath, common.ClientFileName), buf, 0o644); err != nil {
+			return err
+		}
+	}
+
+	b.pathPolicies[clientID] = policy
+
+	return nil
+}
+
+// deleteClientIfUnused deletes the folder of the client along with its settings, such as its path policy, if
+// nothing else is left in it, so a client whose folder backups are all deleted is gone.
+func (b *BackupService) deleteClientIfUnused(clientID string) error {
+	b.pathPolicyMutex.Lock()
+	defer b.pathPolicyMutex.Unlock()
+
+	clientFolderPath := filepath.Join(b.backupRoot, clientID)
+
+	entries, err := b.storage.ReadDir(clientFolderPath)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		if entry.Name() != common.StateFolderName {
+			return nil
+		}
+
+		// e.g. uploads in progress
+		stateEntries, err := b.storage.ReadDir(filepath.Join(clientFolderPath, common.StateFolderName))
+		if err != nil {
+			return err
+		}
+
+		for _, stateEntry := range stateEntries {
+			if stateEntry.Name() != common.ClientFileName {
+				return nil
+			}
+		}
+	}
+
+	if err := b.storage.RemoveAll(clientFolderPath); err != nil {
+		return err
+	}
+
+	delete(b.pathPolicies, clientID)
+
+	return nil
+}
+
+func (b *BackupService) loadClientSettings(clientID string) (*clientSettings, error) {
+	buf, err := b.storage.ReadFile(filepath.Join(b.backupRoot, clientID, common.StateFolderName, common.ClientFileName))
+	if err != nil {
+		return nil, err
+	}
+
+	var settings clientSettings
+	if err := json.Unmarshal(buf, &settings); err != nil {
+		return nil, err
+	}
+
+	return &settings, nil
+}
@@ -0,0 +1,236 @@
+package service_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/IceWhaleTech/IceWhale-Files-Backup/codegen"
+	"github.com/IceWhaleTech/IceWhale-Files-Backup/common"
+	"github.com/IceWhaleTech/IceWhale-Files-Backup/service"
+	"github.com/samber/lo"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/goleak"
+	"golang.org/x/net/webdav"
+)
+
+func TestCheckPath(t *testing.T) {
+	assert.Equal(t, codegen.Windows, service.PathPolicyOf("Windows"))
+	assert.Equal(t, codegen.Macos, service.PathPolicyOf("macOS"))
+	assert.Equal(t, codegen.Posix, service.PathPolicyOf("Linux"))
+
+	for _, path := range []string{"a.txt", "Documents/CONSOLE.txt", "Documents/com0"} {
+		assert.NoError(t, service.CheckPath(codegen.Windows, path), path)
+	}
+
+	for _, path := range []string{"CON", "Documents/nul.txt", "Documents/Lpt1", "a?.txt", `say "hi".txt`, "a/.ZIMA_BACKUP.d/x"} {
+		assert.ErrorIs(t, service.CheckPath(codegen.Windows, path), service.ErrReservedPath, path)
+	}
+
+	// only names of the service are reserved otherwise, as compared under the policy
+	assert.NoError(t, service.CheckPath(codegen.Posix, "CON/a?.txt"))
+	assert.NoError(t, service.CheckPath(codegen.Posix, ".ZIMA_BACKUP"))
+	assert.ErrorIs(t, service.CheckPath(codegen.Posix, ".zima_backup"), service.ErrReservedPath)
+	assert.ErrorIs(t, service.CheckPath(codegen.Macos, ".Zima_Backup"), service.ErrReservedPath)
+}
+
+func TestProceedWithPathPolicy(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	storage := service.NewMemoryStorage("/DATA", service.SystemClock)
+	assert.NoError(t, storage.MkdirAll(filepath.Join(storage.Root(), common.BackupRootFolder), 0o755))
+
+	backupService := service.NewBackupServiceWith(storage, service.SystemClock)
+
+	request := func(clientID, clientType, clientFolderPath string, clientFiles map[string]string) codegen.FolderBackup {
+		sizes := map[string]int64{}
+		hashes := map[string]string{}
+		for name, content := range clientFiles {
+			hash, err := service.XXHashReader(strings.NewReader(content))
+			assert.NoError(t, err)
+
+			sizes[name] = int64(len(content))
+			hashes[name] = hash
+		}
+
+		return codegen.FolderBackup{
+			ClientID:               &clientID,
+			ClientType:             lo.EmptyableToPtr(clientType),
+			ClientFolderPath:       &clientFolderPath,
+			ClientFolderFileSizes:  &sizes,
+			ClientFolderFileHashes: &hashes,
+		}
+	}
+
+	pendingFiles := func(backup *codegen.FolderBackup) []string {
+		run, err := service.LoadRun(storage, filepath.Join(storage.Root(), *backup.BackupFolderPath))
+		assert.NoError(t, err)
+		return run.PendingFiles
+	}
+
+	// a Windows client changing the case of its folder keeps backing up into the same folder backup
+	backup, err := backupService.Proceed(request("client1", "Windows", `C:\Users\icewhale\Downloads`, map[string]string{
+		`C:\Users\icewhale\Downloads\Report.docx`: "report",
+	}))
+	assert.NoError(t, err)
+	assert.Equal(t, codegen.Windows, *backup.PathPolicy)
+	assert.Equal(t, []string{"Report.docx"}, pendingFiles(backup))
+
+	backupFolderPath := *backup.BackupFolderPath
+	assert.NoError(t, storage.WriteFile(filepath.Join(storage.Root(), backupFolderPath, "Report.docx"), []byte("report"), 0o644))
+
+	verification, err := backupService.Complete("client1", `C:\Users\icewhale\Downloads`)
+	assert.NoError(t, err)
+	assert.True(t, *verification.Succeeded)
+
+	backup, err = backupService.Proceed(request("client1", "", `c:\users\icewhale\downloads`, map[string]string{
+		`c:\users\icewhale\downloads\REPORT.DOCX`: "report",
+	}))
+	assert.NoError(t, err)
+	assert.Equal(t, codegen.Windows, *backup.PathPolicy)
+	assert.Equal(t, backupFolderPath, *backup.BackupFolderPath)
+	assert.Empty(t, pendingFiles(backup))
+
+	verification, err = backupService.Complete("client1", `C:\USERS\icewhale\Downloads`)
+	assert.NoError(t, err)
+	assert.True(t, *verification.Succeeded)
+
+	exists, err := backupService.IsBackupExists("client1", `c:\Users\IceWhale\downloads`)
+	assert.NoError(t, err)
+	assert.True(t, exists)
+
+	entries, err := storage.ReadDir(filepath.Join(storage.Root(), common.BackupRootFolder, "client1"))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{common.StateFolderName, "C"}, entryNames(entries))
+
+	// names Windows reserves are turned down
+	_, err = backupService.Proceed(request("client1", "", `C:\Users\icewhale\Downloads`, map[string]string{
+		`C:\Users\icewhale\Downloads\CON.txt`: "console",
+	}))
+	assert.ErrorIs(t, err, service.ErrReservedPath)
+
+	_, err = backupService.Proceed(codegen.FolderBackup{
+		ClientID:               lo.ToPtr("client1"),
+		ClientFolderPath:       lo.ToPtr(`C:\Users\icewhale\Downloads`),
+		ClientFolderFileSizes:  &map[string]int64{},
+		ClientFolderFileHashes: &map[string]string{},
+		PathPolicy:             lo.ToPtr(codegen.PathPolicy("dos")),
+	})
+	assert.ErrorIs(t, err, service.ErrInvalidPathPolicy)
+
+	// names from macOS in decomposed form refer to the files kept in composed form
+	backup, err = backupService.Proceed(request("client2", "macOS", "/Users/icewhale/Documents", map[string]string{
+		"/Users/icewhale/Documents/Caf\u00e9.txt": "coffee",
+	}))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"Caf\u00e9.txt"}, pendingFiles(backup))
+	assert.NoError(t, storage.WriteFile(filepath.Join(storage.Root(), *backup.BackupFolderPath, "Caf\u00e9.txt"), []byte("coffee"), 0o644))
+
+	backup, err = backupService.Proceed(request("client2", "macOS", "/Users/icewhale/Documents", map[string]string{
+		"/Users/icewhale/Documents/Cafe\u0301.txt": "coffee",
+	}))
+	assert.NoError(t, err)
+	assert.Empty(t, pendingFiles(backup))
+
+	// paths stay case sensitive for other clients
+	backup, err = backupService.Proceed(request("client3", "Linux", "/home/icewhale/Documents", map[string]string{
+		"/home/icewhale/Documents/a.txt": "a",
+		"/home/icewhale/Documents/A.txt": "A",
+	}))
+	assert.NoError(t, err)
+	assert.Equal(t, codegen.Posix, *backup.PathPolicy)
+	assert.Equal(t, []string{"A.txt", "a.txt"}, pendingFiles(backup))
+}
+
+func TestDeleteLastFolderBackupOfClient(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	storage := service.NewMemoryStorage("/DATA", service.SystemClock)
+	backupService := service.NewBackupServiceWith(storage, service.SystemClock)
+
+	request := func(clientType, clientFolderPath string) codegen.FolderBackup {
+		return codegen.FolderBackup{
+			ClientID:               lo.ToPtr("client1"),
+			ClientType:             lo.ToPtr(clientType),
+			ClientFolderPath:       lo.ToPtr(clientFolderPath),
+			ClientFolderFileSizes:  &map[string]int64{},
+			ClientFolderFileHashes: &map[string]string{},
+		}
+	}
+
+	for _, clientFolderPath := range []string{`C:\Users\icewhale\Downloads`, `C:\Users\icewhale\Documents`} {
+		backup, err := backupService.Proceed(request("Windows", clientFolderPath))
+		assert.NoError(t, err)
+		assert.Equal(t, codegen.Windows, *backup.PathPolicy)
+	}
+
+	// the client is kept along with its settings while it has folder backups
+	assert.NoError(t, backupService.DeleteBackupsByClientID(context.Background(), "client1", `C:\Users\icewhale\Downloads`))
+
+	exists, err := backupService.IsClientIDExists("client1")
+	assert.NoError(t, err)
+	assert.True(t, exists)
+
+	assert.NoError(t, backupService.DeleteBackupsByClientID(context.Background(), "client1", `C:\Users\icewhale\Documents`))
+
+	exists, err = backupService.IsClientIDExists("client1")
+	assert.NoError(t, err)
+	assert.False(t, exists)
+
+	// so the same client ID starts over, e.g. when reused by another device
+	backup, err := backupService.Proceed(request("Linux", "/home/icewhale/Documents"))
+	assert.NoError(t, err)
+	assert.Equal(t, codegen.Posix, *backup.PathPolicy)
+}
+
+func TestWebDAVWithPathPolicy(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	storage := service.NewMemoryStorage("/DATA", service.SystemClock)
+	assert.NoError(t, storage.MkdirAll(filepath.Join(storage.Root(), common.BackupRootFolder), 0o755))
+
+	backupService := service.NewBackupServiceWith(storage, service.SystemClock)
+
+	backup, err := backupService.Proceed(codegen.FolderBackup{
+		ClientID:               lo.ToPtr("client1"),
+		ClientType:             lo.ToPtr("Windows"),
+		ClientFolderPath:       lo.ToPtr(`C:\Users\icewhale\Downloads`),
+		ClientFolderFileSizes:  &map[string]int64{},
+		ClientFolderFileHashes: &map[string]string{},
+	})
+	assert.NoError(t, err)
+
+	handler := &webdav.Handler{
+		FileSystem: backupService.WebDAVFileSystem(),
+		LockSystem: backupService.WebDAVLockSystem(time.Second),
+	}
+
+	put := func(name string) int {
+		request := httptest.NewRequest(http.MethodPut, "/"+common.BackupRootFolder+"/client1/"+name, strings.NewReader(name))
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, request)
+		return recorder.Code
+	}
+
+	assert.Equal(t, http.StatusCreated, put("c/users/icewhale/DOWNLOADS/a.txt"))
+	assert.Equal(t, http.StatusCreated, put("C/Users/icewhale/Downloads/A.TXT"))
+
+	entries, err := storage.ReadDir(filepath.Join(storage.Root(), *backup.BackupFolderPath))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{common.MetadataFileName, common.StateFolderName, "a.txt"}, entryNames(entries))
+
+	data, err := storage.ReadFile(filepath.Join(storage.Root(), *backup.BackupFolderPath, "a.txt"))
+	assert.NoError(t, err)
+	assert.Equal(t, "C/Users/icewhale/Downloads/A.TXT", string(data))
+
+	// neither names Windows reserves nor files of the service can be written
+	assert.NotEqual(t, http.StatusCreated, put("C/Users/icewhale/Downloads/aux.txt"))
+	assert.NotEqual(t, http.StatusCreated, put("C/Users/icewhale/Downloads/.Zima_Backup"))
+
+	_, err = storage.Stat(filepath.Join(storage.Root(), *backup.BackupFolderPath, "aux.txt"))
+	assert.Error(t, err)
+}
@@ -0,0 +1,13 @@
+package service
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// cloneFile makes dst share the data of src, on file systems supporting it such as Btrfs and XFS, so
+// copying takes no time nor space until either file is changed.
+func cloneFile(dst, src *os.File) error {
+	return unix.IoctlFileClone(int(dst.Fd()), int(src.Fd()))
+}
@@ -0,0 +1,12 @@
+//go:build !linux
+
+package service
+
+import (
+	"errors"
+	"os"
+)
+
+func cloneFile(dst, src *os.File) error {
+	return errors.New("cloning files is not supported")
+}
@@ -0,0 +1,431 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/IceWhaleTech/CasaOS-Common/utils/logger"
+	"github.com/IceWhaleTech/IceWhale-Files-Backup/codegen"
+	"github.com/IceWhaleTech/IceWhale-Files-Backup/common"
+	"github.com/IceWhaleTech/IceWhale-Files-Backup/internal/utils"
+	"github.com/IceWhaleTech/IceWhale-Files-Backup/model"
+	"github.com/IceWhaleTech/IceWhale-Files-Backup/pkg/config"
+	"github.com/samber/lo"
+	"go.uber.org/zap"
+)
+
+// replicationStateSaveInterval is how many files are uploaded between saving the state of a replication,
+// so an interrupted replication doesn't start over.
+const replicationStateSaveInterval = 100
+
+var (
+	ErrReplicationTargetNotFound = errors.New("replication target not found")
+	ErrInvalidReplicationTarget  = errors.New("invalid replication target")
+	ErrReplicationInProgress     = errors.New("replication is already in progress")
+)
+
+// ReplicationTarget is somewhere the backup root is replicated to.
+type ReplicationTarget interface {
+	// Location tells where the target is, without credentials.
+	Location() string
+
+	// List returns the sizes of all files on the target by their slash-separated path relative to it.
+	List(ctx context.Context) (map[string]int64, error)
+
+	// Put uploads the content of the file to the path on the target, replacing the file there if any.
+	Put(ctx context.Context, relativePath string, source io.Reader, info fs.FileInfo) error
+
+	Remove(ctx context.Context, relativePath string) error
+
+	Close() error
+}
+
+// Replicator mirrors the backup root, including history copies and metadata, to each configured target
+// on a schedule. Only files that changed since the last replication are uploaded, and files no longer in
+// the backup root are deleted from the target.
+type Replicator struct {
+	storage         Storage
+	clock           Clock
+	backupRoot      string
+	stateFolderPath string
+	interval        time.Duration
+	targets         []model.ReplicationTargetModel
+
+	mutex    *sync.Mutex
+	statuses map[string]*codegen.ReplicationTarget
+
+	wg *sync.WaitGroup
+}
+
+// replicatedFile is a file as it was when it was last uploaded to a target.
+type replicatedFile struct {
+	Size    int64 `json:"size"`
+	ModTime int64 `json:"mod_time"`
+}
+
+type replicationResult struct {
+	fileCount     int
+	uploadedCount int
+	uploadedSize  int64
+	deletedCount  int
+}
+
+// NewReplicator returns a replicator of the backup root in the storage to the targets, keeping what has
+// been uploaded to each target under the state folder path and telling the time of replications by the clock.
+func NewReplicator(storage Storage, clock Clock, backupRoot, stateFolderPath string, interval time.Duration, targets []model.ReplicationTargetModel) *Replicator {
+	statuses := map[string]*codegen.ReplicationTarget{}
+
+	for _, target := range targets {
+		statuses[target.Name] = &codegen.ReplicationTarget{
+			Name:       lo.ToPtr(target.Name),
+			Type:       lo.ToPtr(codegen.ReplicationTargetType(target.Type)),
+			InProgress: lo.ToPtr(false),
+		}
+	}
+
+	return &Replicator{
+		storage:         storage,
+		clock:           clock,
+		backupRoot:      backupRoot,
+		stateFolderPath: stateFolderPath,
+		interval:        interval,
+		targets:         targets,
+
+		mutex:    &sync.Mutex{},
+		statuses: statuses,
+
+		wg: &sync.WaitGroup{},
+	}
+}
+
+func ReplicationStateFolderPath() string {
+	return filepath.Join(config.AppInfo.DBPath, common.ReplicationFolderName)
+}
+
+// Start replicates to all targets every interval until the context is done.
+func (r *Replicator) Start(ctx context.Context) {
+	if r.interval <= 0 || len(r.targets) == 0 {
+		logger.Info("replication interval or targets are not set, backups are not replicated")
+		return
+	}
+
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		for _, target := range r.targets {
+			if err := r.Replicate(ctx, target.Name); err != nil {
+				logger.Error("failed to replicate backups", zap.String("target", target.Name), zap.Error(err))
+			}
+		}
+	}
+}
+
+// Targets returns the targets along with the status of their last replication.
+func (r *Replicator) Targets() []codegen.ReplicationTarget {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	return lo.Map(r.targets, func(target model.ReplicationTargetModel, _ int) codegen.ReplicationTarget {
+		return *r.statuses[target.Name]
+	})
+}
+
+// RunInBackground starts replicating to the target without waiting for it, and returns its status. It
+// returns ErrReplicationInProgress if the target is already being replicated to.
+func (r *Replicator) RunInBackground(name string) (*codegen.ReplicationTarget, error) {
+	targetModel, ok := lo.Find(r.targets, func(target model.ReplicationTargetModel) bool { return target.Name == name })
+	if !ok {
+		return nil, ErrReplicationTargetNotFound
+	}
+
+	if !r.begin(name) {
+		return nil, fmt.Errorf("%w: %s", ErrReplicationInProgress, name)
+	}
+
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+
+		result, err := r.replicateTo(context.Background(), targetModel)
+
+		r.end(name, result, err)
+
+		if err != nil {
+			logger.Error("failed to replicate backups", zap.String("target", name), zap.Error(err))
+		}
+	}()
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	return lo.ToPtr(*r.statuses[name]), nil
+}
+
+// Wait waits for the replications started in the background.
+func (r *Replicator) Wait() {
+	r.wg.Wait()
+}
+
+// Replicate mirrors the backup root to the target, unless it is already being replicated to.
+func (r *Replicator) Replicate(ctx context.Context, name string) error {
+	targetModel, ok := lo.Find(r.targets, func(target model.ReplicationTargetModel) bool { return target.Name == name })
+	if !ok {
+		return ErrReplicationTargetNotFound
+	}
+
+	if !r.begin(name) {
+		logger.Info("replication is already in progress", zap.String("target", name))
+		return nil
+	}
+
+	result, err := r.replicateTo(ctx, targetModel)
+
+	r.end(name, result, err)
+
+	return err
+}
+
+func (r *Replicator) replicateTo(ctx context.Context, targetModel model.ReplicationTargetModel) (replicationResult, error) {
+	target, err := OpenReplicationTarget(targetModel)
+	if err != nil {
+		return replicationResult{}, err
+	}
+	defer target.Close()
+
+	r.mutex.Lock()
+	r.statuses[targetModel.Name].Location = lo.ToPtr(target.Location())
+	r.mutex.Unlock()
+
+	logger.Info("replicating backups", zap.String("target", targetModel.Name), zap.String("location", target.Location()))
+
+	result, err := r.replicate(ctx, targetModel.Name, target)
+	if err != nil {
+		return result, err
+	}
+
+	logger.Info("backups have been replicated", zap.String("target", targetModel.Name), zap.Int("uploaded", result.uploadedCount), zap.Int("deleted", result.deletedCount))
+
+	return result, nil
+}
+
+func (r *Replicator) replicate(ctx context.Context, name string, target ReplicationTarget) (replicationResult, error) {
+	result := replicationResult{}
+
+	localFiles, err := r.localFiles()
+	if err != nil {
+		return result, err
+	}
+
+	// an empty backup root most likely means the data volume is missing, which must not wipe the target
+	if len(localFiles) == 0 {
+		return result, fmt.Errorf("backup root %s is empty, not replicating it", r.backupRoot)
+	}
+
+	remoteFiles, err := target.List(ctx)
+	if err != nil {
+		return result, err
+	}
+
+	statePath := filepath.Join(r.stateFolderPath, name+".json")
+
+	state, err := loadReplicationState(statePath)
+	if err != nil {
+		logger.Error("failed to load replication state, uploading all files again", zap.String("target", name), zap.Error(err))
+		state = map[string]replicatedFile{}
+	}
+
+	relativePaths := lo.Keys(localFiles)
+	sort.Strings(relativePaths)
+
+	for _, relativePath := range relativePaths {
+		if err := ctx.Err(); err != nil {
+			return result, errors.Join(err, saveReplicationState(statePath, state))
+		}
+
+		info := localFiles[relativePath]
+		file := replicatedFile{Size: info.Size(), ModTime: info.ModTime().UnixNano()}
+
+		if remoteSize, ok := remoteFiles[relativePath]; ok && remoteSize == file.Size && state[relativePath] == file {
+			continue
+		}
+
+		if err := r.put(ctx, target, relativePath, info); err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				// removed since the backup root was walked, e.g. a pruned history copy
+				continue
+			}
+			return result, errors.Join(fmt.Errorf("failed to upload %s: %w", relativePath, err), saveReplicationState(statePath, state))
+		}
+
+		state[relativePath] = file
+		result.uploadedCount++
+		result.uploadedSize += file.Size
+
+		if result.uploadedCount%replicationStateSaveInterval == 0 {
+			if err := saveReplicationState(statePath, state); err != nil {
+				return result, err
+			}
+		}
+	}
+
+	for relativePath := range remoteFiles {
+		if _, ok := localFiles[relativePath]; ok {
+			continue
+		}
+
+		if err := target.Remove(ctx, relativePath); err != nil {
+			return result, errors.Join(fmt.Errorf("failed to delete %s: %w", relativePath, err), saveReplicationState(statePath, state))
+		}
+
+		result.deletedCount++
+	}
+
+	for relativePath := range state {
+		if _, ok := localFiles[relativePath]; !ok {
+			delete(state, relativePath)
+		}
+	}
+
+	result.fileCount = len(localFiles)
+
+	return result, saveReplicationState(statePath, state)
+}
+
+// localFiles returns the files under the backup root by their slash-separated relative path, leaving
+// out service state that only makes sense on this device, such as locks and unfinished uploads.
+func (r *Replicator) localFiles() (map[string]fs.FileInfo, error) {
+	files := map[string]fs.FileInfo{}
+
+	err := r.storage.WalkDir(r.backupRoot, func(file string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		relativePath, err := filepath.Rel(r.backupRoot, file)
+		if err != nil {
+			return err
+		}
+		relativePath = filepath.ToSlash(relativePath)
+
+		if d.IsDir() {
+			if relativePath == common.StateFolderName || path.Base(relativePath) == common.UploadFolderName && path.Base(path.Dir(relativePath)) == common.StateFolderName {
+				return fs.SkipDir
+			}
+			return nil
+		}
+
+		// temporary files of atomic writes
+		if !d.Type().IsRegular() || strings.Contains(d.Name(), ".tmp-") {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		files[relativePath] = info
+
+		return nil
+	})
+
+	return files, err
+}
+
+// put uploads the file under the backup root to the target.
+func (r *Replicator) put(ctx context.Context, target ReplicationTarget, relativePath string, info fs.FileInfo) error {
+	source, err := r.storage.Open(filepath.Join(r.backupRoot, filepath.FromSlash(relativePath)))
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+
+	return target.Put(ctx, relativePath, source, info)
+}
+
+func (r *Replicator) begin(name string) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	status := r.statuses[name]
+	if *status.InProgress {
+		return false
+	}
+
+	status.InProgress = lo.ToPtr(true)
+	status.LastStartTime = lo.ToPtr(r.clock.Now().UnixMilli())
+
+	return true
+}
+
+func (r *Replicator) end(name string, result replicationResult, err error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	now := r.clock.Now().UnixMilli()
+
+	status := r.statuses[name]
+	status.InProgress = lo.ToPtr(false)
+	status.LastEndTime = &now
+	status.UploadedCount = &result.uploadedCount
+	status.UploadedSize = &result.uploadedSize
+	status.DeletedCount = &result.deletedCount
+
+	if err != nil {
+		status.LastError = lo.ToPtr(err.Error())
+		return
+	}
+
+	status.LastError = nil
+	status.LastSuccessTime = &now
+	status.FileCount = &result.fileCount
+}
+
+func loadReplicationState(statePath string) (map[string]replicatedFile, error) {
+	state := map[string]replicatedFile{}
+
+	buf, err := os.ReadFile(statePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return state, nil
+		}
+		return nil, err
+	}
+
+	if err := json.Unmarshal(buf, &state); err != nil {
+		return nil, err
+	}
+
+	return state, nil
+}
+
+func saveReplicationState(statePath string, state map[string]replicatedFile) error {
+	buf, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(statePath), 0o755); err != nil {
+		return err
+	}
+
+	return utils.WriteFileAtomic(statePath, buf, 0o644)
+}
@@ -0,0 +1,130 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/IceWhaleTech/IceWhale-Files-Backup/model"
+)
+
+// OpenReplicationTarget connects to the target as configured.
+func OpenReplicationTarget(target model.ReplicationTargetModel) (ReplicationTarget, error) {
+	switch target.Type {
+	case "local":
+		return newLocalReplicationTarget(target)
+	case "sftp":
+		return newSFTPReplicationTarget(target)
+	case "s3":
+		return newS3ReplicationTarget(target)
+	default:
+		return nil, fmt.Errorf("%w: unknown type %q of target %s", ErrInvalidReplicationTarget, target.Type, target.Name)
+	}
+}
+
+// localReplicationTarget replicates to a folder on another disk, e.g. a USB drive.
+type localReplicationTarget struct {
+	path string
+}
+
+func newLocalReplicationTarget(target model.ReplicationTargetModel) (*localReplicationTarget, error) {
+	if !filepath.IsAbs(target.Path) {
+		return nil, fmt.Errorf("%w: path of target %s must be absolute", ErrInvalidReplicationTarget, target.Name)
+	}
+
+	// the folder must exist, otherwise an unmounted disk would be replicated to the root file system
+	if fileInfo, err := os.Stat(target.Path); err != nil {
+		return nil, err
+	} else if !fileInfo.IsDir() {
+		return nil, fmt.Errorf("%w: path of target %s is not a folder", ErrInvalidReplicationTarget, target.Name)
+	}
+
+	return &localReplicationTarget{path: target.Path}, nil
+}
+
+func (t *localReplicationTarget) Location() string {
+	return t.path
+}
+
+func (t *localReplicationTarget) List(ctx context.Context) (map[string]int64, error) {
+	files := map[string]int64{}
+
+	err := filepath.WalkDir(t.path, func(file string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		if !d.Type().IsRegular() || strings.Contains(d.Name(), ".tmp-") {
+			return nil
+		}
+
+		relativePath, err := filepath.Rel(t.path, file)
+		if err != nil {
+			return err
+		}
+
+		fileInfo, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		files[filepath.ToSlash(relativePath)] = fileInfo.Size()
+
+		return nil
+	})
+
+	return files, err
+}
+
+func (t *localReplicationTarget) Put(ctx context.Context, relativePath string, source io.Reader, info fs.FileInfo) error {
+	targetPath := filepath.Join(t.path, filepath.FromSlash(relativePath))
+
+	if err := os.MkdirAll(filepath.Dir(targetPath), 0o755); err != nil {
+		return err
+	}
+
+	tmpFile, err := os.CreateTemp(filepath.Dir(targetPath), filepath.Base(targetPath)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpFile.Name())
+	defer tmpFile.Close()
+
+	if _, err := io.Copy(tmpFile, source); err != nil {
+		return err
+	}
+
+	if err := tmpFile.Sync(); err != nil {
+		return err
+	}
+
+	if err := tmpFile.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Chtimes(tmpFile.Name(), info.ModTime(), info.ModTime()); err != nil {
+		return err
+	}
+
+	return os.Rename(tmpFile.Name(), targetPath)
+}
+
+func (t *localReplicationTarget) Remove(ctx context.Context, relativePath string) error {
+	err := os.Remove(filepath.Join(t.path, filepath.FromSlash(relativePath)))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func (t *localReplicationTarget) Close() error {
+	return nil
+}
@@ -0,0 +1,83 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"strings"
+
+	"github.com/IceWhaleTech/IceWhale-Files-Backup/model"
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+// s3ReplicationTarget replicates to objects under a prefix in a bucket of an S3-compatible service.
+type s3ReplicationTarget struct {
+	endpoint string
+	bucket   string
+	prefix   string
+
+	client *minio.Client
+}
+
+func newS3ReplicationTarget(target model.ReplicationTargetModel) (*s3ReplicationTarget, error) {
+	if target.Endpoint == "" || target.Bucket == "" {
+		return nil, fmt.Errorf("%w: endpoint and bucket of target %s must be set", ErrInvalidReplicationTarget, target.Name)
+	}
+
+	client, err := minio.New(target.Endpoint, &minio.Options{
+		Creds:  credentials.NewStaticV4(target.AccessKeyID, target.SecretAccessKey, ""),
+		Secure: target.UseSSL,
+		Region: target.Region,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	prefix := strings.Trim(target.Prefix, "/")
+	if prefix != "" {
+		prefix += "/"
+	}
+
+	return &s3ReplicationTarget{
+		endpoint: target.Endpoint,
+		bucket:   target.Bucket,
+		prefix:   prefix,
+		client:   client,
+	}, nil
+}
+
+func (t *s3ReplicationTarget) Location() string {
+	return "s3://" + path.Join(t.endpoint, t.bucket, t.prefix)
+}
+
+func (t *s3ReplicationTarget) List(ctx context.Context) (map[string]int64, error) {
+	files := map[string]int64{}
+
+	for object := range t.client.ListObjects(ctx, t.bucket, minio.ListObjectsOptions{Prefix: t.prefix, Recursive: true}) {
+		if object.Err != nil {
+			return nil, object.Err
+		}
+
+		files[strings.TrimPrefix(object.Key, t.prefix)] = object.Size
+	}
+
+	return files, nil
+}
+
+func (t *s3ReplicationTarget) Put(ctx context.Context, relativePath string, source io.Reader, info fs.FileInfo) error {
+	_, err := t.client.PutObject(ctx, t.bucket, t.prefix+relativePath, source, info.Size(), minio.PutObjectOptions{
+		ContentType: "application/octet-stream",
+	})
+	return err
+}
+
+func (t *s3ReplicationTarget) Remove(ctx context.Context, relativePath string) error {
+	return t.client.RemoveObject(ctx, t.bucket, t.prefix+relativePath, minio.RemoveObjectOptions{})
+}
+
+func (t *s3ReplicationTarget) Close() error {
+	return nil
+}
@@ -0,0 +1,185 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/IceWhaleTech/IceWhale-Files-Backup/model"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+const sftpDialTimeout = 30 * time.Second
+
+// sftpReplicationTarget replicates to a folder on an SFTP server.
+type sftpReplicationTarget struct {
+	address string
+	path    string
+
+	sshClient  *ssh.Client
+	sftpClient *sftp.Client
+}
+
+func newSFTPReplicationTarget(target model.ReplicationTargetModel) (*sftpReplicationTarget, error) {
+	if target.Address == "" || target.User == "" || target.Path == "" {
+		return nil, fmt.Errorf("%w: address, user and path of target %s must be set", ErrInvalidReplicationTarget, target.Name)
+	}
+
+	// the host key must be known, otherwise backups could be handed to anyone in the middle
+	if target.KnownHostsPath == "" {
+		return nil, fmt.Errorf("%w: known hosts path of target %s must be set", ErrInvalidReplicationTarget, target.Name)
+	}
+
+	hostKeyCallback, err := knownhosts.New(target.KnownHostsPath)
+	if err != nil {
+		return nil, err
+	}
+
+	auths := []ssh.AuthMethod{}
+
+	if target.PrivateKeyPath != "" {
+		buf, err := os.ReadFile(target.PrivateKeyPath)
+		if err != nil {
+			return nil, err
+		}
+
+		signer, err := ssh.ParsePrivateKey(buf)
+		if err != nil {
+			return nil, err
+		}
+
+		auths = append(auths, ssh.PublicKeys(signer))
+	}
+
+	if target.Password != "" {
+		auths = append(auths, ssh.Password(target.Password))
+	}
+
+	if len(auths) == 0 {
+		return nil, fmt.Errorf("%w: password or private key path of target %s must be set", ErrInvalidReplicationTarget, target.Name)
+	}
+
+	sshClient, err := ssh.Dial("tcp", target.Address, &ssh.ClientConfig{
+		User:            target.User,
+		Auth:            auths,
+		HostKeyCallback: hostKeyCallback,
+		Timeout:         sftpDialTimeout,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sftpClient, err := sftp.NewClient(sshClient)
+	if err != nil {
+		sshClient.Close()
+		return nil, err
+	}
+
+	return &sftpReplicationTarget{
+		address:    target.Address,
+		path:       target.Path,
+		sshClient:  sshClient,
+		sftpClient: sftpClient,
+	}, nil
+}
+
+func (t *sftpReplicationTarget) Location() string {
+	return "sftp://" + net.JoinHostPort(t.hostPort()) + t.path
+}
+
+func (t *sftpReplicationTarget) hostPort() (string, string) {
+	host, port, err := net.SplitHostPort(t.address)
+	if err != nil {
+		return t.address, "22"
+	}
+	return host, port
+}
+
+func (t *sftpReplicationTarget) List(ctx context.Context) (map[string]int64, error) {
+	files := map[string]int64{}
+
+	if _, err := t.sftpClient.Stat(t.path); err != nil {
+		if os.IsNotExist(err) {
+			return files, nil
+		}
+		return nil, err
+	}
+
+	walker := t.sftpClient.Walk(t.path)
+
+	for walker.Step() {
+		if err := walker.Err(); err != nil {
+			return nil, err
+		}
+
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		fileInfo := walker.Stat()
+		if !fileInfo.Mode().IsRegular() || strings.Contains(fileInfo.Name(), ".tmp-") {
+			continue
+		}
+
+		relativePath := strings.TrimPrefix(strings.TrimPrefix(walker.Path(), t.path), "/")
+		files[relativePath] = fileInfo.Size()
+	}
+
+	return files, nil
+}
+
+func (t *sftpReplicationTarget) Put(ctx context.Context, relativePath string, source io.Reader, info fs.FileInfo) error {
+	targetPath := path.Join(t.path, relativePath)
+
+	if err := t.sftpClient.MkdirAll(path.Dir(targetPath)); err != nil {
+		return err
+	}
+
+	tmpID, err := randomID()
+	if err != nil {
+		return err
+	}
+	tmpPath := targetPath + ".tmp-" + tmpID
+
+	tmpFile, err := t.sftpClient.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	defer t.sftpClient.Remove(tmpPath) // nolint: errcheck
+	defer tmpFile.Close()
+
+	if _, err := io.Copy(tmpFile, source); err != nil {
+		return err
+	}
+
+	if err := tmpFile.Close(); err != nil {
+		return err
+	}
+
+	if err := t.sftpClient.Chtimes(tmpPath, info.ModTime(), info.ModTime()); err != nil {
+		return err
+	}
+
+	return t.sftpClient.PosixRename(tmpPath, targetPath)
+}
+
+func (t *sftpReplicationTarget) Remove(ctx context.Context, relativePath string) error {
+	err := t.sftpClient.Remove(path.Join(t.path, relativePath))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func (t *sftpReplicationTarget) Close() error {
+	t.sftpClient.Close()
+	return t.sshClient.Close()
+}
@@ -0,0 +1,370 @@
+package service_test
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/xml"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/IceWhaleTech/IceWhale-Files-Backup/codegen"
+	"github.com/IceWhaleTech/IceWhale-Files-Backup/common"
+	"github.com/IceWhaleTech/IceWhale-Files-Backup/model"
+	"github.com/IceWhaleTech/IceWhale-Files-Backup/service"
+	"github.com/samber/lo"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/goleak"
+)
+
+// fakeS3 is a stand-in for an S3-compatible service with a single bucket, good enough for listing,
+// uploading, downloading, copying and deleting objects.
+type fakeS3 struct {
+	mutex    sync.Mutex
+	bucket   string
+	objects  map[string][]byte
+	modTimes map[string]time.Time
+}
+
+type fakeS3ListResult struct {
+	XMLName     xml.Name `xml:"ListBucketResult"`
+	Name        string   `xml:"Name"`
+	Prefix      string   `xml:"Prefix"`
+	KeyCount    int      `xml:"KeyCount"`
+	MaxKeys     int      `xml:"MaxKeys"`
+	IsTruncated bool     `xml:"IsTruncated"`
+	Prefixes    []struct {
+		Prefix string `xml:"Prefix"`
+	} `xml:"CommonPrefixes"`
+	Contents []struct {
+		Key          string `xml:"Key"`
+		Size         int64  `xml:"Size"`
+		LastModified string `xml:"LastModified"`
+		ETag         string `xml:"ETag"`
+	} `xml:"Contents"`
+}
+
+func (s *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	if bucket != s.bucket {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	switch {
+	case r.Method == http.MethodGet && key == "":
+		result := fakeS3ListResult{Name: s.bucket, Prefix: r.URL.Query().Get("prefix"), MaxKeys: 1000}
+		delimiter := r.URL.Query().Get("delimiter")
+
+		keys := []string{}
+		prefixes := map[string]bool{}
+		for k := range s.objects {
+			if !strings.HasPrefix(k, result.Prefix) {
+				continue
+			}
+
+			// keys under a folder are rolled up into the folder when listing with a delimiter
+			if i := strings.Index(strings.TrimPrefix(k, result.Prefix), delimiter); delimiter != "" && i >= 0 {
+				prefixes[k[:len(result.Prefix)+i+len(delimiter)]] = true
+				continue
+			}
+
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		for _, prefix := range lo.Keys(prefixes) {
+			result.Prefixes = append(result.Prefixes, struct {
+				Prefix string `xml:"Prefix"`
+			}{Prefix: prefix})
+		}
+		sort.Slice(result.Prefixes, func(i, j int) bool { return result.Prefixes[i].Prefix < result.Prefixes[j].Prefix })
+
+		for _, k := range keys {
+			result.Contents = append(result.Contents, struct {
+				Key          string `xml:"Key"`
+				Size         int64  `xml:"Size"`
+				LastModified string `xml:"LastModified"`
+				ETag         string `xml:"ETag"`
+			}{Key: k, Size: int64(len(s.objects[k])), LastModified: s.modTimes[k].UTC().Format(time.RFC3339Nano), ETag: `"etag"`})
+		}
+		result.KeyCount = len(result.Contents) + len(result.Prefixes)
+
+		w.Header().Set("Content-Type", "application/xml")
+		_ = xml.NewEncoder(w).Encode(result)
+
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		body, ok := s.objects[key]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		w.Header().Set("ETag", `"etag"`)
+		http.ServeContent(w, r, key, s.modTimes[key], bytes.NewReader(body))
+
+	case r.Method == http.MethodPut && r.Header.Get("X-Amz-Copy-Source") != "":
+		source, _ := url.PathUnescape(r.Header.Get("X-Amz-Copy-Source"))
+		_, sourceKey, _ := strings.Cut(strings.TrimPrefix(source, "/"), "/")
+
+		body, ok := s.objects[sourceKey]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		s.put(key, body)
+		w.Header().Set("ETag", `"etag"`)
+		_, _ = w.Write([]byte(`<CopyObjectResult><ETag>"etag"</ETag><LastModified>` + s.modTimes[key].UTC().Format(time.RFC3339Nano) + `</LastModified></CopyObjectResult>`))
+
+	case r.Method == http.MethodPut:
+		body, err := readS3Body(r)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		s.put(key, body)
+		w.Header().Set("ETag", `"etag"`)
+
+	case r.Method == http.MethodDelete:
+		delete(s.objects, key)
+		delete(s.modTimes, key)
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		w.WriteHeader(http.StatusNotImplemented)
+	}
+}
+
+func (s *fakeS3) put(key string, body []byte) {
+	if s.modTimes == nil {
+		s.modTimes = map[string]time.Time{}
+	}
+
+	s.objects[key] = body
+	s.modTimes[key] = time.Now()
+}
+
+// readS3Body reads the body of an upload, decoding it if it is signed chunk by chunk.
+func readS3Body(r *http.Request) ([]byte, error) {
+	if r.Header.Get("X-Amz-Content-Sha256") != "STREAMING-AWS4-HMAC-SHA256-PAYLOAD" {
+		return io.ReadAll(r.Body)
+	}
+
+	body := []byte{}
+	reader := bufio.NewReader(r.Body)
+
+	for {
+		header, err := reader.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+
+		sizeHex, _, _ := strings.Cut(strings.TrimSpace(header), ";")
+
+		size, err := strconv.ParseInt(sizeHex, 16, 64)
+		if err != nil {
+			return nil, err
+		}
+
+		if size == 0 {
+			return body, nil
+		}
+
+		chunk := make([]byte, size+2) // followed by \r\n
+		if _, err := io.ReadFull(reader, chunk); err != nil {
+			return nil, err
+		}
+
+		body = append(body, chunk[:size]...)
+	}
+}
+
+func TestReplication(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	tmpDir, err := os.MkdirTemp("", "test")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	backupRoot := filepath.Join(tmpDir, common.BackupRootFolder)
+	clientFolderFullPath := filepath.Join(backupRoot, "client1", service.Normalize("/home/icewhale/Documents"))
+	uploadFolderFullPath := filepath.Join(backupRoot, "client1", common.StateFolderName, common.UploadFolderName, "upload1")
+
+	assert.NoError(t, os.MkdirAll(filepath.Join(clientFolderFullPath, common.StateFolderName), 0o755))
+	assert.NoError(t, os.MkdirAll(uploadFolderFullPath, 0o755))
+	assert.NoError(t, os.MkdirAll(filepath.Join(backupRoot, common.StateFolderName), 0o755))
+
+	assert.NoError(t, createFileWithContent(clientFolderFullPath, "a.txt", "a"))
+	assert.NoError(t, createFileWithContent(clientFolderFullPath, "a-backup-2023-01-01-00-00-00-000.txt", "old a"))
+	assert.NoError(t, createFileWithContent(filepath.Join(clientFolderFullPath, common.StateFolderName), "metadata.json", "{}"))
+	assert.NoError(t, createFileWithContent(uploadFolderFullPath, "0", "partial upload"))
+	assert.NoError(t, createFileWithContent(filepath.Join(backupRoot, common.StateFolderName), "lock", ""))
+
+	expected := []string{
+		path.Join("client1", service.Normalize("/home/icewhale/Documents"), "a.txt"),
+		path.Join("client1", service.Normalize("/home/icewhale/Documents"), "a-backup-2023-01-01-00-00-00-000.txt"),
+		path.Join("client1", service.Normalize("/home/icewhale/Documents"), common.StateFolderName, "metadata.json"),
+	}
+
+	localTargetPath := filepath.Join(tmpDir, "offsite")
+	assert.NoError(t, os.MkdirAll(localTargetPath, 0o755))
+
+	s3 := &fakeS3{bucket: "backups", objects: map[string][]byte{}}
+	s3Server := httptest.NewServer(s3)
+	defer s3Server.Close()
+
+	replicator := service.NewReplicator(service.NewLocalStorage(tmpDir), service.SystemClock, backupRoot, filepath.Join(tmpDir, "state"), 0, []model.ReplicationTargetModel{
+		{Name: "usb", Type: "local", Path: localTargetPath},
+		{
+			Name:            "cloud",
+			Type:            "s3",
+			Endpoint:        strings.TrimPrefix(s3Server.URL, "http://"),
+			Bucket:          "backups",
+			Prefix:          "zima",
+			Region:          "us-east-1",
+			AccessKeyID:     "access",
+			SecretAccessKey: "secret",
+		},
+	})
+
+	localFiles := func() []string {
+		files := []string{}
+		assert.NoError(t, filepath.Walk(localTargetPath, func(file string, info os.FileInfo, err error) error {
+			if err == nil && !info.IsDir() {
+				relativePath, _ := filepath.Rel(localTargetPath, file)
+				files = append(files, filepath.ToSlash(relativePath))
+			}
+			return err
+		}))
+		return files
+	}
+
+	s3Keys := func() []string {
+		s3.mutex.Lock()
+		defer s3.mutex.Unlock()
+
+		keys := []string{}
+		for key := range s3.objects {
+			keys = append(keys, strings.TrimPrefix(key, "zima/"))
+		}
+		return keys
+	}
+
+	status := func(name string) codegen.ReplicationTarget {
+		for _, target := range replicator.Targets() {
+			if *target.Name == name {
+				return target
+			}
+		}
+		t.Fatalf("target %s not found", name)
+		return codegen.ReplicationTarget{}
+	}
+
+	_, err = replicator.RunInBackground("unknown")
+	assert.ErrorIs(t, err, service.ErrReplicationTargetNotFound)
+
+	for _, name := range []string{"usb", "cloud"} {
+		// everything but the service state is replicated, including history copies and metadata
+		assert.NoError(t, replicator.Replicate(context.Background(), name))
+		assert.Equal(t, 3, *status(name).UploadedCount)
+		assert.Nil(t, status(name).LastError)
+		assert.NotNil(t, status(name).LastSuccessTime)
+
+		// nothing changed, so nothing is uploaded again
+		assert.NoError(t, replicator.Replicate(context.Background(), name))
+		assert.Equal(t, 0, *status(name).UploadedCount)
+		assert.Equal(t, 3, *status(name).FileCount)
+	}
+
+	assert.ElementsMatch(t, expected, localFiles())
+	assert.ElementsMatch(t, expected, s3Keys())
+
+	// only changed files are uploaded, and deleted files are deleted from the targets
+	changedTime := time.Now().Add(time.Minute)
+	assert.NoError(t, createFileWithContent(clientFolderFullPath, "a.txt", "b"))
+	assert.NoError(t, os.Chtimes(filepath.Join(clientFolderFullPath, "a.txt"), changedTime, changedTime))
+	assert.NoError(t, os.Remove(filepath.Join(clientFolderFullPath, "a-backup-2023-01-01-00-00-00-000.txt")))
+
+	for _, name := range []string{"usb", "cloud"} {
+		target, err := replicator.RunInBackground(name)
+		assert.NoError(t, err)
+		assert.True(t, *target.InProgress)
+	}
+	replicator.Wait()
+
+	for _, name := range []string{"usb", "cloud"} {
+		assert.Equal(t, 1, *status(name).UploadedCount)
+		assert.Equal(t, 1, *status(name).DeletedCount)
+		assert.False(t, *status(name).InProgress)
+	}
+
+	assert.ElementsMatch(t, []string{expected[0], expected[2]}, localFiles())
+	assert.ElementsMatch(t, []string{expected[0], expected[2]}, s3Keys())
+
+	content, err := os.ReadFile(filepath.Join(localTargetPath, filepath.FromSlash(expected[0])))
+	assert.NoError(t, err)
+	assert.Equal(t, "b", string(content))
+	assert.Equal(t, "b", string(s3.objects["zima/"+expected[0]]))
+
+	// an empty backup root, e.g. of a missing data volume, doesn't wipe the targets
+	assert.NoError(t, os.RemoveAll(filepath.Join(backupRoot, "client1")))
+
+	assert.Error(t, replicator.Replicate(context.Background(), "usb"))
+	assert.NotNil(t, status("usb").LastError)
+	assert.Len(t, localFiles(), 2)
+}
+
+func TestReplicationFromMemoryStorage(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	tmpDir, err := os.MkdirTemp("", "test")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	clock := &fixedClock{now: time.Date(2023, 4, 10, 12, 0, 0, 0, time.UTC)}
+	storage := service.NewMemoryStorage("/DATA", clock)
+
+	backupRoot := filepath.Join(storage.Root(), common.BackupRootFolder)
+	clientFolderFullPath := filepath.Join(backupRoot, "client1", service.Normalize("/home/icewhale/Documents"))
+
+	assert.NoError(t, storage.MkdirAll(clientFolderFullPath, 0o755))
+	assert.NoError(t, storage.WriteFile(filepath.Join(clientFolderFullPath, "a.txt"), []byte("a"), 0o644))
+
+	localTargetPath := filepath.Join(tmpDir, "offsite")
+	assert.NoError(t, os.MkdirAll(localTargetPath, 0o755))
+
+	replicator := service.NewReplicator(storage, clock, backupRoot, filepath.Join(tmpDir, "state"), 0, []model.ReplicationTargetModel{
+		{Name: "usb", Type: "local", Path: localTargetPath},
+	})
+
+	// the backup root is read through the storage, not from the local disk
+	assert.NoError(t, replicator.Replicate(context.Background(), "usb"))
+
+	target := replicator.Targets()[0]
+	assert.Equal(t, clock.now.UnixMilli(), *target.LastStartTime)
+	assert.Equal(t, clock.now.UnixMilli(), *target.LastSuccessTime)
+
+	content, err := os.ReadFile(filepath.Join(localTargetPath, "client1", service.Normalize("/home/icewhale/Documents"), "a.txt"))
+	assert.NoError(t, err)
+	assert.Equal(t, "a", string(content))
+
+	info, err := os.Stat(filepath.Join(localTargetPath, "client1", service.Normalize("/home/icewhale/Documents"), "a.txt"))
+	assert.NoError(t, err)
+	assert.True(t, clock.now.Equal(info.ModTime()))
+}
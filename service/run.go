@@ -0,0 +1,88 @@
+package service
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+
+	"github.com/IceWhaleTech/IceWhale-Files-Backup/common"
+	"github.com/samber/lo"
+)
+
+// Run is the upload state of the latest run of a folder backup, used to resume the run if it
+// is interrupted before being completed.
+type Run struct {
+	// StartTime is the time in milliseconds when the run was started, same as the time of its manifest.
+	StartTime int64 `json:"start_time"`
+
+	// PendingFiles are the files, relative to the folder backup, the client still needs to upload.
+	// Their previous versions, if any, have already been kept as history copies.
+	PendingFiles []string `json:"pending_files"`
+
+	Completed bool `json:"completed"`
+
+	// pending is the set of PendingFiles, so looking a file up doesn't walk them all.
+	pending map[string]struct{}
+}
+
+func (r *Run) IsPending(relativePath string) bool {
+	if r.pending == nil {
+		r.pending = make(map[string]struct{}, len(r.PendingFiles))
+		for _, pendingFile := range r.PendingFiles {
+			r.pending[pendingFile] = struct{}{}
+		}
+	}
+
+	_, ok := r.pending[relativePath]
+	return ok
+}
+
+func (r *Run) AddPending(relativePath string) {
+	if r.IsPending(relativePath) {
+		return
+	}
+
+	r.PendingFiles = append(r.PendingFiles, relativePath)
+	r.pending[relativePath] = struct{}{}
+}
+
+func (r *Run) RemovePending(relativePath string) {
+	if !r.IsPending(relativePath) {
+		return
+	}
+
+	r.PendingFiles = lo.Without(r.PendingFiles, relativePath)
+	delete(r.pending, relativePath)
+}
+
+func SaveRun(storage Storage, backupFolderFullPath string, run *Run) error {
+	stateFolderPath := filepath.Join(backupFolderFullPath, common.StateFolderName)
+	if err := storage.MkdirAll(stateFolderPath, 0o755); err != nil {
+		return err
+	}
+
+	buf, err := json.Marshal(run)
+	if err != nil {
+		return err
+	}
+
+	return storage.WriteFile(filepath.Join(stateFolderPath, common.RunFileName), buf, 0o600)
+}
+
+// LoadRun returns the latest run of the folder backup, or nil if there is none.
+func LoadRun(storage Storage, backupFolderFullPath string) (*Run, error) {
+	buf, err := storage.ReadFile(filepath.Join(backupFolderFullPath, common.StateFolderName, common.RunFileName))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var run Run
+	if err := json.Unmarshal(buf, &run); err != nil {
+		return nil, err
+	}
+
+	return &run, nil
+}
@@ -0,0 +1,204 @@
+package service_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/IceWhaleTech/IceWhale-Files-Backup/codegen"
+	"github.com/IceWhaleTech/IceWhale-Files-Backup/common"
+	"github.com/IceWhaleTech/IceWhale-Files-Backup/pkg/config"
+	"github.com/IceWhaleTech/IceWhale-Files-Backup/service"
+	"github.com/samber/lo"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/goleak"
+	"golang.org/x/net/webdav"
+)
+
+func TestProceedResumesInterruptedRun(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	tmpDataRootDir, err := os.MkdirTemp("", "test")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tmpDataRootDir)
+
+	storage := service.NewLocalStorage(tmpDataRootDir)
+
+	config.AppInfo.DataRootPath = tmpDataRootDir
+
+	clientID := "client1"
+	clientFolderPath := `C:\Users\icewhale\Downloads`
+
+	backupFolderFullPath := filepath.Join(tmpDataRootDir, common.BackupRootFolder, clientID, service.Normalize(clientFolderPath))
+	assert.NoError(t, os.MkdirAll(backupFolderFullPath, 0o755))
+
+	// files from the last backup
+	assert.NoError(t, createFileWithContent(backupFolderFullPath, "a.txt", "old a"))
+	assert.NoError(t, createFileWithContent(backupFolderFullPath, "b.txt", "same b"))
+
+	// files on the client now
+	clientFiles := map[string]string{
+		"a.txt": "new a!",
+		"b.txt": "same b",
+		"c.txt": "new c",
+	}
+
+	request := func() codegen.FolderBackup {
+		sizes := map[string]int64{}
+		hashes := map[string]string{}
+		for name, content := range clientFiles {
+			hash, err := service.XXHashReader(strings.NewReader(content))
+			assert.NoError(t, err)
+
+			sizes[name] = int64(len(content))
+			hashes[name] = hash
+		}
+
+		return codegen.FolderBackup{
+			ClientID:               &clientID,
+			ClientFolderPath:       &clientFolderPath,
+			ClientFolderFileSizes:  &sizes,
+			ClientFolderFileHashes: &hashes,
+		}
+	}
+
+	countBackupFiles := func() int {
+		entries, err := os.ReadDir(backupFolderFullPath)
+		assert.NoError(t, err)
+
+		return lo.CountBy(entries, func(entry os.DirEntry) bool {
+			return strings.Contains(entry.Name(), "-backup-")
+		})
+	}
+
+	backupService := service.NewBackupService()
+
+	backup, err := backupService.Proceed(request())
+	assert.NoError(t, err)
+	assert.Nil(t, backup.Resumed)
+	assert.Equal(t, 1, countBackupFiles())
+
+	run, err := service.LoadRun(storage, backupFolderFullPath)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a.txt", "c.txt"}, run.PendingFiles)
+	assert.False(t, run.Completed)
+
+	// the laptop sleeps after c.txt is uploaded and while a.txt is being uploaded
+	assert.NoError(t, createFileWithContent(backupFolderFullPath, "c.txt", "new c"))
+	assert.NoError(t, createFileWithContent(backupFolderFullPath, "a.txt", "new"))
+
+	backup, err = backupService.Proceed(request())
+	assert.NoError(t, err)
+	assert.True(t, *backup.Resumed)
+	assert.Equal(t, 1, countBackupFiles(), "half-written file should not be kept as a history copy")
+
+	_, err = os.Stat(filepath.Join(backupFolderFullPath, "a.txt"))
+	assert.ErrorIs(t, err, os.ErrNotExist)
+
+	run, err = service.LoadRun(storage, backupFolderFullPath)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a.txt"}, run.PendingFiles)
+
+	// the client uploads the rest and completes the run
+	assert.NoError(t, createFileWithContent(backupFolderFullPath, "a.txt", "new a!"))
+
+	verification, err := backupService.Complete(clientID, clientFolderPath)
+	assert.NoError(t, err)
+	assert.True(t, *verification.Succeeded)
+
+	run, err = service.LoadRun(storage, backupFolderFullPath)
+	assert.NoError(t, err)
+	assert.True(t, run.Completed)
+	assert.Empty(t, run.PendingFiles)
+
+	backup, err = backupService.Proceed(request())
+	assert.NoError(t, err)
+	assert.Nil(t, backup.Resumed)
+	assert.Equal(t, 1, countBackupFiles())
+}
+
+func TestProceedKeepsUploadsOfRunsNeverCompleted(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	tmpDataRootDir, err := os.MkdirTemp("", "test")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tmpDataRootDir)
+
+	storage := service.NewLocalStorage(tmpDataRootDir)
+	backupService := service.NewBackupServiceWith(storage, service.SystemClock)
+
+	clientID := "client1"
+	clientFolderPath := "/home/icewhale/Documents"
+	backupFolderPath := filepath.Join(common.BackupRootFolder, clientID, service.Normalize(clientFolderPath))
+	backupFolderFullPath := filepath.Join(tmpDataRootDir, backupFolderPath)
+
+	request := func(clientFiles map[string]string) codegen.FolderBackup {
+		sizes := map[string]int64{}
+		hashes := map[string]string{}
+		for name, content := range clientFiles {
+			hash, err := service.XXHashReader(strings.NewReader(content))
+			assert.NoError(t, err)
+
+			sizes[name] = int64(len(content))
+			hashes[name] = hash
+		}
+
+		return codegen.FolderBackup{
+			ClientID:               &clientID,
+			ClientFolderPath:       &clientFolderPath,
+			ClientFolderFileSizes:  &sizes,
+			ClientFolderFileHashes: &hashes,
+		}
+	}
+
+	readBackupFiles := func() []string {
+		entries, err := os.ReadDir(backupFolderFullPath)
+		assert.NoError(t, err)
+
+		contents := []string{}
+		for _, entry := range entries {
+			if strings.Contains(entry.Name(), "-backup-") {
+				buf, err := os.ReadFile(filepath.Join(backupFolderFullPath, entry.Name()))
+				assert.NoError(t, err)
+				contents = append(contents, string(buf))
+			}
+		}
+		return contents
+	}
+
+	_, err = backupService.Proceed(request(map[string]string{"a.txt": "first a", "b.txt": "first b"}))
+	assert.NoError(t, err)
+
+	// the client uploads both files, e.g. with rclone, and never completes the run
+	assert.NoError(t, createFileWithContent(backupFolderFullPath, "a.txt", "first a"))
+	assert.NoError(t, createFileWithContent(backupFolderFullPath, "b.txt", "first b"))
+
+	// a.txt changes again and b.txt is deleted, while the versions uploaded by the first run are kept
+	_, err = backupService.Proceed(request(map[string]string{"a.txt": "second a"}))
+	assert.NoError(t, err)
+
+	assert.ElementsMatch(t, []string{"first a", "first b"}, readBackupFiles())
+
+	deletedFiles, err := backupService.GetDeletedFiles(clientID, clientFolderPath)
+	assert.NoError(t, err)
+	assert.Len(t, deletedFiles, 1)
+
+	// files written over WebDAV are no longer pending once written
+	handler := &webdav.Handler{
+		FileSystem: backupService.WebDAVFileSystem(),
+		LockSystem: backupService.WebDAVLockSystem(time.Second),
+	}
+
+	put := httptest.NewRequest(http.MethodPut, "/"+filepath.ToSlash(filepath.Join(backupFolderPath, "a.txt")), strings.NewReader("second a"))
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, put)
+	assert.Equal(t, http.StatusCreated, recorder.Code)
+
+	run, err := service.LoadRun(storage, backupFolderFullPath)
+	assert.NoError(t, err)
+	assert.Empty(t, run.PendingFiles)
+}
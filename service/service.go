@@ -1,18 +1,35 @@
 package service
 
-import "github.com/IceWhaleTech/CasaOS-Common/external"
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/IceWhaleTech/CasaOS-Common/external"
+	"github.com/IceWhaleTech/CasaOS-Common/utils/logger"
+	"github.com/IceWhaleTech/IceWhale-Files-Backup/common"
+	"github.com/IceWhaleTech/IceWhale-Files-Backup/pkg/config"
+	"go.uber.org/zap"
+)
 
 var MyService Services
 
 type Services interface {
 	Backup() *BackupService
+	Monitor() *Monitor
+	Webhooks() *WebhookService
+	Health() *Health
+	Replicator() *Replicator
 
 	Gateway() external.ManagementService
 }
 
 type services struct {
-	backup  *BackupService
-	gateway external.ManagementService
+	backup     *BackupService
+	monitor    *Monitor
+	webhooks   *WebhookService
+	health     *Health
+	replicator *Replicator
+	gateway    external.ManagementService
 }
 
 func NewService(RuntimePath string) Services {
@@ -21,16 +38,85 @@ func NewService(RuntimePath string) Services {
 		panic(err)
 	}
 
+	storage, err := OpenStorage(config.AppInfo.DataRootPath, *config.StorageInfo)
+	if err != nil {
+		panic(err)
+	}
+
+	backup := NewBackupServiceWith(storage, SystemClock)
+
+	if index, err := openIndex(); err != nil {
+		logger.Error("failed to open index, falling back to walking the backup root", zap.String("path", IndexFilePath()), zap.Error(err))
+	} else {
+		backup.SetIndex(index)
+
+		if empty, err := index.IsEmpty(); err != nil {
+			logger.Error("failed to check if index is empty", zap.Error(err))
+		} else if empty {
+			if err := backup.RebuildIndex(); err != nil {
+				logger.Error("failed to rebuild index", zap.Error(err))
+			}
+		} else if err := backup.ReconcileIndex(); err != nil {
+			// e.g. folder backups changed by another process while this one was not running
+			logger.Error("failed to reconcile index", zap.Error(err))
+		}
+	}
+
+	MetricsRegistry.MustRegister(NewStorageCollector(backup))
+
+	webhooks := NewWebhookService(WebhookFilePath())
+	if err := webhooks.Load(); err != nil {
+		logger.Error("failed to load webhooks", zap.String("path", WebhookFilePath()), zap.Error(err))
+	}
+
+	webhookEvents, _ := backup.Events().Subscribe()
+	go webhooks.Forward(webhookEvents)
+
+	if len(RuntimePath) > 0 {
+		events, _ := backup.Events().Subscribe()
+		go NewMessageBus(RuntimePath).Forward(events)
+	}
+
 	return &services{
-		backup:  NewBackupService(),
-		gateway: gatewayManagement,
+		backup:     backup,
+		monitor:    NewMonitor(backup, *config.MonitorInfo),
+		webhooks:   webhooks,
+		health:     NewHealth(),
+		replicator: NewReplicator(storage, backup.clock, filepath.Join(storage.Root(), common.BackupRootFolder), ReplicationStateFolderPath(), config.ReplicationInfo.Interval, config.ReplicationTargets),
+		gateway:    gatewayManagement,
 	}
 }
 
+func openIndex() (*Index, error) {
+	indexFilePath := IndexFilePath()
+
+	if err := os.MkdirAll(filepath.Dir(indexFilePath), 0o755); err != nil {
+		return nil, err
+	}
+
+	return OpenIndex(indexFilePath)
+}
+
 func (s *services) Backup() *BackupService {
 	return s.backup
 }
 
+func (s *services) Monitor() *Monitor {
+	return s.monitor
+}
+
+func (s *services) Webhooks() *WebhookService {
+	return s.webhooks
+}
+
+func (s *services) Health() *Health {
+	return s.health
+}
+
+func (s *services) Replicator() *Replicator {
+	return s.replicator
+}
+
 func (s *services) Gateway() external.ManagementService {
 	return s.gateway
 }
@@ -0,0 +1,265 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/IceWhaleTech/CasaOS-Common/utils/logger"
+	"github.com/IceWhaleTech/IceWhale-Files-Backup/codegen"
+	"github.com/IceWhaleTech/IceWhale-Files-Backup/pkg/config"
+	"github.com/samber/lo"
+	"go.uber.org/zap"
+)
+
+// quotaWarningInterval is how often a quota warning is published at most for each folder backup, so
+// every refused upload doesn't end up as a notification.
+const quotaWarningInterval = time.Hour
+
+var ErrInsufficientSpace = errors.New("insufficient free space")
+
+// versioning is a file to be kept as a history copy before the client uploads its newer content.
+type versioning struct {
+	file         string
+	relativePath string
+	move         bool
+
+	// deleted is whether the client no longer has the file, in which case it might have been moved
+	deleted bool
+}
+
+// historyCopy is a history copy found under a folder backup.
+type historyCopy struct {
+	path    string
+	version FileVersion
+	size    int64
+}
+
+// availableSpace returns the free space of the storage left above the reserve, which is negative if
+// the reserve is already crossed.
+func (b *BackupService) availableSpace() (int64, error) {
+	freeSpace, err := b.storage.FreeSpace()
+	if err != nil {
+		return 0, err
+	}
+
+	return int64(freeSpace) - config.AppInfo.FreeSpaceReserve, nil
+}
+
+// checkSpace returns ErrInsufficientSpace, and warns about it, if writing the given bytes to the
+// folder backup would cross the reserve.
+func (b *BackupService) checkSpace(backupFolderPath string, size int64) error {
+	available, err := b.availableSpace()
+	if err != nil {
+		return err
+	}
+
+	if size <= available {
+		return nil
+	}
+
+	message := fmt.Sprintf("%d bytes needed, %d bytes available above the reserve of %d bytes", size, lo.Max([]int64{available, 0}), config.AppInfo.FreeSpaceReserve)
+	b.warnQuota(backupFolderPath, message)
+
+	return fmt.Errorf("%w: %s", ErrInsufficientSpace, message)
+}
+
+// ensureSpace makes sure the history copies and the uploads of a run fit above the reserve. Otherwise
+// it moves the files to be copied, then prunes the oldest history copies of the folder backup, and
+// returns ErrInsufficientSpace if that is still not enough.
+func (b *BackupService) ensureSpace(backupFolderPath, backupFolderFullPath string, versionings []versioning, uploadSize int64) error {
+	available, err := b.availableSpace()
+	if err != nil {
+		return err
+	}
+
+	copySize := int64(0)
+
+	for _, v := range versionings {
+		if v.move {
+			continue
+		}
+
+		fileInfo, err := b.storage.Stat(v.file)
+		if err != nil {
+			return err
+		}
+
+		copySize += fileInfo.Size()
+	}
+
+	if copySize+uploadSize <= available {
+		return nil
+	}
+
+	warnings := []string{}
+
+	if copySize > 0 {
+		// the client uploads a changed file either way, so moving it costs nothing but its copy
+		for i := range versionings {
+			versionings[i].move = true
+		}
+
+		logger.Info("free space is low, changed files are moved instead of copied", zap.String("path", backupFolderPath), zap.Int64("available", available), zap.Int64("copy_size", copySize))
+		warnings = append(warnings, fmt.Sprintf("%d bytes of changed files moved instead of copied", copySize))
+	}
+
+	if uploadSize > available {
+		historyCopies, err := listHistoryCopies(b.storage, backupFolderFullPath)
+		if err != nil {
+			return err
+		}
+
+		// history copies are only pruned if that makes enough room, otherwise they would be lost for nothing
+		prunableSize := lo.SumBy(historyCopies, func(historyCopy historyCopy) int64 { return historyCopy.size })
+
+		if uploadSize > available+prunableSize {
+			message := fmt.Sprintf("%d bytes to upload, %d bytes available above the reserve of %d bytes, %d bytes in history copies", uploadSize, lo.Max([]int64{available, 0}), config.AppInfo.FreeSpaceReserve, prunableSize)
+			b.warnQuota(backupFolderPath, message)
+
+			return fmt.Errorf("%w: %s", ErrInsufficientSpace, message)
+		}
+
+		count, err := b.pruneVersions(backupFolderPath, historyCopies, uploadSize-available)
+		if err != nil {
+			return err
+		}
+
+		warnings = append(warnings, fmt.Sprintf("%d oldest history copies pruned", count))
+	}
+
+	b.warnQuota(backupFolderPath, "free space is low: "+strings.Join(warnings, ", "))
+
+	return nil
+}
+
+// pruneVersions removes the given history copies of the folder backup in order until the given bytes
+// are freed or none is left, and returns the number of history copies removed.
+func (b *BackupService) pruneVersions(backupFolderPath string, historyCopies []historyCopy, size int64) (int, error) {
+	freed := int64(0)
+	count := 0
+	prunedPaths := []string{}
+
+	// the deleted files whose last versions are pruned can't be restored anymore
+	defer func() {
+		backupFolderFullPath := filepath.Join(b.storage.Root(), backupFolderPath)
+
+		deletedFiles, err := LoadDeletedFiles(b.storage, backupFolderFullPath)
+		if err != nil {
+			logger.Error("failed to load deleted files", zap.String("path", backupFolderFullPath), zap.Error(err))
+			return
+		}
+
+		if deletedFiles.forgetBackupFiles(backupFolderFullPath, prunedPaths) {
+			if err := SaveDeletedFiles(b.storage, backupFolderFullPath, deletedFiles); err != nil {
+				logger.Error("failed to save deleted files", zap.String("path", backupFolderFullPath), zap.Error(err))
+			}
+		}
+	}()
+
+	for _, historyCopy := range historyCopies {
+		if freed >= size {
+			break
+		}
+
+		if err := b.storage.Remove(historyCopy.path); err != nil {
+			return count, err
+		}
+
+		prunedPaths = append(prunedPaths, historyCopy.path)
+
+		freed += historyCopy.size
+		count++
+
+		logger.Info("history copy has been pruned", zap.String("file", historyCopy.path))
+
+		version := historyCopy.version
+		b.updateIndex(func(index *Index) error {
+			return index.DeleteVersion(backupFolderPath, version.Path, version.BackupFilePath)
+		})
+	}
+
+	if count > 0 {
+		b.publish(codegen.Pruned, backupFolderPath, codegen.BackupEvent{
+			FileCount: &count,
+		})
+	}
+
+	return count, nil
+}
+
+// listHistoryCopies returns the history copies under the folder backup, oldest first.
+func listHistoryCopies(storage Storage, backupFolderFullPath string) ([]historyCopy, error) {
+	historyCopies := []historyCopy{}
+
+	if err := walkHistoryCopies(storage, backupFolderFullPath, func(file string, d fs.DirEntry, version *FileVersion) error {
+		fileInfo, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		historyCopies = append(historyCopies, historyCopy{
+			path:    file,
+			version: *version,
+			size:    fileInfo.Size(),
+		})
+
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	sort.SliceStable(historyCopies, func(i, j int) bool {
+		if historyCopies[i].version.Time != historyCopies[j].version.Time {
+			return historyCopies[i].version.Time < historyCopies[j].version.Time
+		}
+		return historyCopies[i].path < historyCopies[j].path
+	})
+
+	return historyCopies, nil
+}
+
+// warnQuota publishes a quota warning for the folder backup, unless one has been published recently.
+func (b *BackupService) warnQuota(backupFolderPath, message string) {
+	b.quotaMutex.Lock()
+	if lastWarning, ok := b.quotaWarnings[backupFolderPath]; ok && b.clock.Now().Sub(lastWarning) < quotaWarningInterval {
+		b.quotaMutex.Unlock()
+		return
+	}
+	b.quotaWarnings[backupFolderPath] = b.clock.Now()
+	b.quotaMutex.Unlock()
+
+	logger.Info("quota warning", zap.String("path", backupFolderPath), zap.String("message", message))
+
+	b.publish(codegen.QuotaWarning, backupFolderPath, codegen.BackupEvent{
+		Message: &message,
+	})
+}
+
+// GuardWebDAVSpace rejects WebDAV uploads into folder backups that would cross the free space reserve.
+// Uploads of unknown length are only rejected once the reserve has been crossed. Storages that can't
+// tell their free space, such as S3, report it as unlimited, so nothing is rejected there and a full
+// bucket fails the write instead.
+func (b *BackupService) GuardWebDAVSpace(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPut {
+			// the folder backup is found the way the file system finds the file, e.g. whatever the case
+			if backupFolderPath := b.folderBackupOf(b.resolveName(r.URL.Path)); backupFolderPath != "" {
+				if err := b.checkSpace(backupFolderPath, lo.Max([]int64{r.ContentLength, 0})); err != nil {
+					logger.Error("WebDAV upload refused", zap.String("path", r.URL.Path), zap.Error(err))
+
+					status := lo.Ternary(errors.Is(err, ErrInsufficientSpace), http.StatusInsufficientStorage, http.StatusInternalServerError)
+					http.Error(w, err.Error(), status)
+					return
+				}
+			}
+		}
+
+		handler.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,145 @@
+package service_test
+
+import (
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/IceWhaleTech/IceWhale-Files-Backup/codegen"
+	"github.com/IceWhaleTech/IceWhale-Files-Backup/common"
+	"github.com/IceWhaleTech/IceWhale-Files-Backup/internal/utils"
+	"github.com/IceWhaleTech/IceWhale-Files-Backup/pkg/config"
+	"github.com/IceWhaleTech/IceWhale-Files-Backup/service"
+	"github.com/samber/lo"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/goleak"
+)
+
+const mib = 1 << 20
+
+// reserveAllBut sets the reserve so only the given bytes are available above it.
+func reserveAllBut(t *testing.T, available int64) {
+	freeSpace, err := utils.FreeSpace(config.AppInfo.DataRootPath)
+	assert.NoError(t, err)
+
+	config.AppInfo.FreeSpaceReserve = int64(freeSpace) - available
+}
+
+func TestFreeSpaceGuard(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	tmpDataRootDir, err := os.MkdirTemp("", "test")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tmpDataRootDir)
+
+	config.AppInfo.DataRootPath = tmpDataRootDir
+	defer func() { config.AppInfo.FreeSpaceReserve = 0 }()
+
+	clientID := "client1"
+	clientFolderPath := "/home/icewhale/Documents"
+	backupFolderFullPath := filepath.Join(tmpDataRootDir, common.BackupRootFolder, clientID, service.Normalize(clientFolderPath))
+
+	assert.NoError(t, os.MkdirAll(backupFolderFullPath, 0o755))
+	assert.NoError(t, createFileWithContent(backupFolderFullPath, "changed.bin", strings.Repeat("a", 4*mib)))
+	assert.NoError(t, createFileWithContent(backupFolderFullPath, "old-backup-2020-01-01-00-00-00-000.bin", strings.Repeat("o", 8*mib)))
+	assert.NoError(t, createFileWithContent(backupFolderFullPath, "old-backup-2021-01-01-00-00-00-000.bin", strings.Repeat("n", 8*mib)))
+
+	backupService := service.NewBackupService()
+
+	events, unsubscribe := backupService.Events().Subscribe()
+	defer unsubscribe()
+
+	proceed := func(uploadSize int64) error {
+		_, err := backupService.Proceed(codegen.FolderBackup{
+			ClientID:               &clientID,
+			ClientFolderPath:       &clientFolderPath,
+			ClientFolderFileSizes:  &map[string]int64{"changed.bin": uploadSize},
+			ClientFolderFileHashes: &map[string]string{"changed.bin": "hash"},
+		})
+		return err
+	}
+
+	// not even pruning all history copies would make room for the upload, so nothing is touched
+	reserveAllBut(t, 2*mib)
+
+	err = proceed(100 * mib)
+	assert.ErrorIs(t, err, service.ErrInsufficientSpace)
+	assert.FileExists(t, filepath.Join(backupFolderFullPath, "changed.bin"))
+	assert.FileExists(t, filepath.Join(backupFolderFullPath, "old-backup-2020-01-01-00-00-00-000.bin"))
+	assert.FileExists(t, filepath.Join(backupFolderFullPath, "old-backup-2021-01-01-00-00-00-000.bin"))
+
+	event := <-events
+	assert.Equal(t, codegen.QuotaWarning, *event.Type)
+
+	event = <-events
+	assert.Equal(t, codegen.RunFailed, *event.Type)
+
+	// the changed file is moved instead of copied, and the oldest history copy makes room for the upload
+	reserveAllBut(t, 6*mib)
+
+	assert.NoError(t, proceed(10*mib))
+	assert.NoFileExists(t, filepath.Join(backupFolderFullPath, "changed.bin"))
+	assert.NoFileExists(t, filepath.Join(backupFolderFullPath, "old-backup-2020-01-01-00-00-00-000.bin"))
+	assert.FileExists(t, filepath.Join(backupFolderFullPath, "old-backup-2021-01-01-00-00-00-000.bin"))
+
+	event = <-events
+	assert.Equal(t, codegen.Pruned, *event.Type)
+	assert.Equal(t, 1, *event.FileCount)
+
+	// the quota warning has been published recently, so it is not again
+	event = <-events
+	assert.Equal(t, codegen.FileVersioned, *event.Type)
+
+	// uploads over WebDAV that would cross the reserve are refused
+	handler := backupService.GuardWebDAVSpace(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	webDAVPath := "/" + filepath.ToSlash(filepath.Join(common.BackupRootFolder, clientID, service.Normalize(clientFolderPath), "changed.bin"))
+
+	config.AppInfo.FreeSpaceReserve = math.MaxInt64
+
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodPut, webDAVPath, strings.NewReader("content")))
+	assert.Equal(t, http.StatusInsufficientStorage, recorder.Code)
+
+	config.AppInfo.FreeSpaceReserve = 0
+
+	recorder = httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodPut, webDAVPath, strings.NewReader("content")))
+	assert.Equal(t, http.StatusOK, recorder.Code)
+}
+
+func TestFreeSpaceGuardWithPathPolicy(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	defer func() { config.AppInfo.FreeSpaceReserve = 0 }()
+
+	storage := service.NewMemoryStorage("/DATA", service.SystemClock)
+	assert.NoError(t, storage.MkdirAll(filepath.Join(storage.Root(), common.BackupRootFolder), 0o755))
+
+	backupService := service.NewBackupServiceWith(storage, service.SystemClock)
+
+	clientID := "client1"
+	clientFolderPath := `C:\Users\icewhale\Downloads`
+
+	_, err := backupService.Proceed(codegen.FolderBackup{
+		ClientID:               &clientID,
+		ClientType:             lo.ToPtr("Windows"),
+		ClientFolderPath:       &clientFolderPath,
+		ClientFolderFileSizes:  &map[string]int64{},
+		ClientFolderFileHashes: &map[string]string{},
+	})
+	assert.NoError(t, err)
+
+	// a Windows client writes into its folder backup whatever the case of the path it asks for
+	handler := backupService.GuardWebDAVSpace(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	webDAVPath := "/" + filepath.ToSlash(filepath.Join(common.BackupRootFolder, clientID, strings.ToUpper(service.Normalize(clientFolderPath)), "a.txt"))
+
+	config.AppInfo.FreeSpaceReserve = math.MaxInt64
+
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodPut, webDAVPath, strings.NewReader("content")))
+	assert.Equal(t, http.StatusInsufficientStorage, recorder.Code)
+}
@@ -0,0 +1,249 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/IceWhaleTech/IceWhale-Files-Backup/common"
+	"github.com/IceWhaleTech/IceWhale-Files-Backup/internal/utils"
+	"github.com/IceWhaleTech/IceWhale-Files-Backup/model"
+	"golang.org/x/net/webdav"
+)
+
+var ErrInvalidStorage = errors.New("invalid storage")
+
+// Storage is where the folder backups are kept. Names are full paths under the data root, as the
+// service builds them from Root, so the same code works whichever storage is configured. Errors for
+// missing files match fs.ErrNotExist.
+type Storage interface {
+	// Root returns the data root the names are under.
+	Root() string
+
+	Stat(name string) (fs.FileInfo, error)
+
+	// ReadDir returns the entries of the folder sorted by name, like os.ReadDir.
+	ReadDir(name string) ([]fs.DirEntry, error)
+
+	// WalkDir walks the tree under root in lexical order, like filepath.WalkDir.
+	WalkDir(root string, fn fs.WalkDirFunc) error
+
+	Open(name string) (io.ReadSeekCloser, error)
+	ReadFile(name string) ([]byte, error)
+
+	// WriteFile replaces the file atomically, so it is never left partially written.
+	WriteFile(name string, data []byte, perm fs.FileMode) error
+
+	// Import moves the local file, e.g. a finished upload, to the name.
+	Import(localPath, name string) error
+
+	Rename(oldName, newName string) error
+	Copy(src, dst string) error
+	Remove(name string) error
+	RemoveAll(name string) error
+	MkdirAll(name string, perm fs.FileMode) error
+
+	// SizeAndCount returns the total size and the number of files under the folder.
+	SizeAndCount(name string) (int64, int, error)
+
+	// FreeSpace returns the bytes that can still be written.
+	FreeSpace() (uint64, error)
+
+	// WebDAV returns the data root to be served over WebDAV.
+	WebDAV() webdav.FileSystem
+}
+
+// storageFileInfo describes a file, or a folder, of a storage without file info of its own.
+type storageFileInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+	dir     bool
+}
+
+// OpenStorage returns the storage as configured, rooted at the data root.
+func OpenStorage(dataRootPath string, storage model.StorageModel) (Storage, error) {
+	switch storage.Type {
+	case "", "local":
+		return NewLocalStorage(dataRootPath), nil
+	case "s3":
+		return NewS3Storage(dataRootPath, storage)
+	default:
+		return nil, fmt.Errorf("%w: unknown type %q", ErrInvalidStorage, storage.Type)
+	}
+}
+
+// localStorage keeps the folder backups on the local file system.
+type localStorage struct {
+	root string
+}
+
+func NewLocalStorage(root string) Storage {
+	return &localStorage{root: root}
+}
+
+func (s *localStorage) Root() string {
+	return s.root
+}
+
+func (s *localStorage) Stat(name string) (fs.FileInfo, error) {
+	return os.Stat(name)
+}
+
+func (s *localStorage) ReadDir(name string) ([]fs.DirEntry, error) {
+	return os.ReadDir(name)
+}
+
+func (s *localStorage) WalkDir(root string, fn fs.WalkDirFunc) error {
+	return filepath.WalkDir(root, fn)
+}
+
+func (s *localStorage) Open(name string) (io.ReadSeekCloser, error) {
+	return os.Open(name)
+}
+
+func (s *localStorage) ReadFile(name string) ([]byte, error) {
+	return os.ReadFile(name)
+}
+
+func (s *localStorage) WriteFile(name string, data []byte, perm fs.FileMode) error {
+	return utils.WriteFileAtomic(name, data, perm)
+}
+
+func (s *localStorage) Import(localPath, name string) error {
+	return os.Rename(localPath, name)
+}
+
+func (s *localStorage) Rename(oldName, newName string) error {
+	return os.Rename(oldName, newName)
+}
+
+func (s *localStorage) Copy(src, dst string) error {
+	return copyFile(src, dst)
+}
+
+func (s *localStorage) Remove(name string) error {
+	return os.Remove(name)
+}
+
+func (s *localStorage) RemoveAll(name string) error {
+	return os.RemoveAll(name)
+}
+
+func (s *localStorage) MkdirAll(name string, perm fs.FileMode) error {
+	return os.MkdirAll(name, perm)
+}
+
+func (s *localStorage) SizeAndCount(name string) (int64, int, error) {
+	return utils.SizeAndCount(name, common.Throttling)
+}
+
+func (s *localStorage) FreeSpace() (uint64, error) {
+	return utils.FreeSpace(s.root)
+}
+
+func (s *localStorage) WebDAV() webdav.FileSystem {
+	return webdav.Dir(s.root)
+}
+
+func copyFile(src, dst string) error {
+	srcFile, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer srcFile.Close()
+
+	dstFile, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	defer dstFile.Close()
+
+	// a copy shares the data where the file system can, and is written out otherwise
+	if err := cloneFile(dstFile, srcFile); err == nil {
+		return nil
+	}
+
+	_, err = io.Copy(dstFile, srcFile)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// walkDir walks the tree under root with Stat and ReadDir of the storage, for storages without a faster
+// way to do it. It follows the semantics of filepath.WalkDir.
+func walkDir(storage Storage, root string, fn fs.WalkDirFunc) error {
+	info, err := storage.Stat(root)
+	if err != nil {
+		err = fn(root, nil, err)
+	} else {
+		err = walkDirEntry(storage, root, fs.FileInfoToDirEntry(info), fn)
+	}
+
+	if errors.Is(err, fs.SkipDir) || errors.Is(err, fs.SkipAll) {
+		return nil
+	}
+
+	return err
+}
+
+func walkDirEntry(storage Storage, name string, d fs.DirEntry, fn fs.WalkDirFunc) error {
+	if err := fn(name, d, nil); err != nil || !d.IsDir() {
+		if errors.Is(err, fs.SkipDir) && d.IsDir() {
+			err = nil
+		}
+		return err
+	}
+
+	entries, err := storage.ReadDir(name)
+	if err != nil {
+		// give the function a second chance to handle the failure, as filepath.WalkDir does
+		if err = fn(name, d, err); err != nil {
+			if errors.Is(err, fs.SkipDir) {
+				err = nil
+			}
+			return err
+		}
+	}
+
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+
+	for _, entry := range entries {
+		if err := walkDirEntry(storage, filepath.Join(name, entry.Name()), entry, fn); err != nil {
+			if errors.Is(err, fs.SkipDir) {
+				break
+			}
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (i *storageFileInfo) Name() string { return i.name }
+
+func (i *storageFileInfo) Size() int64 { return i.size }
+
+func (i *storageFileInfo) Mode() fs.FileMode {
+	if i.dir {
+		return fs.ModeDir | 0o755
+	}
+	return 0o644
+}
+
+func (i *storageFileInfo) ModTime() time.Time { return i.modTime }
+
+func (i *storageFileInfo) IsDir() bool { return i.dir }
+
+func (i *storageFileInfo) Sys() any { return nil }
+
+func (i *storageFileInfo) Type() fs.FileMode { return i.Mode().Type() }
+
+func (i *storageFileInfo) Info() (fs.FileInfo, error) { return i, nil }
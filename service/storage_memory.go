@@ -0,0 +1,447 @@
+package service
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/webdav"
+)
+
+// memoryStorage keeps the folder backups in memory, following the semantics of the local file system.
+// Everything is gone once the process exits, so it is meant for tests.
+type memoryStorage struct {
+	root  string
+	clock Clock
+
+	mutex *sync.RWMutex
+	files map[string]memoryFile
+	dirs  map[string]time.Time
+}
+
+type memoryFile struct {
+	data    []byte
+	modTime time.Time
+}
+
+// memoryReader reads a snapshot of a file, which isn't affected by later writes to the file.
+type memoryReader struct {
+	*bytes.Reader
+}
+
+// NewMemoryStorage returns an empty storage kept in memory, telling modification times by the clock.
+func NewMemoryStorage(root string, clock Clock) Storage {
+	root = filepath.Clean(root)
+
+	return &memoryStorage{
+		root:  root,
+		clock: clock,
+
+		mutex: &sync.RWMutex{},
+		files: map[string]memoryFile{},
+		dirs:  map[string]time.Time{root: clock.Now()},
+	}
+}
+
+func (s *memoryStorage) Root() string {
+	return s.root
+}
+
+// resolve returns the cleaned name, which must be the data root or under it.
+func (s *memoryStorage) resolve(op, name string) (string, error) {
+	name = filepath.Clean(name)
+
+	if name != s.root && !strings.HasPrefix(name, s.root+string(filepath.Separator)) {
+		return "", &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+
+	return name, nil
+}
+
+func (s *memoryStorage) Stat(name string) (fs.FileInfo, error) {
+	name, err := s.resolve("stat", name)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	return s.stat("stat", name)
+}
+
+func (s *memoryStorage) stat(op, name string) (*storageFileInfo, error) {
+	if file, ok := s.files[name]; ok {
+		return &storageFileInfo{name: filepath.Base(name), size: int64(len(file.data)), modTime: file.modTime}, nil
+	}
+
+	if modTime, ok := s.dirs[name]; ok {
+		return &storageFileInfo{name: filepath.Base(name), modTime: modTime, dir: true}, nil
+	}
+
+	return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+}
+
+func (s *memoryStorage) ReadDir(name string) ([]fs.DirEntry, error) {
+	name, err := s.resolve("readdir", name)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	if err := s.checkDir("readdir", name); err != nil {
+		return nil, err
+	}
+
+	entries := []fs.DirEntry{}
+
+	for fileName := range s.files {
+		if filepath.Dir(fileName) == name {
+			info, _ := s.stat("readdir", fileName)
+			entries = append(entries, info)
+		}
+	}
+
+	for dirName := range s.dirs {
+		if dirName != name && filepath.Dir(dirName) == name {
+			info, _ := s.stat("readdir", dirName)
+			entries = append(entries, info)
+		}
+	}
+
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+
+	return entries, nil
+}
+
+func (s *memoryStorage) WalkDir(root string, fn fs.WalkDirFunc) error {
+	return walkDir(s, root, fn)
+}
+
+func (s *memoryStorage) Open(name string) (io.ReadSeekCloser, error) {
+	data, err := s.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+
+	return &memoryReader{Reader: bytes.NewReader(data)}, nil
+}
+
+func (s *memoryStorage) ReadFile(name string) ([]byte, error) {
+	name, err := s.resolve("open", name)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	file, ok := s.files[name]
+	if !ok {
+		if _, ok := s.dirs[name]; ok {
+			return nil, &fs.PathError{Op: "read", Path: name, Err: errors.New("is a directory")}
+		}
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+
+	// files are replaced rather than modified in place, so the data can be shared
+	return file.data, nil
+}
+
+func (s *memoryStorage) WriteFile(name string, data []byte, perm fs.FileMode) error {
+	name, err := s.resolve("write", name)
+	if err != nil {
+		return err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.put("write", name, bytes.Clone(data))
+}
+
+// put replaces the file, provided its folder exists, as creating a file with os.WriteFile does.
+func (s *memoryStorage) put(op, name string, data []byte) error {
+	if _, ok := s.dirs[name]; ok {
+		return &fs.PathError{Op: op, Path: name, Err: errors.New("is a directory")}
+	}
+
+	if err := s.checkDir(op, filepath.Dir(name)); err != nil {
+		return err
+	}
+
+	s.files[name] = memoryFile{data: data, modTime: s.clock.Now()}
+
+	return nil
+}
+
+func (s *memoryStorage) Import(localPath, name string) error {
+	name, err := s.resolve("import", name)
+	if err != nil {
+		return err
+	}
+
+	data, err := os.ReadFile(localPath)
+	if err != nil {
+		return err
+	}
+
+	s.mutex.Lock()
+	err = s.put("import", name, data)
+	s.mutex.Unlock()
+
+	if err != nil {
+		return err
+	}
+
+	return os.Remove(localPath)
+}
+
+// Rename moves the file, or the folder with everything under it, as os.Rename does.
+func (s *memoryStorage) Rename(oldName, newName string) error {
+	oldName, err := s.resolve("rename", oldName)
+	if err != nil {
+		return err
+	}
+
+	newName, err = s.resolve("rename", newName)
+	if err != nil {
+		return err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if oldName == newName {
+		_, err := s.stat("rename", oldName)
+		return err
+	}
+
+	if file, ok := s.files[oldName]; ok {
+		if err := s.put("rename", newName, file.data); err != nil {
+			return err
+		}
+
+		// a renamed file keeps its modification time
+		s.files[newName] = file
+		delete(s.files, oldName)
+
+		return nil
+	}
+
+	if _, ok := s.dirs[oldName]; !ok {
+		return &fs.PathError{Op: "rename", Path: oldName, Err: fs.ErrNotExist}
+	}
+
+	if oldName == s.root || strings.HasPrefix(newName, oldName+string(filepath.Separator)) {
+		return &fs.PathError{Op: "rename", Path: oldName, Err: fs.ErrInvalid}
+	}
+
+	if _, err := s.stat("rename", newName); err == nil {
+		return &fs.PathError{Op: "rename", Path: newName, Err: fs.ErrExist}
+	}
+
+	if err := s.checkDir("rename", filepath.Dir(newName)); err != nil {
+		return err
+	}
+
+	for fileName, file := range s.files {
+		if relativePath, ok := s.under(oldName, fileName); ok {
+			s.files[filepath.Join(newName, relativePath)] = file
+			delete(s.files, fileName)
+		}
+	}
+
+	for dirName, modTime := range s.dirs {
+		if relativePath, ok := s.under(oldName, dirName); ok {
+			s.dirs[filepath.Join(newName, relativePath)] = modTime
+			delete(s.dirs, dirName)
+		}
+	}
+
+	s.dirs[newName] = s.dirs[oldName]
+	delete(s.dirs, oldName)
+
+	return nil
+}
+
+func (s *memoryStorage) Copy(src, dst string) error {
+	data, err := s.ReadFile(src)
+	if err != nil {
+		return err
+	}
+
+	dst, err = s.resolve("copy", dst)
+	if err != nil {
+		return err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.put("copy", dst, data)
+}
+
+func (s *memoryStorage) Remove(name string) error {
+	name, err := s.resolve("remove", name)
+	if err != nil {
+		return err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if _, ok := s.files[name]; ok {
+		delete(s.files, name)
+		return nil
+	}
+
+	if _, ok := s.dirs[name]; !ok {
+		return &fs.PathError{Op: "remove", Path: name, Err: fs.ErrNotExist}
+	}
+
+	if name == s.root || s.hasChildren(name) {
+		return &fs.PathError{Op: "remove", Path: name, Err: errors.New("directory not empty")}
+	}
+
+	delete(s.dirs, name)
+
+	return nil
+}
+
+func (s *memoryStorage) RemoveAll(name string) error {
+	name, err := s.resolve("removeall", name)
+	if err != nil {
+		return err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	delete(s.files, name)
+
+	for fileName := range s.files {
+		if _, ok := s.under(name, fileName); ok {
+			delete(s.files, fileName)
+		}
+	}
+
+	for dirName := range s.dirs {
+		if _, ok := s.under(name, dirName); ok {
+			delete(s.dirs, dirName)
+		}
+	}
+
+	if name != s.root {
+		delete(s.dirs, name)
+	}
+
+	return nil
+}
+
+func (s *memoryStorage) MkdirAll(name string, perm fs.FileMode) error {
+	name, err := s.resolve("mkdir", name)
+	if err != nil {
+		return err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for dirName := name; ; dirName = filepath.Dir(dirName) {
+		if _, ok := s.files[dirName]; ok {
+			return &fs.PathError{Op: "mkdir", Path: dirName, Err: errors.New("not a directory")}
+		}
+
+		if _, ok := s.dirs[dirName]; ok {
+			break
+		}
+
+		s.dirs[dirName] = s.clock.Now()
+	}
+
+	return nil
+}
+
+func (s *memoryStorage) SizeAndCount(name string) (int64, int, error) {
+	name, err := s.resolve("size", name)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	size := int64(0)
+	count := 0
+
+	for fileName, file := range s.files {
+		if _, ok := s.under(name, fileName); ok {
+			size += int64(len(file.data))
+			count++
+		}
+	}
+
+	return size, count, nil
+}
+
+// FreeSpace is unlimited, as far as the storage is concerned.
+func (s *memoryStorage) FreeSpace() (uint64, error) {
+	return math.MaxInt64, nil
+}
+
+func (s *memoryStorage) WebDAV() webdav.FileSystem {
+	return &storageFileSystem{storage: s, root: s.root}
+}
+
+// checkDir returns an error unless the name is an existing folder.
+func (s *memoryStorage) checkDir(op, name string) error {
+	if _, ok := s.dirs[name]; ok {
+		return nil
+	}
+
+	if _, ok := s.files[name]; ok {
+		return &fs.PathError{Op: op, Path: name, Err: errors.New("not a directory")}
+	}
+
+	return &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+}
+
+// under returns the path of the name relative to the folder, if it is under the folder.
+func (s *memoryStorage) under(folder, name string) (string, bool) {
+	if !strings.HasPrefix(name, folder+string(filepath.Separator)) {
+		return "", false
+	}
+
+	return strings.TrimPrefix(name, folder+string(filepath.Separator)), true
+}
+
+func (s *memoryStorage) hasChildren(name string) bool {
+	for fileName := range s.files {
+		if filepath.Dir(fileName) == name {
+			return true
+		}
+	}
+
+	for dirName := range s.dirs {
+		if dirName != name && filepath.Dir(dirName) == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (r *memoryReader) Close() error {
+	return nil
+}
@@ -0,0 +1,394 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"math"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/IceWhaleTech/IceWhale-Files-Backup/model"
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+	"golang.org/x/net/webdav"
+)
+
+const s3MaxCopyObjectSize = 5 << 30
+
+// s3Storage keeps the folder backups as objects in a bucket of an S3-compatible service, keyed by their
+// path under the data root after the prefix. Folders only exist through the objects under them.
+type s3Storage struct {
+	root   string
+	bucket string
+	prefix string
+
+	client *minio.Client
+}
+
+func NewS3Storage(root string, storage model.StorageModel) (Storage, error) {
+	if storage.Endpoint == "" || storage.Bucket == "" {
+		return nil, fmt.Errorf("%w: endpoint and bucket of s3 storage must be set", ErrInvalidStorage)
+	}
+
+	client, err := minio.New(storage.Endpoint, &minio.Options{
+		Creds:  credentials.NewStaticV4(storage.AccessKeyID, storage.SecretAccessKey, ""),
+		Secure: storage.UseSSL,
+		Region: storage.Region,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	prefix := strings.Trim(storage.Prefix, "/")
+	if prefix != "" {
+		prefix += "/"
+	}
+
+	return &s3Storage{
+		root:   root,
+		bucket: storage.Bucket,
+		prefix: prefix,
+		client: client,
+	}, nil
+}
+
+// key returns the key of the object at the name, which is empty for the data root itself.
+func (s *s3Storage) key(op, name string) (string, error) {
+	relativePath, err := filepath.Rel(s.root, name)
+	if err != nil || relativePath == ".." || strings.HasPrefix(relativePath, ".."+string(filepath.Separator)) {
+		return "", &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+
+	if relativePath == "." {
+		return "", nil
+	}
+
+	return s.prefix + filepath.ToSlash(relativePath), nil
+}
+
+// folderPrefix returns the prefix of the keys of the objects under the folder with the key.
+func (s *s3Storage) folderPrefix(key string) string {
+	if key == "" {
+		return s.prefix
+	}
+	return key + "/"
+}
+
+func (s *s3Storage) Root() string {
+	return s.root
+}
+
+func (s *s3Storage) Stat(name string) (fs.FileInfo, error) {
+	key, err := s.key("stat", name)
+	if err != nil {
+		return nil, err
+	}
+
+	if key == "" {
+		return &storageFileInfo{name: filepath.Base(name), dir: true}, nil
+	}
+
+	object, err := s.client.StatObject(context.Background(), s.bucket, key, minio.StatObjectOptions{})
+	if err == nil {
+		return &storageFileInfo{name: path.Base(key), size: object.Size, modTime: object.LastModified}, nil
+	}
+
+	if !isS3NotFound(err) {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: err}
+	}
+
+	// stop listing once an object is found
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	for object := range s.client.ListObjects(ctx, s.bucket, minio.ListObjectsOptions{Prefix: key + "/", MaxKeys: 1}) {
+		if object.Err != nil {
+			return nil, &fs.PathError{Op: "stat", Path: name, Err: object.Err}
+		}
+
+		return &storageFileInfo{name: path.Base(key), dir: true}, nil
+	}
+
+	return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrNotExist}
+}
+
+func (s *s3Storage) ReadDir(name string) ([]fs.DirEntry, error) {
+	key, err := s.key("readdir", name)
+	if err != nil {
+		return nil, err
+	}
+
+	prefix := s.folderPrefix(key)
+	entries := []fs.DirEntry{}
+
+	for object := range s.client.ListObjects(context.Background(), s.bucket, minio.ListObjectsOptions{Prefix: prefix}) {
+		if object.Err != nil {
+			return nil, &fs.PathError{Op: "readdir", Path: name, Err: object.Err}
+		}
+
+		entryName := strings.TrimPrefix(object.Key, prefix)
+
+		if strings.HasSuffix(entryName, "/") {
+			entries = append(entries, &storageFileInfo{name: strings.TrimSuffix(entryName, "/"), dir: true})
+		} else if entryName != "" {
+			entries = append(entries, &storageFileInfo{name: entryName, size: object.Size, modTime: object.LastModified})
+		}
+	}
+
+	if len(entries) == 0 && key != "" {
+		if _, err := s.Stat(name); err != nil {
+			return nil, err
+		}
+	}
+
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+
+	return entries, nil
+}
+
+func (s *s3Storage) WalkDir(root string, fn fs.WalkDirFunc) error {
+	return walkDir(s, root, fn)
+}
+
+func (s *s3Storage) Open(name string) (io.ReadSeekCloser, error) {
+	key, err := s.key("open", name)
+	if err != nil {
+		return nil, err
+	}
+
+	object, err := s.client.GetObject(context.Background(), s.bucket, key, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+
+	// the object is only requested once it is read, so check it exists right away
+	if _, err := object.Stat(); err != nil {
+		object.Close()
+
+		if isS3NotFound(err) {
+			return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+		}
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+
+	return object, nil
+}
+
+func (s *s3Storage) ReadFile(name string) ([]byte, error) {
+	object, err := s.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer object.Close()
+
+	return io.ReadAll(object)
+}
+
+func (s *s3Storage) WriteFile(name string, data []byte, perm fs.FileMode) error {
+	key, err := s.key("write", name)
+	if err != nil {
+		return err
+	}
+
+	// an object is replaced atomically by the service
+	_, err = s.client.PutObject(context.Background(), s.bucket, key, bytes.NewReader(data), int64(len(data)), minio.PutObjectOptions{
+		ContentType: "application/octet-stream",
+	})
+	return err
+}
+
+func (s *s3Storage) Import(localPath, name string) error {
+	key, err := s.key("import", name)
+	if err != nil {
+		return err
+	}
+
+	if _, err := s.client.FPutObject(context.Background(), s.bucket, key, localPath, minio.PutObjectOptions{
+		ContentType: "application/octet-stream",
+	}); err != nil {
+		return err
+	}
+
+	return os.Remove(localPath)
+}
+
+// Rename copies the object, or all objects under the folder, to the new name and deletes the original.
+func (s *s3Storage) Rename(oldName, newName string) error {
+	oldKey, err := s.key("rename", oldName)
+	if err != nil {
+		return err
+	}
+
+	newKey, err := s.key("rename", newName)
+	if err != nil {
+		return err
+	}
+
+	info, err := s.Stat(oldName)
+	if err != nil {
+		return err
+	}
+
+	if !info.IsDir() {
+		if err := s.copyObject(oldKey, newKey); err != nil {
+			return err
+		}
+
+		return s.client.RemoveObject(context.Background(), s.bucket, oldKey, minio.RemoveObjectOptions{})
+	}
+
+	oldPrefix := s.folderPrefix(oldKey)
+	newPrefix := s.folderPrefix(newKey)
+
+	keys, err := s.listKeys(oldPrefix)
+	if err != nil {
+		return err
+	}
+
+	for _, key := range keys {
+		if err := s.copyObject(key, newPrefix+strings.TrimPrefix(key, oldPrefix)); err != nil {
+			return err
+		}
+
+		if err := s.client.RemoveObject(context.Background(), s.bucket, key, minio.RemoveObjectOptions{}); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *s3Storage) Copy(src, dst string) error {
+	srcKey, err := s.key("copy", src)
+	if err != nil {
+		return err
+	}
+
+	dstKey, err := s.key("copy", dst)
+	if err != nil {
+		return err
+	}
+
+	return s.copyObject(srcKey, dstKey)
+}
+
+// copyObject copies the object within the service. A single copy is limited in size, so larger objects
+// are copied part by part.
+func (s *s3Storage) copyObject(srcKey, dstKey string) error {
+	src := minio.CopySrcOptions{Bucket: s.bucket, Object: srcKey}
+	dst := minio.CopyDestOptions{Bucket: s.bucket, Object: dstKey}
+
+	object, err := s.client.StatObject(context.Background(), s.bucket, srcKey, minio.StatObjectOptions{})
+	if err != nil {
+		return err
+	}
+
+	if object.Size <= s3MaxCopyObjectSize {
+		_, err = s.client.CopyObject(context.Background(), dst, src)
+	} else {
+		_, err = s.client.ComposeObject(context.Background(), dst, src)
+	}
+
+	return err
+}
+
+func (s *s3Storage) Remove(name string) error {
+	key, err := s.key("remove", name)
+	if err != nil {
+		return err
+	}
+
+	// deleting a missing object succeeds, so check first to behave like os.Remove
+	if _, err := s.Stat(name); err != nil {
+		return err
+	}
+
+	return s.client.RemoveObject(context.Background(), s.bucket, key, minio.RemoveObjectOptions{})
+}
+
+func (s *s3Storage) RemoveAll(name string) error {
+	key, err := s.key("removeall", name)
+	if err != nil {
+		return err
+	}
+
+	keys, err := s.listKeys(s.folderPrefix(key))
+	if err != nil {
+		return err
+	}
+
+	if key != "" {
+		keys = append(keys, key)
+	}
+
+	for _, key := range keys {
+		if err := s.client.RemoveObject(context.Background(), s.bucket, key, minio.RemoveObjectOptions{}); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// MkdirAll does nothing, since folders come into being with the objects under them.
+func (s *s3Storage) MkdirAll(name string, perm fs.FileMode) error {
+	_, err := s.key("mkdir", name)
+	return err
+}
+
+func (s *s3Storage) SizeAndCount(name string) (int64, int, error) {
+	key, err := s.key("size", name)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	size := int64(0)
+	count := 0
+
+	for object := range s.client.ListObjects(context.Background(), s.bucket, minio.ListObjectsOptions{Prefix: s.folderPrefix(key), Recursive: true}) {
+		if object.Err != nil {
+			return 0, 0, object.Err
+		}
+
+		size += object.Size
+		count++
+	}
+
+	return size, count, nil
+}
+
+// FreeSpace is unlimited as far as the service can tell. Quotas of the bucket, if any, surface as
+// failed writes.
+func (s *s3Storage) FreeSpace() (uint64, error) {
+	return math.MaxInt64, nil
+}
+
+func (s *s3Storage) WebDAV() webdav.FileSystem {
+	return &storageFileSystem{storage: s, root: s.root}
+}
+
+func (s *s3Storage) listKeys(prefix string) ([]string, error) {
+	keys := []string{}
+
+	for object := range s.client.ListObjects(context.Background(), s.bucket, minio.ListObjectsOptions{Prefix: prefix, Recursive: true}) {
+		if object.Err != nil {
+			return nil, object.Err
+		}
+
+		keys = append(keys, object.Key)
+	}
+
+	return keys, nil
+}
+
+func isS3NotFound(err error) bool {
+	response := minio.ToErrorResponse(err)
+	return response.StatusCode == http.StatusNotFound || response.Code == "NoSuchKey"
+}
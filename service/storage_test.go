@@ -0,0 +1,363 @@
+package service_test
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/IceWhaleTech/IceWhale-Files-Backup/codegen"
+	"github.com/IceWhaleTech/IceWhale-Files-Backup/common"
+	"github.com/IceWhaleTech/IceWhale-Files-Backup/model"
+	"github.com/IceWhaleTech/IceWhale-Files-Backup/service"
+	"github.com/samber/lo"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/goleak"
+	"golang.org/x/net/webdav"
+)
+
+func TestOpenStorage(t *testing.T) {
+	storage, err := service.OpenStorage("/DATA", model.StorageModel{})
+	assert.NoError(t, err)
+	assert.NotNil(t, storage)
+
+	_, err = service.OpenStorage("/DATA", model.StorageModel{Type: "ftp"})
+	assert.ErrorIs(t, err, service.ErrInvalidStorage)
+
+	// s3 storage without a bucket
+	_, err = service.OpenStorage("/DATA", model.StorageModel{Type: "s3", Endpoint: "s3.example.com"})
+	assert.ErrorIs(t, err, service.ErrInvalidStorage)
+}
+
+func TestS3Storage(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	s3 := &fakeS3{bucket: "backups", objects: map[string][]byte{}}
+	s3Server := httptest.NewServer(s3)
+	defer s3Server.Close()
+
+	dataRoot := filepath.Join(os.TempDir(), "DATA")
+
+	storage, err := service.OpenStorage(dataRoot, model.StorageModel{
+		Type:            "s3",
+		Endpoint:        strings.TrimPrefix(s3Server.URL, "http://"),
+		Bucket:          "backups",
+		Prefix:          "zima",
+		Region:          "us-east-1",
+		AccessKeyID:     "access",
+		SecretAccessKey: "secret",
+	})
+	assert.NoError(t, err)
+
+	clientFolderPath := `C:\Users\icewhale\Documents`
+	backupFolderPath := filepath.Join(common.BackupRootFolder, "client1", service.Normalize(clientFolderPath))
+	backupFolderFullPath := filepath.Join(dataRoot, backupFolderPath)
+	filePath := filepath.Join(backupFolderFullPath, "a.txt")
+
+	// paths outside of the data root are refused
+	_, err = storage.Stat(filepath.Join(os.TempDir(), "a.txt"))
+	assert.ErrorIs(t, err, fs.ErrInvalid)
+
+	_, err = storage.Stat(filePath)
+	assert.ErrorIs(t, err, fs.ErrNotExist)
+
+	_, err = storage.Open(filePath)
+	assert.ErrorIs(t, err, fs.ErrNotExist)
+
+	assert.ErrorIs(t, storage.Remove(filePath), fs.ErrNotExist)
+
+	assert.NoError(t, storage.WriteFile(filePath, []byte("a"), 0o644))
+	assert.Contains(t, s3.objects, "zima/"+filepath.ToSlash(filepath.Join(common.BackupRootFolder, "client1", "C/Users/icewhale/Documents", "a.txt")))
+
+	content, err := storage.ReadFile(filePath)
+	assert.NoError(t, err)
+	assert.Equal(t, "a", string(content))
+
+	// folders exist through the objects under them
+	info, err := storage.Stat(backupFolderFullPath)
+	assert.NoError(t, err)
+	assert.True(t, info.IsDir())
+
+	// metadata and manifests are kept in the storage too
+	assert.NoError(t, service.SaveMetadata(storage, &codegen.FolderBackup{
+		BackupFolderPath: &backupFolderPath,
+		ClientFolderPath: &clientFolderPath,
+		ClientID:         lo.ToPtr("client1"),
+	}))
+
+	backups, err := service.GetBackupsByPath(storage, filepath.Join(dataRoot, common.BackupRootFolder, "client1"), false)
+	assert.NoError(t, err)
+	assert.Len(t, backups, 1)
+
+	entries, err := storage.ReadDir(backupFolderFullPath)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{common.MetadataFileName, "a.txt"}, entryNames(entries))
+
+	// history copies are made within the service
+	backupPath, err := service.BackupFile(storage, filePath, false, time.Now())
+	assert.NoError(t, err)
+
+	content, err = storage.ReadFile(backupPath)
+	assert.NoError(t, err)
+	assert.Equal(t, "a", string(content))
+
+	nonBackupFiles, err := service.FilterBackupFiles(storage, backupFolderFullPath)
+	assert.NoError(t, err)
+	assert.Len(t, nonBackupFiles, 1)
+
+	walked := []string{}
+	assert.NoError(t, storage.WalkDir(backupFolderFullPath, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if d.Name() == common.MetadataFileName {
+			return nil
+		}
+
+		relativePath, _ := filepath.Rel(backupFolderFullPath, path)
+		walked = append(walked, relativePath)
+		return nil
+	}))
+	assert.Equal(t, []string{".", filepath.Base(backupPath), "a.txt"}, walked)
+
+	size, count, err := storage.SizeAndCount(backupFolderFullPath)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, count)
+	assert.Greater(t, size, int64(2))
+
+	// renaming a folder moves everything under it
+	renamedFolderFullPath := filepath.Join(dataRoot, common.BackupRootFolder, "client1", "renamed")
+	assert.NoError(t, storage.Rename(backupFolderFullPath, renamedFolderFullPath))
+
+	_, err = storage.Stat(backupFolderFullPath)
+	assert.ErrorIs(t, err, fs.ErrNotExist)
+
+	_, renamedCount, err := storage.SizeAndCount(renamedFolderFullPath)
+	assert.NoError(t, err)
+	assert.Equal(t, count, renamedCount)
+
+	assert.NoError(t, storage.RemoveAll(renamedFolderFullPath))
+	assert.Empty(t, s3.objects)
+}
+
+func TestS3StorageWebDAV(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	s3 := &fakeS3{bucket: "backups", objects: map[string][]byte{}}
+	s3Server := httptest.NewServer(s3)
+	defer s3Server.Close()
+
+	dataRoot := filepath.Join(os.TempDir(), "DATA")
+
+	storage, err := service.NewS3Storage(dataRoot, model.StorageModel{
+		Endpoint:        strings.TrimPrefix(s3Server.URL, "http://"),
+		Bucket:          "backups",
+		Region:          "us-east-1",
+		AccessKeyID:     "access",
+		SecretAccessKey: "secret",
+	})
+	assert.NoError(t, err)
+
+	handler := &webdav.Handler{
+		FileSystem: storage.WebDAV(),
+		LockSystem: webdav.NewMemLS(),
+	}
+
+	request := func(method, name, body string) *httptest.ResponseRecorder {
+		request := httptest.NewRequest(method, "/"+filepath.ToSlash(filepath.Join(common.BackupRootFolder, "client1", name)), strings.NewReader(body))
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, request)
+		return recorder
+	}
+
+	assert.Equal(t, http.StatusCreated, request(http.MethodPut, "a.txt", "a").Code)
+	assert.Equal(t, http.StatusCreated, request(http.MethodPut, "b.txt", "b").Code)
+
+	// uploaded to the storage once written
+	content, err := storage.ReadFile(filepath.Join(dataRoot, common.BackupRootFolder, "client1", "a.txt"))
+	assert.NoError(t, err)
+	assert.Equal(t, "a", string(content))
+
+	response := request(http.MethodGet, "a.txt", "")
+	assert.Equal(t, http.StatusOK, response.Code)
+	body, err := io.ReadAll(response.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, "a", string(body))
+
+	// overwritten in place
+	assert.Equal(t, http.StatusCreated, request(http.MethodPut, "a.txt", "new a").Code)
+	assert.Equal(t, "new a", request(http.MethodGet, "a.txt", "").Body.String())
+
+	response = request("PROPFIND", "", "")
+	assert.Equal(t, http.StatusMultiStatus, response.Code)
+	assert.Contains(t, response.Body.String(), "b.txt")
+
+	assert.Equal(t, http.StatusNoContent, request(http.MethodDelete, "b.txt", "").Code)
+	assert.Equal(t, http.StatusNotFound, request(http.MethodGet, "b.txt", "").Code)
+}
+
+func entryNames(entries []fs.DirEntry) []string {
+	names := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	return names
+}
+
+// fixedClock tells the time it is set to.
+type fixedClock struct {
+	now time.Time
+}
+
+func (c *fixedClock) Now() time.Time {
+	return c.now
+}
+
+// failingStorage fails to make history copies, as a full or broken disk would.
+type failingStorage struct {
+	service.Storage
+
+	err error
+}
+
+func (s *failingStorage) Copy(src, dst string) error {
+	return s.err
+}
+
+func (s *failingStorage) Rename(oldName, newName string) error {
+	return s.err
+}
+
+func TestMemoryStorage(t *testing.T) {
+	dataRoot := filepath.Join(os.TempDir(), "DATA")
+	clock := &fixedClock{now: time.Date(2023, 4, 10, 12, 0, 0, 0, time.UTC)}
+
+	storage := service.NewMemoryStorage(dataRoot, clock)
+	folderPath := filepath.Join(dataRoot, "a", "b")
+
+	// like a local file system, files can't be written to a missing folder
+	assert.ErrorIs(t, storage.WriteFile(filepath.Join(folderPath, "a.txt"), []byte("a"), 0o644), fs.ErrNotExist)
+
+	assert.NoError(t, storage.MkdirAll(folderPath, 0o755))
+	assert.NoError(t, storage.WriteFile(filepath.Join(folderPath, "b.txt"), []byte("b"), 0o644))
+	assert.NoError(t, storage.WriteFile(filepath.Join(folderPath, "a.txt"), []byte("a"), 0o644))
+	assert.NoError(t, storage.MkdirAll(filepath.Join(folderPath, "c"), 0o755))
+
+	entries, err := storage.ReadDir(folderPath)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a.txt", "b.txt", "c"}, entryNames(entries))
+
+	info, err := storage.Stat(filepath.Join(folderPath, "a.txt"))
+	assert.NoError(t, err)
+	assert.Equal(t, clock.now, info.ModTime())
+
+	_, err = storage.Stat(filepath.Join(os.TempDir(), "a.txt"))
+	assert.ErrorIs(t, err, fs.ErrInvalid)
+
+	assert.Error(t, storage.Remove(folderPath), "folder isn't empty")
+
+	assert.NoError(t, storage.Rename(filepath.Join(dataRoot, "a"), filepath.Join(dataRoot, "renamed")))
+
+	content, err := storage.ReadFile(filepath.Join(dataRoot, "renamed", "b", "a.txt"))
+	assert.NoError(t, err)
+	assert.Equal(t, "a", string(content))
+
+	size, count, err := storage.SizeAndCount(dataRoot)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(2), size)
+	assert.Equal(t, 2, count)
+
+	assert.NoError(t, storage.RemoveAll(filepath.Join(dataRoot, "renamed")))
+
+	entries, err = storage.ReadDir(dataRoot)
+	assert.NoError(t, err)
+	assert.Empty(t, entries)
+}
+
+func TestBackupServiceCreatesBackupRootInStorage(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	tmpDataRootDir, err := os.MkdirTemp("", "test")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tmpDataRootDir)
+
+	storage := service.NewMemoryStorage(tmpDataRootDir, service.SystemClock)
+	service.NewBackupServiceWith(storage, service.SystemClock)
+
+	info, err := storage.Stat(filepath.Join(tmpDataRootDir, common.BackupRootFolder))
+	assert.NoError(t, err)
+	assert.True(t, info.IsDir())
+
+	// not on the local file system
+	_, err = os.Stat(filepath.Join(tmpDataRootDir, common.BackupRootFolder))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestBackupServiceWithMemoryStorage(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	// locks are still kept on the local file system
+	tmpDataRootDir, err := os.MkdirTemp("", "test")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tmpDataRootDir)
+
+	clock := &fixedClock{now: time.Date(2023, 4, 10, 12, 0, 0, 0, time.UTC)}
+	storage := service.NewMemoryStorage(tmpDataRootDir, clock)
+
+	clientID := "client1"
+	clientFolderPath := `C:\Users\icewhale\Downloads`
+
+	backupFolderFullPath := filepath.Join(tmpDataRootDir, common.BackupRootFolder, clientID, service.Normalize(clientFolderPath))
+	assert.NoError(t, storage.MkdirAll(backupFolderFullPath, 0o755))
+	assert.NoError(t, storage.WriteFile(filepath.Join(backupFolderFullPath, "a.txt"), []byte("old a"), 0o644))
+	assert.NoError(t, storage.WriteFile(filepath.Join(backupFolderFullPath, "b.txt"), []byte("old b"), 0o644))
+
+	request := func(clientFiles map[string]string) codegen.FolderBackup {
+		sizes := map[string]int64{}
+		hashes := map[string]string{}
+		for name, content := range clientFiles {
+			hash, err := service.XXHashReader(strings.NewReader(content))
+			assert.NoError(t, err)
+
+			sizes[name] = int64(len(content))
+			hashes[name] = hash
+		}
+
+		return codegen.FolderBackup{
+			ClientID:               &clientID,
+			ClientFolderPath:       &clientFolderPath,
+			ClientFolderFileSizes:  &sizes,
+			ClientFolderFileHashes: &hashes,
+		}
+	}
+
+	_, err = service.NewBackupServiceWith(storage, clock).Proceed(request(map[string]string{"a.txt": "new a!", "b.txt": "old b"}))
+	assert.NoError(t, err)
+
+	// history copies are named after the time of the clock
+	content, err := storage.ReadFile(filepath.Join(backupFolderFullPath, "a-backup-2023-04-10-12-00-00-000Z.txt"))
+	assert.NoError(t, err)
+	assert.Equal(t, "old a", string(content))
+
+	// nothing of the folder backup is written to the local file system
+	_, err = os.Stat(backupFolderFullPath)
+	assert.ErrorIs(t, err, fs.ErrNotExist)
+
+	clock.now = clock.now.Add(time.Hour)
+
+	injected := errors.New("injected")
+	_, err = service.NewBackupServiceWith(&failingStorage{Storage: storage, err: injected}, clock).Proceed(request(map[string]string{"a.txt": "new a!", "b.txt": "new b!"}))
+	assert.ErrorIs(t, err, injected)
+
+	// the file is left as it is for the next attempt
+	content, err = storage.ReadFile(filepath.Join(backupFolderFullPath, "b.txt"))
+	assert.NoError(t, err)
+	assert.Equal(t, "old b", string(content))
+}
@@ -0,0 +1,269 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/net/webdav"
+)
+
+// storageFileSystem serves the data root of a storage without a local folder over WebDAV. Files being
+// written are kept in a local temporary file and imported into the storage once closed.
+type storageFileSystem struct {
+	storage Storage
+	root    string
+}
+
+// storageFile is a file or a folder of the storage opened for reading.
+type storageFile struct {
+	io.ReadSeekCloser
+
+	storage Storage
+	name    string
+	info    fs.FileInfo
+}
+
+// storageWriteFile is a file of the storage opened for writing.
+type storageWriteFile struct {
+	*os.File
+
+	storage Storage
+	name    string
+	dirty   bool
+}
+
+func (fs *storageFileSystem) resolve(name string) (string, error) {
+	if strings.Contains(name, "\x00") {
+		return "", os.ErrInvalid
+	}
+
+	return filepath.Join(fs.root, filepath.FromSlash(path.Clean("/"+name))), nil
+}
+
+func (fs *storageFileSystem) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	fullName, err := fs.resolve(name)
+	if err != nil {
+		return err
+	}
+
+	if _, err := fs.storage.Stat(fullName); err == nil {
+		return &os.PathError{Op: "mkdir", Path: name, Err: os.ErrExist}
+	}
+
+	return fs.storage.MkdirAll(fullName, perm)
+}
+
+func (fs *storageFileSystem) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	fullName, err := fs.resolve(name)
+	if err != nil {
+		return nil, err
+	}
+
+	if flag&webDAVWriteFlags != 0 {
+		return fs.openForWriting(fullName, flag)
+	}
+
+	info, err := fs.storage.Stat(fullName)
+	if err != nil {
+		return nil, err
+	}
+
+	file := &storageFile{storage: fs.storage, name: fullName, info: info}
+
+	if !info.IsDir() {
+		if file.ReadSeekCloser, err = fs.storage.Open(fullName); err != nil {
+			return nil, err
+		}
+	}
+
+	return file, nil
+}
+
+func (fs *storageFileSystem) openForWriting(fullName string, flag int) (webdav.File, error) {
+	info, err := fs.storage.Stat(fullName)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	exists := err == nil
+
+	if exists && info.IsDir() {
+		return nil, &os.PathError{Op: "open", Path: fullName, Err: errors.New("is a directory")}
+	}
+
+	if !exists && flag&os.O_CREATE == 0 {
+		return nil, err
+	}
+
+	tmpFile, err := os.CreateTemp("", "webdav-*")
+	if err != nil {
+		return nil, err
+	}
+
+	file := &storageWriteFile{File: tmpFile, storage: fs.storage, name: fullName, dirty: !exists || flag&os.O_TRUNC != 0}
+
+	// the file is written in place, so start from its current content
+	if !file.dirty {
+		if err := file.load(); err != nil {
+			file.discard()
+			return nil, err
+		}
+	}
+
+	return file, nil
+}
+
+func (fs *storageFileSystem) RemoveAll(ctx context.Context, name string) error {
+	fullName, err := fs.resolve(name)
+	if err != nil {
+		return err
+	}
+
+	if fullName == filepath.Clean(fs.root) {
+		// prohibit removing the root, as webdav.Dir does
+		return os.ErrInvalid
+	}
+
+	return fs.storage.RemoveAll(fullName)
+}
+
+func (fs *storageFileSystem) Rename(ctx context.Context, oldName, newName string) error {
+	oldFullName, err := fs.resolve(oldName)
+	if err != nil {
+		return err
+	}
+
+	newFullName, err := fs.resolve(newName)
+	if err != nil {
+		return err
+	}
+
+	if oldFullName == filepath.Clean(fs.root) || newFullName == filepath.Clean(fs.root) {
+		return os.ErrInvalid
+	}
+
+	return fs.storage.Rename(oldFullName, newFullName)
+}
+
+func (fs *storageFileSystem) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	fullName, err := fs.resolve(name)
+	if err != nil {
+		return nil, err
+	}
+
+	return fs.storage.Stat(fullName)
+}
+
+func (f *storageFile) Read(p []byte) (int, error) {
+	if f.ReadSeekCloser == nil {
+		return 0, &os.PathError{Op: "read", Path: f.name, Err: errors.New("is a directory")}
+	}
+	return f.ReadSeekCloser.Read(p)
+}
+
+func (f *storageFile) Seek(offset int64, whence int) (int64, error) {
+	if f.ReadSeekCloser == nil {
+		return 0, nil
+	}
+	return f.ReadSeekCloser.Seek(offset, whence)
+}
+
+func (f *storageFile) Close() error {
+	if f.ReadSeekCloser == nil {
+		return nil
+	}
+	return f.ReadSeekCloser.Close()
+}
+
+func (f *storageFile) Readdir(count int) ([]fs.FileInfo, error) {
+	entries, err := f.storage.ReadDir(f.name)
+	if err != nil {
+		return nil, err
+	}
+
+	if count > 0 && len(entries) > count {
+		entries = entries[:count]
+	}
+
+	infos := make([]fs.FileInfo, 0, len(entries))
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil {
+			return nil, err
+		}
+		infos = append(infos, info)
+	}
+
+	return infos, nil
+}
+
+func (f *storageFile) Stat() (fs.FileInfo, error) {
+	return f.info, nil
+}
+
+func (f *storageFile) Write(p []byte) (int, error) {
+	return 0, &os.PathError{Op: "write", Path: f.name, Err: os.ErrPermission}
+}
+
+func (f *storageWriteFile) Write(p []byte) (int, error) {
+	f.dirty = true
+	return f.File.Write(p)
+}
+
+func (f *storageWriteFile) Readdir(count int) ([]fs.FileInfo, error) {
+	return nil, &os.PathError{Op: "readdir", Path: f.name, Err: errors.New("not a directory")}
+}
+
+func (f *storageWriteFile) Stat() (fs.FileInfo, error) {
+	info, err := f.File.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	return &storageFileInfo{name: filepath.Base(f.name), size: info.Size(), modTime: info.ModTime()}, nil
+}
+
+// Close imports the written content into the storage, unless nothing has been written.
+func (f *storageWriteFile) Close() error {
+	if err := f.File.Close(); err != nil {
+		os.Remove(f.File.Name())
+		return err
+	}
+
+	if !f.dirty {
+		return os.Remove(f.File.Name())
+	}
+
+	if err := f.storage.Import(f.File.Name(), f.name); err != nil {
+		os.Remove(f.File.Name())
+		return err
+	}
+
+	return nil
+}
+
+func (f *storageWriteFile) load() error {
+	source, err := f.storage.Open(f.name)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+
+	if _, err := io.Copy(f.File, source); err != nil {
+		return err
+	}
+
+	_, err = f.File.Seek(0, io.SeekStart)
+	return err
+}
+
+func (f *storageWriteFile) discard() {
+	f.File.Close()
+	os.Remove(f.File.Name())
+}
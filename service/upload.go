@@ -0,0 +1,496 @@
+package service
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/IceWhaleTech/CasaOS-Common/utils/logger"
+	"github.com/IceWhaleTech/IceWhale-Files-Backup/codegen"
+	"github.com/IceWhaleTech/IceWhale-Files-Backup/common"
+	"github.com/IceWhaleTech/IceWhale-Files-Backup/internal/utils"
+	"github.com/samber/lo"
+	"go.uber.org/zap"
+)
+
+const (
+	uploadFileName     = "upload.json"
+	uploadDataFileName = "data"
+)
+
+var (
+	ErrUploadNotFound     = errors.New("upload not found")
+	ErrInvalidUpload      = errors.New("invalid upload")
+	ErrInvalidChunk       = errors.New("invalid chunk")
+	ErrUploadIncomplete   = errors.New("upload is incomplete")
+	ErrUploadHashMismatch = errors.New("hash of the uploaded file doesn't match")
+	ErrUploadInUse        = errors.New("upload is in use")
+
+	uploadIDPattern = regexp.MustCompile(`^[0-9a-f]{32}$`)
+)
+
+// CreateUpload starts a chunked upload of a file into an existing folder backup.
+func (b *BackupService) CreateUpload(clientID string, upload codegen.Upload) (*codegen.Upload, error) {
+	if upload.ClientFolderPath == nil || upload.ClientFilePath == nil || upload.Size == nil || upload.Hash == nil {
+		return nil, fmt.Errorf("%w: certain fields are missing", ErrInvalidUpload)
+	}
+
+	if *upload.Size < 0 {
+		return nil, fmt.Errorf("%w: size is negative", ErrInvalidUpload)
+	}
+
+	if upload.ChunkSize == nil {
+		upload.ChunkSize = lo.ToPtr(int64(common.DefaultChunkSize))
+	}
+
+	if *upload.ChunkSize <= 0 || *upload.ChunkSize > common.MaxChunkSize {
+		return nil, fmt.Errorf("%w: chunk size must be between 1 and %d", ErrInvalidUpload, common.MaxChunkSize)
+	}
+
+	if _, err := b.uploadTargetPath(clientID, &upload); err != nil {
+		return nil, err
+	}
+
+	if err := b.checkSpace(b.clientPathsOf(clientID, *upload.ClientFolderPath).backupFolderPath, *upload.Size); err != nil {
+		return nil, err
+	}
+
+	uploadID, err := randomID()
+	if err != nil {
+		return nil, err
+	}
+
+	upload.UploadID = &uploadID
+	upload.ChunkCount = lo.ToPtr(int((*upload.Size + *upload.ChunkSize - 1) / *upload.ChunkSize))
+	upload.ReceivedChunks = &[]int{}
+	upload.CreatedTime = lo.ToPtr(b.clock.Now().UnixMilli())
+	upload.Completed = lo.ToPtr(false)
+
+	uploadFolderPath := b.uploadFolderPath(clientID, *upload.UploadID)
+	if err := os.MkdirAll(uploadFolderPath, 0o755); err != nil {
+		return nil, err
+	}
+
+	// preallocate the file so chunks can be written in any order
+	dataFile, err := os.Create(filepath.Join(uploadFolderPath, uploadDataFileName))
+	if err != nil {
+		return nil, err
+	}
+	defer dataFile.Close()
+
+	if err := dataFile.Truncate(*upload.Size); err != nil {
+		return nil, err
+	}
+
+	if err := saveUpload(uploadFolderPath, &upload); err != nil {
+		return nil, err
+	}
+
+	logger.Info("upload has been created", zap.String("client_id", clientID), zap.String("upload_id", *upload.UploadID), zap.String("file", *upload.ClientFilePath))
+
+	return &upload, nil
+}
+
+func (b *BackupService) GetUpload(clientID, uploadID string) (*codegen.Upload, error) {
+	if !uploadIDPattern.MatchString(uploadID) || checkClientID(clientID) != nil {
+		return nil, ErrUploadNotFound
+	}
+
+	return loadUpload(b.uploadFolderPath(clientID, uploadID))
+}
+
+// WriteChunk verifies the chunk against its hash and writes it at its offset of the file being uploaded.
+func (b *BackupService) WriteChunk(clientID, uploadID string, index int, hash string, r io.Reader) (*codegen.Upload, error) {
+	upload, unlockUpload, err := b.lockUpload(clientID, uploadID)
+	if err != nil {
+		return nil, err
+	}
+	defer unlockUpload()
+
+	if index < 0 || index >= *upload.ChunkCount {
+		return nil, fmt.Errorf("%w: index %d is out of range", ErrInvalidChunk, index)
+	}
+
+	offset := int64(index) * *upload.ChunkSize
+	length := lo.Min([]int64{*upload.ChunkSize, *upload.Size - offset})
+
+	buf, err := io.ReadAll(io.LimitReader(r, length+1))
+	if err != nil {
+		return nil, err
+	}
+
+	if int64(len(buf)) != length {
+		return nil, fmt.Errorf("%w: expected %d bytes, got %d", ErrInvalidChunk, length, len(buf))
+	}
+
+	if chunkHash, err := XXHashReader(bytes.NewReader(buf)); err != nil {
+		return nil, err
+	} else if chunkHash != hash {
+		return nil, fmt.Errorf("%w: hash doesn't match", ErrInvalidChunk)
+	}
+
+	uploadFolderPath := b.uploadFolderPath(clientID, uploadID)
+
+	dataFile, err := os.OpenFile(filepath.Join(uploadFolderPath, uploadDataFileName), os.O_WRONLY, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	defer dataFile.Close()
+
+	if _, err := dataFile.WriteAt(buf, offset); err != nil {
+		return nil, err
+	}
+
+	if !lo.Contains(*upload.ReceivedChunks, index) {
+		receivedChunks := append(*upload.ReceivedChunks, index)
+		sort.Ints(receivedChunks)
+		upload.ReceivedChunks = &receivedChunks
+	}
+
+	if err := saveUpload(uploadFolderPath, upload); err != nil {
+		return nil, err
+	}
+
+	return upload, nil
+}
+
+// FinishUpload verifies the whole file against its hash and moves it into the folder backup, keeping
+// any different file at the same path as a history copy.
+func (b *BackupService) FinishUpload(clientID, uploadID string) (*codegen.Upload, error) {
+	upload, unlockUpload, err := b.lockUpload(clientID, uploadID)
+	if err != nil {
+		return nil, err
+	}
+	defer unlockUpload()
+
+	if len(*upload.ReceivedChunks) < *upload.ChunkCount {
+		return nil, fmt.Errorf("%w: %d of %d chunks received", ErrUploadIncomplete, len(*upload.ReceivedChunks), *upload.ChunkCount)
+	}
+
+	uploadFolderPath := b.uploadFolderPath(clientID, uploadID)
+	dataFilePath := filepath.Join(uploadFolderPath, uploadDataFileName)
+
+	fileHash, err := XXHash(dataFilePath)
+	if err != nil {
+		return nil, err
+	}
+
+	if fileHash != *upload.Hash {
+		// some chunk must be wrong even though its own hash matched, so start over
+		upload.ReceivedChunks = &[]int{}
+		if err := saveUpload(uploadFolderPath, upload); err != nil {
+			return nil, err
+		}
+
+		paths := b.clientPathsOf(clientID, *upload.ClientFolderPath)
+		b.publish(codegen.VerificationFailed, paths.backupFolderPath, codegen.BackupEvent{
+			Path:      lo.ToPtr(paths.relativePath(*upload.ClientFilePath)),
+			FileCount: lo.ToPtr(1),
+		})
+
+		return nil, ErrUploadHashMismatch
+	}
+
+	targetPath, err := b.uploadTargetPath(clientID, upload)
+	if err != nil {
+		return nil, err
+	}
+
+	paths := b.clientPathsOf(clientID, *upload.ClientFolderPath)
+	backupFolderPath := paths.backupFolderPath
+
+	// wait for any backup being proceeded, since it might be versioning the same file
+	unlock, err := b.locks.Lock(backupFolderPath, "upload")
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	backupFolderFullPath := paths.backupFolderFullPath
+	relativePath := paths.relativePath(*upload.ClientFilePath)
+
+	run, err := LoadRun(b.storage, backupFolderFullPath)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := b.storage.Stat(targetPath); err == nil {
+		existingHash, err := FileHash(b.storage, targetPath)
+		if err != nil {
+			return nil, err
+		}
+
+		// no need to keep the existing file if it is pending, since its previous version has been kept already
+		if existingHash != fileHash && (run == nil || !run.IsPending(relativePath)) {
+			backupFilePath, err := b.backupFile(versionStoreOf(b.storage, backupFolderFullPath), backupFolderFullPath, targetPath, true)
+			if err != nil {
+				logger.Error("failed to backup file", zap.String("file", targetPath), zap.Error(err))
+				return nil, err
+			}
+
+			logger.Info("file has been backed up", zap.String("file", targetPath), zap.String("backup", backupFilePath))
+
+			b.indexVersion(backupFolderPath, backupFolderFullPath, relativePath, backupFilePath, true)
+
+			filesVersionedTotal.WithLabelValues("move").Inc()
+
+			b.publish(codegen.FileVersioned, backupFolderPath, codegen.BackupEvent{
+				Path: &relativePath,
+			})
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	if err := b.storage.MkdirAll(filepath.Dir(targetPath), 0o755); err != nil {
+		return nil, err
+	}
+
+	if err := b.storage.Import(dataFilePath, targetPath); err != nil {
+		return nil, err
+	}
+
+	if run != nil && run.IsPending(relativePath) {
+		run.RemovePending(relativePath)
+		if err := SaveRun(b.storage, backupFolderFullPath, run); err != nil {
+			return nil, err
+		}
+
+		b.updateIndex(func(index *Index) error {
+			return index.PutRun(backupFolderPath, run)
+		})
+	}
+
+	b.updateIndex(func(index *Index) error {
+		return index.PutFile(backupFolderPath, relativePath, fileHash, *upload.Size)
+	})
+
+	if err := os.RemoveAll(uploadFolderPath); err != nil {
+		logger.Error("failed to remove upload folder", zap.String("path", uploadFolderPath), zap.Error(err))
+	}
+
+	upload.Completed = lo.ToPtr(true)
+
+	b.publish(codegen.FileUploaded, backupFolderPath, codegen.BackupEvent{
+		Path: &relativePath,
+	})
+
+	logger.Info("upload has been completed", zap.String("client_id", clientID), zap.String("upload_id", uploadID), zap.String("file", targetPath))
+
+	return upload, nil
+}
+
+func (b *BackupService) DeleteUpload(clientID, uploadID string) error {
+	_, unlockUpload, err := b.lockUpload(clientID, uploadID)
+	if err != nil {
+		return err
+	}
+	defer unlockUpload()
+
+	return os.RemoveAll(b.uploadFolderPath(clientID, uploadID))
+}
+
+// cleanUpUploads removes uploads into the folder backup that no longer match the files of the client,
+// so only uploads still useful are resumed.
+func (b *BackupService) cleanUpUploads(clientID string, paths *clientPaths, clientFolderFileHashes *map[string]string) {
+	uploadRootPath := filepath.Join(b.backupRoot, clientID, common.StateFolderName, common.UploadFolderName)
+
+	entries, err := os.ReadDir(uploadRootPath)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logger.Error("failed to read uploads", zap.String("path", uploadRootPath), zap.Error(err))
+		}
+		return
+	}
+
+	hashes := map[string]string{}
+	if clientFolderFileHashes != nil {
+		for clientFile, hash := range *clientFolderFileHashes {
+			hashes[paths.relativePath(clientFile)] = hash
+		}
+	}
+
+	for _, entry := range entries {
+		upload, err := b.GetUpload(clientID, entry.Name())
+		if err != nil {
+			continue
+		}
+
+		if pathKey(paths.policy, NormalizePath(paths.policy, *upload.ClientFolderPath)) != pathKey(paths.policy, paths.clientFolderPath) {
+			continue
+		}
+
+		if hash, ok := hashes[paths.relativePath(*upload.ClientFilePath)]; ok && hash == *upload.Hash {
+			continue
+		}
+
+		// an upload in use, e.g. being finished while waiting for this run, is left for the next run, since
+		// waiting for it here would wait for this run itself
+		_, unlockUpload, err := b.tryLockUpload(clientID, *upload.UploadID)
+		if err != nil {
+			if errors.Is(err, ErrUploadInUse) {
+				logger.Info("stale upload is in use, leaving it", zap.String("upload_id", *upload.UploadID))
+			}
+			continue
+		}
+
+		err = os.RemoveAll(b.uploadFolderPath(clientID, *upload.UploadID))
+		unlockUpload()
+
+		if err != nil {
+			logger.Error("failed to remove stale upload", zap.String("upload_id", *upload.UploadID), zap.Error(err))
+			continue
+		}
+
+		logger.Info("stale upload has been removed", zap.String("upload_id", *upload.UploadID), zap.String("file", *upload.ClientFilePath))
+	}
+}
+
+func (b *BackupService) uploadFolderPath(clientID, uploadID string) string {
+	return filepath.Join(b.backupRoot, clientID, common.StateFolderName, common.UploadFolderName, uploadID)
+}
+
+// uploadTargetPath returns the full path the uploaded file will be moved to, making sure it stays
+// within the folder backup.
+func (b *BackupService) uploadTargetPath(clientID string, upload *codegen.Upload) (string, error) {
+	if err := checkClientID(clientID); err != nil {
+		return "", fmt.Errorf("%w: %s", ErrInvalidUpload, err.Error())
+	}
+
+	if lo.Contains(strings.Split(Normalize(*upload.ClientFolderPath), "/"), "..") {
+		return "", fmt.Errorf("%w: folder path is outside of the client folder", ErrInvalidUpload)
+	}
+
+	paths := b.clientPathsOf(clientID, *upload.ClientFolderPath)
+	backupFolderFullPath := paths.backupFolderFullPath
+
+	relativePath := paths.relativePath(*upload.ClientFilePath)
+	targetPath := filepath.Join(backupFolderFullPath, relativePath)
+
+	// the folder backup itself is checked too, since cleaning its path might have taken it elsewhere
+	clientFullPath := filepath.Join(b.backupRoot, clientID)
+	if !strings.HasPrefix(backupFolderFullPath, clientFullPath+string(filepath.Separator)) {
+		return "", fmt.Errorf("%w: folder path is outside of the client folder", ErrInvalidUpload)
+	}
+
+	if relativePath == "" || !strings.HasPrefix(targetPath, backupFolderFullPath+string(filepath.Separator)) {
+		return "", fmt.Errorf("%w: file path is outside of the folder backup", ErrInvalidUpload)
+	}
+
+	if isReservedPath(versionStoreOf(b.storage, backupFolderFullPath), relativePath) {
+		return "", fmt.Errorf("%w: file path is reserved", ErrInvalidUpload)
+	}
+
+	if err := CheckPath(paths.policy, relativePath); err != nil {
+		return "", fmt.Errorf("%w: %s", ErrInvalidUpload, err.Error())
+	}
+
+	return targetPath, nil
+}
+
+// checkClientID returns an error if the client ID can't name a folder right under the backup root.
+func checkClientID(clientID string) error {
+	if clientID == "" || clientID == "." || clientID == ".." || strings.ContainsAny(clientID, `/\`) {
+		return fmt.Errorf("client ID %q is invalid", clientID)
+	}
+
+	return nil
+}
+
+// uploadLock serializes the operations on an upload.
+type uploadLock struct {
+	mutex *sync.Mutex
+
+	// refs counts operations holding or waiting for the lock, so it is only dropped when unused.
+	refs int
+}
+
+// lockUpload holds the upload until the returned function is called, and returns it as last saved. Only
+// uploads found get a lock, so looking up unknown upload IDs doesn't leave any behind.
+func (b *BackupService) lockUpload(clientID, uploadID string) (*codegen.Upload, func(), error) {
+	return b.acquireUpload(clientID, uploadID, true)
+}
+
+// tryLockUpload is lockUpload without waiting. It returns ErrUploadInUse if another operation holds the lock.
+func (b *BackupService) tryLockUpload(clientID, uploadID string) (*codegen.Upload, func(), error) {
+	return b.acquireUpload(clientID, uploadID, false)
+}
+
+func (b *BackupService) acquireUpload(clientID, uploadID string, wait bool) (*codegen.Upload, func(), error) {
+	if _, err := b.GetUpload(clientID, uploadID); err != nil {
+		return nil, nil, err
+	}
+
+	b.uploadMutex.Lock()
+	state, ok := b.uploadingIDs[uploadID]
+	if !ok {
+		state = &uploadLock{mutex: &sync.Mutex{}}
+		b.uploadingIDs[uploadID] = state
+	}
+	state.refs++
+	b.uploadMutex.Unlock()
+
+	release := func() {
+		b.uploadMutex.Lock()
+		defer b.uploadMutex.Unlock()
+
+		state.refs--
+		if state.refs == 0 {
+			delete(b.uploadingIDs, uploadID)
+		}
+	}
+
+	if wait {
+		state.mutex.Lock()
+	} else if !state.mutex.TryLock() {
+		release()
+		return nil, nil, fmt.Errorf("%w: %s", ErrUploadInUse, uploadID)
+	}
+
+	unlock := func() {
+		state.mutex.Unlock()
+		release()
+	}
+
+	// the upload might have been finished or deleted while waiting
+	upload, err := b.GetUpload(clientID, uploadID)
+	if err != nil {
+		unlock()
+		return nil, nil, err
+	}
+
+	return upload, unlock, nil
+}
+
+func saveUpload(uploadFolderPath string, upload *codegen.Upload) error {
+	buf, err := json.Marshal(upload)
+	if err != nil {
+		return err
+	}
+
+	return utils.WriteFileAtomic(filepath.Join(uploadFolderPath, uploadFileName), buf, 0o600)
+}
+
+func loadUpload(uploadFolderPath string) (*codegen.Upload, error) {
+	buf, err := os.ReadFile(filepath.Join(uploadFolderPath, uploadFileName))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, ErrUploadNotFound
+		}
+		return nil, err
+	}
+
+	var upload codegen.Upload
+	if err := json.Unmarshal(buf, &upload); err != nil {
+		return nil, err
+	}
+
+	return &upload, nil
+}
@@ -0,0 +1,233 @@
+package service_test
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/IceWhaleTech/IceWhale-Files-Backup/codegen"
+	"github.com/IceWhaleTech/IceWhale-Files-Backup/common"
+	"github.com/IceWhaleTech/IceWhale-Files-Backup/pkg/config"
+	"github.com/IceWhaleTech/IceWhale-Files-Backup/service"
+	"github.com/samber/lo"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/goleak"
+)
+
+func TestUpload(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	tmpDataRootDir, err := os.MkdirTemp("", "test")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tmpDataRootDir)
+
+	storage := service.NewLocalStorage(tmpDataRootDir)
+
+	config.AppInfo.DataRootPath = tmpDataRootDir
+
+	clientID := "client1"
+	clientFolderPath := `C:\Users\icewhale\Downloads`
+
+	backupFolderPath := filepath.Join(common.BackupRootFolder, clientID, service.Normalize(clientFolderPath))
+	backupFolderFullPath := filepath.Join(tmpDataRootDir, backupFolderPath)
+
+	assert.NoError(t, service.SaveMetadata(storage, &codegen.FolderBackup{
+		BackupFolderPath: &backupFolderPath,
+		ClientFolderPath: &clientFolderPath,
+		ClientID:         &clientID,
+	}))
+
+	// an older version of the file is already there
+	assert.NoError(t, os.MkdirAll(filepath.Join(backupFolderFullPath, "Movies"), 0o755))
+	assert.NoError(t, createFileWithContent(backupFolderFullPath, "Movies/2.mp4", "old content"))
+
+	content := "hello world, hello earth"
+	chunks := []string{content[:10], content[10:20], content[20:]}
+
+	hash, err := service.XXHashReader(strings.NewReader(content))
+	assert.NoError(t, err)
+
+	backupService := service.NewBackupService()
+
+	// file path outside of the folder backup is rejected
+	_, err = backupService.CreateUpload(clientID, codegen.Upload{
+		ClientFolderPath: &clientFolderPath,
+		ClientFilePath:   lo.ToPtr(`..\..\2.mp4`),
+		Size:             lo.ToPtr(int64(len(content))),
+		Hash:             &hash,
+	})
+	assert.ErrorIs(t, err, service.ErrInvalidUpload)
+
+	upload, err := backupService.CreateUpload(clientID, codegen.Upload{
+		ClientFolderPath: &clientFolderPath,
+		ClientFilePath:   lo.ToPtr(`C:\Users\icewhale\Downloads\Movies\2.mp4`),
+		Size:             lo.ToPtr(int64(len(content))),
+		Hash:             &hash,
+		ChunkSize:        lo.ToPtr(int64(10)),
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 3, *upload.ChunkCount)
+	assert.Empty(t, *upload.ReceivedChunks)
+
+	// chunk with wrong hash is rejected
+	_, err = backupService.WriteChunk(clientID, *upload.UploadID, 0, "wrong hash", strings.NewReader(chunks[0]))
+	assert.ErrorIs(t, err, service.ErrInvalidChunk)
+
+	// chunk with wrong size is rejected
+	_, err = backupService.WriteChunk(clientID, *upload.UploadID, 2, "", strings.NewReader(chunks[1]))
+	assert.ErrorIs(t, err, service.ErrInvalidChunk)
+
+	// upload the chunks out of order, with an interruption
+	for _, index := range []int{2, 0} {
+		chunkHash, err := service.XXHashReader(strings.NewReader(chunks[index]))
+		assert.NoError(t, err)
+
+		_, err = backupService.WriteChunk(clientID, *upload.UploadID, index, chunkHash, strings.NewReader(chunks[index]))
+		assert.NoError(t, err)
+	}
+
+	_, err = backupService.FinishUpload(clientID, *upload.UploadID)
+	assert.ErrorIs(t, err, service.ErrUploadIncomplete)
+
+	// resume
+	upload, err = backupService.GetUpload(clientID, *upload.UploadID)
+	assert.NoError(t, err)
+	assert.Equal(t, []int{0, 2}, *upload.ReceivedChunks)
+
+	chunkHash, err := service.XXHashReader(strings.NewReader(chunks[1]))
+	assert.NoError(t, err)
+
+	_, err = backupService.WriteChunk(clientID, *upload.UploadID, 1, chunkHash, strings.NewReader(chunks[1]))
+	assert.NoError(t, err)
+
+	upload, err = backupService.FinishUpload(clientID, *upload.UploadID)
+	assert.NoError(t, err)
+	assert.True(t, *upload.Completed)
+
+	buf, err := os.ReadFile(filepath.Join(backupFolderFullPath, "Movies", "2.mp4"))
+	assert.NoError(t, err)
+	assert.Equal(t, content, string(buf))
+
+	// the older version is kept as a history copy
+	entries, err := os.ReadDir(filepath.Join(backupFolderFullPath, "Movies"))
+	assert.NoError(t, err)
+	assert.Len(t, entries, 2)
+
+	_, err = backupService.GetUpload(clientID, *upload.UploadID)
+	assert.ErrorIs(t, err, service.ErrUploadNotFound)
+}
+
+func TestUploadOutsideOfClientFolder(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	tmpDataRootDir, err := os.MkdirTemp("", "test")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tmpDataRootDir)
+
+	backupService := service.NewBackupServiceWith(service.NewLocalStorage(tmpDataRootDir), service.SystemClock)
+
+	content := "root:x:0:0"
+	hash, err := service.XXHashReader(strings.NewReader(content))
+	assert.NoError(t, err)
+
+	for _, tc := range []struct {
+		clientID         string
+		clientFolderPath string
+	}{
+		{clientID: "..", clientFolderPath: "/etc"},
+		{clientID: "../..", clientFolderPath: "/etc"},
+		{clientID: "client1", clientFolderPath: "/../../../etc"},
+		{clientID: "client1", clientFolderPath: `C:\..\..\..\etc`},
+		{clientID: "client1", clientFolderPath: "/home/../../client2/home"},
+	} {
+		_, err := backupService.CreateUpload(tc.clientID, codegen.Upload{
+			ClientFolderPath: &tc.clientFolderPath,
+			ClientFilePath:   lo.ToPtr("passwd"),
+			Size:             lo.ToPtr(int64(len(content))),
+			Hash:             &hash,
+		})
+		assert.ErrorIs(t, err, service.ErrInvalidUpload, tc)
+	}
+
+	_, err = backupService.GetUpload("..", "0123456789abcdef0123456789abcdef")
+	assert.ErrorIs(t, err, service.ErrUploadNotFound)
+
+	// unknown uploads are turned down before being held
+	_, err = backupService.WriteChunk("client1", "0123456789abcdef0123456789abcdef", 0, hash, strings.NewReader(content))
+	assert.ErrorIs(t, err, service.ErrUploadNotFound)
+
+	assert.ErrorIs(t, backupService.DeleteUpload("client1", "0123456789abcdef0123456789abcdef"), service.ErrUploadNotFound)
+}
+
+func TestFinishUploadWhileProceeding(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	tmpDataRootDir, err := os.MkdirTemp("", "test")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tmpDataRootDir)
+
+	clock := &fixedClock{now: time.Date(2023, 4, 10, 12, 0, 0, 0, time.UTC)}
+	storage := service.NewLocalStorage(tmpDataRootDir)
+
+	clientID := "client1"
+	clientFolderPath := "/home/icewhale/Documents"
+	backupFolderPath := filepath.Join(common.BackupRootFolder, clientID, service.Normalize(clientFolderPath))
+
+	backupService := service.NewBackupServiceWith(storage, clock)
+
+	// interrupted before the file is uploaded
+	_, err = backupService.Proceed(folderBackupRequest(t, clientID, clientFolderPath, "a.txt"))
+	assert.NoError(t, err)
+
+	hash, err := service.XXHashReader(strings.NewReader("a"))
+	assert.NoError(t, err)
+
+	upload, err := backupService.CreateUpload(clientID, codegen.Upload{
+		ClientFolderPath: &clientFolderPath,
+		ClientFilePath:   lo.ToPtr(clientFolderPath + "/a.txt"),
+		Size:             lo.ToPtr(int64(1)),
+		Hash:             &hash,
+	})
+	assert.NoError(t, err)
+
+	_, err = backupService.WriteChunk(clientID, *upload.UploadID, 0, hash, strings.NewReader("a"))
+	assert.NoError(t, err)
+
+	// as if versioning is in progress, so both wait for it
+	unlock, err := backupService.Locks().Lock(backupFolderPath, "test")
+	assert.NoError(t, err)
+
+	// the client has changed the file since, so the run resumed cleans up the upload
+	proceeded := make(chan error, 1)
+	go func() {
+		_, err := backupService.Proceed(folderBackupRequest(t, clientID, clientFolderPath, "b.txt"))
+		proceeded <- err
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+
+	finished := make(chan error, 1)
+	go func() {
+		_, err := backupService.FinishUpload(clientID, *upload.UploadID)
+		finished <- err
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+
+	unlock()
+
+	for _, done := range []chan error{proceeded, finished} {
+		select {
+		case err := <-done:
+			assert.NoError(t, err)
+		case <-time.After(5 * time.Second):
+			t.Fatal("proceeding and finishing the upload should not wait for each other")
+		}
+	}
+
+	content, err := storage.ReadFile(filepath.Join(tmpDataRootDir, backupFolderPath, "a.txt"))
+	assert.NoError(t, err)
+	assert.Equal(t, "a", string(content))
+}
@@ -0,0 +1,252 @@
+package service
+
+import (
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/IceWhaleTech/CasaOS-Common/utils/logger"
+	"github.com/IceWhaleTech/IceWhale-Files-Backup/codegen"
+	"github.com/IceWhaleTech/IceWhale-Files-Backup/common"
+	"github.com/IceWhaleTech/IceWhale-Files-Backup/pkg/config"
+	"github.com/samber/lo"
+	"go.uber.org/zap"
+)
+
+// configuredVersionStore returns the version store new folder backups use.
+func configuredVersionStore() codegen.VersionStore {
+	switch store := codegen.VersionStore(config.AppInfo.VersionStore); store {
+	case codegen.Suffix, codegen.Hidden:
+		return store
+	default:
+		logger.Error("unknown version store, falling back to suffix", zap.String("store", config.AppInfo.VersionStore))
+		return codegen.Suffix
+	}
+}
+
+// versionStoreOf returns the version store of the folder backup, which is the suffix store unless its
+// metadata tells otherwise, e.g. for folder backups made before the store could be chosen.
+func versionStoreOf(storage Storage, backupFolderFullPath string) codegen.VersionStore {
+	backup, err := LoadMetadata(storage, backupFolderFullPath)
+	if err != nil || backup.VersionStore == nil {
+		return codegen.Suffix
+	}
+
+	return *backup.VersionStore
+}
+
+// isReservedPath tells whether the path, relative to the folder backup, is kept by the service under the
+// version store, so no file of the client may be written there.
+func isReservedPath(store codegen.VersionStore, relativePath string) bool {
+	parts := strings.Split(filepath.ToSlash(relativePath), "/")
+	if lo.Contains(parts, common.StateFolderName) {
+		return true
+	}
+
+	// history copies are out of the way in the hidden store, so only their folder is reserved
+	if store == codegen.Hidden {
+		return parts[0] == common.VersionFolderName || strings.HasPrefix(parts[len(parts)-1], common.MetadataFileName)
+	}
+
+	return isBackupFile(parts[len(parts)-1])
+}
+
+// backupFile keeps a history copy of the file in the version store of the folder backup, i.e. next to
+// the file, or in the same folder under the hidden version folder.
+func (b *BackupService) backupFile(store codegen.VersionStore, backupFolderFullPath, file string, move bool) (string, error) {
+	dir := filepath.Dir(file)
+
+	if store == codegen.Hidden {
+		relativeDir, err := filepath.Rel(backupFolderFullPath, dir)
+		if err != nil {
+			return "", err
+		}
+
+		dir = filepath.Join(backupFolderFullPath, common.VersionFolderName, relativeDir)
+
+		if err := b.storage.MkdirAll(dir, 0o755); err != nil {
+			return "", err
+		}
+	}
+
+	return backupFileIn(b.storage, file, dir, move, b.clock.Now())
+}
+
+// walkHistoryCopies calls the function for each history copy in the version store of the folder backup,
+// along with the version it was made for. Paths of the version are relative to the folder backup. History
+// copies a migration to the hidden store has moved before being interrupted are found under the version
+// folder even though the folder backup still uses the suffix store.
+func walkHistoryCopies(storage Storage, backupFolderFullPath string, fn func(file string, d fs.DirEntry, version *FileVersion) error) error {
+	root := backupFolderFullPath
+	versionFolderPath := filepath.Join(backupFolderFullPath, common.VersionFolderName)
+
+	if versionStoreOf(storage, backupFolderFullPath) == codegen.Hidden {
+		root = versionFolderPath
+
+		// nothing has been versioned yet
+		if _, err := storage.Stat(root); os.IsNotExist(err) {
+			return nil
+		}
+	}
+
+	return storage.WalkDir(root, func(file string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if d.IsDir() {
+			if d.Name() == common.StateFolderName {
+				return fs.SkipDir
+			}
+			return nil
+		}
+
+		version := parseBackupFileName(d.Name())
+		if version == nil {
+			return nil
+		}
+
+		dirRoot := root
+		if dir := filepath.Dir(file); dir == versionFolderPath || strings.HasPrefix(dir, versionFolderPath+string(filepath.Separator)) {
+			dirRoot = versionFolderPath
+		}
+
+		relativeDir, err := filepath.Rel(dirRoot, filepath.Dir(file))
+		if err != nil {
+			return err
+		}
+
+		relativeFile, err := filepath.Rel(backupFolderFullPath, file)
+		if err != nil {
+			return err
+		}
+
+		version.Path = path.Join(filepath.ToSlash(relativeDir), version.Path)
+		version.BackupFilePath = filepath.ToSlash(relativeFile)
+
+		return fn(file, d, version)
+	})
+}
+
+// MigrateVersions moves the history copies of the folder backups using the suffix store under their hidden
+// version folders, and switches them to the hidden store. Folder backups failing to migrate are logged and
+// left for the next run, which picks up where an interrupted migration stopped. It returns the number of
+// history copies moved.
+func (b *BackupService) MigrateVersions() (int, error) {
+	backups, err := getBackupsByPath(b.storage, b.clock, b.backupRoot, false)
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+
+	for _, backup := range backups {
+		n, err := b.migrateFolderBackupVersions(*backup.BackupFolderPath)
+		count += n
+
+		if err != nil {
+			logger.Error("failed to migrate history copies", zap.String("path", *backup.BackupFolderPath), zap.Error(err))
+			continue
+		}
+
+		if n > 0 {
+			logger.Info("history copies have been migrated", zap.String("path", *backup.BackupFolderPath), zap.Int("count", n))
+		}
+	}
+
+	return count, nil
+}
+
+func (b *BackupService) migrateFolderBackupVersions(backupFolderPath string) (int, error) {
+	unlock, err := b.locks.Lock(backupFolderPath, "migrate")
+	if err != nil {
+		return 0, err
+	}
+	defer unlock()
+
+	backupFolderFullPath := filepath.Join(b.storage.Root(), backupFolderPath)
+
+	backup, err := LoadMetadata(b.storage, backupFolderFullPath)
+	if err != nil {
+		return 0, err
+	}
+
+	if lo.FromPtr(backup.VersionStore) == codegen.Hidden {
+		return 0, nil
+	}
+
+	historyCopies, err := listHistoryCopies(b.storage, backupFolderFullPath)
+	if err != nil {
+		return 0, err
+	}
+
+	deletedFiles, err := LoadDeletedFiles(b.storage, backupFolderFullPath)
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	deletedFilesChanged := false
+
+	for _, historyCopy := range historyCopies {
+		version := historyCopy.version
+
+		// moved already by an interrupted migration
+		if strings.HasPrefix(version.BackupFilePath, common.VersionFolderName+"/") {
+			continue
+		}
+
+		newBackupFilePath := path.Join(common.VersionFolderName, version.BackupFilePath)
+		newFile := filepath.Join(backupFolderFullPath, filepath.FromSlash(newBackupFilePath))
+
+		if err = b.storage.MkdirAll(filepath.Dir(newFile), 0o755); err != nil {
+			break
+		}
+
+		if err = b.storage.Rename(historyCopy.path, newFile); err != nil {
+			break
+		}
+
+		count++
+
+		if deletedFiles.moveBackupFile(version.BackupFilePath, newBackupFilePath) {
+			deletedFilesChanged = true
+		}
+
+		b.updateIndex(func(index *Index) error {
+			if err := index.DeleteVersion(backupFolderPath, version.Path, version.BackupFilePath); err != nil {
+				return err
+			}
+
+			return index.PutVersion(backupFolderPath, &FileVersion{
+				Path:           version.Path,
+				BackupFilePath: newBackupFilePath,
+				Time:           version.Time,
+				Moved:          version.Moved,
+			})
+		})
+	}
+
+	// saved even if interrupted, so the records keep pointing at the history copies moved so far
+	if deletedFilesChanged {
+		if err := SaveDeletedFiles(b.storage, backupFolderFullPath, deletedFiles); err != nil {
+			return count, err
+		}
+	}
+
+	if err != nil {
+		return count, err
+	}
+
+	backup.VersionStore = lo.ToPtr(codegen.Hidden)
+
+	if err := SaveMetadata(b.storage, backup); err != nil {
+		return count, err
+	}
+
+	b.rememberFolderBackup(backupFolderPath, codegen.Hidden)
+
+	return count, nil
+}
@@ -0,0 +1,223 @@
+package service_test
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/IceWhaleTech/IceWhale-Files-Backup/codegen"
+	"github.com/IceWhaleTech/IceWhale-Files-Backup/common"
+	"github.com/IceWhaleTech/IceWhale-Files-Backup/pkg/config"
+	"github.com/IceWhaleTech/IceWhale-Files-Backup/service"
+	"github.com/samber/lo"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/goleak"
+)
+
+// folderBackupRequest returns a run of the folder backup where the client has the given files, with their
+// names without extension as content.
+func folderBackupRequest(t *testing.T, clientID, clientFolderPath string, clientFiles ...string) codegen.FolderBackup {
+	sizes := map[string]int64{}
+	hashes := map[string]string{}
+	for _, name := range clientFiles {
+		content := strings.TrimSuffix(filepath.Base(name), filepath.Ext(name))
+
+		hash, err := service.XXHashReader(strings.NewReader(content))
+		assert.NoError(t, err)
+
+		sizes[name] = int64(len(content))
+		hashes[name] = hash
+	}
+
+	return codegen.FolderBackup{
+		ClientID:               &clientID,
+		ClientFolderPath:       &clientFolderPath,
+		ClientFolderFileSizes:  &sizes,
+		ClientFolderFileHashes: &hashes,
+	}
+}
+
+func TestProceedWithHiddenVersionStore(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	config.AppInfo.VersionStore = string(codegen.Hidden)
+	defer func() { config.AppInfo.VersionStore = string(codegen.Suffix) }()
+
+	clock := &fixedClock{now: time.Date(2023, 4, 10, 12, 0, 0, 0, time.UTC)}
+	storage := service.NewMemoryStorage("/DATA", clock)
+
+	clientID := "client1"
+	clientFolderPath := "/home/icewhale/Documents"
+	backupFolderFullPath := filepath.Join(storage.Root(), common.BackupRootFolder, clientID, service.Normalize(clientFolderPath))
+
+	backupService := service.NewBackupServiceWith(storage, clock)
+
+	// a file named like a history copy is just another file of the client
+	userFile := "notes-backup-2023-01-01-00-00-00-000.txt"
+
+	backup, err := backupService.Proceed(folderBackupRequest(t, clientID, clientFolderPath, "a.txt", userFile))
+	assert.NoError(t, err)
+	assert.Equal(t, codegen.Hidden, *backup.VersionStore)
+
+	assert.NoError(t, storage.WriteFile(filepath.Join(backupFolderFullPath, "a.txt"), []byte("a"), 0o644))
+	assert.NoError(t, storage.WriteFile(filepath.Join(backupFolderFullPath, userFile), []byte("notes-backup-2023-01-01-00-00-00-000"), 0o644))
+
+	verification, err := backupService.Complete(clientID, clientFolderPath)
+	assert.NoError(t, err)
+	assert.True(t, *verification.Succeeded)
+
+	files, err := service.FilterBackupFiles(storage, backupFolderFullPath)
+	assert.NoError(t, err)
+	assert.Len(t, files, 2)
+
+	// the client has deleted both files, whose last versions are kept out of sight
+	_, err = backupService.Proceed(folderBackupRequest(t, clientID, clientFolderPath))
+	assert.NoError(t, err)
+
+	entries, err := storage.ReadDir(backupFolderFullPath)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{common.VersionFolderName, common.MetadataFileName, common.StateFolderName}, entryNames(entries))
+
+	entries, err = storage.ReadDir(filepath.Join(backupFolderFullPath, common.VersionFolderName))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{
+		"a-backup-2023-04-10-12-00-00-000Z.txt",
+		"notes-backup-2023-01-01-00-00-00-000-backup-2023-04-10-12-00-00-000Z.txt",
+	}, entryNames(entries))
+
+	deletedFiles, err := backupService.GetDeletedFiles(clientID, clientFolderPath)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a.txt", userFile}, lo.Map(deletedFiles, func(deletedFile codegen.DeletedFile, _ int) string {
+		return *deletedFile.Path
+	}))
+	assert.Equal(t, common.VersionFolderName+"/a-backup-2023-04-10-12-00-00-000Z.txt", *deletedFiles[0].BackupFilePath)
+}
+
+func TestMigrateVersions(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	clock := &fixedClock{now: time.Date(2023, 4, 10, 12, 0, 0, 0, time.UTC)}
+	storage := service.NewMemoryStorage("/DATA", clock)
+
+	clientID := "client1"
+	clientFolderPath := "/home/icewhale/Documents"
+	backupFolderFullPath := filepath.Join(storage.Root(), common.BackupRootFolder, clientID, service.Normalize(clientFolderPath))
+
+	backupService := service.NewBackupServiceWith(storage, clock)
+
+	backup, err := backupService.Proceed(folderBackupRequest(t, clientID, clientFolderPath, "docs/a.txt"))
+	assert.NoError(t, err)
+	assert.Equal(t, codegen.Suffix, *backup.VersionStore)
+
+	assert.NoError(t, storage.MkdirAll(filepath.Join(backupFolderFullPath, "docs"), 0o755))
+	assert.NoError(t, storage.WriteFile(filepath.Join(backupFolderFullPath, "docs", "a.txt"), []byte("a"), 0o644))
+
+	verification, err := backupService.Complete(clientID, clientFolderPath)
+	assert.NoError(t, err)
+	assert.True(t, *verification.Succeeded)
+
+	// the client has deleted the file, which is kept next to where it was
+	_, err = backupService.Proceed(folderBackupRequest(t, clientID, clientFolderPath))
+	assert.NoError(t, err)
+
+	entries, err := storage.ReadDir(filepath.Join(backupFolderFullPath, "docs"))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a-backup-2023-04-10-12-00-00-000Z.txt"}, entryNames(entries))
+
+	count, err := backupService.MigrateVersions()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, count)
+
+	entries, err = storage.ReadDir(filepath.Join(backupFolderFullPath, "docs"))
+	assert.NoError(t, err)
+	assert.Empty(t, entries)
+
+	entries, err = storage.ReadDir(filepath.Join(backupFolderFullPath, common.VersionFolderName, "docs"))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a-backup-2023-04-10-12-00-00-000Z.txt"}, entryNames(entries))
+
+	metadata, err := service.LoadMetadata(storage, backupFolderFullPath)
+	assert.NoError(t, err)
+	assert.Equal(t, codegen.Hidden, *metadata.VersionStore)
+
+	deletedFiles, err := backupService.GetDeletedFiles(clientID, clientFolderPath)
+	assert.NoError(t, err)
+	assert.Len(t, deletedFiles, 1)
+	assert.Equal(t, common.VersionFolderName+"/docs/a-backup-2023-04-10-12-00-00-000Z.txt", *deletedFiles[0].BackupFilePath)
+
+	// the history copies are no files of the client, and there is nothing more to migrate
+	files, err := service.FilterBackupFiles(storage, backupFolderFullPath)
+	assert.NoError(t, err)
+	assert.Empty(t, files)
+
+	count, err = backupService.MigrateVersions()
+	assert.NoError(t, err)
+	assert.Equal(t, 0, count)
+}
+
+func TestMigrateVersionsInterrupted(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	tmpDir, err := os.MkdirTemp("", "test")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	index, err := service.OpenIndex(filepath.Join(tmpDir, common.IndexFileName))
+	assert.NoError(t, err)
+	defer index.Close()
+
+	clock := &fixedClock{now: time.Date(2023, 4, 10, 12, 0, 0, 0, time.UTC)}
+	storage := service.NewMemoryStorage("/DATA", clock)
+
+	clientID := "client1"
+	clientFolderPath := "/home/icewhale/Documents"
+	backupFolderPath := filepath.Join(common.BackupRootFolder, clientID, service.Normalize(clientFolderPath))
+	backupFolderFullPath := filepath.Join(storage.Root(), backupFolderPath)
+
+	backupService := service.NewBackupServiceWith(storage, clock)
+	backupService.SetIndex(index)
+
+	_, err = backupService.Proceed(folderBackupRequest(t, clientID, clientFolderPath, "docs/a.txt", "docs/b.txt"))
+	assert.NoError(t, err)
+
+	assert.NoError(t, storage.MkdirAll(filepath.Join(backupFolderFullPath, "docs"), 0o755))
+	assert.NoError(t, storage.WriteFile(filepath.Join(backupFolderFullPath, "docs", "a.txt"), []byte("a"), 0o644))
+	assert.NoError(t, storage.WriteFile(filepath.Join(backupFolderFullPath, "docs", "b.txt"), []byte("b"), 0o644))
+
+	_, err = backupService.Complete(clientID, clientFolderPath)
+	assert.NoError(t, err)
+
+	_, err = backupService.Proceed(folderBackupRequest(t, clientID, clientFolderPath))
+	assert.NoError(t, err)
+
+	// the migration stopped after moving the history copy of a.txt, so the folder backup still uses the suffix store
+	assert.NoError(t, storage.MkdirAll(filepath.Join(backupFolderFullPath, common.VersionFolderName, "docs"), 0o755))
+	assert.NoError(t, storage.Rename(
+		filepath.Join(backupFolderFullPath, "docs", "a-backup-2023-04-10-12-00-00-000Z.txt"),
+		filepath.Join(backupFolderFullPath, common.VersionFolderName, "docs", "a-backup-2023-04-10-12-00-00-000Z.txt"),
+	))
+
+	// the history copy moved so far is still found for the file it was made for
+	assert.NoError(t, backupService.RebuildIndex())
+
+	versions, err := index.Versions(backupFolderPath, "docs/a.txt")
+	assert.NoError(t, err)
+	assert.Len(t, versions, 1)
+	assert.Equal(t, common.VersionFolderName+"/docs/a-backup-2023-04-10-12-00-00-000Z.txt", versions[0].BackupFilePath)
+
+	// the migration picks up where it stopped
+	count, err := backupService.MigrateVersions()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, count)
+
+	entries, err := storage.ReadDir(filepath.Join(backupFolderFullPath, common.VersionFolderName, "docs"))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a-backup-2023-04-10-12-00-00-000Z.txt", "b-backup-2023-04-10-12-00-00-000Z.txt"}, entryNames(entries))
+
+	versions, err = index.Versions(backupFolderPath, "docs/b.txt")
+	assert.NoError(t, err)
+	assert.Len(t, versions, 1)
+	assert.Equal(t, common.VersionFolderName+"/docs/b-backup-2023-04-10-12-00-00-000Z.txt", versions[0].BackupFilePath)
+}
@@ -0,0 +1,429 @@
+package service
+
+import (
+	"context"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/IceWhaleTech/CasaOS-Common/utils/logger"
+	"github.com/IceWhaleTech/IceWhale-Files-Backup/codegen"
+	"github.com/IceWhaleTech/IceWhale-Files-Backup/common"
+	"github.com/samber/lo"
+	"go.uber.org/zap"
+	"golang.org/x/net/webdav"
+	"golang.org/x/text/unicode/norm"
+)
+
+const (
+	webDAVWriteFlags = os.O_WRONLY | os.O_RDWR | os.O_CREATE | os.O_TRUNC | os.O_APPEND
+
+	// DefaultWebDAVLockWait is how long a change waits for the files of a folder backup to be versioned
+	// before it is turned down as locked.
+	DefaultWebDAVLockWait = 30 * time.Second
+	webDAVLockInterval    = 100 * time.Millisecond
+)
+
+// webDAVFileSystem is the data folder served over WebDAV. Any change to a folder backup holds a read lock
+// on it, so changes wait while its files are being versioned, and versioning waits for changes in progress.
+type webDAVFileSystem struct {
+	webdav.FileSystem
+
+	backup *BackupService
+	locks  *LockManager
+}
+
+// webDAVLockSystem keeps the locks taken by WebDAV clients in memory, and treats a folder backup whose
+// files are being versioned as locked, so changes to it are turned down with 423 Locked if versioning
+// doesn't finish in time.
+type webDAVLockSystem struct {
+	webdav.LockSystem
+
+	backup *BackupService
+	locks  *LockManager
+	wait   time.Duration
+}
+
+type lockedFile struct {
+	webdav.File
+
+	unlock  func()
+	written func()
+}
+
+// WebDAVFileSystem returns the data folder to be served over WebDAV.
+func (b *BackupService) WebDAVFileSystem() webdav.FileSystem {
+	return &webDAVFileSystem{
+		FileSystem: b.storage.WebDAV(),
+		backup:     b,
+		locks:      b.locks,
+	}
+}
+
+// WebDAVLockSystem returns the lock system for the data folder served over WebDAV, where changes to a
+// folder backup wait up to the given duration for its files to be versioned.
+func (b *BackupService) WebDAVLockSystem(wait time.Duration) webdav.LockSystem {
+	return &webDAVLockSystem{
+		LockSystem: webdav.NewMemLS(),
+
+		backup: b,
+		locks:  b.locks,
+		wait:   wait,
+	}
+}
+
+func (fs *webDAVFileSystem) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	if err := fs.backup.checkName("mkdir", name); err != nil {
+		return err
+	}
+	name = fs.backup.resolveName(name)
+
+	unlock, err := fs.lock(name)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	return fs.FileSystem.Mkdir(ctx, name, perm)
+}
+
+func (fs *webDAVFileSystem) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	if flag&webDAVWriteFlags == 0 {
+		return fs.FileSystem.OpenFile(ctx, fs.backup.resolveName(name), flag, perm)
+	}
+
+	if err := fs.backup.checkName("open", name); err != nil {
+		return nil, err
+	}
+	name = fs.backup.resolveName(name)
+
+	// held until the file is closed, i.e. until the whole content has been written
+	unlock, err := fs.lock(name)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := fs.FileSystem.OpenFile(ctx, name, flag, perm)
+	if err != nil {
+		unlock()
+		return nil, err
+	}
+
+	written := func() {}
+	if backupFolderPath := fs.backup.folderBackupOf(name); backupFolderPath != "" {
+		written = func() {
+			relativePath := strings.TrimPrefix(path.Clean("/"+name), "/"+filepath.ToSlash(backupFolderPath)+"/")
+			fs.backup.clearPending(backupFolderPath, relativePath)
+			fs.backup.publish(codegen.FileUploaded, backupFolderPath, codegen.BackupEvent{
+				Path: &relativePath,
+			})
+		}
+	}
+
+	return &lockedFile{File: file, unlock: unlock, written: written}, nil
+}
+
+func (fs *webDAVFileSystem) RemoveAll(ctx context.Context, name string) error {
+	if err := fs.backup.checkReserved("remove", name); err != nil {
+		return err
+	}
+	name = fs.backup.resolveName(name)
+
+	unlock, err := fs.lock(name)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	return fs.FileSystem.RemoveAll(ctx, name)
+}
+
+func (fs *webDAVFileSystem) Rename(ctx context.Context, oldName, newName string) error {
+	if err := fs.backup.checkReserved("rename", oldName); err != nil {
+		return err
+	}
+	if err := fs.backup.checkName("rename", newName); err != nil {
+		return err
+	}
+	oldName, newName = fs.backup.resolveName(oldName), fs.backup.resolveName(newName)
+
+	unlock, err := fs.lock(oldName, newName)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	return fs.FileSystem.Rename(ctx, oldName, newName)
+}
+
+func (fs *webDAVFileSystem) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	return fs.FileSystem.Stat(ctx, fs.backup.resolveName(name))
+}
+
+// lock takes read locks on the folder backups containing the given names, in a consistent order so
+// concurrent requests cannot deadlock.
+func (fs *webDAVFileSystem) lock(names ...string) (func(), error) {
+	backupFolderPaths := []string{}
+	for _, name := range names {
+		if backupFolderPath := fs.backup.folderBackupOf(name); backupFolderPath != "" {
+			backupFolderPaths = append(backupFolderPaths, backupFolderPath)
+		}
+	}
+
+	sort.Strings(backupFolderPaths)
+
+	unlocks := []func(){}
+	unlockAll := func() {
+		for i := len(unlocks) - 1; i >= 0; i-- {
+			unlocks[i]()
+		}
+	}
+
+	for i, backupFolderPath := range backupFolderPaths {
+		if i > 0 && backupFolderPath == backupFolderPaths[i-1] {
+			continue
+		}
+
+		unlock, err := fs.locks.RLock(backupFolderPath, "webdav")
+		if err != nil {
+			unlockAll()
+			return nil, err
+		}
+
+		unlocks = append(unlocks, unlock)
+	}
+
+	return unlockAll, nil
+}
+
+// Confirm is called for requests coming with locks taken before.
+func (ls *webDAVLockSystem) Confirm(now time.Time, name0, name1 string, conditions ...webdav.Condition) (func(), error) {
+	for _, name := range []string{name0, name1} {
+		if !ls.waitForVersioning(name) {
+			// the handler replies 412 Precondition Failed, since it only replies 423 Locked for Create
+			return nil, webdav.ErrConfirmationFailed
+		}
+	}
+
+	return ls.LockSystem.Confirm(now, name0, name1, conditions...)
+}
+
+// Create is called for LOCK requests, and for temporary locks of other changes coming without locks.
+func (ls *webDAVLockSystem) Create(now time.Time, details webdav.LockDetails) (string, error) {
+	if !ls.waitForVersioning(details.Root) {
+		return "", webdav.ErrLocked
+	}
+
+	return ls.LockSystem.Create(now, details)
+}
+
+// waitForVersioning waits for the folder backup containing the name, if any, to be no longer write
+// locked, and tells whether it is.
+func (ls *webDAVLockSystem) waitForVersioning(name string) bool {
+	backupFolderPath := ls.backup.folderBackupOf(ls.backup.resolveName(name))
+	if backupFolderPath == "" {
+		return true
+	}
+
+	deadline := time.Now().Add(ls.wait)
+
+	for ls.locks.IsWriteLocked(backupFolderPath) {
+		if time.Now().After(deadline) {
+			logger.Info("folder backup is still locked, turning down WebDAV change", zap.String("path", backupFolderPath), zap.String("name", name))
+			return false
+		}
+
+		time.Sleep(webDAVLockInterval)
+	}
+
+	return true
+}
+
+// folderBackupOf returns the backup folder path of the folder backup containing the name, or an empty
+// string if the name is not in any folder backup.
+func (b *BackupService) folderBackupOf(name string) string {
+	backupFolderPath, _ := b.folderBackupStoreOf(name)
+	return backupFolderPath
+}
+
+// folderBackupStoreOf returns the backup folder path and the version store of the folder backup containing
+// the name, or an empty string if the name is not in any folder backup. Folder backups seen before are
+// looked up in memory, so only names out of them are looked up on storage.
+func (b *BackupService) folderBackupStoreOf(name string) (string, codegen.VersionStore) {
+	name = strings.TrimPrefix(path.Clean("/"+name), "/")
+
+	// folder backups are at least two levels under the backup root, i.e. the client and the folder
+	parts := strings.Split(name, "/")
+	if len(parts) < 3 || parts[0] != common.BackupRootFolder {
+		return "", ""
+	}
+
+	b.folderBackupMutex.Lock()
+	for i := len(parts); i >= 3; i-- {
+		backupFolderPath := filepath.Join(parts[:i]...)
+
+		if store, ok := b.folderBackups[backupFolderPath]; ok {
+			b.folderBackupMutex.Unlock()
+			return backupFolderPath, store
+		}
+	}
+	b.folderBackupMutex.Unlock()
+
+	for i := len(parts); i >= 3; i-- {
+		backupFolderPath := filepath.Join(parts[:i]...)
+
+		// being created, so its version store is yet to be decided
+		if b.locks.IsActive(backupFolderPath) {
+			return backupFolderPath, versionStoreOf(b.storage, filepath.Join(b.storage.Root(), backupFolderPath))
+		}
+
+		backupFolderFullPath := filepath.Join(b.storage.Root(), backupFolderPath)
+
+		if _, err := b.storage.Stat(filepath.Join(backupFolderFullPath, common.MetadataFileName)); err != nil {
+			continue
+		}
+
+		backup, err := LoadMetadata(b.storage, backupFolderFullPath)
+		if err != nil {
+			// not remembered, so the version store is looked up again once the metadata is recovered
+			return backupFolderPath, codegen.Suffix
+		}
+
+		store := lo.FromPtr(backup.VersionStore)
+		if store == "" {
+			store = codegen.Suffix
+		}
+
+		b.rememberFolderBackup(backupFolderPath, store)
+
+		return backupFolderPath, store
+	}
+
+	return "", ""
+}
+
+// rememberFolderBackup keeps the version store of the folder backup for WebDAV requests to look up.
+func (b *BackupService) rememberFolderBackup(backupFolderPath string, store codegen.VersionStore) {
+	b.folderBackupMutex.Lock()
+	defer b.folderBackupMutex.Unlock()
+
+	b.folderBackups[filepath.Clean(backupFolderPath)] = store
+}
+
+// forgetFolderBackup drops the folder backup once it is deleted.
+func (b *BackupService) forgetFolderBackup(backupFolderPath string) {
+	b.folderBackupMutex.Lock()
+	defer b.folderBackupMutex.Unlock()
+
+	delete(b.folderBackups, filepath.Clean(backupFolderPath))
+}
+
+// resolveName returns the name the file is kept under, looking it up as the client it is under compares
+// paths, so a client changing the case of a folder keeps writing into the existing one.
+func (b *BackupService) resolveName(name string) string {
+	clientID, relativePath, ok := clientPathOf(name)
+	if !ok {
+		return name
+	}
+
+	policy := b.pathPolicy(clientID)
+	if policy == codegen.Posix {
+		return name
+	}
+
+	relativePath = newPathResolver(b.storage, policy).resolve(filepath.Join(b.backupRoot, clientID), norm.NFC.String(relativePath))
+
+	return "/" + path.Join(common.BackupRootFolder, clientID, relativePath)
+}
+
+// clearPending takes the file written over WebDAV off the files pending in the latest run of the folder
+// backup, since it has been uploaded completely. Failures are only logged, as the next run compares the
+// file with the client anyway.
+func (b *BackupService) clearPending(backupFolderPath, relativePath string) {
+	// WebDAV writes to the same folder backup run side by side
+	b.runMutex.Lock()
+	defer b.runMutex.Unlock()
+
+	backupFolderFullPath := filepath.Join(b.storage.Root(), backupFolderPath)
+
+	run, err := LoadRun(b.storage, backupFolderFullPath)
+	if err != nil || run == nil || !run.IsPending(relativePath) {
+		return
+	}
+
+	run.RemovePending(relativePath)
+
+	if err := SaveRun(b.storage, backupFolderFullPath, run); err != nil {
+		logger.Error("failed to save run", zap.String("path", backupFolderFullPath), zap.Error(err))
+		return
+	}
+
+	b.updateIndex(func(index *Index) error {
+		return index.PutRun(backupFolderPath, run)
+	})
+}
+
+// checkName returns a permission error if the name can't be written under the path policy of the client it
+// is under, such as a name Windows reserves for a Windows client.
+func (b *BackupService) checkName(op, name string) error {
+	if clientID, relativePath, ok := clientPathOf(name); ok {
+		if err := CheckPath(b.pathPolicy(clientID), relativePath); err != nil {
+			logger.Info("turning down WebDAV change to a reserved path", zap.String("name", name), zap.Error(err))
+			return &os.PathError{Op: op, Path: name, Err: os.ErrPermission}
+		}
+	}
+
+	return b.checkReserved(op, name)
+}
+
+// checkReserved returns a permission error if the name is kept by the service, i.e. metadata, state folders or
+// the hidden version folder of a folder backup, so it is neither written, moved nor deleted over WebDAV.
+func (b *BackupService) checkReserved(op, name string) error {
+	parts := strings.Split(strings.TrimPrefix(path.Clean("/"+name), "/"), "/")
+	if len(parts) < 2 || parts[0] != common.BackupRootFolder {
+		return nil
+	}
+
+	// metadata and state folders, along with their temporary files
+	if lo.Contains(parts[1:], common.StateFolderName) || strings.HasPrefix(parts[len(parts)-1], common.MetadataFileName) {
+		logger.Info("turning down WebDAV change to service state", zap.String("name", name))
+		return &os.PathError{Op: op, Path: name, Err: os.ErrPermission}
+	}
+
+	if backupFolderPath, store := b.folderBackupStoreOf(name); backupFolderPath != "" && store == codegen.Hidden {
+		relativePath := strings.TrimPrefix(path.Clean("/"+name), "/"+filepath.ToSlash(backupFolderPath)+"/")
+
+		if isReservedPath(store, relativePath) {
+			logger.Info("turning down WebDAV change to the version folder", zap.String("name", name))
+			return &os.PathError{Op: op, Path: name, Err: os.ErrPermission}
+		}
+	}
+
+	return nil
+}
+
+// clientPathOf splits the name into the client and the path under the folder of the client, if the name is
+// under the folder of a client.
+func clientPathOf(name string) (string, string, bool) {
+	parts := strings.Split(strings.TrimPrefix(path.Clean("/"+name), "/"), "/")
+	if len(parts) < 3 || parts[0] != common.BackupRootFolder {
+		return "", "", false
+	}
+
+	return parts[1], path.Join(parts[2:]...), true
+}
+
+func (f *lockedFile) Close() error {
+	defer f.unlock()
+
+	if err := f.File.Close(); err != nil {
+		return err
+	}
+
+	f.written()
+
+	return nil
+}
@@ -0,0 +1,172 @@
+package service_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/IceWhaleTech/IceWhale-Files-Backup/codegen"
+	"github.com/IceWhaleTech/IceWhale-Files-Backup/common"
+	"github.com/IceWhaleTech/IceWhale-Files-Backup/pkg/config"
+	"github.com/IceWhaleTech/IceWhale-Files-Backup/service"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/goleak"
+	"golang.org/x/net/webdav"
+)
+
+func TestWebDAVLockSystem(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	tmpDataRootDir, err := os.MkdirTemp("", "test")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tmpDataRootDir)
+
+	config.AppInfo.DataRootPath = tmpDataRootDir
+
+	backupFolderPath := filepath.Join(common.BackupRootFolder, "client1", "C/Users/icewhale/Downloads")
+	assert.NoError(t, os.MkdirAll(filepath.Join(tmpDataRootDir, backupFolderPath), 0o755))
+	assert.NoError(t, os.WriteFile(filepath.Join(tmpDataRootDir, backupFolderPath, common.MetadataFileName), []byte("{}"), 0o644))
+
+	backupService := service.NewBackupService()
+
+	handler := &webdav.Handler{
+		FileSystem: backupService.WebDAVFileSystem(),
+		LockSystem: backupService.WebDAVLockSystem(300 * time.Millisecond),
+	}
+
+	put := func(name string) int {
+		request := httptest.NewRequest(http.MethodPut, "/"+filepath.ToSlash(filepath.Join(backupFolderPath, name)), strings.NewReader(name))
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, request)
+		return recorder.Code
+	}
+
+	assert.Equal(t, http.StatusCreated, put("a.txt"))
+
+	// as if versioning is in progress
+	unlock, err := backupService.Locks().Lock(backupFolderPath, "proceed")
+	assert.NoError(t, err)
+
+	// turned down if versioning doesn't finish in time
+	assert.Equal(t, http.StatusLocked, put("b.txt"))
+
+	// held until versioning finishes in time
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		unlock()
+	}()
+
+	assert.Equal(t, http.StatusCreated, put("c.txt"))
+
+	_, err = os.Stat(filepath.Join(tmpDataRootDir, backupFolderPath, "b.txt"))
+	assert.True(t, os.IsNotExist(err))
+
+	_, err = os.Stat(filepath.Join(tmpDataRootDir, backupFolderPath, "c.txt"))
+	assert.NoError(t, err)
+}
+
+func TestWebDAVFollowsMigratedVersionStore(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	clock := &fixedClock{now: time.Date(2023, 4, 10, 12, 0, 0, 0, time.UTC)}
+	storage := service.NewMemoryStorage("/DATA", clock)
+
+	clientID := "client1"
+	clientFolderPath := "/home/icewhale/Documents"
+	backupFolderPath := filepath.Join(common.BackupRootFolder, clientID, service.Normalize(clientFolderPath))
+
+	backupService := service.NewBackupServiceWith(storage, clock)
+	fs := backupService.WebDAVFileSystem()
+
+	_, err := backupService.Proceed(folderBackupRequest(t, clientID, clientFolderPath, "a.txt"))
+	assert.NoError(t, err)
+
+	write := func(name string) error {
+		file, err := fs.OpenFile(context.Background(), "/"+filepath.ToSlash(filepath.Join(backupFolderPath, name)), os.O_CREATE|os.O_WRONLY, 0o644)
+		if err != nil {
+			return err
+		}
+		return file.Close()
+	}
+
+	// the version folder is just another folder of the client in the suffix store
+	assert.NoError(t, write("a.txt"))
+	assert.NoError(t, fs.Mkdir(context.Background(), "/"+filepath.ToSlash(filepath.Join(backupFolderPath, common.VersionFolderName)), 0o755))
+
+	_, err = backupService.MigrateVersions()
+	assert.NoError(t, err)
+
+	// but only written by the service once migrated to the hidden store
+	assert.ErrorIs(t, write(filepath.Join(common.VersionFolderName, "b.txt")), os.ErrPermission)
+	assert.NoError(t, write("b.txt"))
+}
+
+func TestWebDAVKeepsServiceState(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	config.AppInfo.VersionStore = string(codegen.Hidden)
+	defer func() { config.AppInfo.VersionStore = string(codegen.Suffix) }()
+
+	clock := &fixedClock{now: time.Date(2023, 4, 10, 12, 0, 0, 0, time.UTC)}
+	storage := service.NewMemoryStorage("/DATA", clock)
+
+	clientID := "client1"
+	clientFolderPath := "/home/icewhale/Documents"
+	backupFolderPath := filepath.Join(common.BackupRootFolder, clientID, service.Normalize(clientFolderPath))
+	backupFolderFullPath := filepath.Join(storage.Root(), backupFolderPath)
+
+	backupService := service.NewBackupServiceWith(storage, clock)
+
+	_, err := backupService.Proceed(folderBackupRequest(t, clientID, clientFolderPath, "a.txt"))
+	assert.NoError(t, err)
+
+	assert.NoError(t, storage.WriteFile(filepath.Join(backupFolderFullPath, "a.txt"), []byte("a"), 0o644))
+
+	verification, err := backupService.Complete(clientID, clientFolderPath)
+	assert.NoError(t, err)
+	assert.True(t, *verification.Succeeded)
+
+	// the client has deleted the file, whose last version is kept in the version folder
+	_, err = backupService.Proceed(folderBackupRequest(t, clientID, clientFolderPath))
+	assert.NoError(t, err)
+
+	handler := &webdav.Handler{
+		FileSystem: backupService.WebDAVFileSystem(),
+		LockSystem: backupService.WebDAVLockSystem(time.Second),
+	}
+
+	request := func(method, name, destination string) int {
+		request := httptest.NewRequest(method, "/"+filepath.ToSlash(filepath.Join(backupFolderPath, name)), nil)
+		if destination != "" {
+			request.Header.Set("Destination", "/"+filepath.ToSlash(filepath.Join(backupFolderPath, destination)))
+		}
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, request)
+		return recorder.Code
+	}
+
+	historyCopy := filepath.Join(common.VersionFolderName, "a-backup-2023-04-10-12-00-00-000Z.txt")
+
+	assert.Equal(t, http.StatusForbidden, request("MOVE", historyCopy, "a.txt"))
+	assert.Equal(t, http.StatusForbidden, request("MOVE", common.VersionFolderName, "versions"))
+	assert.Equal(t, http.StatusMethodNotAllowed, request(http.MethodDelete, historyCopy, ""))
+	assert.Equal(t, http.StatusMethodNotAllowed, request(http.MethodDelete, common.VersionFolderName, ""))
+	assert.Equal(t, http.StatusMethodNotAllowed, request(http.MethodDelete, common.StateFolderName, ""))
+	assert.Equal(t, http.StatusMethodNotAllowed, request(http.MethodDelete, common.MetadataFileName, ""))
+
+	_, err = storage.Stat(filepath.Join(backupFolderFullPath, historyCopy))
+	assert.NoError(t, err)
+
+	_, err = service.LoadMetadata(storage, backupFolderFullPath)
+	assert.NoError(t, err)
+
+	// files of the client can still be moved and deleted
+	assert.Equal(t, http.StatusCreated, request(http.MethodPut, "b.txt", ""))
+	assert.Equal(t, http.StatusCreated, request("MOVE", "b.txt", "c.txt"))
+	assert.Equal(t, http.StatusNoContent, request(http.MethodDelete, "c.txt", ""))
+}
@@ -0,0 +1,451 @@
+package service
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/IceWhaleTech/CasaOS-Common/utils/logger"
+	"github.com/IceWhaleTech/IceWhale-Files-Backup/codegen"
+	"github.com/IceWhaleTech/IceWhale-Files-Backup/common"
+	"github.com/IceWhaleTech/IceWhale-Files-Backup/internal/utils"
+	"github.com/IceWhaleTech/IceWhale-Files-Backup/pkg/config"
+	"github.com/samber/lo"
+	"go.uber.org/zap"
+)
+
+const (
+	webhookTimeout           = 10 * time.Second
+	webhookMaxAttempts       = 5
+	webhookMaxDeliveries     = 100
+	DefaultWebhookRetryDelay = 10 * time.Second
+
+	WebhookEventHeader     = "X-Files-Backup-Event"
+	WebhookDeliveryHeader  = "X-Files-Backup-Delivery"
+	WebhookSignatureHeader = "X-Files-Backup-Signature"
+)
+
+var (
+	ErrWebhookNotFound = errors.New("webhook not found")
+	ErrInvalidWebhook  = errors.New("invalid webhook")
+)
+
+// webhookFileEvents are the events about single files, which are too chatty to deliver unless a webhook
+// asks for them explicitly.
+var webhookFileEvents = []codegen.BackupEventType{codegen.FileVersioned, codegen.FileUploaded}
+
+// WebhookService keeps the webhooks configured through the API and delivers events of folder backups to them.
+type WebhookService struct {
+	filePath   string
+	client     *http.Client
+	clock      Clock
+	retryDelay time.Duration
+
+	mutex    *sync.Mutex
+	webhooks []codegen.Webhook
+
+	// deliveries keeps the recent deliveries of each webhook, latest first. They are not persisted.
+	deliveries map[string][]codegen.WebhookDelivery
+
+	wg *sync.WaitGroup
+}
+
+func NewWebhookService(filePath string) *WebhookService {
+	return NewWebhookServiceWith(filePath, SystemClock)
+}
+
+// NewWebhookServiceWith returns the service keeping the webhooks in the file and telling the time of
+// webhooks and deliveries by the clock.
+func NewWebhookServiceWith(filePath string, clock Clock) *WebhookService {
+	return &WebhookService{
+		filePath:   filePath,
+		client:     &http.Client{Timeout: webhookTimeout},
+		clock:      clock,
+		retryDelay: DefaultWebhookRetryDelay,
+
+		mutex:      &sync.Mutex{},
+		webhooks:   []codegen.Webhook{},
+		deliveries: map[string][]codegen.WebhookDelivery{},
+
+		wg: &sync.WaitGroup{},
+	}
+}
+
+func WebhookFilePath() string {
+	return filepath.Join(config.AppInfo.DBPath, common.WebhookFileName)
+}
+
+// SetRetryDelay sets the delay before the first retry of a failed delivery, which doubles on each retry after.
+func (w *WebhookService) SetRetryDelay(retryDelay time.Duration) {
+	w.retryDelay = retryDelay
+}
+
+// Load reads the webhooks saved before, if any.
+func (w *WebhookService) Load() error {
+	buf, err := os.ReadFile(w.filePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	webhooks := []codegen.Webhook{}
+	if err := json.Unmarshal(buf, &webhooks); err != nil {
+		return err
+	}
+
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	w.webhooks = webhooks
+
+	return nil
+}
+
+func (w *WebhookService) Webhooks() []codegen.Webhook {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	return lo.Map(w.webhooks, func(webhook codegen.Webhook, _ int) codegen.Webhook {
+		return withoutSecret(webhook)
+	})
+}
+
+func (w *WebhookService) Webhook(webhookID string) (*codegen.Webhook, error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	_, i, ok := lo.FindIndexOf(w.webhooks, func(webhook codegen.Webhook) bool { return *webhook.WebhookID == webhookID })
+	if !ok {
+		return nil, ErrWebhookNotFound
+	}
+
+	return lo.ToPtr(withoutSecret(w.webhooks[i])), nil
+}
+
+func (w *WebhookService) CreateWebhook(webhook codegen.Webhook) (*codegen.Webhook, error) {
+	if err := validateWebhook(webhook); err != nil {
+		return nil, err
+	}
+
+	webhookID, err := randomID()
+	if err != nil {
+		return nil, err
+	}
+
+	webhook.WebhookID = &webhookID
+	webhook.CreatedTime = lo.ToPtr(w.clock.Now().UnixMilli())
+
+	if webhook.Enabled == nil {
+		webhook.Enabled = lo.ToPtr(true)
+	}
+
+	if webhook.Events == nil {
+		webhook.Events = &[]codegen.BackupEventType{}
+	}
+
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if err := w.save(append(w.webhooks, webhook)); err != nil {
+		return nil, err
+	}
+
+	logger.Info("webhook has been created", zap.String("webhook_id", webhookID), zap.String("url", *webhook.URL))
+
+	return lo.ToPtr(withoutSecret(webhook)), nil
+}
+
+// UpdateWebhook replaces the URL, events and whether the webhook is enabled. The secret is kept if not given.
+func (w *WebhookService) UpdateWebhook(webhookID string, webhook codegen.Webhook) (*codegen.Webhook, error) {
+	if err := validateWebhook(webhook); err != nil {
+		return nil, err
+	}
+
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	_, i, ok := lo.FindIndexOf(w.webhooks, func(webhook codegen.Webhook) bool { return *webhook.WebhookID == webhookID })
+	if !ok {
+		return nil, ErrWebhookNotFound
+	}
+
+	current := w.webhooks[i]
+
+	webhook.WebhookID = current.WebhookID
+	webhook.CreatedTime = current.CreatedTime
+
+	if webhook.Secret == nil {
+		webhook.Secret = current.Secret
+	}
+
+	if webhook.Enabled == nil {
+		webhook.Enabled = lo.ToPtr(true)
+	}
+
+	if webhook.Events == nil {
+		webhook.Events = &[]codegen.BackupEventType{}
+	}
+
+	webhooks := append([]codegen.Webhook{}, w.webhooks...)
+	webhooks[i] = webhook
+
+	if err := w.save(webhooks); err != nil {
+		return nil, err
+	}
+
+	logger.Info("webhook has been updated", zap.String("webhook_id", webhookID), zap.String("url", *webhook.URL))
+
+	return lo.ToPtr(withoutSecret(webhook)), nil
+}
+
+func (w *WebhookService) DeleteWebhook(webhookID string) error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	webhooks := lo.Reject(w.webhooks, func(webhook codegen.Webhook, _ int) bool { return *webhook.WebhookID == webhookID })
+	if len(webhooks) == len(w.webhooks) {
+		return ErrWebhookNotFound
+	}
+
+	if err := w.save(webhooks); err != nil {
+		return err
+	}
+
+	delete(w.deliveries, webhookID)
+
+	logger.Info("webhook has been deleted", zap.String("webhook_id", webhookID))
+
+	return nil
+}
+
+// Deliveries returns the recent deliveries of the webhook, latest first.
+func (w *WebhookService) Deliveries(webhookID string) ([]codegen.WebhookDelivery, error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if !lo.ContainsBy(w.webhooks, func(webhook codegen.Webhook) bool { return *webhook.WebhookID == webhookID }) {
+		return nil, ErrWebhookNotFound
+	}
+
+	return append([]codegen.WebhookDelivery{}, w.deliveries[webhookID]...), nil
+}
+
+// Forward delivers the events received to the webhooks asking for them until the channel is closed,
+// then waits for the deliveries still being retried.
+func (w *WebhookService) Forward(events <-chan codegen.BackupEvent) {
+	defer w.wg.Wait()
+
+	for event := range events {
+		w.mutex.Lock()
+		webhooks := lo.Filter(w.webhooks, func(webhook codegen.Webhook, _ int) bool {
+			return lo.FromPtr(webhook.Enabled) && wantsEvent(webhook, *event.Type)
+		})
+		w.mutex.Unlock()
+
+		for _, webhook := range webhooks {
+			w.wg.Add(1)
+			go func(webhook codegen.Webhook, event codegen.BackupEvent) {
+				defer w.wg.Done()
+				w.deliver(webhook, event)
+			}(webhook, event)
+		}
+	}
+}
+
+// deliver posts the event to the webhook, retrying with exponential backoff until the webhook accepts it,
+// rejects it for good, or the attempts run out.
+func (w *WebhookService) deliver(webhook codegen.Webhook, event codegen.BackupEvent) {
+	deliveryID, err := randomID()
+	if err != nil {
+		logger.Error("failed to generate delivery id", zap.Error(err))
+		return
+	}
+
+	delivery := codegen.WebhookDelivery{
+		DeliveryID: &deliveryID,
+		Event:      &event,
+		Attempts:   lo.ToPtr(0),
+		Succeeded:  lo.ToPtr(false),
+	}
+
+	buf, err := json.Marshal(event)
+	if err != nil {
+		logger.Error("failed to marshal event", zap.Error(err))
+		return
+	}
+
+	delay := w.retryDelay
+
+	for {
+		statusCode, err := w.post(webhook, deliveryID, *event.Type, buf)
+
+		*delivery.Attempts++
+		delivery.Time = lo.ToPtr(w.clock.Now().UnixMilli())
+		delivery.StatusCode = lo.Ternary(statusCode > 0, &statusCode, nil)
+		delivery.Error = nil
+
+		if err == nil {
+			delivery.Succeeded = lo.ToPtr(true)
+		} else {
+			delivery.Error = lo.ToPtr(err.Error())
+		}
+
+		if !w.logDelivery(*webhook.WebhookID, delivery) {
+			// the webhook has been deleted meanwhile
+			return
+		}
+
+		if err == nil {
+			return
+		}
+
+		if *delivery.Attempts >= webhookMaxAttempts || !retryable(statusCode) {
+			logger.Error("failed to deliver event to webhook", zap.String("webhook_id", *webhook.WebhookID), zap.String("type", string(*event.Type)), zap.Int("attempts", *delivery.Attempts), zap.Error(err))
+			return
+		}
+
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+func (w *WebhookService) post(webhook codegen.Webhook, deliveryID string, eventType codegen.BackupEventType, buf []byte) (int, error) {
+	request, err := http.NewRequest(http.MethodPost, *webhook.URL, bytes.NewReader(buf))
+	if err != nil {
+		return 0, err
+	}
+
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("User-Agent", common.FilesBackupServiceName+"/"+common.FilesBackupVersion)
+	request.Header.Set(WebhookEventHeader, string(eventType))
+	request.Header.Set(WebhookDeliveryHeader, deliveryID)
+
+	if secret := lo.FromPtr(webhook.Secret); secret != "" {
+		request.Header.Set(WebhookSignatureHeader, SignWebhookPayload(secret, buf))
+	}
+
+	response, err := w.client.Do(request)
+	if err != nil {
+		return 0, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode < 200 || response.StatusCode >= 300 {
+		return response.StatusCode, fmt.Errorf("webhook replied %s", response.Status)
+	}
+
+	return response.StatusCode, nil
+}
+
+// logDelivery adds the delivery to the log of the webhook, or updates it if it is already there.
+// It returns false if the webhook no longer exists.
+func (w *WebhookService) logDelivery(webhookID string, delivery codegen.WebhookDelivery) bool {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if !lo.ContainsBy(w.webhooks, func(webhook codegen.Webhook) bool { return *webhook.WebhookID == webhookID }) {
+		return false
+	}
+
+	deliveries := lo.Reject(w.deliveries[webhookID], func(d codegen.WebhookDelivery, _ int) bool {
+		return *d.DeliveryID == *delivery.DeliveryID
+	})
+
+	deliveries = append([]codegen.WebhookDelivery{delivery}, deliveries...)
+	if len(deliveries) > webhookMaxDeliveries {
+		deliveries = deliveries[:webhookMaxDeliveries]
+	}
+
+	w.deliveries[webhookID] = deliveries
+
+	return true
+}
+
+// save writes the webhooks to the file before taking them, so they are not changed if saving fails.
+// The mutex must be held.
+func (w *WebhookService) save(webhooks []codegen.Webhook) error {
+	buf, err := json.MarshalIndent(webhooks, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(w.filePath), 0o755); err != nil {
+		return err
+	}
+
+	// the file holds the secrets, so only the service can read it
+	if err := utils.WriteFileAtomic(w.filePath, buf, 0o600); err != nil {
+		return err
+	}
+
+	w.webhooks = webhooks
+
+	return nil
+}
+
+// SignWebhookPayload returns the signature of the payload as in the signature header, i.e. `sha256=`
+// followed by the hex encoded HMAC-SHA256 of the payload using the secret.
+func SignWebhookPayload(secret string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(payload)
+
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func validateWebhook(webhook codegen.Webhook) error {
+	if webhook.URL == nil || *webhook.URL == "" {
+		return fmt.Errorf("%w: url is missing", ErrInvalidWebhook)
+	}
+
+	u, err := url.Parse(*webhook.URL)
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrInvalidWebhook, err.Error())
+	}
+
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("%w: url must be an absolute http or https url", ErrInvalidWebhook)
+	}
+
+	return nil
+}
+
+func wantsEvent(webhook codegen.Webhook, eventType codegen.BackupEventType) bool {
+	if events := lo.FromPtr(webhook.Events); len(events) > 0 {
+		return lo.Contains(events, eventType)
+	}
+
+	return !lo.Contains(webhookFileEvents, eventType)
+}
+
+// retryable tells if a delivery might succeed later, i.e. the webhook couldn't be reached, failed itself
+// or asked to slow down. Other client errors would fail again the same way.
+func retryable(statusCode int) bool {
+	return statusCode == 0 || statusCode == http.StatusRequestTimeout || statusCode == http.StatusTooManyRequests || statusCode >= 500
+}
+
+func withoutSecret(webhook codegen.Webhook) codegen.Webhook {
+	webhook.Secret = nil
+	return webhook
+}
+
+func randomID() (string, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(id), nil
+}
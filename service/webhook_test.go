@@ -0,0 +1,137 @@
+package service_test
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/IceWhaleTech/IceWhale-Files-Backup/codegen"
+	"github.com/IceWhaleTech/IceWhale-Files-Backup/service"
+	"github.com/samber/lo"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/goleak"
+)
+
+func TestWebhooks(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	tmpDir, err := os.MkdirTemp("", "test")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	webhookFilePath := filepath.Join(tmpDir, "webhooks.json")
+
+	clock := &fixedClock{now: time.Date(2023, 4, 10, 12, 0, 0, 0, time.UTC)}
+	webhooks := service.NewWebhookServiceWith(webhookFilePath, clock)
+
+	_, err = webhooks.CreateWebhook(codegen.Webhook{URL: lo.ToPtr("ftp://example.com")})
+	assert.ErrorIs(t, err, service.ErrInvalidWebhook)
+
+	webhook, err := webhooks.CreateWebhook(codegen.Webhook{
+		URL:    lo.ToPtr("http://example.com/hook"),
+		Secret: lo.ToPtr("secret"),
+	})
+	assert.NoError(t, err)
+	assert.Nil(t, webhook.Secret)
+	assert.True(t, *webhook.Enabled)
+	assert.Equal(t, clock.now.UnixMilli(), *webhook.CreatedTime)
+
+	// the secret is kept if not given
+	webhook, err = webhooks.UpdateWebhook(*webhook.WebhookID, codegen.Webhook{
+		URL:    lo.ToPtr("http://example.com/other"),
+		Events: &[]codegen.BackupEventType{codegen.RunFailed},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "http://example.com/other", *webhook.URL)
+
+	// webhooks are kept across restarts
+	reloaded := service.NewWebhookService(webhookFilePath)
+	assert.NoError(t, reloaded.Load())
+
+	all := reloaded.Webhooks()
+	assert.Len(t, all, 1)
+	assert.Equal(t, *webhook.WebhookID, *all[0].WebhookID)
+	assert.Equal(t, []codegen.BackupEventType{codegen.RunFailed}, *all[0].Events)
+	assert.Nil(t, all[0].Secret)
+
+	assert.NoError(t, reloaded.DeleteWebhook(*webhook.WebhookID))
+	assert.ErrorIs(t, reloaded.DeleteWebhook(*webhook.WebhookID), service.ErrWebhookNotFound)
+
+	_, err = reloaded.Webhook(*webhook.WebhookID)
+	assert.ErrorIs(t, err, service.ErrWebhookNotFound)
+}
+
+func TestWebhookDelivery(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	tmpDir, err := os.MkdirTemp("", "test")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	type received struct {
+		eventType string
+		signature string
+		body      []byte
+	}
+
+	var mutex sync.Mutex
+	requests := []received{}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		assert.NoError(t, err)
+
+		mutex.Lock()
+		defer mutex.Unlock()
+
+		requests = append(requests, received{
+			eventType: r.Header.Get(service.WebhookEventHeader),
+			signature: r.Header.Get(service.WebhookSignatureHeader),
+			body:      body,
+		})
+
+		// fail the first attempt to have it retried
+		if len(requests) == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer server.Close()
+
+	webhooks := service.NewWebhookService(filepath.Join(tmpDir, "webhooks.json"))
+	webhooks.SetRetryDelay(time.Millisecond)
+
+	webhook, err := webhooks.CreateWebhook(codegen.Webhook{
+		URL:    &server.URL,
+		Secret: lo.ToPtr("secret"),
+		Events: &[]codegen.BackupEventType{codegen.RunCompleted},
+	})
+	assert.NoError(t, err)
+
+	events := make(chan codegen.BackupEvent, 2)
+	events <- codegen.BackupEvent{Type: lo.ToPtr(codegen.RunFailed)}
+	events <- codegen.BackupEvent{Type: lo.ToPtr(codegen.RunCompleted), FileCount: lo.ToPtr(1)}
+	close(events)
+
+	webhooks.Forward(events)
+
+	// only the event asked for is delivered, and retried once after failing
+	assert.Len(t, requests, 2)
+
+	for _, request := range requests {
+		assert.Equal(t, string(codegen.RunCompleted), request.eventType)
+		assert.Equal(t, service.SignWebhookPayload("secret", request.body), request.signature)
+	}
+
+	deliveries, err := webhooks.Deliveries(*webhook.WebhookID)
+	assert.NoError(t, err)
+	assert.Len(t, deliveries, 1)
+	assert.Equal(t, 2, *deliveries[0].Attempts)
+	assert.True(t, *deliveries[0].Succeeded)
+	assert.Equal(t, http.StatusOK, *deliveries[0].StatusCode)
+	assert.Equal(t, codegen.RunCompleted, *deliveries[0].Event.Type)
+}
@@ -7,6 +7,7 @@ import (
 
 	"github.com/IceWhaleTech/CasaOS-Common/utils/logger"
 	"github.com/IceWhaleTech/IceWhale-Files-Backup/pkg/config"
+	"github.com/IceWhaleTech/IceWhale-Files-Backup/service"
 	"go.uber.org/zap"
 	"golang.org/x/net/webdav"
 )
@@ -18,11 +19,13 @@ func StartWebDAVService() (*http.Server, chan error) {
 		panic(err)
 	}
 
+	service.MyService.Health().SetWebDAVAddress(listener.Addr().String())
+
 	webDAVServerError := make(chan error, 1)
 	webDAVServer := &http.Server{
-		Handler: &webdav.Handler{
-			FileSystem: webdav.Dir(config.AppInfo.DataRootPath),
-			LockSystem: webdav.NewMemLS(),
+		Handler: service.InstrumentWebDAV(service.MyService.Backup().GuardWebDAVSpace(&webdav.Handler{
+			FileSystem: service.MyService.Backup().WebDAVFileSystem(),
+			LockSystem: service.MyService.Backup().WebDAVLockSystem(service.DefaultWebDAVLockWait),
 			Logger: func(r *http.Request, err error) {
 				if err != nil {
 					logger.Error("WebDAV error", zap.Error(err))
@@ -31,7 +34,7 @@ func StartWebDAVService() (*http.Server, chan error) {
 
 				logger.Info("WebDAV request", zap.String("method", r.Method), zap.String("path", r.URL.Path))
 			},
-		},
+		})),
 		ReadHeaderTimeout: 5 * time.Second, // fix G112: Potential slowloris attack (see https://github.com/securego/gosec)
 	}
 